@@ -1,11 +1,19 @@
 module android/soong
 
+require github.com/dsnet/compress v0.0.0
+
 require github.com/golang/protobuf v0.0.0
 
 require github.com/google/blueprint v0.0.0
 
+require github.com/klauspost/compress v0.0.0
+
+replace github.com/dsnet/compress v0.0.0 => ../../external/dsnet-compress
+
 replace github.com/golang/protobuf v0.0.0 => ../../external/golang-protobuf
 
 replace github.com/google/blueprint v0.0.0 => ../blueprint
 
+replace github.com/klauspost/compress v0.0.0 => ../../external/klauspost-compress
+
 go 1.13
@@ -116,6 +116,45 @@ func manifestContents(contents []byte) ([]byte, error) {
 	return finalBytes, nil
 }
 
+// maxManifestLineLen is the length in bytes of the longest line allowed in a manifest, longer
+// values are continued on lines that start with a space.
+const maxManifestLineLen = 72
+
+// ValidateManifest returns an error naming the first bad line of the manifest contents if a line
+// is longer than 72 bytes without its newline, contains a control character other than tab, or
+// if the manifest doesn't end with a blank line, which causes tools like jarsigner to reject the
+// jar or drop the last attribute.  Lines can end with CR LF, LF or CR.
+func ValidateManifest(contents []byte) error {
+	line := 1
+	for len(contents) > 0 {
+		end := bytes.IndexAny(contents, "\r\n")
+		if end < 0 {
+			return fmt.Errorf("manifest line %d %q doesn't end with a newline", line, contents)
+		}
+		text := contents[:end]
+		if len(text) > maxManifestLineLen {
+			return fmt.Errorf("manifest line %d is %d bytes long, longer than the %d bytes allowed, "+
+				"continue long values on lines that start with a space", line, len(text), maxManifestLineLen)
+		}
+		for _, c := range text {
+			if (c < 0x20 && c != '\t') || c == 0x7f {
+				return fmt.Errorf("manifest line %d %q contains control character %q", line, text, c)
+			}
+		}
+
+		if bytes.HasPrefix(contents[end:], []byte("\r\n")) {
+			end++
+		}
+		contents = contents[end+1:]
+		if len(contents) == 0 && len(text) != 0 {
+			return fmt.Errorf("manifest line %d %q is not followed by a blank line at the end of the manifest",
+				line, text)
+		}
+		line++
+	}
+	return nil
+}
+
 var javaIgnorableIdentifier = &unicode.RangeTable{
 	R16: []unicode.Range16{
 		{0x00, 0x08, 1},
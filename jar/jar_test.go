@@ -17,6 +17,7 @@ package jar
 import (
 	"bytes"
 	"io"
+	"strings"
 	"testing"
 )
 
@@ -77,6 +78,59 @@ func TestGetJavaPackage(t *testing.T) {
 	}
 }
 
+func TestValidateManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantErr string
+	}{
+		{
+			name: "valid",
+			in:   "Manifest-Version: 1.0\nCreated-By: soong_zip\n\n",
+		},
+		{
+			name: "valid crlf",
+			in:   "Manifest-Version: 1.0\r\nCreated-By: soong_zip\r\n\r\n",
+		},
+		{
+			name: "wrapped long line",
+			in:   "Manifest-Version: 1.0\nClass-Path: " + strings.Repeat("a", 60) + "\n " + strings.Repeat("b", 60) + "\n\n",
+		},
+		{
+			name:    "long line",
+			in:      "Manifest-Version: 1.0\nClass-Path: " + strings.Repeat("a", 70) + "\n\n",
+			wantErr: "manifest line 2 is 82 bytes long",
+		},
+		{
+			name:    "missing trailing newline",
+			in:      "Manifest-Version: 1.0\nMain-Class: Foo",
+			wantErr: `manifest line 2 "Main-Class: Foo" doesn't end with a newline`,
+		},
+		{
+			name:    "missing trailing blank line",
+			in:      "Manifest-Version: 1.0\nMain-Class: Foo\n",
+			wantErr: `manifest line 2 "Main-Class: Foo" is not followed by a blank line`,
+		},
+		{
+			name:    "control character",
+			in:      "Manifest-Version: 1.0\nMain-Class: F\x00oo\n\n",
+			wantErr: `manifest line 2 "Main-Class: F\x00oo" contains control character`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateManifest([]byte(tt.in))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidateManifest() error = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateManifest() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 func Test_javaIdentRune(t *testing.T) {
 	// runes that should be valid anywhere in an identifier
 	validAnywhere := []rune{
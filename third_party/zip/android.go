@@ -16,12 +16,124 @@ package zip
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"strings"
+	"unicode/utf8"
 )
 
 const DataDescriptorFlag = 0x8
 const ExtendedTimeStampTag = 0x5455
 
+// bzip2Method is the method ID of bzip2 compressed entries, which need a newer version of the spec
+// to extract.
+const bzip2Method = 12
+
+// aesMethod is the method ID of WinZip AES encrypted entries, which need version 5.1 of the spec to
+// extract.
+const aesMethod = 99
+
+// zstdMethod is the method ID of Zstandard compressed entries, which need version 6.3 of the spec to
+// extract.
+const zstdMethod = 93
+
+// utf8Flag is bit 11 of the general purpose flags, set when the name and comment are UTF-8.
+const utf8Flag = 0x800
+
+// setUTF8Flag sets the utf8Flag of fh if its name or comment contain bytes outside of ASCII and
+// both are valid UTF-8.  Pure ASCII names are the same in every encoding and don't need the flag,
+// and names that aren't valid UTF-8 are left without it, as readers would decode them incorrectly.
+func setUTF8Flag(fh *FileHeader) {
+	if (!isASCII(fh.Name) || !isASCII(fh.Comment)) &&
+		utf8.ValidString(fh.Name) && utf8.ValidString(fh.Comment) {
+		fh.Flags |= utf8Flag
+	}
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// readerVersion returns the version of the spec needed to extract the entry with header fh, based on
+// the features it uses: 1.0 for stored files, 2.0 for directories and every other method, 4.5 for
+// zip64, 4.6 for bzip2, 5.1 for AES encryption and 6.3 for zstd and UTF-8 names.  Entries whose
+// sizes aren't known yet and only turn out to need zip64 are raised to 4.5 once they are closed.
+func readerVersion(fh *FileHeader) uint16 {
+	version := uint16(zipVersion20)
+	if fh.Method == Store && !strings.HasSuffix(fh.Name, "/") {
+		version = zipVersion10
+	}
+
+	raise := func(v uint16) {
+		if v > version {
+			version = v
+		}
+	}
+	if fh.isZip64() {
+		raise(zipVersion45)
+	}
+	switch fh.Method {
+	case bzip2Method:
+		raise(zipVersion46)
+	case aesMethod:
+		raise(zipVersion51)
+	case zstdMethod:
+		raise(zipVersion63)
+	}
+	if fh.Flags&utf8Flag != 0 {
+		raise(zipVersion63)
+	}
+	return version
+}
+
+// SetForceZip64 makes Close write zip64 extras for every entry in the central directory and a zip64
+// end of central directory record even when the values would fit in the 32-bit fields.  zip64 records
+// are always written when they are required, this is mostly useful for testing.
+func (w *Writer) SetForceZip64(force bool) {
+	w.forceZip64 = force
+}
+
+// SetComment sets the comment written into the end of central directory record by Close.
+func (w *Writer) SetComment(comment string) error {
+	if len(comment) > uint16max {
+		return fmt.Errorf("zip: comment is %d bytes, longer than the maximum of %d bytes",
+			len(comment), uint16max)
+	}
+	w.comment = comment
+	return nil
+}
+
+// KeepEntry adds orig to the central directory without writing its local header or data, which
+// must already be present in the output at the same offset.  It is used to append entries to the
+// zip file orig was read from, after calling SetOffset with the offset returned by DirectoryOffset
+// and writing to the existing file starting at that offset.
+func (w *Writer) KeepEntry(orig *File) {
+	fileHeader := orig.FileHeader
+	fh := &fileHeader
+
+	// The zip64 extra is automatically recreated by Close() when necessary.
+	fh.Extra = stripExtraTags(fh.Extra, zip64ExtraId)
+
+	w.dir = append(w.dir, &header{
+		FileHeader: fh,
+		offset:     uint64(orig.headerOffset),
+	})
+}
+
+// DirectoryOffset returns the offset of the central directory of the zip file in r.
+func DirectoryOffset(r io.ReaderAt, size int64) (int64, error) {
+	end, err := readDirectoryEnd(r, size)
+	if err != nil {
+		return 0, err
+	}
+	return int64(end.directoryOffset), nil
+}
+
 func (w *Writer) CopyFrom(orig *File, newName string) error {
 	if w.last != nil && !w.last.closed {
 		if err := w.last.close(); err != nil {
@@ -86,6 +198,11 @@ func (w *Writer) CopyFrom(orig *File, newName string) error {
 // Extended-Timestamp extra(LFH): <tag-size-flag-modtime-actime-changetime>
 // Extended-Timestamp extra(CDH): <tag-size-flag-modtime>
 func stripExtras(input []byte) []byte {
+	return stripExtraTags(input, zip64ExtraId, ExtendedTimeStampTag)
+}
+
+// stripExtraTags returns input without the extra blocks with any of the given tags.
+func stripExtraTags(input []byte, tags ...uint16) []byte {
 	ret := []byte{}
 
 	for len(input) >= 4 {
@@ -95,7 +212,13 @@ func stripExtras(input []byte) []byte {
 		if int(size) > len(r) {
 			break
 		}
-		if tag != zip64ExtraId && tag != ExtendedTimeStampTag {
+		strip := false
+		for _, t := range tags {
+			if tag == t {
+				strip = true
+			}
+		}
+		if !strip {
 			ret = append(ret, input[:4+size]...)
 		}
 		input = input[4+size:]
@@ -132,8 +255,10 @@ func (w *Writer) CreateCompressedHeader(fh *FileHeader) (io.WriteCloser, error)
 
 	fh.Flags |= DataDescriptorFlag // we will write a data descriptor
 
+	setUTF8Flag(fh)
+
 	fh.CreatorVersion = fh.CreatorVersion&0xff00 | zipVersion20 // preserve compatibility byte
-	fh.ReaderVersion = zipVersion20
+	fh.ReaderVersion = readerVersion(fh)
 
 	fw := &compressedFileWriter{
 		fileWriter{
@@ -149,6 +274,7 @@ func (w *Writer) CreateCompressedHeader(fh *FileHeader) (io.WriteCloser, error)
 	w.dir = append(w.dir, h)
 	fw.header = h
 
+	alignLocalExtra(fh, w.cw.count)
 	if err := writeHeader(w.cw, fh); err != nil {
 		return nil, err
 	}
@@ -157,6 +283,28 @@ func (w *Writer) CreateCompressedHeader(fh *FileHeader) (io.WriteCloser, error)
 	return fw, nil
 }
 
+// alignLocalExtra pads the local extra field of fh with zeros so that the contents of the entry
+// start at a multiple of fh.Alignment when its local header is written at offset.  The central
+// directory keeps the unpadded extra field.
+func alignLocalExtra(fh *FileHeader, offset int64) {
+	if fh.Alignment <= 1 {
+		return
+	}
+	extra := fh.Extra
+	if fh.LocalExtra != nil {
+		extra = fh.LocalExtra
+	}
+	headerLen := int64(fileHeaderLen + len(fh.Name) + len(extra))
+	if fh.Flags&DataDescriptorFlag == 0 && fh.isZip64() {
+		// The zip64 extra that writeHeader adds for the sizes.
+		headerLen += 20
+	}
+	align := int64(fh.Alignment)
+	if pad := (align - (offset+headerLen)%align) % align; pad > 0 {
+		fh.LocalExtra = append(extra[:len(extra):len(extra)], make([]byte, pad)...)
+	}
+}
+
 // Updated version of CreateHeader that doesn't enforce writing a data descriptor
 func (w *Writer) CreateHeaderAndroid(fh *FileHeader) (io.Writer, error) {
 	writeDataDescriptor := fh.Method != Store
@@ -192,7 +340,9 @@ func (w *compressedFileWriter) Close() error {
 	if fh.isZip64() {
 		fh.CompressedSize = uint32max
 		fh.UncompressedSize = uint32max
-		fh.ReaderVersion = zipVersion45 // requires 4.5 - File uses ZIP64 format extensions
+		if fh.ReaderVersion < zipVersion45 {
+			fh.ReaderVersion = zipVersion45 // requires 4.5 - File uses ZIP64 format extensions
+		}
 	} else {
 		fh.CompressedSize = uint32(fh.CompressedSize64)
 		fh.UncompressedSize = uint32(fh.UncompressedSize64)
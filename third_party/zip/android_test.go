@@ -16,6 +16,10 @@ package zip
 
 import (
 	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"strings"
 	"testing"
 )
 
@@ -74,3 +78,333 @@ func TestStripZip64Extras(t *testing.T) {
 		}
 	}
 }
+
+func TestZip64LocalHeader(t *testing.T) {
+	const size = 5 << 30
+
+	fh := &FileHeader{
+		Name:               "big",
+		Method:             Store,
+		CompressedSize64:   size,
+		UncompressedSize64: size,
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeHeader(buf, fh); err != nil {
+		t.Fatal(err)
+	}
+
+	b := readBuf(buf.Bytes())
+	if sig := b.uint32(); sig != fileHeaderSignature {
+		t.Fatalf("incorrect signature %x", sig)
+	}
+	b = b[10:] // skip version, flags, method and modification time
+	b.uint32() // crc32
+	if compressedSize := b.uint32(); compressedSize != uint32max {
+		t.Errorf("want compressed size %x, got %x", uint32(uint32max), compressedSize)
+	}
+	if uncompressedSize := b.uint32(); uncompressedSize != uint32max {
+		t.Errorf("want uncompressed size %x, got %x", uint32(uint32max), uncompressedSize)
+	}
+	nameLen := int(b.uint16())
+	extraLen := int(b.uint16())
+	if extraLen != 20 {
+		t.Fatalf("want 20 bytes of extra, got %d", extraLen)
+	}
+
+	extra := readBuf(b[nameLen : nameLen+extraLen])
+	if tag := extra.uint16(); tag != zip64ExtraId {
+		t.Errorf("want zip64 extra tag, got %x", tag)
+	}
+	if extraSize := extra.uint16(); extraSize != 16 {
+		t.Errorf("want zip64 extra size 16, got %d", extraSize)
+	}
+	if uncompressedSize := extra.uint64(); uncompressedSize != size {
+		t.Errorf("want zip64 uncompressed size %d, got %d", uint64(size), uncompressedSize)
+	}
+	if compressedSize := extra.uint64(); compressedSize != size {
+		t.Errorf("want zip64 compressed size %d, got %d", uint64(size), compressedSize)
+	}
+
+	if len(fh.Extra) != 0 {
+		t.Errorf("expected the header's Extra to be unmodified, got %v", fh.Extra)
+	}
+}
+
+func TestForceZip64(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetForceZip64(true)
+
+	contents := []byte("hello")
+	fw, err := w.Create("hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(contents)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sig [4]byte
+	binary.LittleEndian.PutUint32(sig[:], directory64EndSignature)
+	if !bytes.Contains(buf.Bytes(), sig[:]) {
+		t.Error("missing zip64 end of central directory record")
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != 1 {
+		t.Fatalf("want 1 file, got %d", len(r.File))
+	}
+	if r.File[0].ReaderVersion != zipVersion45 {
+		t.Errorf("want reader version %d, got %d", zipVersion45, r.File[0].ReaderVersion)
+	}
+	rc, err := r.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Errorf("want %q, got %q", contents, got)
+	}
+}
+
+func TestBzip2ReaderVersion(t *testing.T) {
+	for _, forceZip64 := range []bool{false, true} {
+		buf := &bytes.Buffer{}
+		w := NewWriter(buf)
+		w.SetForceZip64(forceZip64)
+
+		fh := &FileHeader{
+			Name:               "hello.txt",
+			Method:             bzip2Method,
+			UncompressedSize64: 5,
+		}
+		fw, err := w.CreateCompressedHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("BZh9"))
+		fw.Close()
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if v := binary.LittleEndian.Uint16(buf.Bytes()[4:]); v != zipVersion46 {
+			t.Errorf("forceZip64 %v: want local header reader version %d, got %d", forceZip64, zipVersion46, v)
+		}
+
+		r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.File[0].ReaderVersion != zipVersion46 {
+			t.Errorf("forceZip64 %v: want reader version %d, got %d", forceZip64, zipVersion46, r.File[0].ReaderVersion)
+		}
+	}
+}
+
+func TestReaderVersion(t *testing.T) {
+	testCases := []struct {
+		name       string
+		fh         FileHeader
+		compressed bool
+		want       uint16
+	}{
+		{
+			name: "store",
+			fh:   FileHeader{Name: "a", Method: Store},
+			want: zipVersion10,
+		},
+		{
+			name: "directory",
+			fh:   FileHeader{Name: "d/", Method: Store},
+			want: zipVersion20,
+		},
+		{
+			name:       "deflate",
+			fh:         FileHeader{Name: "a", Method: Deflate},
+			compressed: true,
+			want:       zipVersion20,
+		},
+		{
+			name:       "zip64",
+			fh:         FileHeader{Name: "a", Method: Deflate, UncompressedSize64: uint32max},
+			compressed: true,
+			want:       zipVersion45,
+		},
+		{
+			name:       "zip64 bzip2",
+			fh:         FileHeader{Name: "a", Method: bzip2Method, UncompressedSize64: uint32max},
+			compressed: true,
+			want:       zipVersion46,
+		},
+		{
+			name:       "zstd",
+			fh:         FileHeader{Name: "a", Method: zstdMethod},
+			compressed: true,
+			want:       zipVersion63,
+		},
+		{
+			name: "utf8",
+			fh:   FileHeader{Name: "\u00e9", Method: Store, Flags: utf8Flag},
+			want: zipVersion63,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			w := NewWriter(buf)
+			fh := test.fh
+			if test.compressed {
+				fw, err := w.CreateCompressedHeader(&fh)
+				if err != nil {
+					t.Fatal(err)
+				}
+				fw.Close()
+			} else if _, err := w.CreateHeaderAndroid(&fh); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if v := binary.LittleEndian.Uint16(buf.Bytes()[4:]); v != test.want {
+				t.Errorf("want local header reader version %d, got %d", test.want, v)
+			}
+			r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.File[0].ReaderVersion; got != test.want {
+				t.Errorf("want reader version %d, got %d", test.want, got)
+			}
+			if got := r.File[0].CreatorVersion & 0xff; got != zipVersion20 {
+				t.Errorf("want creator version %d, got %d", zipVersion20, got)
+			}
+		})
+	}
+}
+
+func TestSetComment(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	if err := w.SetComment(strings.Repeat("x", uint16max+1)); err == nil {
+		t.Error("expected an error for a comment longer than 65535 bytes")
+	}
+
+	comment := "archive comment"
+	if err := w.SetComment(comment); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Create("hello.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Comment != comment {
+		t.Errorf("want comment %q, got %q", comment, r.Comment)
+	}
+	if len(r.File) != 1 {
+		t.Errorf("want 1 file, got %d", len(r.File))
+	}
+}
+
+func TestLocalExtra(t *testing.T) {
+	central := []byte{0x55, 0x54, 5, 0, 1, 1, 2, 3, 4}
+	local := []byte{0x55, 0x54, 9, 0, 3, 1, 2, 3, 4, 5, 6, 7, 8}
+
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	fh := &FileHeader{Name: "a", Method: Store, Extra: central, LocalExtra: local}
+	if _, err := w.CreateHeader(fh); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := buf.Bytes()
+	if got := int(binary.LittleEndian.Uint16(data[28:])); got != len(local) {
+		t.Fatalf("want local extra length %d, got %d", len(local), got)
+	}
+	if got := data[30+len("a") : 30+len("a")+len(local)]; !bytes.Equal(got, local) {
+		t.Errorf("want local extra %v, got %v", local, got)
+	}
+
+	r, err := NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.File[0].Extra; !bytes.Equal(got, central) {
+		t.Errorf("want central extra %v, got %v", central, got)
+	}
+}
+
+func TestAlignment(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	for _, name := range []string{"a", "bb", "ccc"} {
+		fh := &FileHeader{
+			Name:               name,
+			Method:             Store,
+			Extra:              []byte{0xfe, 0xca, 0, 0},
+			CRC32:              crc32.ChecksumIEEE([]byte(name)),
+			UncompressedSize64: uint64(len(name)),
+			Alignment:          8,
+		}
+		fw, err := w.CreateHeaderAndroid(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range r.File {
+		offset, err := f.DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset%8 != 0 {
+			t.Errorf("%s: want contents aligned to 8, got offset %d", f.Name, offset)
+		}
+		if want := []byte{0xfe, 0xca, 0, 0}; !bytes.Equal(f.Extra, want) {
+			t.Errorf("%s: want central extra %x, got %x", f.Name, want, f.Extra)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != f.Name {
+			t.Errorf("want contents %q, got %q", f.Name, contents)
+		}
+	}
+}
@@ -54,8 +54,20 @@ const (
 	creatorMacOSX = 19
 
 	// version numbers
+	// BEGIN ANDROID CHANGE add the version needed for stored files
+	zipVersion10 = 10 // 1.0 (reads stored files)
+	// END ANDROID CHANGE
 	zipVersion20 = 20 // 2.0
 	zipVersion45 = 45 // 4.5 (reads and writes zip64 archives)
+	// BEGIN ANDROID CHANGE add the version needed for bzip2
+	zipVersion46 = 46 // 4.6 (reads bzip2 compressed entries)
+	// END ANDROID CHANGE
+	// BEGIN ANDROID CHANGE add the version needed for AES encryption
+	zipVersion51 = 51 // 5.1 (reads AES encrypted entries)
+	// END ANDROID CHANGE
+	// BEGIN ANDROID CHANGE add the version needed for zstd and UTF-8 names
+	zipVersion63 = 63 // 6.3 (reads zstd compressed entries and UTF-8 names)
+	// END ANDROID CHANGE
 
 	// limits for non zip64 files
 	uint16max = (1 << 16) - 1
@@ -88,6 +100,20 @@ type FileHeader struct {
 	Extra              []byte
 	ExternalAttrs      uint32 // Meaning depends on CreatorVersion
 	Comment            string
+
+	// BEGIN ANDROID CHANGE support extra fields that differ between the local and central headers
+	// LocalExtra, if not nil, is written into the local file header instead of Extra, for extra
+	// fields like the extended timestamp whose local version holds more than the central one.
+	// It is not set by the reader.
+	LocalExtra []byte
+	// END ANDROID CHANGE
+
+	// BEGIN ANDROID CHANGE support aligning the contents of entries
+	// Alignment, if greater than 1, pads the extra field of the local header with zeros so
+	// that the contents of the entry start at a multiple of Alignment bytes from the start of
+	// the file, like zipalign.  It is not set by the reader.
+	Alignment int
+	// END ANDROID CHANGE
 }
 
 // FileInfo returns an os.FileInfo for the FileHeader.
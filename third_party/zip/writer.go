@@ -22,6 +22,14 @@ type Writer struct {
 	last        *fileWriter
 	closed      bool
 	compressors map[uint16]Compressor
+
+	// BEGIN ANDROID CHANGE add forceZip64
+	forceZip64 bool
+	// END ANDROID CHANGE
+
+	// BEGIN ANDROID CHANGE support zip file comments
+	comment string
+	// END ANDROID CHANGE
 }
 
 type header struct {
@@ -72,13 +80,21 @@ func (w *Writer) Close() error {
 		b := writeBuf(buf[:])
 		b.uint32(uint32(directoryHeaderSignature))
 		b.uint16(h.CreatorVersion)
+		// BEGIN ANDROID CHANGE support forcing zip64 and use the zip64 offset consistently
+		zip64 := w.forceZip64 || h.isZip64() || h.offset >= uint32max
+		if zip64 && h.ReaderVersion < zipVersion45 {
+			h.ReaderVersion = zipVersion45 // requires 4.5 - File uses ZIP64 format extensions
+		}
+		// END ANDROID CHANGE
 		b.uint16(h.ReaderVersion)
 		b.uint16(h.Flags)
 		b.uint16(h.Method)
 		b.uint16(h.ModifiedTime)
 		b.uint16(h.ModifiedDate)
 		b.uint32(h.CRC32)
-		if h.isZip64() || h.offset >= uint32max {
+		// BEGIN ANDROID CHANGE support forcing zip64
+		if zip64 {
+			// END ANDROID CHANGE
 			// the file needs a zip64 header. store maxint in both
 			// 32 bit size fields (and offset later) to signal that the
 			// zip64 extra header should be used.
@@ -103,7 +119,9 @@ func (w *Writer) Close() error {
 		b.uint16(uint16(len(h.Comment)))
 		b = b[4:] // skip disk number start and internal file attr (2x uint16)
 		b.uint32(h.ExternalAttrs)
-		if h.offset > uint32max {
+		// BEGIN ANDROID CHANGE use the zip64 offset whenever the zip64 extra is present
+		if zip64 {
+			// END ANDROID CHANGE
 			b.uint32(uint32max)
 		} else {
 			b.uint32(uint32(h.offset))
@@ -127,7 +145,9 @@ func (w *Writer) Close() error {
 	size := uint64(end - start)
 	offset := uint64(start)
 
-	if records > uint16max || size > uint32max || offset > uint32max {
+	// BEGIN ANDROID CHANGE support forcing zip64
+	if w.forceZip64 || records >= uint16max || size >= uint32max || offset >= uint32max {
+		// END ANDROID CHANGE
 		var buf [directory64EndLen + directory64LocLen]byte
 		b := writeBuf(buf[:])
 
@@ -169,10 +189,15 @@ func (w *Writer) Close() error {
 	b.uint16(uint16(records)) // number of entries total
 	b.uint32(uint32(size))    // size of directory
 	b.uint32(uint32(offset))  // start of directory
-	// skipped size of comment (always zero)
+	// BEGIN ANDROID CHANGE support zip file comments
+	b.uint16(uint16(len(w.comment))) // size of comment
 	if _, err := w.cw.Write(buf[:]); err != nil {
 		return err
 	}
+	if _, err := io.WriteString(w.cw, w.comment); err != nil {
+		return err
+	}
+	// END ANDROID CHANGE
 
 	return w.cw.w.(*bufio.Writer).Flush()
 }
@@ -224,8 +249,13 @@ func (w *Writer) createHeaderImpl(fh *FileHeader) (io.Writer, error) {
 	// BEGIN ANDROID CHANGE move the setting of DataDescriptorFlag into CreateHeader
 	// fh.Flags |= 0x8 // we will write a data descriptor
 	// END ANDROID CHANGE
+	// BEGIN ANDROID CHANGE mark non-ASCII names as UTF-8
+	setUTF8Flag(fh)
+	// END ANDROID CHANGE
 	fh.CreatorVersion = fh.CreatorVersion&0xff00 | zipVersion20 // preserve compatibility byte
-	fh.ReaderVersion = zipVersion20
+	// BEGIN ANDROID CHANGE pick the version needed from the features of the entry
+	fh.ReaderVersion = readerVersion(fh)
+	// END ANDROID CHANGE
 
 	fw := &fileWriter{
 		zipw:      w.cw,
@@ -250,6 +280,9 @@ func (w *Writer) createHeaderImpl(fh *FileHeader) (io.Writer, error) {
 	w.dir = append(w.dir, h)
 	fw.header = h
 
+	// BEGIN ANDROID CHANGE support aligning the contents of entries
+	alignLocalExtra(fh, w.cw.count)
+	// END ANDROID CHANGE
 	if err := writeHeader(w.cw, fh); err != nil {
 		return nil, err
 	}
@@ -259,6 +292,9 @@ func (w *Writer) createHeaderImpl(fh *FileHeader) (io.Writer, error) {
 }
 
 func writeHeader(w io.Writer, h *FileHeader) error {
+	// BEGIN ANDROID CHANGE support zip64 local headers without a data descriptor
+	var zip64Extra []byte
+	// END ANDROID CHANGE
 	var buf [fileHeaderLen]byte
 	b := writeBuf(buf[:])
 	b.uint32(uint32(fileHeaderSignature))
@@ -276,32 +312,56 @@ func writeHeader(w io.Writer, h *FileHeader) error {
 	} else {
 		b.uint32(h.CRC32)
 
-		if h.CompressedSize64 > uint32max || h.UncompressedSize64 > uint32max {
-			panic("skipping writing the data descriptor for a 64-bit value is not yet supported")
-		}
-		compressedSize := uint32(h.CompressedSize64)
+		compressedSize := h.CompressedSize64
 		if compressedSize == 0 {
-			compressedSize = h.CompressedSize
+			compressedSize = uint64(h.CompressedSize)
 		}
 
-		uncompressedSize := uint32(h.UncompressedSize64)
+		uncompressedSize := h.UncompressedSize64
 		if uncompressedSize == 0 {
-			uncompressedSize = h.UncompressedSize
+			uncompressedSize = uint64(h.UncompressedSize)
 		}
 
-		b.uint32(compressedSize)
-		b.uint32(uncompressedSize)
+		if compressedSize >= uint32max || uncompressedSize >= uint32max {
+			// Without a data descriptor the sizes have to go into a zip64 extra in
+			// the local header. It is written separately so that it doesn't end up
+			// duplicated in the central directory, which appends its own.
+			b.uint32(uint32max) // compressed size
+			b.uint32(uint32max) // uncompressed size
+
+			var zip64Buf [20]byte // 2x uint16 + 2x uint64
+			eb := writeBuf(zip64Buf[:])
+			eb.uint16(zip64ExtraId)
+			eb.uint16(16) // size = 2x uint64
+			eb.uint64(uncompressedSize)
+			eb.uint64(compressedSize)
+			zip64Extra = zip64Buf[:]
+		} else {
+			b.uint32(uint32(compressedSize))
+			b.uint32(uint32(uncompressedSize))
+		}
 	}
 	// END ANDROID CHANGE
 	b.uint16(uint16(len(h.Name)))
-	b.uint16(uint16(len(h.Extra)))
+	// BEGIN ANDROID CHANGE include the local zip64 extra and use the local extra fields
+	extra := h.Extra
+	if h.LocalExtra != nil {
+		extra = h.LocalExtra
+	}
+	b.uint16(uint16(len(extra) + len(zip64Extra)))
+	// END ANDROID CHANGE
 	if _, err := w.Write(buf[:]); err != nil {
 		return err
 	}
 	if _, err := io.WriteString(w, h.Name); err != nil {
 		return err
 	}
-	_, err := w.Write(h.Extra)
+	// BEGIN ANDROID CHANGE include the local zip64 extra and use the local extra fields
+	if _, err := w.Write(extra); err != nil {
+		return err
+	}
+	_, err := w.Write(zip64Extra)
+	// END ANDROID CHANGE
 	return err
 }
 
@@ -361,7 +421,11 @@ func (w *fileWriter) close() (err error) {
 	if fh.isZip64() {
 		fh.CompressedSize = uint32max
 		fh.UncompressedSize = uint32max
-		fh.ReaderVersion = zipVersion45 // requires 4.5 - File uses ZIP64 format extensions
+		// BEGIN ANDROID CHANGE don't lower the version needed by other features
+		if fh.ReaderVersion < zipVersion45 {
+			fh.ReaderVersion = zipVersion45 // requires 4.5 - File uses ZIP64 format extensions
+		}
+		// END ANDROID CHANGE
 	} else {
 		fh.CompressedSize = uint32(fh.CompressedSize64)
 		fh.UncompressedSize = uint32(fh.UncompressedSize64)
@@ -0,0 +1,189 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash"
+	"io"
+
+	"android/soong/third_party/zip"
+)
+
+// AESMethod is the method ID of entries encrypted with the WinZip AES scheme, see
+// https://www.winzip.com/en/support/aes-encryption/.  The method the contents were compressed with
+// before they were encrypted is recorded in the AESExtraTag extra field.
+const AESMethod uint16 = 99
+
+// AESExtraTag is the ID of the extra field that every AESMethod entry has.  Its 7 bytes contain the
+// AE version (2), the vendor ID "AE", the key strength (3 for AES-256) and the actual compression
+// method of the entry.
+const AESExtraTag = 0x9901
+
+const (
+	// encryptedFlag is bit 0 of the general purpose flags, set for encrypted entries.
+	encryptedFlag = 0x1
+
+	// AE-2 entries store a CRC32 of 0 and rely on the authentication code instead, so that the
+	// CRC of a small file can't leak information about its contents.
+	aesVersion     = 2
+	aesStrength256 = 3
+	aesKeySize     = 32
+	aesSaltSize    = 16
+	aesVerifierLen = 2
+	aesMACLen      = 10
+
+	// aesIterations is the PBKDF2 iteration count fixed by the WinZip AES spec.
+	aesIterations = 1000
+)
+
+// aesSaltReader is where the salts of entries are read from, tests replace it to produce known
+// output.
+var aesSaltReader io.Reader = rand.Reader
+
+// aesExtra returns the AESExtraTag extra field of an entry whose contents were compressed with
+// method.
+func aesExtra(method uint16) []byte {
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], AESExtraTag)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], aesVersion)
+	copy(extra[6:], "AE")
+	extra[8] = aesStrength256
+	binary.LittleEndian.PutUint16(extra[9:], method)
+	return extra
+}
+
+// pbkdf2SHA1 derives a key of keyLen bytes from password and salt with PBKDF2 as defined by
+// RFC 8018, using HMAC-SHA1 as the pseudorandom function.
+func pbkdf2SHA1(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	key := make([]byte, 0, keyLen+prf.Size())
+	u := make([]byte, prf.Size())
+	t := make([]byte, prf.Size())
+	var blockIndex [4]byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		binary.BigEndian.PutUint32(blockIndex[:], block)
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(blockIndex[:])
+		u = prf.Sum(u[:0])
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// aesKeys derives the encryption key, the authentication key and the password verifier of an entry
+// from the password and the salt of the entry.
+func aesKeys(password string, salt []byte) (encKey, authKey, verifier []byte) {
+	keys := pbkdf2SHA1([]byte(password), salt, aesIterations, 2*aesKeySize+aesVerifierLen)
+	return keys[:aesKeySize], keys[aesKeySize : 2*aesKeySize], keys[2*aesKeySize:]
+}
+
+// aesWriter encrypts the already compressed contents of an entry written to it.  The encrypted data
+// starts with a random salt and the password verifier, followed by the contents encrypted with
+// AES-256 in counter mode, and ends with the first 10 bytes of the HMAC-SHA1 of the encrypted
+// contents.
+type aesWriter struct {
+	w  io.WriteCloser
+	fh *zip.FileHeader
+
+	block cipher.Block
+	mac   hash.Hash
+
+	// counter is the little endian number of the current block, starting at 1, which unlike the
+	// big endian counter of cipher.NewCTR is what the spec requires.  keyStream is the encrypted
+	// counter, of which used bytes have been consumed.
+	counter   [aes.BlockSize]byte
+	keyStream [aes.BlockSize]byte
+	used      int
+
+	buf []byte
+}
+
+// newAESWriter writes the salt and password verifier of the entry with header fh to w, and returns
+// a writer that encrypts the compressed contents into w.  Closing it writes the authentication
+// code, clears the CRC32 of fh as AE-2 requires, and closes w.
+func newAESWriter(w io.WriteCloser, fh *zip.FileHeader, password string) (io.WriteCloser, error) {
+	salt := make([]byte, aesSaltSize)
+	if _, err := io.ReadFull(aesSaltReader, salt); err != nil {
+		return nil, err
+	}
+
+	encKey, authKey, verifier := aesKeys(password, salt)
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(salt); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(verifier); err != nil {
+		return nil, err
+	}
+
+	return &aesWriter{
+		w:     w,
+		fh:    fh,
+		block: block,
+		mac:   hmac.New(sha1.New, authKey),
+		used:  aes.BlockSize,
+	}, nil
+}
+
+func (a *aesWriter) Write(p []byte) (int, error) {
+	// Don't modify p, io.Writer implementations must not.
+	a.buf = append(a.buf[:0], p...)
+	for i := range a.buf {
+		if a.used == aes.BlockSize {
+			for j := range a.counter {
+				a.counter[j]++
+				if a.counter[j] != 0 {
+					break
+				}
+			}
+			a.block.Encrypt(a.keyStream[:], a.counter[:])
+			a.used = 0
+		}
+		a.buf[i] ^= a.keyStream[a.used]
+		a.used++
+	}
+	a.mac.Write(a.buf)
+	return a.w.Write(a.buf)
+}
+
+func (a *aesWriter) Close() error {
+	if _, err := a.w.Write(a.mac.Sum(nil)[:aesMACLen]); err != nil {
+		return err
+	}
+	a.fh.CRC32 = 0
+	return a.w.Close()
+}
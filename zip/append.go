@@ -0,0 +1,107 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"android/soong/third_party/zip"
+)
+
+// existingZip is a zip file that new entries are being appended to.
+type existingZip struct {
+	reader *zip.Reader
+
+	// offset is the offset of the central directory of the existing zip file, new entries are
+	// written over it.
+	offset int64
+}
+
+// appendZip adds the entries described by args to the existing zip file at args.OutputFilePath.
+// The new entries and a new central directory are written over the old central directory, so the
+// data of entries that aren't replaced is never rewritten.  The data of replaced entries is left in
+// the file, but is no longer referenced by the central directory.  If writing fails the output
+// file may be left corrupt.
+func appendZip(ctx context.Context, args ZipArgs, stats *Stats) error {
+	if args.EmulateJar || args.SrcJar {
+		return fmt.Errorf("appending to jars or srcjars is not supported")
+	}
+
+	f, err := os.OpenFile(args.OutputFilePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	r, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		return fmt.Errorf("failed to read %q to append to it: %s", args.OutputFilePath, err)
+	}
+
+	offset, err := zip.DirectoryOffset(f, info.Size())
+	if err != nil {
+		return fmt.Errorf("failed to read %q to append to it: %s", args.OutputFilePath, err)
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	err = zipTo(ctx, args, f, stats, &existingZip{reader: r, offset: offset})
+	if err != nil {
+		return err
+	}
+
+	// The new central directory may be shorter than the old one, drop anything left after it.
+	end, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(end); err != nil {
+		return err
+	}
+	if args.DurableWrite {
+		// The zip file is written in place, so there is no rename to sync.
+		return outputSyncer.syncFile(f)
+	}
+	return nil
+}
+
+// skipExistingEntries returns the mappings whose destinations aren't entries of the existing zip
+// file, recording the others in z.skippedExisting.
+func (z *ZipWriter) skipExistingEntries(mappings []pathMapping) []pathMapping {
+	existing := make(map[string]bool)
+	for _, file := range z.existing.reader.File {
+		existing[file.Name] = true
+	}
+
+	ret := mappings[:0]
+	for _, m := range mappings {
+		if existing[m.dest] {
+			z.skippedExisting = append(z.skippedExisting, m.dest)
+			continue
+		}
+		ret = append(ret, m)
+	}
+	return ret
+}
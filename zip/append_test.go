@@ -0,0 +1,265 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"android/soong/third_party/zip"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+// readZipContents returns the names of the entries in the zip file at path and their contents.
+func readZipContents(t *testing.T, path string) ([]string, map[string][]byte) {
+	t.Helper()
+
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	var names []string
+	contents := make(map[string][]byte)
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("error when opening %s: %s", f.Name, err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("error when reading %s: %s", f.Name, err)
+		}
+		contents[f.Name] = b
+	}
+	return names, contents
+}
+
+func TestAppend(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"v1/d/f": fileA,
+		"v1/g":   fileB,
+		"v2/d/f": fileC,
+		"v2/d/h": fileB,
+	})
+
+	zipArgs := func(out string, b *FileArgsBuilder, append bool) ZipArgs {
+		if err := b.Error(); err != nil {
+			t.Fatal(err)
+		}
+
+		args := ZipArgs{}
+		args.FileArgs = b.FileArgs()
+		args.OutputFilePath = out
+		args.CompressionLevel = 9
+		args.AddDirectoryEntriesToZip = true
+		args.Append = append
+		args.Filesystem = fs
+		args.Stderr = &bytes.Buffer{}
+		return args
+	}
+
+	dir, err := ioutil.TempDir("", "TestAppend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("append file", func(t *testing.T) {
+		out := filepath.Join(dir, "append_file.zip")
+
+		err := Zip(zipArgs(out, fileArgsBuilder().SourcePrefixToStrip("v1").File("v1/d/f"), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		before, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset, err := zip.DirectoryOffset(bytes.NewReader(before), int64(len(before)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = Zip(zipArgs(out, fileArgsBuilder().SourcePrefixToStrip("v1").File("v1/g"), true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		after, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(after, before[:offset]) {
+			t.Error("expected existing entries to be left untouched")
+		}
+
+		names, contents := readZipContents(t, out)
+		wantNames := []string{"d/", "d/f", "g"}
+		if !reflect.DeepEqual(names, wantNames) {
+			t.Errorf("want files %q, got %q", wantNames, names)
+		}
+		if !bytes.Equal(contents["d/f"], fileA) || !bytes.Equal(contents["g"], fileB) {
+			t.Errorf("incorrect contents %q", contents)
+		}
+	})
+
+	t.Run("replace file", func(t *testing.T) {
+		out := filepath.Join(dir, "replace_file.zip")
+
+		err := Zip(zipArgs(out, fileArgsBuilder().SourcePrefixToStrip("v1").File("v1/d/f").File("v1/g"), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = Zip(zipArgs(out, fileArgsBuilder().SourcePrefixToStrip("v2").Dir("v2/d"), true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names, contents := readZipContents(t, out)
+		wantNames := []string{"d/", "g", "d/f", "d/h"}
+		if !reflect.DeepEqual(names, wantNames) {
+			t.Errorf("want files %q, got %q", wantNames, names)
+		}
+		wantContents := map[string][]byte{
+			"d/":  {},
+			"d/f": fileC,
+			"d/h": fileB,
+			"g":   fileB,
+		}
+		if !reflect.DeepEqual(contents, wantContents) {
+			t.Errorf("want contents %q, got %q", wantContents, contents)
+		}
+	})
+
+	t.Run("only if missing", func(t *testing.T) {
+		out := filepath.Join(dir, "only_if_missing.zip")
+
+		err := Zip(zipArgs(out, fileArgsBuilder().SourcePrefixToStrip("v1").File("v1/d/f").File("v1/g"), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// d/f is in both, d/h is only in the overlay.
+		args := zipArgs(out, fileArgsBuilder().SourcePrefixToStrip("v2").Dir("v2/d"), true)
+		args.AddIfMissing = true
+		stats, err := ZipWithStats(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"d/f"}; !reflect.DeepEqual(stats.SkippedExistingEntries, want) {
+			t.Errorf("want skipped entries %q, got %q", want, stats.SkippedExistingEntries)
+		}
+
+		names, contents := readZipContents(t, out)
+		wantNames := []string{"d/", "d/f", "g", "d/h"}
+		if !reflect.DeepEqual(names, wantNames) {
+			t.Errorf("want files %q, got %q", wantNames, names)
+		}
+		wantContents := map[string][]byte{
+			"d/":  {},
+			"d/f": fileA,
+			"d/h": fileB,
+			"g":   fileB,
+		}
+		if !reflect.DeepEqual(contents, wantContents) {
+			t.Errorf("want contents %q, got %q", wantContents, contents)
+		}
+	})
+
+	t.Run("only if missing without overlap", func(t *testing.T) {
+		out := filepath.Join(dir, "only_if_missing_no_overlap.zip")
+
+		err := Zip(zipArgs(out, fileArgsBuilder().SourcePrefixToStrip("v1").File("v1/g"), false))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		args := zipArgs(out, fileArgsBuilder().SourcePrefixToStrip("v2").File("v2/d/h"), true)
+		args.AddIfMissing = true
+		stats, err := ZipWithStats(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats.SkippedExistingEntries) != 0 {
+			t.Errorf("want no skipped entries, got %q", stats.SkippedExistingEntries)
+		}
+
+		names, _ := readZipContents(t, out)
+		if want := []string{"g", "d/", "d/h"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("want files %q, got %q", want, names)
+		}
+	})
+
+	t.Run("only if missing without append", func(t *testing.T) {
+		args := zipArgs(filepath.Join(dir, "no_append.zip"), fileArgsBuilder().File("v1/g"), false)
+		args.AddIfMissing = true
+		if err := Zip(args); err == nil || err.Error() != "add if missing requires append" {
+			t.Errorf("want error %q, got %v", "add if missing requires append", err)
+		}
+	})
+
+	t.Run("recompute crc", func(t *testing.T) {
+		out := filepath.Join(dir, "recompute_crc.zip")
+
+		args := zipArgs(out, fileArgsBuilder().SourcePrefixToStrip("v1").Dir("v1"), false)
+		args.NonDeflatedFiles = map[string]bool{"g": true}
+		if err := Zip(args); err != nil {
+			t.Fatal(err)
+		}
+		corrupt := corruptTestZip(t, out, dir, "recompute_crc_corrupt.zip", "g")
+
+		args = zipArgs(out, fileArgsBuilder().SourcePrefixToStrip("v2").File("v2/d/h"), true)
+		args.RecomputeCRC = true
+		if err := Zip(args); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		_, contents := readZipContents(t, out)
+		if !bytes.Equal(contents["g"], fileB) || !bytes.Equal(contents["d/h"], fileB) {
+			t.Errorf("incorrect contents %q", contents)
+		}
+
+		args.OutputFilePath = corrupt
+		err := Zip(args)
+		if want := `failed to keep existing entry "g": ` + zip.ErrChecksum.Error(); err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+
+	t.Run("missing output", func(t *testing.T) {
+		out := filepath.Join(dir, "missing.zip")
+
+		err := Zip(zipArgs(out, fileArgsBuilder().SourcePrefixToStrip("v1").File("v1/g"), true))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names, _ := readZipContents(t, out)
+		if want := []string{"g"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("want files %q, got %q", want, names)
+		}
+	})
+}
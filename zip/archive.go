@@ -0,0 +1,152 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/google/blueprint/pathtools"
+
+	"android/soong/third_party/zip"
+)
+
+// ArchiveSeparator separates the path of a zip file from a pattern matching its entries in a
+// source file of a FileArg, as in "outer.zip!inner/path/*.txt".  The pattern may itself name an
+// entry that is a zip file followed by another separator and pattern, as in
+// "outer.zip!inner.zip!*.txt", to select the entries of a nested zip file.
+const ArchiveSeparator = "!"
+
+// splitArchiveSource returns the zip file and the pattern of its entries named by the source file
+// s, and false if s isn't of the form "archive!pattern" with archive a file that exists.  Files
+// whose names contain the separator are still used as is.
+func (z *ZipWriter) splitArchiveSource(s string) (archive, pattern string, ok bool, err error) {
+	sep := strings.Index(s, ArchiveSeparator)
+	if sep == -1 {
+		return "", "", false, nil
+	}
+	if exists, _, err := z.fs.Exists(s); err != nil || exists {
+		return "", "", false, err
+	}
+	archive, pattern = s[:sep], s[sep+len(ArchiveSeparator):]
+	if exists, isDir, err := z.fs.Exists(archive); err != nil || !exists || isDir {
+		return "", "", false, err
+	}
+	return archive, pattern, true, nil
+}
+
+// globArchive returns the sources of the entries of the zip file archive whose names match the
+// pattern, in the order of the zip file, and records their entries in z.archiveMembers.  Directory
+// entries are left out, the directories are added for the files inside them.  The zip file stays
+// open until the zip file being written is finished.
+func (z *ZipWriter) globArchive(archive, pattern string) ([]string, error) {
+	f, err := z.fs.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	info, err := z.fs.Stat(archive)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read %q: %s", archive, err)
+	}
+	z.archives = append(z.archives, f)
+
+	return z.globArchiveEntries(archive, r, pattern)
+}
+
+// globArchiveEntries returns the sources of the entries of r matching pattern, see globArchive.
+// Nested zip files are read into memory.
+func (z *ZipWriter) globArchiveEntries(archive string, r *zip.Reader, pattern string) ([]string, error) {
+	if sep := strings.Index(pattern, ArchiveSeparator); sep != -1 {
+		inner, rest := pattern[:sep], pattern[sep+len(ArchiveSeparator):]
+		for _, f := range r.File {
+			if f.Name != inner {
+				continue
+			}
+			contents, err := readArchiveEntry(f)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %q: %s", archive+ArchiveSeparator+inner, err)
+			}
+			nested, err := zip.NewReader(bytes.NewReader(contents), int64(len(contents)))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %q: %s", archive+ArchiveSeparator+inner, err)
+			}
+			return z.globArchiveEntries(archive+ArchiveSeparator+inner, nested, rest)
+		}
+		// Report the whole pattern as missing.
+		return nil, nil
+	}
+
+	if z.archiveMembers == nil {
+		z.archiveMembers = make(map[string]*zip.File)
+	}
+
+	var srcs []string
+	for _, f := range r.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		match, err := pathtools.Match(pattern, f.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", pattern, err)
+		}
+		if match {
+			src := archive + ArchiveSeparator + f.Name
+			z.archiveMembers[src] = f
+			srcs = append(srcs, src)
+		}
+	}
+	return srcs, nil
+}
+
+func readArchiveEntry(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// archiveMemberReader reads the contents of an entry of a zip file, which is only opened once it
+// is first read so that entries aren't all open at the same time, and closed once it has been
+// read completely.
+type archiveMemberReader struct {
+	file *zip.File
+	r    io.ReadCloser
+}
+
+func (a *archiveMemberReader) Read(p []byte) (int, error) {
+	if a.r == nil {
+		r, err := a.file.Open()
+		if err != nil {
+			return 0, err
+		}
+		a.r = r
+	}
+	n, err := a.r.Read(p)
+	if err != nil {
+		a.r.Close()
+	}
+	return n, err
+}
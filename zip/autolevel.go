@@ -0,0 +1,104 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+
+	"android/soong/third_party/zip"
+)
+
+const (
+	// autoSampleSize is the size of the prefix of a file that AutoCompressionLevel compresses to
+	// pick its compression level.
+	autoSampleSize = 32 * 1024
+
+	// A file is stored if compressing its sample at flate.BestSpeed saves less than
+	// autoStorePercent percent of its size.
+	autoStorePercent = 5
+	// A file is compressed at flate.BestCompression if that makes its sample at least
+	// autoBestPercent percent smaller than flate.BestSpeed does, and at flate.BestSpeed otherwise.
+	autoBestPercent = 5
+)
+
+// autoSampler holds the compressors used to sample files for AutoCompressionLevel, which are all
+// sampled before any of them are added.
+type autoSampler struct {
+	fast, best *flate.Writer
+	sample     []byte
+	buf        bytes.Buffer
+}
+
+// compressedSize returns the size of b compressed by fw.
+func (s *autoSampler) compressedSize(fw *flate.Writer, b []byte) (int, error) {
+	s.buf.Reset()
+	fw.Reset(&s.buf)
+	if _, err := fw.Write(b); err != nil {
+		return 0, err
+	}
+	if err := fw.Close(); err != nil {
+		return 0, err
+	}
+	return s.buf.Len(), nil
+}
+
+// autoCompression returns the method and level to use for the file src with AutoCompressionLevel,
+// by compressing its first autoSampleSize bytes at flate.BestSpeed and flate.BestCompression, see
+// ZipArgs.AutoCompressionLevel.  The choice only depends on the contents of the sample, so it is
+// the same every time for the same file.  If the file can't be read method and level are returned
+// unchanged, and addFile reports the error.
+func (z *ZipWriter) autoCompression(src string, method uint16, level int) (uint16, int, error) {
+	s := z.autoSampler
+	if s == nil {
+		s = &autoSampler{sample: make([]byte, autoSampleSize)}
+		var err error
+		if s.fast, err = flate.NewWriter(nil, flate.BestSpeed); err != nil {
+			return 0, 0, err
+		}
+		if s.best, err = flate.NewWriter(nil, flate.BestCompression); err != nil {
+			return 0, 0, err
+		}
+		z.autoSampler = s
+	}
+
+	f, err := z.fs.Open(src)
+	if err != nil {
+		return method, level, nil
+	}
+	n, err := io.ReadFull(f, s.sample)
+	f.Close()
+	if (err != nil && err != io.ErrUnexpectedEOF) || n == 0 {
+		return method, level, nil
+	}
+	sample := s.sample[:n]
+
+	fast, err := s.compressedSize(s.fast, sample)
+	if err != nil {
+		return 0, 0, err
+	}
+	if fast*100 >= n*(100-autoStorePercent) {
+		return zip.Store, flate.NoCompression, nil
+	}
+	best, err := s.compressedSize(s.best, sample)
+	if err != nil {
+		return 0, 0, err
+	}
+	if best*100 <= fast*(100-autoBestPercent) {
+		return method, flate.BestCompression, nil
+	}
+	return method, flate.BestSpeed, nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"strings"
+)
+
+// expandBraces returns the patterns produced by expanding the {x,y,z} alternations in pattern, like
+// a shell would.  Alternations may be nested, and \{, \} and \, match the literal characters.  A
+// brace without a matching closing brace is kept literally, with a warning.
+func (z *ZipWriter) expandBraces(pattern string) []string {
+	expanded, unmatched := expandBraces(pattern)
+	if unmatched {
+		z.warnf("unmatched brace in %q, treating it literally", pattern)
+	}
+
+	for i, p := range expanded {
+		// Patterns without wildcards are used as paths, remove the escapes that the glob
+		// would otherwise have handled.
+		if !strings.ContainsAny(p, "*?[") {
+			expanded[i] = braceUnescaper.Replace(p)
+		}
+	}
+
+	return expanded
+}
+
+var braceUnescaper = strings.NewReplacer(`\{`, `{`, `\}`, `}`, `\,`, `,`)
+
+// expandBraces expands the first alternation in pattern, and then recursively expands the
+// alternatives and the rest of the pattern.  It also returns true if any brace was unmatched.
+func expandBraces(pattern string) (expanded []string, unmatched bool) {
+	start := -1
+	depth := 0
+	var commas []int
+
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '{':
+			if depth == 0 {
+				start = i
+				commas = nil
+			}
+			depth++
+		case ',':
+			if depth == 1 {
+				commas = append(commas, i)
+			}
+		case '}':
+			if depth == 0 {
+				// A closing brace without an opening brace is literal.
+				continue
+			}
+			depth--
+			if depth > 0 {
+				continue
+			}
+
+			prefix := pattern[:start]
+			suffix, suffixUnmatched := expandBraces(pattern[i+1:])
+
+			var alternatives []string
+			if len(commas) == 0 {
+				// A brace pair without any alternatives is literal, but may contain
+				// alternations.
+				inner, innerUnmatched := expandBraces(pattern[start+1 : i])
+				for _, alt := range inner {
+					alternatives = append(alternatives, "{"+alt+"}")
+				}
+				unmatched = innerUnmatched
+			} else {
+				bounds := append(append([]int{start}, commas...), i)
+				for j := 0; j < len(bounds)-1; j++ {
+					inner, innerUnmatched := expandBraces(pattern[bounds[j]+1 : bounds[j+1]])
+					alternatives = append(alternatives, inner...)
+					unmatched = unmatched || innerUnmatched
+				}
+			}
+
+			for _, alt := range alternatives {
+				for _, s := range suffix {
+					expanded = append(expanded, prefix+alt+s)
+				}
+			}
+			return expanded, unmatched || suffixUnmatched
+		}
+	}
+
+	if depth > 0 {
+		// The first opening brace was never closed, keep it literally and expand anything
+		// after it.
+		rest, _ := expandBraces(pattern[start+1:])
+		for _, s := range rest {
+			expanded = append(expanded, pattern[:start+1]+s)
+		}
+		return expanded, true
+	}
+
+	return []string{pattern}, false
+}
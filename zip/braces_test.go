@@ -0,0 +1,100 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"log"
+	"reflect"
+	"testing"
+)
+
+func TestExpandBraces(t *testing.T) {
+	testCases := []struct {
+		pattern   string
+		expanded  []string
+		unmatched bool
+	}{
+		{
+			pattern:  "a/b",
+			expanded: []string{"a/b"},
+		},
+		{
+			pattern:  "src/{a,b}/*.txt",
+			expanded: []string{"src/a/*.txt", "src/b/*.txt"},
+		},
+		{
+			pattern:  "{a,b}/{c,d}",
+			expanded: []string{"a/c", "a/d", "b/c", "b/d"},
+		},
+		{
+			pattern:  "x{a,b{c,d},}y",
+			expanded: []string{"xay", "xbcy", "xbdy", "xy"},
+		},
+		{
+			pattern:  "{a}/{b,c}",
+			expanded: []string{"{a}/b", "{a}/c"},
+		},
+		{
+			pattern:  `a\{b,c\}`,
+			expanded: []string{`a\{b,c\}`},
+		},
+		{
+			pattern:  `{a\,b,c}`,
+			expanded: []string{`a\,b`, "c"},
+		},
+		{
+			pattern:   "a{b,c",
+			expanded:  []string{"a{b,c"},
+			unmatched: true,
+		},
+		{
+			pattern:   "a{b,{c,d}",
+			expanded:  []string{"a{b,c", "a{b,d"},
+			unmatched: true,
+		},
+		{
+			pattern:  "a}b",
+			expanded: []string{"a}b"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.pattern, func(t *testing.T) {
+			expanded, unmatched := expandBraces(test.pattern)
+			if !reflect.DeepEqual(expanded, test.expanded) {
+				t.Errorf("want %q, got %q", test.expanded, expanded)
+			}
+			if unmatched != test.unmatched {
+				t.Errorf("want unmatched %v, got %v", test.unmatched, unmatched)
+			}
+		})
+	}
+}
+
+func TestExpandBracesWarning(t *testing.T) {
+	stderr := &bytes.Buffer{}
+	z := &ZipWriter{logger: log.New(stderr, "", 0)}
+
+	expanded := z.expandBraces(`a{b,\{c`)
+	if want := []string{"a{b,{c"}; !reflect.DeepEqual(expanded, want) {
+		t.Errorf("want %q, got %q", want, expanded)
+	}
+
+	want := "warning: unmatched brace in \"a{b,\\\\{c\", treating it literally\n"
+	if got := stderr.String(); got != want {
+		t.Errorf("want stderr %q, got %q", want, got)
+	}
+}
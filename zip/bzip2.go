@@ -0,0 +1,73 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	stdbzip2 "compress/bzip2"
+	"io"
+	"io/ioutil"
+
+	"github.com/dsnet/compress/bzip2"
+
+	"android/soong/third_party/zip"
+)
+
+// Bzip2Method is the compression method ID assigned to bzip2 by section 4.4.5 of APPNOTE.TXT.
+// Readers need at least version 4.6 of the spec to extract bzip2 entries, the zip writer records
+// that in the local and central headers.
+const Bzip2Method uint16 = 12
+
+func init() {
+	zip.RegisterDecompressor(Bzip2Method, newBzip2Reader)
+}
+
+func newBzip2Reader(r io.Reader) io.ReadCloser {
+	return ioutil.NopCloser(stdbzip2.NewReader(r))
+}
+
+// compressBzip2 compresses the entire contents of r into a single bzip2 stream.
+func (z *ZipWriter) compressBzip2(r io.Reader, level int) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+
+	zw, err := z.newBzip2Writer(buf, level)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.Copy(zw, r)
+	if err != nil {
+		zw.Close()
+		return nil, err
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// newBzip2Writer returns a writer that compresses into w.  Compression levels 1-9 select the
+// block size in units of 100kB, like the bzip2 command line tool, and -1 selects the default of
+// 900kB.
+func (z *ZipWriter) newBzip2Writer(w io.Writer, level int) (io.WriteCloser, error) {
+	if level < bzip2.BestSpeed {
+		level = bzip2.DefaultCompression
+	}
+
+	return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: level})
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"android/soong/third_party/zip"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+// cacheVersion is part of the key and the header of every cached entry.  It must be changed
+// whenever the format of cached entries, or the compressed data written for the same source file,
+// method and level, changes.
+const cacheVersion = 1
+
+// cacheHeaderLen is the length of the header of a cached entry: the version, method, CRC32 and
+// uncompressed size, followed by the compressed contents.
+const cacheHeaderLen = 4 + 2 + 4 + 8
+
+// cacheKey returns the name in z.cacheDir of the cached entry of the file src with info compressed
+// with method at level.
+func (z *ZipWriter) cacheKey(src string, info os.FileInfo, method uint16, level int) string {
+	if abs, err := filepath.Abs(src); err == nil {
+		src = abs
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00%d\x00%d\x00%d\x00%d\x00", cacheVersion, src,
+		info.ModTime().UnixNano(), info.Size(), method, z.flateLevel(level))
+	if method == SharedDictionaryMethod {
+		dict := sha256.Sum256(z.sharedDictionary)
+		h.Write(dict[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeCachedContents writes the entry with header fh for the file src with info, reusing its
+// compressed contents from z.cacheDir if a previous run cached them.  Otherwise the file is
+// compressed and its compressed contents are added to the cache.  It returns false if the file
+// isn't cached, because it is stored or streamed, and needs to be written normally.
+func (z *ZipWriter) writeCachedContents(fh *zip.FileHeader, src string, info os.FileInfo, level int,
+	r pathtools.ReaderAtSeekerCloser) (bool, error) {
+
+	size := int64(fh.UncompressedSize64)
+	if fh.Method == zip.Store || size == 0 || (z.storeBelow > 0 && size < z.storeBelow) ||
+		(z.largeFileThreshold > 0 && size >= z.largeFileThreshold) {
+		return false, nil
+	}
+
+	cachePath := filepath.Join(z.cacheDir, z.cacheKey(src, info, fh.Method, level))
+
+	fh.SetModTime(z.time)
+
+	compressChan := make(chan *zipEntry, 1)
+	z.writeOps <- compressChan
+
+	if data, err := ioutil.ReadFile(cachePath); err == nil && len(data) >= cacheHeaderLen &&
+		binary.LittleEndian.Uint32(data) == cacheVersion &&
+		binary.LittleEndian.Uint64(data[10:]) == fh.UncompressedSize64 {
+
+		r.Close()
+		fh.Method = binary.LittleEndian.Uint16(data[4:])
+		fh.CRC32 = binary.LittleEndian.Uint32(data[6:])
+		compressChan <- &zipEntry{
+			fh:            fh,
+			compLevel:     level,
+			futureReaders: singleFutureReader(bytes.NewReader(data[cacheHeaderLen:])),
+		}
+		close(compressChan)
+		z.cachedEntries++
+		return true, nil
+	}
+
+	firstChan := make(chan *zipEntry, 1)
+	go z.cacheContents(cachePath, firstChan, compressChan)
+	return true, z.compressFileContents(fh, level, r, firstChan)
+}
+
+// cacheContents receives a compressed entry from in, writes its contents to the cache file
+// cachePath and passes it on to out.  Failing to write the cache file is only a warning, the entry
+// is compressed again on the next run.
+func (z *ZipWriter) cacheContents(cachePath string, in, out chan *zipEntry) {
+	ze := <-in
+
+	buf := &bytes.Buffer{}
+	var header [cacheHeaderLen]byte
+	buf.Write(header[:])
+	for futureReader := range ze.futureReaders {
+		if _, err := io.Copy(buf, <-futureReader); err != nil {
+			z.errors <- err
+			return
+		}
+	}
+
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint32(data, cacheVersion)
+	binary.LittleEndian.PutUint16(data[4:], ze.fh.Method)
+	binary.LittleEndian.PutUint32(data[6:], ze.fh.CRC32)
+	binary.LittleEndian.PutUint64(data[10:], ze.fh.UncompressedSize64)
+	if err := writeCacheFile(cachePath, data); err != nil {
+		z.warnf("failed to cache compressed contents: %s", err)
+	}
+
+	ze.futureReaders = singleFutureReader(bytes.NewReader(data[cacheHeaderLen:]))
+	out <- ze
+	close(out)
+}
+
+// writeCacheFile writes data to cachePath through a temporary file, so that concurrent runs never
+// see a partially written cache file.
+func writeCacheFile(cachePath string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(cachePath), ".tmp-"+filepath.Base(cachePath))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), cachePath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+// writeSha256 writes the hex encoded SHA-256 of the file at zipPath to path.  The file is read
+// back from disk, so when writeIfChanged left an unchanged zip file in place the hash is of the
+// existing file.
+func writeSha256(path, zipPath string, writeIfChanged bool) error {
+	f, err := os.Open(zipPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	b := []byte(hex.EncodeToString(h.Sum(nil)))
+	if writeIfChanged {
+		return pathtools.WriteFileIfChanged(path, b, 0666)
+	}
+	return ioutil.WriteFile(path, b, 0666)
+}
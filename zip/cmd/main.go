@@ -15,6 +15,7 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -24,7 +25,9 @@ import (
 	"runtime/trace"
 	"strconv"
 	"strings"
+	"time"
 
+	rawzip "android/soong/third_party/zip"
 	"android/soong/zip"
 )
 
@@ -44,12 +47,85 @@ func (u *uniqueSet) Set(s string) error {
 	return nil
 }
 
+type extensions []string
+
+func (e *extensions) String() string {
+	return strings.Join(*e, ",")
+}
+
+func (e *extensions) Set(s string) error {
+	*e = append(*e, strings.Split(s, ",")...)
+	return nil
+}
+
 type file struct{}
 
 func (file) String() string { return `""` }
 
 func (file) Set(s string) error {
-	fileArgsBuilder.File(s)
+	if dest, src := zip.SplitFileDest(s); dest != "" {
+		fileArgsBuilder.RenamedFile(dest, src)
+	} else {
+		fileArgsBuilder.File(src)
+	}
+	return nil
+}
+
+// multiDestFile is a -f-multi src=dest1,dest2 argument.
+type multiDestFile struct{}
+
+func (multiDestFile) String() string { return `""` }
+
+func (multiDestFile) Set(s string) error {
+	// SplitFileDest handles the \= escapes, the destinations follow the "=" here.
+	src, dests := zip.SplitFileDest(s)
+	if src == "" || dests == "" {
+		return fmt.Errorf("must be of the form src=dest1,dest2")
+	}
+	fileArgsBuilder.MultiDestFile(src, strings.Split(dests, ",")...)
+	return nil
+}
+
+// stdinUser is the flag that has consumed stdin, only one flag may read it.
+var stdinUser string
+
+func useStdin(flag string) error {
+	if stdinUser == flag {
+		return fmt.Errorf("only one -%s entry is allowed", flag)
+	} else if stdinUser != "" {
+		return fmt.Errorf("-%s can't be combined with -%s", flag, stdinUser)
+	}
+	stdinUser = flag
+	return nil
+}
+
+// stdinFile adds a file whose contents are read from stdin, it may only be used once.
+type stdinFile struct{}
+
+func (stdinFile) String() string { return `""` }
+
+func (stdinFile) Set(dest string) error {
+	if err := useStdin("f-stdin"); err != nil {
+		return err
+	}
+	fileArgsBuilder.ReaderFile(dest, os.Stdin)
+	return nil
+}
+
+// stdinFiles adds the files listed on stdin like -l, it may only be used once.
+type stdinFiles struct{}
+
+func (stdinFiles) IsBoolFlag() bool { return true }
+func (stdinFiles) String() string   { return "" }
+
+func (stdinFiles) Set(s string) error {
+	if v, err := strconv.ParseBool(s); err != nil || !v {
+		return err
+	}
+	if err := useStdin("stdin-files"); err != nil {
+		return err
+	}
+	fileArgsBuilder.ListReader(os.Stdin)
 	return nil
 }
 
@@ -71,15 +147,38 @@ func (dir) Set(s string) error {
 	return nil
 }
 
+type recursiveDir struct{}
+
+func (recursiveDir) String() string { return `""` }
+
+func (recursiveDir) Set(s string) error {
+	fileArgsBuilder.RecursiveDir(s)
+	return nil
+}
+
 type relativeRoot struct{}
 
 func (relativeRoot) String() string { return "" }
 
 func (relativeRoot) Set(s string) error {
-	fileArgsBuilder.SourcePrefixToStrip(s)
+	fileArgsBuilder.PushSourcePrefixToStrip(s)
 	return nil
 }
 
+// popRelativeRoot restores the relative root that was in effect before the last -C.
+type popRelativeRoot struct{}
+
+func (popRelativeRoot) IsBoolFlag() bool { return true }
+func (popRelativeRoot) String() string   { return "" }
+
+func (popRelativeRoot) Set(s string) error {
+	if v, err := strconv.ParseBool(s); err != nil || !v {
+		return err
+	}
+	fileArgsBuilder.PopSourcePrefixToStrip()
+	return fileArgsBuilder.Error()
+}
+
 type junkPaths struct{}
 
 func (junkPaths) IsBoolFlag() bool { return true }
@@ -91,6 +190,31 @@ func (junkPaths) Set(s string) error {
 	return err
 }
 
+type junkExcept struct{}
+
+func (junkExcept) String() string { return "" }
+
+func (junkExcept) Set(s string) error {
+	fileArgsBuilder.JunkPathsExcept(s)
+	return nil
+}
+
+type stripComponents struct{}
+
+func (stripComponents) String() string { return "" }
+
+func (stripComponents) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return fmt.Errorf("must not be negative")
+	}
+	fileArgsBuilder.StripComponents(n)
+	return nil
+}
+
 type rootPrefix struct{}
 
 func (rootPrefix) String() string { return "" }
@@ -100,25 +224,140 @@ func (rootPrefix) Set(s string) error {
 	return nil
 }
 
+type entryComment struct{}
+
+func (entryComment) String() string { return "" }
+
+func (entryComment) Set(s string) error {
+	fileArgsBuilder.Comment(s)
+	return nil
+}
+
+// levelPatterns collects -Lf level:glob arguments.
+type levelPatterns []zip.CompressionLevelPattern
+
+func (l *levelPatterns) String() string { return `""` }
+
+func (l *levelPatterns) Set(s string) error {
+	colon := strings.Index(s, ":")
+	if colon == -1 {
+		return fmt.Errorf("must be of the form level:glob")
+	}
+	level, err := strconv.Atoi(s[:colon])
+	if err != nil {
+		return err
+	}
+	*l = append(*l, zip.CompressionLevelPattern{Pattern: s[colon+1:], Level: level})
+	return nil
+}
+
+// compressionLevel is the -L argument, a level from -1 to 9 or auto.
+type compressionLevel struct {
+	level int
+	auto  bool
+}
+
+func (l *compressionLevel) String() string {
+	if l.auto {
+		return "auto"
+	}
+	return strconv.Itoa(l.level)
+}
+
+func (l *compressionLevel) Set(s string) error {
+	if s == "auto" {
+		l.auto = true
+		return nil
+	}
+	level, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("must be a number or auto")
+	}
+	l.level, l.auto = level, false
+	return nil
+}
+
+// modePatterns collects -mode mode:glob arguments.
+type modePatterns []zip.ModePattern
+
+func (m *modePatterns) String() string { return `""` }
+
+func (m *modePatterns) Set(s string) error {
+	colon := strings.Index(s, ":")
+	if colon == -1 {
+		return fmt.Errorf("must be of the form mode:glob")
+	}
+	mode, err := strconv.ParseUint(s[:colon], 8, 32)
+	if err != nil || mode&^uint64(os.ModePerm) != 0 {
+		return fmt.Errorf("mode %q must be octal permission bits, like 0644", s[:colon])
+	}
+	*m = append(*m, zip.ModePattern{Pattern: s[colon+1:], Mode: os.FileMode(mode)})
+	return nil
+}
+
+// extensionAlignments collects -page-align alignment:extensions arguments.
+type extensionAlignments map[string]int
+
+func (e extensionAlignments) String() string { return `""` }
+
+func (e extensionAlignments) Set(s string) error {
+	colon := strings.Index(s, ":")
+	if colon == -1 {
+		return fmt.Errorf("must be of the form alignment:extensions")
+	}
+	align, err := strconv.Atoi(s[:colon])
+	if err != nil {
+		return err
+	}
+	for _, ext := range strings.Split(s[colon+1:], ",") {
+		e[ext] = align
+	}
+	return nil
+}
+
+// prefixMaps collects -prefix-map from:to arguments.
+type prefixMaps []zip.PrefixMap
+
+func (p *prefixMaps) String() string { return `""` }
+
+func (p *prefixMaps) Set(s string) error {
+	colon := strings.Index(s, ":")
+	if colon == -1 {
+		return fmt.Errorf("must be of the form from:to")
+	}
+	*p = append(*p, zip.PrefixMap{From: s[:colon], To: s[colon+1:]})
+	return nil
+}
+
+type multiFlag []string
+
+func (m *multiFlag) String() string {
+	return strings.Join(*m, " ")
+}
+
+func (m *multiFlag) Set(s string) error {
+	*m = append(*m, s)
+	return nil
+}
+
 var (
 	fileArgsBuilder  = zip.NewFileArgsBuilder()
 	nonDeflatedFiles = make(uniqueSet)
+	excludes         multiFlag
+	storedExtensions extensions
+	storePatterns    multiFlag
+	merges           multiFlag
+	extractIncludes  multiFlag
+	compLevels       levelPatterns
+	pathPrefixMaps   prefixMaps
+	fileModes        modePatterns
 )
 
 func main() {
-	var expandedArgs []string
-	for _, arg := range os.Args {
-		if strings.HasPrefix(arg, "@") {
-			bytes, err := ioutil.ReadFile(strings.TrimPrefix(arg, "@"))
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
-			}
-			respArgs := zip.ReadRespFile(bytes)
-			expandedArgs = append(expandedArgs, respArgs...)
-		} else {
-			expandedArgs = append(expandedArgs, arg)
-		}
+	expandedArgs, err := zip.ExpandRespFiles(os.Args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
 	}
 
 	flags := flag.NewFlagSet("flags", flag.ExitOnError)
@@ -128,27 +367,118 @@ func main() {
 		os.Exit(2)
 	}
 
-	out := flags.String("o", "", "file to write zip file to")
-	manifest := flags.String("m", "", "input jar manifest file name")
+	out := flags.String("o", "", "file to write zip file to, or - to write to stdout")
+	manifest := flags.String("m", "", "input jar manifest file name, or - to read it from stdin")
 	directories := flags.Bool("d", false, "include directories in zip")
-	compLevel := flags.Int("L", 5, "deflate compression level (0-9)")
+	dirMode := flags.String("dir-mode", "", "octal permission bits of directory entries, like 0755, instead of 0700")
+	compLevel := &compressionLevel{level: 5}
+	flags.Var(compLevel, "L", "deflate compression level (0-9, -1 for the default, or auto to pick store, 1 or 9 for each file by sampling it)")
+	strategy := flags.String("strategy", "default", "deflate compression strategy (default, or huffman-only for faster compression of dense data)")
+	method := flags.String("method", "deflate", "compression method for compressed files (deflate, store, zstd, bzip2, or deflate-shared-dict-nonportable)")
 	emulateJar := flags.Bool("jar", false, "modify the resultant .zip to emulate the output of 'jar'")
 	writeIfChanged := flags.Bool("write_if_changed", false, "only update resultant .zip if it has changed")
+	listOut := flags.String("list-out", "", "file to write a sorted, tab separated listing of the name, method, compressed size, uncompressed size and CRC32 of each entry to")
+	tempDir := flags.String("tmpdir", "", "directory to write the zip file to before it is moved to -o, defaults to the directory of -o")
+	durable := flags.Bool("durable", false, "sync the zip file and its directory to stable storage before exiting")
+	contentIndex := flags.Bool("content-index", false, "add a .zipindex entry listing the name, method, size and CRC32 of every other entry")
+	dryRun := flags.Bool("dry-run", false, "print the path in the zip and the source path of each file instead of writing the zip")
+	shaOut := flags.String("sha256-out", "", "file to write the hex encoded SHA-256 of the finished zip to")
+	verify := flags.Bool("verify", false, "read back every entry of the finished zip and fail if its contents don't match its CRC32")
+	appendToZip := flags.Bool("append", false, "add files to the existing output zip instead of replacing it, replacing entries with the same name")
+	appendOnlyIfMissing := flags.Bool("append-only-if-missing", false, "with -append, only add files that aren't already in the existing output zip")
 	ignoreMissingFiles := flags.Bool("ignore_missing_files", false, "continue if a requested file does not exist")
+	skipUnreadable := flags.Bool("skip-unreadable", false, "skip files that exist but can't be read instead of failing")
+	ignoreErrors := flags.Bool("ignore-errors", false, "warn and continue if a directory in a -D or -r directory can't be read")
 	symlinks := flags.Bool("symlinks", true, "store symbolic links in zip instead of following them")
 	srcJar := flags.Bool("srcjar", false, "move .java files to locations that match their package statement")
+	emptyDirs := flags.Bool("empty-dirs-only", false, "add directory entries only for directories that are empty after globbing and -x excludes")
+	maxEntries := flags.Int("max-entries", 0, "fail if the zip would have more than this many files, 0 disables the check")
+	maxOutputSize := flags.Int64("max-output-size", 0, "fail if the zip would be larger than this many bytes, 0 disables the check")
+	maxNameLength := flags.Int("max-name", 0, "fail if the name of any entry is longer than this many bytes, 0 disables the check")
+	largeFileThreshold := flags.Int64("large-file-threshold", 0, "size in bytes at and above which files are compressed while writing them instead of in memory, 0 disables streaming")
+	maxInFlight := flags.Int64("max-in-flight-bytes", 0, "limit on the total size of files held in memory while compressing them, 0 for the default of 512MB")
+	comment := flags.String("comment", "", "comment to write into the end of central directory record of the zip")
+	zipIgnore := flags.Bool("zipignore", false, "skip paths in -D and -r directories that match the patterns in a .zipignore file in the -C directory")
+	progress := flags.Bool("progress", false, "print the percentage of files written to stderr")
+	storeOwnership := flags.Bool("store-ownership", false, "store the numeric uid and gid of each file in an Info-ZIP Unix extra field")
+	xattrs := flags.Bool("xattrs", false, "store the extended attributes of each file, like security.capability, in an extra field, or restore them with -extract")
+	extendedTime := flags.Bool("extended-timestamp", false, "store the modification and access times of each file as Unix times in an Info-ZIP extended timestamp extra field")
+	ntfsTimes := flags.Bool("ntfs-times", false, "store the modification, access and change times of each file with 100ns resolution in an NTFS extra field")
+	allowBackslash := flags.Bool("allow-backslash", false, "allow paths in the zip that contain a backslash instead of failing")
+	pathSeparator := flags.String("path-separator", "/", `separator of the directories in the names of the zip, / or \ for legacy readers, which warns`)
+	stripTopLevel := flags.Bool("strip-top-level", false, "remove the first directory from the paths in the zip if every file is inside the same one")
+	stripTopLevelRequired := flags.Bool("strip-top-level-required", false, "fail if -strip-top-level can't strip a directory because the files aren't all inside the same one")
+	noClean := flags.Bool("no-clean", false, "don't clean the paths in the zip or reject paths that are absolute or outside of the zip")
+	sharedDict := flags.String("shared-dict", "", "file containing the preset dictionary for -method deflate-shared-dict-nonportable")
+	dedupContents := flags.Bool("dedup-contents", false, "compress files with identical contents only once and copy the compressed data into the other entries")
+	duplicateSymlinks := flags.Bool("duplicate-symlinks", false, "store files with the same contents as an earlier file as relative symlinks to it, not portable to Windows")
+	align := flags.Int("align", 0, "pad stored entries so their contents start at a multiple of this many bytes, like zipalign, usually 4")
+	pageAlignments := extensionAlignments{}
+	flags.Var(pageAlignments, "page-align", "alignment:extensions, store the files with the comma separated extensions aligned to alignment instead of -align, like 16384:so")
+	alwaysDataDescriptor := flags.Bool("data-descriptors", false, "write every entry, including stored ones, with a data descriptor after its contents")
+	forceUTF8 := flags.Bool("force-utf8", false, "mark every entry as having a UTF-8 name, not only the ones that aren't ASCII")
+	hostSystem := flags.String("host-system", "default", "host system to record in the version made by field of every entry (default, unix, or msdos)")
+	errorOnEmptyGlob := flags.Bool("error-on-empty-glob", false, "fail if a glob or {x,y} alternative in -f or -l, or a -D or -r directory, matches no files")
+	flags.Var(&pathPrefixMaps, "prefix-map", "from:to to move paths in the zip under from to to instead, repeatable, the first match wins and an empty from matches every path")
+	storeBelow := flags.Int64("store-below", 0, "size in bytes below which files are stored uncompressed, 0 disables it")
+	minSize := flags.Int64("min-size", 0, "size in bytes below which files from -f, -l, -D and -r arguments are left out, 0 for no minimum")
+	noMacOSCruft := flags.Bool("no-macos-cruft", false, "leave __MACOSX directories and files starting with ._ from -f, -l, -D and -r arguments out of the zip file")
+	maxSize := flags.Int64("max-size", 0, "size in bytes above which files from -f, -l, -D and -r arguments are left out, 0 for no maximum")
+	normalizePerms := flags.Bool("normalize-perms", false, "store files with mode 0755 if they are executable by anyone and 0644 otherwise, before -mode")
+	flags.Var(&fileModes, "mode", "mode:glob to store the files whose paths in the zip match glob with the octal permission bits mode, repeatable, the last match wins")
+	provenance := flags.Bool("provenance", false, "add an entry that records the tool version, timestamp and inputs of the zip file")
+	provenanceEntry := flags.String("provenance-entry", zip.DefaultProvenanceEntry, "path in the zip of the entry added by -provenance")
+	splitSize := flags.Int64("split", 0, "split the output into volumes of at most this many bytes, out.z01, out.z02, ... and out.zip")
+	cacheDir := flags.String("cache-dir", "", "directory to keep compressed file contents in for reuse by later runs")
+	firstEntry := flags.String("first-entry", "", "path in the zip of an entry to write before all the others, like an index")
+	rulesFile := flags.String("rules-file", "", "file of \"glob = method[:level]\" lines choosing the compression of files whose paths in the zip match glob, the first match wins")
+	orderFile := flags.String("order-file", "", "file listing paths in the zip, one per line, in the order their entries are written, other entries follow")
+	jarOrdering := flags.Bool("jar-order", false, "order entries like --jar does, META-INF/MANIFEST.MF and META-INF/ first, without the rest of --jar")
+	password := flags.String("password", "", "password to encrypt entries with AES-256, visible to other processes, prefer -password-file or -password-env")
+	passwordFile := flags.String("password-file", "", "file containing the password to encrypt entries with AES-256, a trailing newline is ignored")
+	passwordEnv := flags.String("password-env", "", "environment variable containing the password to encrypt entries with AES-256")
+	verbose := flags.Bool("v", false, "print statistics about the written entries to stderr")
+	quiet := flags.Bool("quiet", false, "don't print warnings, only errors")
+	verboseLog := flags.Bool("verbose", false, "print the name and compression method of every entry as it is written, along with the warnings")
+	sortEntries := flags.Bool("sort", false, "sort entries by their path in the zip instead of the order they were specified")
+	timestamp := flags.String("timestamp", "", "modification time for all entries, as Unix seconds or RFC 3339; times before 1980 are clamped to 1980-01-01 (default: clamp times to $SOURCE_DATE_EPOCH if it is set)")
+	renameOnCollision := flags.Bool("flatten-on-conflict-rename", false, "rename files with the same path in the zip, like files flattened by -j, by adding _1, _2, ... before their extension")
+	onDuplicate := flags.String("on-duplicate", "error", "how to handle more than one file with the same path in the zip (error, first, or last)")
+	verifyArchive := flags.String("verify-archive", "", "zip file to check the CRC32 of every entry of instead of creating a zip, exits with an error listing the bad entries")
+	list := flags.String("list", "", "zip file to print a tab separated listing of the name, method, compressed size, uncompressed size, CRC32, mode and modification time of each entry of instead of creating a zip")
+	extract := flags.String("extract", "", "zip file to extract into the -o directory instead of creating a zip, can't be combined with -f, -l, -D, -r or -merge")
+	overwrite := flags.String("overwrite", "error", "how -extract handles files that already exist (error, skip, or replace)")
+	fromTar := flags.String("from-tar", "", "tar file, optionally gzip compressed, or - for stdin, to convert into the -o zip instead of creating a zip, can't be combined with -f, -l, -D, -r or -merge")
+	repackage := flags.String("repackage", "", "zip file to copy into the -o zip, leaving out entries that match -x and renaming them with -prefix-map, can't be combined with -f, -l, -D, -r or -merge")
+	recomputeCRC := flags.Bool("recompute-crc", false, "check the contents of the entries copied by -merge, -repackage and -append against their CRC32 instead of reusing it")
+	mergeDuplicates := flags.String("merge-duplicates", "error", "how to handle files in more than one -merge zip (error, first, or last)")
 
 	parallelJobs := flags.Int("parallel", runtime.NumCPU(), "number of parallel threads to use")
 	cpuProfile := flags.String("cpuprofile", "", "write cpu profile to file")
 	traceFile := flags.String("trace", "", "write trace to file")
 
 	flags.Var(&rootPrefix{}, "P", "path prefix within the zip at which to place files")
-	flags.Var(&listFiles{}, "l", "file containing list of .class files")
+	flags.Var(&listFiles{}, "l", "file containing list of .class files, entries of the form @file include another list")
 	flags.Var(&dir{}, "D", "directory to include in zip")
-	flags.Var(&file{}, "f", "file to include in zip")
+	flags.Var(&stdinFile{}, "f-stdin", "path in the zip of a file whose contents are read from stdin")
+	flags.Var(&stdinFiles{}, "stdin-files", "read a list of files like -l from stdin")
+	flags.Var(&recursiveDir{}, "r", "directory to include in zip like -D, but fails if it is not a directory")
+	flags.Var(&file{}, "f", "file to include in zip, or dest=src to include src at dest in the zip, use \\= for a literal =, or zip!glob to include the entries of zip matching glob")
+	flags.Var(&multiDestFile{}, "f-multi", "src=dest1,dest2 to include src at each of the comma separated paths in the zip, compressing it once")
 	flags.Var(&nonDeflatedFiles, "s", "file path to be stored within the zip without compression")
-	flags.Var(&relativeRoot{}, "C", "path to use as relative root of files in following -f, -l, or -D arguments")
+	flags.Var(&compLevels, "Lf", "level:glob to compress files whose paths in the zip match glob at level instead of -L, the first match wins")
+	flags.Var(&storePatterns, "store-pattern", "glob pattern of file base names to be stored within the zip without compression, repeatable")
+	storePatternPaths := flags.Bool("store-pattern-path", false, "match -store-pattern against paths in the zip instead of base names")
+	flags.Var(&storedExtensions, "store-ext", "comma separated list of case insensitive file extensions to be stored within the zip without compression")
+	flags.Var(&relativeRoot{}, "C", "path to use as relative root of files in following -f, -l, -D, or -r arguments, until the matching -C-")
+	flags.Var(&popRelativeRoot{}, "C-", "restore the relative root that was in effect before the last -C")
+	flags.Var(&stripComponents{}, "strip-components", "number of leading path components, after removing -C, to drop from files in following -f, -l, -D, or -r arguments")
+	flags.Var(&entryComment{}, "entry-comment", "comment for the entries of following -f, -l, -D, or -r arguments, empty to stop adding comments")
 	flags.Var(&junkPaths{}, "j", "junk paths, zip files without directory names")
+	flags.Var(&junkExcept{}, "junk-except", "glob pattern of source paths in following -f, -l, -D, or -r arguments that keep their directories with -j, empty to clear the patterns")
+	flags.Var(&merges, "merge", "zip file whose entries should be copied into the output, can't be combined with -f, -l, -D or -r")
+	flags.Var(&excludes, "x", "glob pattern of paths relative to -C to skip in -D and -r directories, or of entries to leave out with -repackage, ** matches any number of directories")
+	flags.Var(&extractIncludes, "extract-include", "glob pattern of paths in the -extract zip to extract, ** matches any number of directories")
 
 	flags.Parse(expandedArgs[1:])
 
@@ -157,6 +487,17 @@ func main() {
 		flags.Usage()
 	}
 
+	if *quiet && *verboseLog {
+		fmt.Fprintln(os.Stderr, "-quiet can't be combined with -verbose")
+		os.Exit(1)
+	}
+	logLevel := zip.LogNormal
+	if *quiet {
+		logLevel = zip.LogQuiet
+	} else if *verboseLog {
+		logLevel = zip.LogVerbose
+	}
+
 	if *cpuProfile != "" {
 		f, err := os.Create(*cpuProfile)
 		if err != nil {
@@ -188,22 +529,448 @@ func main() {
 		os.Exit(1)
 	}
 
-	err := zip.Zip(zip.ZipArgs{
+	manifestPath := *manifest
+	var manifestContents []byte
+	if manifestPath == "-" {
+		if stdinUser != "" {
+			fmt.Fprintf(os.Stderr, "-m - can't be combined with -%s\n", stdinUser)
+			os.Exit(1)
+		}
+		var err error
+		manifestContents, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err.Error())
+			os.Exit(1)
+		}
+		if manifestContents == nil {
+			manifestContents = []byte{}
+		}
+		manifestPath = ""
+	}
+
+	if *verifyArchive != "" {
+		failed, err := zip.VerifyArchive(*verifyArchive)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err.Error())
+			os.Exit(1)
+		}
+		if len(failed) > 0 {
+			fmt.Fprintf(os.Stderr, "error: %s failed verification:\n", *verifyArchive)
+			for _, entryErr := range failed {
+				fmt.Fprintln(os.Stderr, "  "+entryErr.Error())
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *list != "" {
+		entries, err := zip.List(*list)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err.Error())
+			os.Exit(1)
+		}
+		w := bufio.NewWriter(os.Stdout)
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%08x\t%s\t%s\n", e.Name, e.MethodName(),
+				e.CompressedSize, e.UncompressedSize, e.CRC32, e.Mode, e.Modified.Format(time.RFC3339))
+		}
+		if err := w.Flush(); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *extract != "" {
+		if len(fileArgsBuilder.FileArgs()) > 0 || len(merges) > 0 {
+			fmt.Fprintln(os.Stderr, "-extract can't be combined with -f, -l, -D, -r or -merge")
+			os.Exit(1)
+		}
+		if *out == "" {
+			fmt.Fprintln(os.Stderr, "-extract requires -o to be the directory to extract into")
+			os.Exit(1)
+		}
+
+		overwriteMode, err := zip.ParseOverwriteMode(*overwrite)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			flags.Usage()
+		}
+
+		err = zip.Extract(*extract, *out, zip.ExtractOptions{
+			Overwrite: overwriteMode,
+			Includes:  extractIncludes,
+			Excludes:  excludes,
+			Symlinks:  *symlinks,
+			Xattrs:    *xattrs,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *fromTar != "" {
+		if len(fileArgsBuilder.FileArgs()) > 0 || len(merges) > 0 {
+			fmt.Fprintln(os.Stderr, "-from-tar can't be combined with -f, -l, -D, -r or -merge")
+			os.Exit(1)
+		}
+		if *fromTar == "-" && stdinUser != "" {
+			fmt.Fprintf(os.Stderr, "-from-tar - can't be combined with -%s\n", stdinUser)
+			os.Exit(1)
+		}
+
+		if compLevel.auto {
+			fmt.Fprintln(os.Stderr, "-L auto can't be combined with -from-tar")
+			os.Exit(1)
+		}
+		opts := zip.FromTarOptions{CompressionLevel: compLevel.level}
+		if *quiet {
+			opts.Stderr = ioutil.Discard
+		}
+		err := convertTar(*out, *fromTar, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *repackage != "" {
+		if len(fileArgsBuilder.FileArgs()) > 0 || len(merges) > 0 {
+			fmt.Fprintln(os.Stderr, "-repackage can't be combined with -f, -l, -D, -r or -merge")
+			os.Exit(1)
+		}
+
+		transform, err := zip.RepackageTransform(excludes, pathPrefixMaps)
+		if err == nil {
+			err = repackageZip(*out, *repackage, transform, zip.RepackageOptions{RecomputeCRC: *recomputeCRC})
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(merges) > 0 {
+		if len(fileArgsBuilder.FileArgs()) > 0 {
+			fmt.Fprintln(os.Stderr, "-merge can't be combined with -f, -l, -D or -r")
+			os.Exit(1)
+		}
+
+		duplicates, err := zip.ParseDuplicateMode(*mergeDuplicates)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			flags.Usage()
+		}
+
+		err = mergeZips(*out, merges, zip.MergeOptions{Duplicates: duplicates, RecomputeCRC: *recomputeCRC})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	var compressionMethod zip.CompressionMethod
+	switch *method {
+	case "deflate":
+		compressionMethod = zip.CompressionDeflate
+	case "store":
+		compressionMethod = zip.CompressionStore
+	case "zstd":
+		compressionMethod = zip.CompressionZstd
+	case "bzip2":
+		compressionMethod = zip.CompressionBzip2
+	case "deflate-shared-dict-nonportable":
+		compressionMethod = zip.CompressionDeflateSharedDictionaryNonPortable
+	default:
+		fmt.Fprintf(os.Stderr, "unknown compression method %q\n", *method)
+		flags.Usage()
+	}
+
+	var sharedDictionary []byte
+	if *sharedDict != "" {
+		var err error
+		sharedDictionary, err = ioutil.ReadFile(*sharedDict)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	encryptPassword, err := readPassword(*password, *passwordFile, *passwordEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err.Error())
+		os.Exit(1)
+	}
+
+	duplicateMode, err := zip.ParseDuplicateMode(*onDuplicate)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		flags.Usage()
+	}
+
+	compressionStrategy, err := zip.ParseCompressionStrategy(*strategy)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		flags.Usage()
+	}
+
+	host, err := zip.ParseHostSystem(*hostSystem)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		flags.Usage()
+	}
+
+	var provenancePath string
+	if *provenance {
+		provenancePath = *provenanceEntry
+	}
+
+	var modTime time.Time
+	if *timestamp != "" {
+		if secs, err := strconv.ParseInt(*timestamp, 10, 64); err == nil {
+			modTime = time.Unix(secs, 0)
+		} else if t, err := time.Parse(time.RFC3339, *timestamp); err == nil {
+			modTime = t
+		} else {
+			fmt.Fprintf(os.Stderr, "invalid -timestamp %q, must be Unix seconds or RFC 3339\n", *timestamp)
+			os.Exit(1)
+		}
+	}
+
+	var directoryMode os.FileMode
+	if *dirMode != "" {
+		mode, err := strconv.ParseUint(*dirMode, 8, 32)
+		if err != nil || mode&^uint64(os.ModePerm) != 0 {
+			fmt.Fprintf(os.Stderr, "invalid -dir-mode %q, must be octal permission bits, like 0755\n", *dirMode)
+			os.Exit(1)
+		}
+		directoryMode = os.FileMode(mode)
+	}
+
+	var progressFunc zip.ProgressFunc
+	if *progress {
+		progressFunc = printProgress
+	}
+
+	args := zip.ZipArgs{
 		FileArgs:                 fileArgsBuilder.FileArgs(),
 		OutputFilePath:           *out,
 		EmulateJar:               *emulateJar,
 		SrcJar:                   *srcJar,
 		AddDirectoryEntriesToZip: *directories,
-		CompressionLevel:         *compLevel,
-		ManifestSourcePath:       *manifest,
+		DirectoryMode:            directoryMode,
+		EmptyDirectoryEntries:    *emptyDirs,
+		MaxNameLength:            *maxNameLength,
+		MaxEntries:               *maxEntries,
+		MaxOutputBytes:           *maxOutputSize,
+		LargeFileThreshold:       *largeFileThreshold,
+		MaxInFlightBytes:         *maxInFlight,
+		SharedDictionary:         sharedDictionary,
+		ArchiveComment:           *comment,
+		EnableZipIgnore:          *zipIgnore,
+		ProgressFunc:             progressFunc,
+		StoreOwnership:           *storeOwnership,
+		StoreXattrs:              *xattrs,
+		StoreNTFSTimes:           *ntfsTimes,
+		StoreExtendedTimestamp:   *extendedTime,
+		NoCleanPaths:             *noClean,
+		AllowBackslashes:         *allowBackslash,
+		PathSeparator:            *pathSeparator,
+		StripTopLevel:            *stripTopLevel,
+		StripTopLevelRequired:    *stripTopLevelRequired,
+		CompressionLevel:         compLevel.level,
+		AutoCompressionLevel:     compLevel.auto,
+		CompressionLevelPatterns: compLevels,
+		CompressionRulesPath:     *rulesFile,
+		CompressionMethod:        compressionMethod,
+		ManifestSourcePath:       manifestPath,
+		ManifestContents:         manifestContents,
 		NumParallelJobs:          *parallelJobs,
 		NonDeflatedFiles:         nonDeflatedFiles,
+		StoredExtensions:         storedExtensions,
+		StorePatterns:            storePatterns,
+		StorePatternsMatchPath:   *storePatternPaths,
+		SkipUnreadable:           *skipUnreadable,
+		CompressionStrategy:      compressionStrategy,
 		WriteIfChanged:           *writeIfChanged,
 		StoreSymlinks:            *symlinks,
 		IgnoreMissingFiles:       *ignoreMissingFiles,
-	})
-	if err != nil {
+		IgnoreErrors:             *ignoreErrors,
+		ExcludePatterns:          excludes,
+		SortEntries:              *sortEntries,
+		Timestamp:                modTime,
+		Append:                   *appendToZip,
+		AddIfMissing:             *appendOnlyIfMissing,
+		RecomputeCRC:             *recomputeCRC,
+		ListOutputPath:           *listOut,
+		WriteContentIndex:        *contentIndex,
+		TempDir:                  *tempDir,
+		DurableWrite:             *durable,
+		ShaOutputPath:            *shaOut,
+		DryRun:                   *dryRun,
+		VerifyAfterWrite:         *verify,
+		DuplicateMode:            duplicateMode,
+		Password:                 encryptPassword,
+		ErrorOnEmptyGlob:         *errorOnEmptyGlob,
+		HostSystem:               host,
+		ForceUTF8:                *forceUTF8,
+		AlwaysDataDescriptor:     *alwaysDataDescriptor,
+		AlignUncompressed:        *align,
+		AlignExtensions:          pageAlignments,
+		DeduplicateContents:      *dedupContents,
+		DuplicatesAsSymlinks:     *duplicateSymlinks,
+		PrefixMaps:               pathPrefixMaps,
+		StoreBelowBytes:          *storeBelow,
+		MinFileSize:              *minSize,
+		MaxFileSize:              *maxSize,
+		SkipMacOSCruft:           *noMacOSCruft,
+		ModePatterns:             fileModes,
+		NormalizePermissions:     *normalizePerms,
+		ProvenanceEntry:          provenancePath,
+		JarOrdering:              *jarOrdering,
+		OrderFilePath:            *orderFile,
+		FirstEntry:               *firstEntry,
+		CacheDir:                 *cacheDir,
+		SplitSize:                *splitSize,
+		RenameOnCollision:        *renameOnCollision,
+		LogLevel:                 logLevel,
+	}
+
+	// Collecting stats can cost extra work, like measuring the savings of a shared dictionary, so
+	// only collect them when they will be printed.
+	if *verbose {
+		stats, err := zip.ZipWithStats(args)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err.Error())
+			os.Exit(1)
+		}
+		stats.Print(os.Stderr)
+	} else if err := zip.Zip(args); err != nil {
 		fmt.Fprintln(os.Stderr, "error:", err.Error())
 		os.Exit(1)
 	}
 }
+
+// readPassword returns the password given by at most one of the -password, -password-file and
+// -password-env flags.  The password itself is never included in errors.
+func readPassword(password, file, env string) (string, error) {
+	given := 0
+	for _, s := range []string{password, file, env} {
+		if s != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		return "", fmt.Errorf("only one of -password, -password-file and -password-env may be given")
+	}
+
+	switch {
+	case file != "":
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		password = strings.TrimRight(string(b), "\r\n")
+		if password == "" {
+			return "", fmt.Errorf("password file %q is empty", file)
+		}
+	case env != "":
+		password = os.Getenv(env)
+		if password == "" {
+			return "", fmt.Errorf("environment variable %q is empty or unset", env)
+		}
+	}
+	return password, nil
+}
+
+// printProgress overwrites the current line of stderr with the percentage of files written.
+func printProgress(done, total int) {
+	fmt.Fprintf(os.Stderr, "\r%3d%%", done*100/total)
+	if done == total {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func convertTar(out, input string, opts zip.FromTarOptions) (err error) {
+	if out == "" {
+		return fmt.Errorf("output file path must be nonempty")
+	}
+
+	in := os.Stdin
+	if input != "-" {
+		in, err = os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(out)
+		}
+	}()
+
+	return zip.FromTar(f, in, opts)
+}
+
+func repackageZip(out, input string, transform zip.RepackageFunc, opts zip.RepackageOptions) (err error) {
+	if out == "" {
+		return fmt.Errorf("output file path must be nonempty")
+	}
+
+	r, err := rawzip.OpenReader(input)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(out)
+		}
+	}()
+
+	return zip.RepackageWithOptions(&r.Reader, f, transform, opts)
+}
+
+func mergeZips(out string, inputs []string, opts zip.MergeOptions) (err error) {
+	if out == "" {
+		return fmt.Errorf("output file path must be nonempty")
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(out)
+		}
+	}()
+
+	return zip.Merge(f, inputs, opts)
+}
@@ -0,0 +1,338 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"android/soong/third_party/zip"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+// contentKey identifies files whose compressed contents are identical, because they have the same
+// contents, or are the same FileArg DestFiles source file src, and are compressed with the same
+// method and level.
+type contentKey struct {
+	sum    [sha256.Size]byte
+	src    string
+	method uint16
+	level  int
+}
+
+// sharedContents holds the compressed contents of the first of the files with the same
+// contentKey, which are copied into the entries of the others.
+type sharedContents struct {
+	// started is set once the first file has been sent to be compressed, and target to its
+	// destination when the others are stored as symlinks to it.  They are only accessed by the
+	// goroutine that adds the files.
+	started bool
+	target  string
+
+	// done is closed once the first file has been compressed and the fields below are set.
+	done   chan struct{}
+	data   []byte
+	method uint16
+	crc    uint32
+
+	// copies is the number of entries that still have to copy data, which is released once it
+	// reaches 0.  It is guarded by mu.
+	mu     sync.Mutex
+	copies int
+}
+
+// findDuplicateContents hashes the regular files of mappings that could have the same contents as
+// another one, because they have the same size and are compressed with the same method and level,
+// and records the ones that do in z.contentKeys and z.sharedContents.  Files that will be streamed
+// or that can't be read are left for addFile to handle normally.  When duplicates are stored as
+// symlinks the method and level don't matter, and are left out of the keys.
+func (z *ZipWriter) findDuplicateContents(mappings []pathMapping) error {
+	type sizeKey struct {
+		size   int64
+		method uint16
+		level  int
+	}
+	bySize := make(map[sizeKey][]string)
+	var order []sizeKey
+	for _, m := range mappings {
+		if m.reader != nil {
+			continue
+		}
+		var s os.FileInfo
+		var err error
+		if z.followSymlinks {
+			s, err = z.fs.Stat(m.src)
+		} else {
+			s, err = z.fs.Lstat(m.src)
+		}
+		if err != nil || !s.Mode().IsRegular() || s.Size() == 0 {
+			continue
+		}
+		key := sizeKey{size: s.Size()}
+		if !z.duplicateSymlinks {
+			if z.largeFileThreshold > 0 && s.Size() >= z.largeFileThreshold {
+				continue
+			}
+			key.method, key.level = m.zipMethod, m.compLevel
+		}
+		if bySize[key] == nil {
+			order = append(order, key)
+		}
+		bySize[key] = append(bySize[key], m.src)
+	}
+
+	counts := make(map[contentKey]int)
+	sums := make(map[string][sha256.Size]byte)
+	for _, key := range order {
+		srcs := bySize[key]
+		if len(srcs) < 2 {
+			continue
+		}
+		for _, src := range srcs {
+			sum, ok := sums[src]
+			if !ok {
+				var err error
+				sum, err = z.hashFile(src)
+				if err != nil && z.skipUnreadable {
+					// addFile skips it.
+					continue
+				} else if err != nil {
+					return err
+				}
+				sums[src] = sum
+			}
+			counts[contentKey{sum: sum, method: key.method, level: key.level}]++
+		}
+	}
+
+	z.contentKeys = make(map[string][sha256.Size]byte)
+	z.sharedContents = make(map[contentKey]*sharedContents)
+	for src, sum := range sums {
+		z.contentKeys[src] = sum
+	}
+	for key, count := range counts {
+		if count > 1 {
+			z.sharedContents[key] = &sharedContents{done: make(chan struct{}), copies: count - 1}
+		}
+	}
+	return nil
+}
+
+// findMultiDestContents records the regular files of mappings that are added at more than one of
+// their FileArg DestFiles in z.sharedContents, keyed by their source path, so that they are only
+// compressed once.  Files that will be streamed are left to be compressed for each entry.
+func (z *ZipWriter) findMultiDestContents(mappings []pathMapping) {
+	counts := make(map[contentKey]int)
+	var order []contentKey
+	for _, m := range mappings {
+		if !m.multiDest {
+			continue
+		}
+		key := contentKey{src: m.src, method: m.zipMethod, level: m.compLevel}
+		if counts[key] == 0 {
+			order = append(order, key)
+		}
+		counts[key]++
+	}
+
+	for _, key := range order {
+		if counts[key] < 2 {
+			continue
+		}
+		if z.largeFileThreshold > 0 {
+			if s, err := z.fs.Stat(key.src); err != nil || s.Size() >= z.largeFileThreshold {
+				continue
+			}
+		}
+		if z.sharedContents == nil {
+			z.sharedContents = make(map[contentKey]*sharedContents)
+		}
+		z.sharedContents[key] = &sharedContents{done: make(chan struct{}), copies: counts[key] - 1}
+	}
+}
+
+func (z *ZipWriter) hashFile(src string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := z.fs.Open(src)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// writeSharedContents writes the entry with header fh for the file src, which was found to have the
+// same contents as other files by findDuplicateContents, or to be added at several of its DestFiles
+// by findMultiDestContents.  The first of them is compressed normally
+// and its compressed contents are kept, the others copy them instead of compressing the file again.
+// It returns false if src doesn't have duplicates, and the file needs to be written normally.
+func (z *ZipWriter) writeSharedContents(fh *zip.FileHeader, src string, level int,
+	r pathtools.ReaderAtSeekerCloser) (bool, error) {
+
+	shared := z.sharedContents[contentKey{src: src, method: fh.Method, level: level}]
+	if shared == nil {
+		sum, ok := z.contentKeys[src]
+		if !ok {
+			return false, nil
+		}
+		shared = z.sharedContents[contentKey{sum: sum, method: fh.Method, level: level}]
+		if shared == nil {
+			return false, nil
+		}
+	}
+
+	fh.SetModTime(z.time)
+
+	compressChan := make(chan *zipEntry, 1)
+	z.writeOps <- compressChan
+
+	if !shared.started {
+		shared.started = true
+		firstChan := make(chan *zipEntry, 1)
+		go z.keepSharedContents(shared, firstChan, compressChan)
+		return true, z.compressFileContents(fh, level, r, firstChan)
+	}
+
+	r.Close()
+	go z.copySharedContents(shared, fh, level, compressChan)
+	return true, nil
+}
+
+// writeDuplicateSymlink writes the entry with header fh for the file src as a symlink to the first
+// file with the same contents, if findDuplicateContents found that there is one.  It returns false
+// if the file needs to be written normally, because it is the first one, it has no duplicates, or
+// the link would have to point outside of the zip file.
+func (z *ZipWriter) writeDuplicateSymlink(fh *zip.FileHeader, src string,
+	r pathtools.ReaderAtSeekerCloser) (bool, error) {
+
+	sum, ok := z.contentKeys[src]
+	if !ok {
+		return false, nil
+	}
+	shared := z.sharedContents[contentKey{sum: sum}]
+	if shared == nil {
+		return false, nil
+	}
+
+	if !shared.started {
+		shared.started = true
+		shared.target = fh.Name
+		return false, nil
+	}
+
+	dest := filepath.ToSlash(fh.Name)
+	target := filepath.ToSlash(shared.target)
+	if outsideZip(dest) || outsideZip(target) {
+		return false, nil
+	}
+	link, err := filepath.Rel(path.Dir(dest), target)
+	if err != nil {
+		return false, nil
+	}
+
+	r.Close()
+	z.writeSymlinkEntry(fh, filepath.ToSlash(link))
+
+	z.sharedContentsMu.Lock()
+	z.deduplicatedEntries++
+	z.sharedContentsMu.Unlock()
+	return true, nil
+}
+
+// outsideZip returns true if name can't be the name of an entry inside of the zip file.
+func outsideZip(name string) bool {
+	name = path.Clean(name)
+	return path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../")
+}
+
+// keepSharedContents receives the compressed entry of the first file with shared contents from in,
+// keeps its contents in shared and passes it on to out.
+func (z *ZipWriter) keepSharedContents(shared *sharedContents, in, out chan *zipEntry) {
+	ze := <-in
+
+	buf := &bytes.Buffer{}
+	for futureReader := range ze.futureReaders {
+		if _, err := io.Copy(buf, <-futureReader); err != nil {
+			z.errors <- err
+			return
+		}
+	}
+
+	// The copies may release shared.data as soon as done is closed.
+	data := buf.Bytes()
+	shared.data = data
+	shared.method = ze.fh.Method
+	shared.crc = ze.fh.CRC32
+	close(shared.done)
+
+	ze.futureReaders = singleFutureReader(bytes.NewReader(data))
+	out <- ze
+	close(out)
+}
+
+// copySharedContents sends an entry with header fh and the compressed contents kept in shared to
+// compressChan once they are available.
+func (z *ZipWriter) copySharedContents(shared *sharedContents, fh *zip.FileHeader, level int,
+	compressChan chan *zipEntry) {
+
+	<-shared.done
+
+	fh.Method = shared.method
+	fh.CRC32 = shared.crc
+	ze := &zipEntry{
+		fh:            fh,
+		compLevel:     level,
+		futureReaders: singleFutureReader(bytes.NewReader(shared.data)),
+	}
+
+	shared.mu.Lock()
+	shared.copies--
+	if shared.copies == 0 {
+		// The readers of the copies still refer to the contents, but nothing else needs them.
+		shared.data = nil
+	}
+	shared.mu.Unlock()
+
+	z.sharedContentsMu.Lock()
+	z.deduplicatedEntries++
+	z.sharedContentsMu.Unlock()
+
+	compressChan <- ze
+	close(compressChan)
+}
+
+// singleFutureReader returns futureReaders for an entry whose contents are all read from r.
+func singleFutureReader(r io.Reader) chan chan io.Reader {
+	futureReaders := make(chan chan io.Reader, 1)
+	futureReader := make(chan io.Reader, 1)
+	futureReaders <- futureReader
+	close(futureReaders)
+	futureReader <- r
+	close(futureReader)
+	return futureReaders
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// SharedDictionaryMethod is the compression method ID of entries written with
+// CompressionDeflateSharedDictionaryNonPortable.  The data is a raw deflate stream like method 8,
+// but it was compressed with a preset dictionary that back references may point into.  The zip
+// format has no way to record a preset dictionary for raw deflate streams, so the entries can't be
+// given the standard deflate method ID without standard readers producing corrupt data.  This ID
+// isn't assigned by APPNOTE.TXT, so readers that don't have the dictionary fail with an
+// unsupported method error instead.
+const SharedDictionaryMethod uint16 = 0xd1c7
+
+// NewSharedDictionaryDecompressor returns a decompressor for SharedDictionaryMethod entries
+// written with dict, which can be registered with zip.Reader.RegisterDecompressor or
+// zip.RegisterDecompressor.
+func NewSharedDictionaryDecompressor(dict []byte) func(r io.Reader) io.ReadCloser {
+	return func(r io.Reader) io.ReadCloser {
+		return flate.NewReaderDict(r, dict)
+	}
+}
+
+// validSharedDictionary returns an error if a shared dictionary is given without the compression
+// method that uses it or the other way around.
+func validSharedDictionary(method CompressionMethod, dict []byte) error {
+	if method == CompressionDeflateSharedDictionaryNonPortable && len(dict) == 0 {
+		return fmt.Errorf("compression method %v requires a shared dictionary", method)
+	}
+	if method != CompressionDeflateSharedDictionaryNonPortable && len(dict) > 0 {
+		return fmt.Errorf("a shared dictionary requires compression method %v",
+			CompressionDeflateSharedDictionaryNonPortable)
+	}
+	return nil
+}
+
+// compressSharedDictionary compresses r primed with the shared dictionary.  When stats are being
+// collected it also compresses r without the dictionary to measure how much it saved.
+func (z *ZipWriter) compressSharedDictionary(r io.ReadSeeker, level int) (*bytes.Buffer, error) {
+	compressed, err := z.compressBlock(r, level, z.sharedDictionary, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if z.stats != nil {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		plain, err := z.compressBlock(r, level, nil, true)
+		if err != nil {
+			return nil, err
+		}
+
+		z.sharedDictionaryMu.Lock()
+		z.sharedDictionarySavedBytes += int64(plain.Len() - compressed.Len())
+		z.sharedDictionaryMu.Unlock()
+	}
+
+	return compressed, nil
+}
@@ -0,0 +1,351 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"android/soong/third_party/zip"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+// OverwriteMode selects what Extract does when a file it is extracting already exists.
+type OverwriteMode int
+
+const (
+	// OverwriteError fails when a file already exists.
+	OverwriteError OverwriteMode = iota
+	// OverwriteSkip leaves existing files untouched.
+	OverwriteSkip
+	// OverwriteReplace replaces existing files.
+	OverwriteReplace
+)
+
+func (m OverwriteMode) String() string {
+	switch m {
+	case OverwriteError:
+		return "error"
+	case OverwriteSkip:
+		return "skip"
+	case OverwriteReplace:
+		return "replace"
+	default:
+		return fmt.Sprintf("OverwriteMode(%d)", int(m))
+	}
+}
+
+// ParseOverwriteMode returns the OverwriteMode with the given name.
+func ParseOverwriteMode(s string) (OverwriteMode, error) {
+	for _, m := range []OverwriteMode{OverwriteError, OverwriteSkip, OverwriteReplace} {
+		if s == m.String() {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown overwrite mode %q, must be error, skip or replace", s)
+}
+
+type ExtractOptions struct {
+	// Overwrite selects what happens when a file being extracted already exists.  Existing
+	// directories are always reused.
+	Overwrite OverwriteMode
+
+	// Includes, if not empty, limits extraction to entries that match one of the patterns, or that
+	// are inside a directory that matches one.  Excludes skips entries the same way, and wins over
+	// Includes.  Patterns follow pathtools.Match, so ** matches any number of directories.
+	Includes []string
+	Excludes []string
+
+	// Symlinks restores symlink entries as symlinks.  Otherwise they are extracted as regular files
+	// containing the target of the link.
+	Symlinks bool
+
+	// Xattrs restores the extended attributes that StoreXattrs recorded for files, which is only
+	// supported on Linux.  Attributes like security.capability can only be set with privileges.
+	Xattrs bool
+}
+
+// Extract extracts the entries of the zip file at src into destDir, which is created if necessary.
+// Entries whose names are absolute or lead outside of destDir are rejected before anything is
+// extracted.  The Unix permissions recorded in the entries are restored, entries without them use
+// 0644 for files and 0755 for directories.  Symlinks are created after all other entries, and
+// entries below a symlink, whether it came from the zip file or already existed in destDir, are
+// rejected, as are directory entries that are symlinks and symlinks replacing directory entries,
+// so that no entry is ever written through a symlink.
+func Extract(src string, destDir string, opts ExtractOptions) error {
+	r, err := zip.OpenReader(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var files []*zip.File
+	for _, f := range r.File {
+		name, err := extractName(f.Name)
+		if err != nil {
+			return fmt.Errorf("%s: %s", src, err)
+		}
+
+		include, err := opts.includes(name)
+		if err != nil {
+			return err
+		}
+		if include {
+			files = append(files, f)
+		}
+	}
+
+	if err := os.MkdirAll(destDir, 0777); err != nil {
+		return err
+	}
+
+	var dirs, symlinks []*zip.File
+	dirPaths := make(map[string]bool)
+	for _, f := range files {
+		if err := checkNoSymlinkParents(destDir, f); err != nil {
+			return fmt.Errorf("%s: %s", src, err)
+		}
+
+		switch mode := f.Mode(); {
+		case mode.IsDir():
+			path := extractPath(destDir, f)
+			// MkdirAll succeeds through an existing symlink to a directory, and the permissions
+			// of the directory would be changed through it below.
+			if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				return fmt.Errorf("%s: entry %q would be extracted through the symlink %q", src, f.Name, path)
+			}
+			dirs = append(dirs, f)
+			dirPaths[path] = true
+			if err := os.MkdirAll(path, 0777); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0 && opts.Symlinks:
+			symlinks = append(symlinks, f)
+		default:
+			if err := extractFile(f, extractPath(destDir, f), opts.Overwrite, opts.Xattrs); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, f := range symlinks {
+		// Check again, an earlier symlink may have been created at a parent of this one.
+		if err := checkNoSymlinkParents(destDir, f); err != nil {
+			return fmt.Errorf("%s: %s", src, err)
+		}
+		// Replacing an empty directory from the zip file with a symlink would apply the
+		// permissions of the directory entry to the target of the symlink.
+		if dirPaths[extractPath(destDir, f)] {
+			return fmt.Errorf("%s: symlink entry %q would replace a directory entry with the same name", src, f.Name)
+		}
+		if err := extractSymlink(f, extractPath(destDir, f), opts.Overwrite); err != nil {
+			return err
+		}
+	}
+
+	// Restore the permissions of directories last, they may not allow writing the entries inside
+	// of them.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path := extractPath(destDir, dirs[i])
+		// os.Chmod follows symlinks, only change paths that are still directories.
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s: directory entry %q was replaced during extraction", src, dirs[i].Name)
+		}
+		if err := os.Chmod(path, extractPerm(dirs[i], 0755)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractName returns the cleaned name of an entry, or an error if it could be used to write
+// outside of the directory being extracted into.
+func extractName(name string) (string, error) {
+	clean := filepath.Clean(strings.TrimSuffix(name, "/"))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("entry %q is outside of the directory being extracted into", name)
+	}
+	return clean, nil
+}
+
+func extractPath(destDir string, f *zip.File) string {
+	name, _ := extractName(f.Name)
+	return filepath.Join(destDir, name)
+}
+
+// checkNoSymlinkParents returns an error if any existing directory between destDir and the path of
+// f is a symlink, which could make writing f, or creating its missing parent directories, escape
+// destDir.
+func checkNoSymlinkParents(destDir string, f *zip.File) error {
+	name, _ := extractName(f.Name)
+	dir := destDir
+	components := strings.Split(name, string(filepath.Separator))
+	for _, component := range components[:len(components)-1] {
+		dir = filepath.Join(dir, component)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("entry %q would be extracted through the symlink %q", f.Name, dir)
+		}
+	}
+	return nil
+}
+
+// extractPerm returns the permissions of f, including the setuid, setgid and sticky bits, or def
+// if the entry doesn't record Unix permissions.
+func extractPerm(f *zip.File, def os.FileMode) os.FileMode {
+	// Only zip files created on Unix or macOS store the Unix mode in the upper 16 bits of the
+	// external attributes, the reader makes up permissions for everything else.
+	const creatorUnix, creatorMacOSX = 3, 19
+	creator := f.CreatorVersion >> 8
+	mode := f.Mode()
+	if perm := mode.Perm(); (creator == creatorUnix || creator == creatorMacOSX) && perm != 0 {
+		return perm | mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+	}
+	return def
+}
+
+// includes returns true if name, or any directory that contains it, matches the include patterns
+// and doesn't match the exclude patterns.
+func (opts ExtractOptions) includes(name string) (bool, error) {
+	match := func(patterns []string) (bool, error) {
+		for p := name; p != "."; p = filepath.Dir(p) {
+			for _, pattern := range patterns {
+				match, err := pathtools.Match(pattern, p)
+				if err != nil {
+					return false, fmt.Errorf("%s: %s", pattern, err)
+				}
+				if match {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	}
+
+	if excluded, err := match(opts.Excludes); err != nil || excluded {
+		return false, err
+	}
+	if len(opts.Includes) == 0 {
+		return true, nil
+	}
+	return match(opts.Includes)
+}
+
+// prepareOverwrite checks whether path can be written according to overwrite, and removes any
+// existing file that is being replaced.  It returns false if the entry should be skipped.
+func prepareOverwrite(path string, overwrite OverwriteMode) (bool, error) {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	switch overwrite {
+	case OverwriteError:
+		return false, fmt.Errorf("%q already exists", path)
+	case OverwriteSkip:
+		return false, nil
+	case OverwriteReplace:
+		return true, os.Remove(path)
+	default:
+		return false, fmt.Errorf("unknown overwrite mode %v", overwrite)
+	}
+}
+
+func extractFile(f *zip.File, path string, overwrite OverwriteMode, restoreXattrs bool) (err error) {
+	if write, err := prepareOverwrite(path, overwrite); err != nil || !write {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	perm := extractPerm(f, 0644)
+	w, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("failed to extract %q: %s", f.Name, err)
+	}
+
+	// The permissions passed to OpenFile are masked by the umask, set them explicitly.
+	if err := w.Chmod(perm); err != nil {
+		return err
+	}
+
+	if restoreXattrs {
+		xattrs, err := parseXattrExtra(f.Extra)
+		if err != nil {
+			return fmt.Errorf("%q: %s", f.Name, err)
+		}
+		if len(xattrs) > 0 {
+			if err := writeXattrs(path, xattrs); err != nil {
+				return fmt.Errorf("failed to restore the extended attributes of %q: %s", f.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func extractSymlink(f *zip.File, path string, overwrite OverwriteMode) error {
+	if write, err := prepareOverwrite(path, overwrite); err != nil || !write {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	target, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("failed to extract %q: %s", f.Name, err)
+	}
+
+	return os.Symlink(string(target), path)
+}
@@ -0,0 +1,438 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"android/soong/third_party/zip"
+)
+
+type testExtractEntry struct {
+	name     string
+	mode     os.FileMode
+	contents []byte
+}
+
+// writeExtractZip writes a zip file containing entries with the given modes to dir.
+func writeExtractZip(t *testing.T, dir string, entries []testExtractEntry) string {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, e := range entries {
+		fh := &zip.FileHeader{Name: e.name, Method: zip.Store}
+		if e.mode != 0 {
+			fh.SetMode(e.mode)
+		}
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.contents)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "in.zip")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// extractedFiles returns the relative paths of everything under dir.
+func extractedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestExtractZipSlip(t *testing.T) {
+	testCases := []string{
+		"../evil",
+		"a/../../evil",
+		"/abs/evil",
+	}
+
+	for _, name := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "TestExtractZipSlip")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			in := writeExtractZip(t, dir, []testExtractEntry{
+				{name: "ok", contents: fileA},
+				{name: name, contents: fileB},
+			})
+
+			out := filepath.Join(dir, "out")
+			err = Extract(in, out, ExtractOptions{})
+			want := in + `: entry "` + name + `" is outside of the directory being extracted into`
+			if err == nil || err.Error() != want {
+				t.Errorf("want error %q, got %v", want, err)
+			}
+
+			if _, err := os.Stat(out); !os.IsNotExist(err) {
+				t.Errorf("expected nothing to be extracted, got %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "evil")); !os.IsNotExist(err) {
+				t.Errorf("expected evil to not be written, got %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestExtractPermissions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := writeExtractZip(t, dir, []testExtractEntry{
+		{name: "d/", mode: os.ModeDir | 0750},
+		{name: "d/exec", mode: 0755, contents: fileA},
+		{name: "d/private", mode: 0600, contents: fileB},
+		{name: "d/setuid", mode: os.ModeSetuid | 0755, contents: fileC},
+		{name: "sticky/", mode: os.ModeDir | os.ModeSticky | 0777},
+		{name: "readonly/", mode: os.ModeDir | 0555},
+		{name: "readonly/f", mode: 0444, contents: fileC},
+		{name: "nomode", contents: fileA},
+		{name: "link", mode: os.ModeSymlink | 0777, contents: []byte("d/exec")},
+	})
+
+	t.Run("symlinks", func(t *testing.T) {
+		out := filepath.Join(dir, "symlinks")
+		defer func() {
+			os.Chmod(filepath.Join(out, "readonly"), 0755)
+			os.RemoveAll(out)
+		}()
+
+		if err := Extract(in, out, ExtractOptions{Symlinks: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		wantModes := map[string]os.FileMode{
+			"d":          os.ModeDir | 0750,
+			"d/exec":     0755,
+			"d/private":  0600,
+			"d/setuid":   os.ModeSetuid | 0755,
+			"sticky":     os.ModeDir | os.ModeSticky | 0777,
+			"readonly":   os.ModeDir | 0555,
+			"readonly/f": 0444,
+			"nomode":     0644,
+		}
+		for name, want := range wantModes {
+			info, err := os.Lstat(filepath.Join(out, name))
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			if got := info.Mode(); got != want {
+				t.Errorf("incorrect mode for %s, want %s got %s", name, want, got)
+			}
+		}
+
+		target, err := os.Readlink(filepath.Join(out, "link"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != "d/exec" {
+			t.Errorf("want symlink target %q, got %q", "d/exec", target)
+		}
+
+		contents, err := ioutil.ReadFile(filepath.Join(out, "d/private"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(contents, fileB) {
+			t.Errorf("want contents %q, got %q", fileB, contents)
+		}
+	})
+
+	t.Run("no symlinks", func(t *testing.T) {
+		out := filepath.Join(dir, "nosymlinks")
+		defer func() {
+			os.Chmod(filepath.Join(out, "readonly"), 0755)
+			os.RemoveAll(out)
+		}()
+
+		if err := Extract(in, out, ExtractOptions{Symlinks: false}); err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := os.Lstat(filepath.Join(out, "link"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.Mode().IsRegular() {
+			t.Errorf("expected link to be a regular file, got %s", info.Mode())
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(out, "link"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != "d/exec" {
+			t.Errorf("want contents %q, got %q", "d/exec", contents)
+		}
+	})
+}
+
+func TestExtractSelective(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestExtractSelective")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := writeExtractZip(t, dir, []testExtractEntry{
+		{name: "a/", mode: os.ModeDir | 0755},
+		{name: "a/x.c", contents: fileA},
+		{name: "a/x.o", contents: fileB},
+		{name: "a/gen/y.c", contents: fileC},
+		{name: "b/z.c", contents: fileA},
+	})
+
+	testCases := []struct {
+		name     string
+		includes []string
+		excludes []string
+		files    []string
+	}{
+		{
+			name:  "all",
+			files: []string{"a", "a/gen", "a/gen/y.c", "a/x.c", "a/x.o", "b", "b/z.c"},
+		},
+		{
+			name:     "include directory",
+			includes: []string{"a"},
+			files:    []string{"a", "a/gen", "a/gen/y.c", "a/x.c", "a/x.o"},
+		},
+		{
+			name:     "include pattern",
+			includes: []string{"**/*.c"},
+			files:    []string{"a", "a/gen", "a/gen/y.c", "a/x.c", "b", "b/z.c"},
+		},
+		{
+			name:     "exclude directory",
+			excludes: []string{"a/gen"},
+			files:    []string{"a", "a/x.c", "a/x.o", "b", "b/z.c"},
+		},
+		{
+			name:     "include and exclude",
+			includes: []string{"a"},
+			excludes: []string{"**/*.o"},
+			files:    []string{"a", "a/gen", "a/gen/y.c", "a/x.c"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := ioutil.TempDir(dir, "out")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = Extract(in, out, ExtractOptions{
+				Includes: test.includes,
+				Excludes: test.excludes,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := extractedFiles(t, out); !reflect.DeepEqual(got, test.files) {
+				t.Errorf("want files %q, got %q", test.files, got)
+			}
+		})
+	}
+}
+
+func TestExtractOverwrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestExtractOverwrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := writeExtractZip(t, dir, []testExtractEntry{
+		{name: "f", contents: fileA},
+	})
+
+	testCases := []struct {
+		overwrite OverwriteMode
+		contents  []byte
+		err       bool
+	}{
+		{overwrite: OverwriteError, contents: fileB, err: true},
+		{overwrite: OverwriteSkip, contents: fileB},
+		{overwrite: OverwriteReplace, contents: fileA},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.overwrite.String(), func(t *testing.T) {
+			out, err := ioutil.TempDir(dir, "out")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(out, "f"), fileB, 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			err = Extract(in, out, ExtractOptions{Overwrite: test.overwrite})
+			if test.err != (err != nil) {
+				t.Errorf("want error %v, got %v", test.err, err)
+			}
+
+			contents, err := ioutil.ReadFile(filepath.Join(out, "f"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(contents, test.contents) {
+				t.Errorf("want contents %q, got %q", test.contents, contents)
+			}
+		})
+	}
+}
+
+func TestExtractThroughSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestExtractThroughSymlink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outside := filepath.Join(dir, "outside")
+	if err := os.Mkdir(outside, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("chained symlinks", func(t *testing.T) {
+		in := writeExtractZip(t, dir, []testExtractEntry{
+			{name: "x", mode: os.ModeSymlink | 0777, contents: []byte(outside)},
+			{name: "x/evil", mode: os.ModeSymlink | 0777, contents: []byte("target")},
+		})
+
+		out := filepath.Join(dir, "chained")
+		err := Extract(in, out, ExtractOptions{Symlinks: true})
+		want := in + `: entry "x/evil" would be extracted through the symlink "` + filepath.Join(out, "x") + `"`
+		if err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+		if _, err := os.Lstat(filepath.Join(outside, "evil")); !os.IsNotExist(err) {
+			t.Errorf("expected nothing to be written outside, got %v", err)
+		}
+	})
+
+	t.Run("existing symlink", func(t *testing.T) {
+		in := writeExtractZip(t, dir, []testExtractEntry{
+			{name: "x/sub/evil", contents: fileA},
+		})
+
+		out := filepath.Join(dir, "existing")
+		if err := os.Mkdir(out, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(outside, filepath.Join(out, "x")); err != nil {
+			t.Fatal(err)
+		}
+
+		err := Extract(in, out, ExtractOptions{})
+		want := in + `: entry "x/sub/evil" would be extracted through the symlink "` + filepath.Join(out, "x") + `"`
+		if err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+		if _, err := os.Lstat(filepath.Join(outside, "sub")); !os.IsNotExist(err) {
+			t.Errorf("expected nothing to be written outside, got %v", err)
+		}
+	})
+
+	outsidePerm := func(t *testing.T) os.FileMode {
+		t.Helper()
+		info, err := os.Stat(outside)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Mode().Perm()
+	}
+	if err := os.Chmod(outside, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("symlink replacing directory", func(t *testing.T) {
+		in := writeExtractZip(t, dir, []testExtractEntry{
+			{name: "d/", mode: os.ModeDir | 0777},
+			{name: "d", mode: os.ModeSymlink | 0777, contents: []byte(outside)},
+		})
+
+		out := filepath.Join(dir, "replacing")
+		err := Extract(in, out, ExtractOptions{Overwrite: OverwriteReplace, Symlinks: true})
+		want := in + `: symlink entry "d" would replace a directory entry with the same name`
+		if err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+		if perm := outsidePerm(t); perm != 0700 {
+			t.Errorf("expected the permissions outside to be unchanged, got %v", perm)
+		}
+	})
+
+	t.Run("existing symlink directory", func(t *testing.T) {
+		in := writeExtractZip(t, dir, []testExtractEntry{
+			{name: "d/", mode: os.ModeDir | 0777},
+		})
+
+		out := filepath.Join(dir, "existingdir")
+		if err := os.Mkdir(out, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(outside, filepath.Join(out, "d")); err != nil {
+			t.Fatal(err)
+		}
+
+		err := Extract(in, out, ExtractOptions{Overwrite: OverwriteReplace})
+		want := in + `: entry "d/" would be extracted through the symlink "` + filepath.Join(out, "d") + `"`
+		if err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+		if perm := outsidePerm(t); perm != 0700 {
+			t.Errorf("expected the permissions outside to be unchanged, got %v", perm)
+		}
+	})
+}
@@ -0,0 +1,271 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+// ioFs reads the source files of ZipArgs.FS through the pathtools.FileSystem interface used by the
+// rest of the package.
+type ioFs struct {
+	// FileSystem is never set, it is only embedded for the unexported method of the interface,
+	// which is only called by the pathtools implementations of Glob that ioFs replaces.
+	pathtools.FileSystem
+
+	fsys fs.FS
+}
+
+func newIoFs(fsys fs.FS) *ioFs {
+	return &ioFs{fsys: fsys}
+}
+
+// fsPath converts name to a path in an fs.FS, which are always slash separated, relative and
+// clean.
+func fsPath(op, name string) (string, error) {
+	p := path.Clean(filepath.ToSlash(name))
+	if !fs.ValidPath(p) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return p, nil
+}
+
+// ioFsBuffer holds the contents of a file of an fs.FS that doesn't implement io.ReaderAt and
+// io.Seeker.
+type ioFsBuffer struct{ *bytes.Reader }
+
+func (ioFsBuffer) Close() error { return nil }
+
+type ioFsFile struct {
+	fs.File
+	io.ReaderAt
+	io.Seeker
+}
+
+func (f *ioFs) Open(name string) (pathtools.ReaderAtSeekerCloser, error) {
+	p, err := fsPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := f.fsys.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	if ra, ok := file.(io.ReaderAt); ok {
+		if seeker, ok := file.(io.Seeker); ok {
+			return ioFsFile{file, ra, seeker}, nil
+		}
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return ioFsBuffer{bytes.NewReader(data)}, nil
+}
+
+func (f *ioFs) Exists(name string) (bool, bool, error) {
+	info, err := f.Stat(name)
+	if os.IsNotExist(err) {
+		return false, false, nil
+	} else if err != nil {
+		return false, false, err
+	}
+	return true, info.IsDir(), nil
+}
+
+// Glob matches pattern like pathtools.FileSystem.Glob, with "**" matching any number of
+// directories and wildcards not matching files that start with a '.', using fs.Glob and
+// fs.WalkDir.
+func (f *ioFs) Glob(pattern string, excludes []string,
+	follow pathtools.ShouldFollowSymlinks) (matches, dirs []string, err error) {
+
+	if path.Base(pattern) == "**" {
+		return nil, nil, pathtools.GlobLastRecursiveErr
+	}
+	if !strings.ContainsAny(pattern, "*?[") {
+		if exists, _, err := f.Exists(pattern); err != nil || !exists {
+			return nil, nil, err
+		}
+		return []string{pattern}, nil, nil
+	}
+
+	p, err := fsPath("glob", pattern)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	elems := strings.Split(p, "/")
+	recursive := -1
+	for i, elem := range elems {
+		if elem == "**" {
+			if recursive >= 0 {
+				return nil, nil, pathtools.GlobMultipleRecursiveErr
+			}
+			recursive = i
+		} else if strings.Contains(elem, "**") {
+			return nil, nil, pathtools.GlobInvalidRecursiveErr
+		}
+	}
+
+	if recursive < 0 {
+		matches, err = f.glob(p)
+	} else {
+		// Glob the rest of the pattern in every directory below the ones matching the part
+		// before the "**".
+		var roots []string
+		if recursive == 0 {
+			roots = []string{"."}
+		} else if roots, err = f.glob(path.Join(elems[:recursive]...)); err != nil {
+			return nil, nil, err
+		}
+		rest := path.Join(elems[recursive+1:]...)
+		for _, root := range roots {
+			recursiveDirs, err := f.ListDirsRecursive(root, follow)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, dir := range recursiveDirs {
+				m, err := f.glob(path.Join(pathtools.MatchEscape(dir), rest))
+				if err != nil {
+					return nil, nil, err
+				}
+				matches = append(matches, m...)
+			}
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(excludes) > 0 {
+		var filtered []string
+	matchLoop:
+		for _, m := range matches {
+			for _, e := range excludes {
+				if exclude, err := pathtools.Match(e, m); err != nil {
+					return nil, nil, err
+				} else if exclude {
+					continue matchLoop
+				}
+			}
+			filtered = append(filtered, m)
+		}
+		matches = filtered
+	}
+	return matches, nil, nil
+}
+
+// glob returns the paths matching pattern, leaving out files starting with a '.' unless the
+// pattern does too.
+func (f *ioFs) glob(pattern string) ([]string, error) {
+	matches, err := fs.Glob(f.fsys, pattern)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(path.Base(pattern), ".") {
+		return matches, nil
+	}
+	var ret []string
+	for _, m := range matches {
+		if !strings.HasPrefix(path.Base(m), ".") {
+			ret = append(ret, m)
+		}
+	}
+	return ret, nil
+}
+
+func (f *ioFs) IsDir(name string) (bool, error) {
+	info, err := f.Stat(name)
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+func (f *ioFs) IsSymlink(name string) (bool, error) {
+	info, err := f.Lstat(name)
+	if err != nil {
+		return false, err
+	}
+	return info.Mode()&os.ModeSymlink != 0, nil
+}
+
+// Lstat is the same as Stat, as fs.FS doesn't have a way to stat a symlink without following it.
+func (f *ioFs) Lstat(name string) (os.FileInfo, error) {
+	return f.Stat(name)
+}
+
+func (f *ioFs) Stat(name string) (os.FileInfo, error) {
+	p, err := fsPath("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Stat(f.fsys, p)
+}
+
+// ListDirsRecursive returns name and all the directories below it, leaving out the ones starting
+// with a '.'.
+func (f *ioFs) ListDirsRecursive(name string,
+	follow pathtools.ShouldFollowSymlinks) (dirs []string, err error) {
+
+	p, err := fsPath("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.WalkDir(f.fsys, p, func(dir string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if dir != p && strings.HasPrefix(d.Name(), ".") {
+			return fs.SkipDir
+		}
+		dirs = append(dirs, dir)
+		return nil
+	})
+	return dirs, err
+}
+
+func (f *ioFs) ReadDirNames(name string) ([]string, error) {
+	p, err := fsPath("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadDir(f.fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names, nil
+}
+
+func (f *ioFs) Readlink(name string) (string, error) {
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+}
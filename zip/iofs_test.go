@@ -0,0 +1,133 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"android/soong/third_party/zip"
+)
+
+func TestFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"src/a.txt":          {Data: []byte("a")},
+		"src/b.bin":          {Data: []byte("b")},
+		"src/.hidden.txt":    {Data: []byte("hidden")},
+		"src/sub/c.txt":      {Data: []byte("c")},
+		"src/sub/deep/d.txt": {Data: []byte("d")},
+		"other/e.txt":        {Data: []byte("e")},
+	}
+
+	testCases := []struct {
+		name  string
+		args  *FileArgsBuilder
+		files map[string]string
+		err   string
+	}{
+		{
+			name:  "file",
+			args:  NewFileArgsBuilder().File("other/e.txt"),
+			files: map[string]string{"other/e.txt": "e"},
+		},
+		{
+			name:  "glob",
+			args:  NewFileArgsBuilder().SourcePrefixToStrip("src").File("src/*.txt"),
+			files: map[string]string{"a.txt": "a"},
+		},
+		{
+			name: "recursive glob",
+			args: NewFileArgsBuilder().SourcePrefixToStrip("src").File("src/**/*.txt"),
+			files: map[string]string{
+				"a.txt":          "a",
+				"sub/c.txt":      "c",
+				"sub/deep/d.txt": "d",
+			},
+		},
+		{
+			name: "dir",
+			args: NewFileArgsBuilder().SourcePrefixToStrip("src").Dir("src/sub"),
+			files: map[string]string{
+				"sub/c.txt":      "c",
+				"sub/deep/d.txt": "d",
+			},
+		},
+		{
+			name: "missing",
+			args: NewFileArgsBuilder().File("missing"),
+			err:  "lstat missing: file does not exist",
+		},
+		{
+			name: "outside",
+			args: NewFileArgsBuilder().File("../src/a.txt"),
+			err:  "stat ../src/a.txt: invalid argument",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			err := ZipTo(ZipArgs{
+				FileArgs:         test.args.FileArgs(),
+				CompressionLevel: 9,
+				FS:               fsys,
+				Stderr:           &bytes.Buffer{},
+			}, buf)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("want error %q, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := make(map[string]string)
+			for _, f := range zr.File {
+				r, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatalf("%s: %s", f.Name, err)
+				}
+				files[f.Name] = string(data)
+			}
+			if !reflect.DeepEqual(files, test.files) {
+				t.Errorf("want files %q, got %q", test.files, files)
+			}
+		})
+	}
+
+	t.Run("with Filesystem", func(t *testing.T) {
+		err := ZipTo(ZipArgs{
+			FileArgs:   NewFileArgsBuilder().File("other/e.txt").FileArgs(),
+			FS:         fsys,
+			Filesystem: mockFs,
+		}, &bytes.Buffer{})
+		if want := "FS can't be combined with Filesystem"; err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"android/soong/third_party/zip"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+// EntryInfo describes an entry in the central directory of a zip file.
+type EntryInfo struct {
+	Name             string
+	Method           uint16
+	CompressedSize   uint64
+	UncompressedSize uint64
+	CRC32            uint32
+	Modified         time.Time
+	Mode             os.FileMode
+}
+
+// List returns the entries of the zip file at path, in the order of its central directory.  Only
+// the central directory is read, the contents of the entries aren't decompressed or checked
+// against their CRC32, see VerifyArchive.
+func List(path string) ([]EntryInfo, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	entries := make([]EntryInfo, len(r.File))
+	for i, f := range r.File {
+		entries[i] = EntryInfo{
+			Name:             f.Name,
+			Method:           f.Method,
+			CompressedSize:   f.CompressedSize64,
+			UncompressedSize: f.UncompressedSize64,
+			CRC32:            f.CRC32,
+			Modified:         f.ModTime(),
+			Mode:             f.Mode(),
+		}
+	}
+	return entries, nil
+}
+
+// MethodName returns the name of the compression method of e as printed by the -list flag.
+func (e EntryInfo) MethodName() string {
+	return methodName(e.Method)
+}
+
+// listing returns a line for each entry in the central directory of r, sorted by name.  Each line
+// contains the tab separated name, method, compressed size, uncompressed size and CRC32 in hex of
+// the entry.
+func listing(r *zip.Reader) []byte {
+	files := append([]*zip.File(nil), r.File...)
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+
+	buf := &bytes.Buffer{}
+	for _, f := range files {
+		fmt.Fprintf(buf, "%s\t%s\t%d\t%d\t%08x\n", f.Name, methodName(f.Method),
+			f.CompressedSize64, f.UncompressedSize64, f.CRC32)
+	}
+	return buf.Bytes()
+}
+
+// ContentIndexEntry is the path in the zip file of the entry added by ZipArgs.WriteContentIndex.
+const ContentIndexEntry = ".zipindex"
+
+// contentIndex returns a line for each of headers, sorted by name.  Each line contains the tab
+// separated name, method, uncompressed size and CRC32 in hex of the entry, like listing without
+// the compressed size, which depends on the compression level and not only on the contents.
+func contentIndex(headers []*zip.FileHeader) ([]byte, error) {
+	headers = append([]*zip.FileHeader(nil), headers...)
+	sort.SliceStable(headers, func(i, j int) bool {
+		return headers[i].Name < headers[j].Name
+	})
+
+	buf := &bytes.Buffer{}
+	for _, fh := range headers {
+		if strings.ContainsAny(fh.Name, "\t\n") {
+			return nil, fmt.Errorf("name %q can't be written to the content index, it contains a tab or newline",
+				fh.Name)
+		}
+		fmt.Fprintf(buf, "%s\t%s\t%d\t%08x\n", fh.Name, methodName(fh.Method), fh.UncompressedSize64,
+			fh.CRC32)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeContentIndex writes the content index of headers into zipw as ContentIndexEntry, and
+// returns its header.  It must be called once all of headers have been written, as their sizes
+// and CRC32s are only final after that.
+func (z *ZipWriter) writeContentIndex(zipw *zip.Writer, headers []*zip.FileHeader) (*zip.FileHeader, error) {
+	contents, err := contentIndex(headers)
+	if err != nil {
+		return nil, err
+	}
+
+	fh := &zip.FileHeader{
+		Name:   ContentIndexEntry,
+		Method: zip.Deflate,
+	}
+	fh.SetModTime(z.time)
+	if err := z.setHostSystem(fh); err != nil {
+		return nil, err
+	}
+	w, err := zipw.CreateHeader(fh)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(contents); err != nil {
+		return nil, err
+	}
+	return fh, nil
+}
+
+// writeListing writes the listing of the entries in r to path.
+func writeListing(path string, r *zip.Reader, writeIfChanged bool) error {
+	b := listing(r)
+	if writeIfChanged {
+		return pathtools.WriteFileIfChanged(path, b, 0666)
+	}
+	return ioutil.WriteFile(path, b, 0666)
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"android/soong/third_party/zip"
+)
+
+type MergeOptions struct {
+	// Duplicates selects how file entries with the same name in multiple inputs are handled.
+	// Duplicate directory entries are always merged into the first one.
+	Duplicates DuplicateMode
+
+	// RecomputeCRC decompresses the stored and deflated entries that are copied without
+	// decompressing them and fails if their contents don't match the CRC32 from their input,
+	// instead of trusting it.  Entries that are recompressed are always checked.
+	RecomputeCRC bool
+}
+
+type mergeEntry struct {
+	file  *zip.File
+	input string
+}
+
+// Merge writes a zip file to out that contains the entries of all of the input zip files, in the
+// order they appear in the inputs.  When DuplicateLast replaces an entry, the replacement is
+// written at the position of the first entry with that name.
+//
+// Stored and deflated entries are copied without decompressing them, reusing their CRC32 unless
+// RecomputeCRC is set.  Entries using any other method are decompressed and deflated so that the
+// merged zip file only uses standard methods.  The extra fields of recompressed entries are
+// dropped, as they may describe the original data.
+func Merge(out io.Writer, inputs []string, opts MergeOptions) error {
+	var entries []*mergeEntry
+	byName := make(map[string]*mergeEntry)
+
+	for _, input := range inputs {
+		r, err := zip.OpenReader(input)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		for _, f := range r.File {
+			entry := &mergeEntry{file: f, input: input}
+
+			prev, exists := byName[f.Name]
+			if !exists {
+				byName[f.Name] = entry
+				entries = append(entries, entry)
+				continue
+			}
+
+			if strings.HasSuffix(f.Name, "/") {
+				continue
+			}
+
+			switch opts.Duplicates {
+			case DuplicateError:
+				return fmt.Errorf("destination %q has two files %q and %q", f.Name, prev.input, input)
+			case DuplicateFirst:
+			case DuplicateLast:
+				*prev = *entry
+			default:
+				return fmt.Errorf("unknown duplicate mode %v", opts.Duplicates)
+			}
+		}
+	}
+
+	zipw := zip.NewWriter(out)
+
+	for _, entry := range entries {
+		if err := copyEntry(zipw, entry.file, entry.file.Name, opts.RecomputeCRC); err != nil {
+			return fmt.Errorf("failed to copy %q from %q: %s", entry.file.Name, entry.input, err)
+		}
+	}
+
+	return zipw.Close()
+}
+
+// copyEntry writes f into zipw as an entry called name.  Stored and deflated entries are copied
+// as is, after checking their contents against their CRC32 if recomputeCRC is set, and other
+// methods are recompressed.
+func copyEntry(zipw *zip.Writer, f *zip.File, name string, recomputeCRC bool) error {
+	switch f.Method {
+	case zip.Store, zip.Deflate:
+		if recomputeCRC {
+			if err := verifyEntry(f); err != nil {
+				return err
+			}
+		}
+		return zipw.CopyFrom(f, name)
+	default:
+		return recompressEntry(zipw, f, name)
+	}
+}
+
+// recompressEntry decompresses f and writes it into zipw as a deflated entry called name.
+func recompressEntry(zipw *zip.Writer, f *zip.File, name string) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	fh := &zip.FileHeader{
+		Name:           name,
+		Method:         zip.Deflate,
+		CreatorVersion: f.CreatorVersion,
+		ModifiedTime:   f.ModifiedTime,
+		ModifiedDate:   f.ModifiedDate,
+		ExternalAttrs:  f.ExternalAttrs,
+		Comment:        f.Comment,
+	}
+
+	w, err := zipw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,342 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"android/soong/third_party/zip"
+)
+
+type testZipEntry struct {
+	name     string
+	method   uint16
+	contents []byte
+}
+
+// writeTestZip writes a zip file containing entries to dir/name and returns its path.
+func writeTestZip(t *testing.T, dir, name string, entries []testZipEntry) string {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, e := range entries {
+		if e.method == ZstdMethod {
+			// There is no zstd compressor registered with the zip package, write the
+			// compressed data directly.
+			compressed, err := (&ZipWriter{compLevel: 5}).compressZstd(bytes.NewReader(e.contents), 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := zw.CreateCompressedHeader(&zip.FileHeader{
+				Name:               e.name,
+				Method:             e.method,
+				CRC32:              crc32.ChecksumIEEE(e.contents),
+				UncompressedSize64: uint64(len(e.contents)),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write(compressed.Bytes())
+			w.Close()
+			continue
+		}
+
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:   e.name,
+			Method: e.method,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.contents)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func rawEntryData(t *testing.T, f *zip.File, r io.ReaderAt) []byte {
+	t.Helper()
+
+	offset, err := f.DataOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := make([]byte, f.CompressedSize64)
+	if _, err := r.ReadAt(raw, offset); err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMerge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	in1 := writeTestZip(t, dir, "in1.zip", []testZipEntry{
+		{"dir/", zip.Store, nil},
+		{"dir/a", zip.Deflate, fileA},
+		{"dup", zip.Store, fileB},
+	})
+	in2 := writeTestZip(t, dir, "in2.zip", []testZipEntry{
+		{"dir/", zip.Store, nil},
+		{"dup", zip.Deflate, fileC},
+		{"c", zip.Store, fileC},
+	})
+
+	testCases := []struct {
+		name       string
+		duplicates DuplicateMode
+
+		files    []string
+		contents map[string][]byte
+		err      string
+	}{
+		{
+			name:       "error",
+			duplicates: DuplicateError,
+			err:        `destination "dup" has two files`,
+		},
+		{
+			name:       "first",
+			duplicates: DuplicateFirst,
+
+			files:    []string{"dir/", "dir/a", "dup", "c"},
+			contents: map[string][]byte{"dir/a": fileA, "dup": fileB, "c": fileC},
+		},
+		{
+			name:       "last",
+			duplicates: DuplicateLast,
+
+			files:    []string{"dir/", "dir/a", "dup", "c"},
+			contents: map[string][]byte{"dir/a": fileA, "dup": fileC, "c": fileC},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			err := Merge(buf, []string{in1, in2}, MergeOptions{Duplicates: test.duplicates})
+
+			if test.err != "" {
+				if err == nil {
+					t.Fatalf("want error %q, got no error", test.err)
+				} else if !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("want error %q, got %q", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			br := bytes.NewReader(buf.Bytes())
+			zr, err := zip.NewReader(br, int64(br.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var files []string
+			for _, f := range zr.File {
+				files = append(files, f.Name)
+
+				r, err := f.Open()
+				if err != nil {
+					t.Fatalf("error when opening %s: %s", f.Name, err)
+				}
+				got, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatalf("error when reading %s: %s", f.Name, err)
+				}
+				if want := test.contents[f.Name]; !bytes.Equal(got, want) {
+					t.Errorf("incorrect contents for %s, want %q got %q", f.Name, want, got)
+				}
+			}
+
+			if !reflect.DeepEqual(files, test.files) {
+				t.Errorf("want files %q, got %q", test.files, files)
+			}
+		})
+	}
+}
+
+func TestMergeMethods(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestMergeMethods")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := writeTestZip(t, dir, "in.zip", []testZipEntry{
+		{"stored", zip.Store, fileA},
+		{"deflated", zip.Deflate, fileB},
+		{"zstd", ZstdMethod, fileC},
+	})
+
+	buf := &bytes.Buffer{}
+	err = Merge(buf, []string{in}, MergeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inReader, err := zip.OpenReader(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inReader.Close()
+	inFile, err := os.Open(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inFile.Close()
+
+	br := bytes.NewReader(buf.Bytes())
+	zr, err := zip.NewReader(br, int64(br.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantMethods := map[string]uint16{
+		"stored":   zip.Store,
+		"deflated": zip.Deflate,
+		"zstd":     zip.Deflate,
+	}
+	wantContents := map[string][]byte{
+		"stored":   fileA,
+		"deflated": fileB,
+		"zstd":     fileC,
+	}
+
+	if len(zr.File) != len(inReader.File) {
+		t.Fatalf("want %d files, got %d", len(inReader.File), len(zr.File))
+	}
+
+	for i, f := range zr.File {
+		if f.Method != wantMethods[f.Name] {
+			t.Errorf("incorrect file %s method want %v got %v", f.Name, wantMethods[f.Name], f.Method)
+		}
+
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("error when opening %s: %s", f.Name, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("error when reading %s: %s", f.Name, err)
+		}
+		if !bytes.Equal(got, wantContents[f.Name]) {
+			t.Errorf("incorrect contents for %s, want %q got %q", f.Name, wantContents[f.Name], got)
+		}
+
+		if f.Method == inReader.File[i].Method {
+			// Entries that kept their method should have been copied without recompressing.
+			want := rawEntryData(t, inReader.File[i], inFile)
+			if got := rawEntryData(t, f, br); !bytes.Equal(got, want) {
+				t.Errorf("expected %s to be copied without recompressing", f.Name)
+			}
+		}
+	}
+}
+
+// corruptTestZip writes a copy of the zip file at path to dir/name with the first byte of the
+// contents of the entry called entry flipped, and returns its path.
+func corruptTestZip(t *testing.T, path, dir, name, entry string) string {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if f.Name == entry {
+			offset, err := f.DataOffset()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[offset] ^= 0xff
+		}
+	}
+	out := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(out, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestMergeRecomputeCRC(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTestZip(t, dir, "in.zip", []testZipEntry{
+		{"stored", zip.Store, fileA},
+		{"deflated", zip.Deflate, fileB},
+	})
+	corrupt := corruptTestZip(t, in, dir, "corrupt.zip", "stored")
+
+	for _, recompute := range []bool{false, true} {
+		buf := &bytes.Buffer{}
+		if err := Merge(buf, []string{in}, MergeOptions{RecomputeCRC: recompute}); err != nil {
+			t.Fatalf("recompute %v: got error %v", recompute, err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]uint32{
+			"stored":   crc32.ChecksumIEEE(fileA),
+			"deflated": crc32.ChecksumIEEE(fileB),
+		}
+		for _, f := range zr.File {
+			if f.CRC32 != want[f.Name] {
+				t.Errorf("recompute %v: %s: want CRC32 %08x, got %08x", recompute, f.Name, want[f.Name], f.CRC32)
+			}
+		}
+		if failed := verifyEntries(zr); len(failed) > 0 {
+			t.Errorf("recompute %v: want no failed entries, got %v", recompute, failed)
+		}
+	}
+
+	// Without recomputing the corrupt entry is copied as is.
+	if err := Merge(&bytes.Buffer{}, []string{corrupt}, MergeOptions{}); err != nil {
+		t.Errorf("got error %v", err)
+	}
+
+	err := Merge(&bytes.Buffer{}, []string{corrupt}, MergeOptions{RecomputeCRC: true})
+	want := `failed to copy "stored" from "` + corrupt + `": ` + zip.ErrChecksum.Error()
+	if err == nil || err.Error() != want {
+		t.Errorf("want error %q, got %v", want, err)
+	}
+}
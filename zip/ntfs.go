@@ -0,0 +1,77 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+)
+
+// NTFSTimesTag is the ID of the NTFS extra field, which stores the modification, access and
+// creation times of an entry with 100ns resolution.
+const NTFSTimesTag = 0x000a
+
+// ntfsEpoch is the start of the NTFS FILETIME epoch.
+var ntfsEpoch = time.Date(1601, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ntfsFileTime returns t as the number of 100ns intervals since ntfsEpoch.  time.Duration can't
+// hold the whole range, so whole seconds and the remainder are converted separately.
+func ntfsFileTime(t time.Time) uint64 {
+	secs := t.Unix() - ntfsEpoch.Unix()
+	return uint64(secs)*1e7 + uint64(t.Nanosecond()/100)
+}
+
+// ntfsTimesExtra returns an NTFS extra field with a single attribute 1 holding the given times.
+func ntfsTimesExtra(mtime, atime, ctime time.Time) []byte {
+	b := make([]byte, 36)
+	binary.LittleEndian.PutUint16(b[0:], NTFSTimesTag)
+	binary.LittleEndian.PutUint16(b[2:], 32) // size of the data after the header
+	// b[4:8] is reserved.
+	binary.LittleEndian.PutUint16(b[8:], 1)   // attribute tag
+	binary.LittleEndian.PutUint16(b[10:], 24) // size of the attribute
+	binary.LittleEndian.PutUint64(b[12:], ntfsFileTime(mtime))
+	binary.LittleEndian.PutUint64(b[20:], ntfsFileTime(atime))
+	binary.LittleEndian.PutUint64(b[28:], ntfsFileTime(ctime))
+	return b
+}
+
+// ntfsExtra returns the NTFS extra field for a file with the given stat, or nil if NTFS times
+// aren't being stored.  All three times are the Timestamp override if there is one, or the
+// DOS timestamp of the entry if there is no stat.  The times of the stat are clamped to
+// SOURCE_DATE_EPOCH if it is set, and its status change time stands in for the creation time,
+// which Unix filesystems don't generally record.
+func (z *ZipWriter) ntfsExtra(info os.FileInfo) []byte {
+	if !z.ntfsTimes {
+		return nil
+	}
+
+	if !z.timestampOverride.IsZero() {
+		t := z.timestampOverride
+		return ntfsTimesExtra(t, t, t)
+	}
+
+	if info == nil {
+		return ntfsTimesExtra(z.time, z.time, z.time)
+	}
+
+	mtime := info.ModTime()
+	atime, ctime, ok := statTimes(info)
+	if !ok {
+		atime, ctime = mtime, mtime
+	}
+	epoch := z.sourceDateEpoch
+	return ntfsTimesExtra(clampToEpoch(mtime, epoch), clampToEpoch(atime, epoch), clampToEpoch(ctime, epoch))
+}
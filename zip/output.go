@@ -0,0 +1,155 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// createTempOutput creates the file that the zip file at path is written to before it is moved into
+// place by moveOutput.  It is created in dir, or in the directory of path if dir is empty so that
+// it can be renamed over path.  The file is created with mode 0666 less the umask like os.Create
+// does, unlike ioutil.TempFile.
+func createTempOutput(dir, path string) (*os.File, error) {
+	if dir == "" {
+		dir = filepath.Dir(path)
+	}
+	prefix := filepath.Join(dir, "."+filepath.Base(path)+".tmp")
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("%s%d-%d", prefix, os.Getpid(), i)
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// syncer flushes files and directories to stable storage for ZipArgs.DurableWrite.
+type syncer interface {
+	syncFile(f *os.File) error
+	syncDir(dir string) error
+}
+
+type osSyncer struct{}
+
+func (osSyncer) syncFile(f *os.File) error { return f.Sync() }
+
+func (osSyncer) syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// outputSyncer is the syncer used for ZipArgs.DurableWrite, tests replace it to check the order of
+// the calls.
+var outputSyncer syncer = osSyncer{}
+
+// moveOutput moves the finished zip file tmp to path with renameOrCopy, and syncs the directory of
+// path once it has been moved if durable is set.
+func moveOutput(tmp, path string, durable bool) error {
+	if err := renameOrCopy(tmp, path, durable); err != nil {
+		return err
+	}
+	if durable {
+		return outputSyncer.syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// renameOrCopy renames tmp to path if they are on the same filesystem and copies it otherwise, in
+// which case tmp is left for the caller to remove.  If durable is set the copy is synced.
+func renameOrCopy(tmp, path string, durable bool) error {
+	err := os.Rename(tmp, path)
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+
+	src, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil && durable {
+		err = outputSyncer.syncFile(dst)
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Don't leave a partial zip file behind.
+		os.Remove(path)
+	}
+	return err
+}
+
+// sameContents returns true if the files a and b have the same contents, or false if b doesn't
+// exist.
+func sameContents(a, b string) (bool, error) {
+	fb, err := os.Open(b)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+
+	infoA, err := fa.Stat()
+	if err != nil {
+		return false, err
+	}
+	infoB, err := fb.Stat()
+	if err != nil {
+		return false, err
+	}
+	if infoA.Size() != infoB.Size() {
+		return false, nil
+	}
+
+	bufA := make([]byte, 64*1024)
+	bufB := make([]byte, len(bufA))
+	for {
+		n, err := io.ReadFull(fa, bufA)
+		if err == io.EOF {
+			return true, nil
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return false, err
+		}
+		if _, err := io.ReadFull(fb, bufB[:n]); err != nil {
+			return false, err
+		}
+		if !bytes.Equal(bufA[:n], bufB[:n]) {
+			return false, nil
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"encoding/binary"
+	"os"
+	"syscall"
+)
+
+// UnixOwnershipTag is the ID of the Info-ZIP Unix extra field ("ux"), which stores the numeric
+// uid and gid of an entry.
+const UnixOwnershipTag = 0x7875
+
+// unixOwnershipExtra returns an Info-ZIP Unix extra field with version 1 and 4 byte uid and gid.
+func unixOwnershipExtra(uid, gid uint32) []byte {
+	b := make([]byte, 15)
+	binary.LittleEndian.PutUint16(b[0:], UnixOwnershipTag)
+	binary.LittleEndian.PutUint16(b[2:], 11) // size of the data after the header
+	b[4] = 1                                 // version
+	b[5] = 4                                 // size of the uid
+	binary.LittleEndian.PutUint32(b[6:], uid)
+	b[10] = 4 // size of the gid
+	binary.LittleEndian.PutUint32(b[11:], gid)
+	return b
+}
+
+// ownershipExtra returns the Info-ZIP Unix extra field for a file with the given stat, owned by
+// 0/0 if the stat doesn't provide the owner, or nil if ownership isn't being stored.
+func (z *ZipWriter) ownershipExtra(info os.FileInfo) []byte {
+	if !z.storeOwnership {
+		return nil
+	}
+
+	var uid, gid uint32
+	if info != nil {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = stat.Uid, stat.Gid
+		}
+	}
+	return unixOwnershipExtra(uid, gid)
+}
+
+// hasExtraTag returns true if extra contains an extra field with the given tag.
+func hasExtraTag(extra []byte, tag uint16) bool {
+	for len(extra) >= 4 {
+		if binary.LittleEndian.Uint16(extra) == tag {
+			return true
+		}
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		extra = extra[4+size:]
+	}
+	return false
+}
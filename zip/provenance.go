@@ -0,0 +1,90 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"encoding/json"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// DefaultProvenanceEntry is the conventional name of the entry written by ZipArgs.ProvenanceEntry.
+const DefaultProvenanceEntry = ".zip-build-info.json"
+
+// provenanceSource is the source name used in messages for the provenance entry.
+const provenanceSource = "<provenance>"
+
+// provenance is the contents of the provenance entry.  It only holds values that are the same
+// every time the same binary is run with the same arguments and timestamp, so that it doesn't
+// break reproducible builds.
+type provenance struct {
+	Tool        string            `json:"tool"`
+	ToolVersion string            `json:"tool_version"`
+	GoVersion   string            `json:"go_version"`
+	Timestamp   string            `json:"timestamp"`
+	Inputs      []provenanceInput `json:"inputs"`
+}
+
+// provenanceInput describes one of ZipArgs.FileArgs.
+type provenanceInput struct {
+	SourceFiles         []string `json:"source_files,omitempty"`
+	GlobDir             string   `json:"glob_dir,omitempty"`
+	Reader              bool     `json:"reader,omitempty"`
+	DestFile            string   `json:"dest_file,omitempty"`
+	SourcePrefixToStrip string   `json:"source_prefix_to_strip,omitempty"`
+	PathPrefixInZip     string   `json:"path_prefix_in_zip,omitempty"`
+	JunkPaths           bool     `json:"junk_paths,omitempty"`
+	StripComponents     int      `json:"strip_components,omitempty"`
+}
+
+// toolVersion returns the version of the module of the running binary, or "unknown" if it wasn't
+// built with module information.
+func toolVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// provenanceContents returns the JSON contents of the provenance entry for a zip file written from
+// fileArgs with entries that have the modification time timestamp.
+func provenanceContents(fileArgs []FileArg, timestamp time.Time) ([]byte, error) {
+	p := provenance{
+		Tool:        "soong_zip",
+		ToolVersion: toolVersion(),
+		GoVersion:   runtime.Version(),
+		Timestamp:   timestamp.UTC().Format(time.RFC3339),
+		Inputs:      []provenanceInput{},
+	}
+	for _, fa := range fileArgs {
+		p.Inputs = append(p.Inputs, provenanceInput{
+			SourceFiles:         fa.SourceFiles,
+			GlobDir:             fa.GlobDir,
+			Reader:              fa.Reader != nil,
+			DestFile:            fa.DestFile,
+			SourcePrefixToStrip: fa.SourcePrefixToStrip,
+			PathPrefixInZip:     fa.PathPrefixInZip,
+			JunkPaths:           fa.JunkPaths,
+			StripComponents:     fa.StripComponents,
+		})
+	}
+
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
@@ -17,9 +17,14 @@ package zip
 import (
 	"fmt"
 	"runtime"
+	"sync/atomic"
 )
 
 type RateLimit struct {
+	// peak is the most capacity that has been in use at once, accessed atomically.  It is first
+	// in the struct to keep it 64-bit aligned on 32-bit platforms.
+	peak int64
+
 	requests    chan request
 	completions chan int64
 
@@ -65,6 +70,11 @@ func (r *RateLimit) Finish(size int64) {
 	r.completions <- size
 }
 
+// Peak returns the most capacity that has been in use at once.
+func (r *RateLimit) Peak() int64 {
+	return atomic.LoadInt64(&r.peak)
+}
+
 // Stop the background goroutine
 func (r *RateLimit) Stop() {
 	close(r.stop)
@@ -106,6 +116,9 @@ func (r *RateLimit) monitorChannels(capacity int64) {
 			}
 			if accepted {
 				usedCapacity += currentRequest.size
+				if usedCapacity > atomic.LoadInt64(&r.peak) {
+					atomic.StoreInt64(&r.peak, usedCapacity)
+				}
 				currentRequest.serviced <- struct{}{}
 				currentRequest = nil
 			}
@@ -0,0 +1,115 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"android/soong/third_party/zip"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+// RepackageFunc is called by Repackage with the header of each entry of the input zip file.  It
+// returns the name of the entry in the output zip file, or false to leave the entry out.
+// Directory entries are called with their names ending in "/", and the "/" is added back if the
+// returned name doesn't have it.
+type RepackageFunc func(fh *zip.FileHeader) (newName string, keep bool)
+
+type RepackageOptions struct {
+	// RecomputeCRC checks the contents of the entries that are copied without decompressing
+	// them against their CRC32, like MergeOptions.RecomputeCRC.
+	RecomputeCRC bool
+}
+
+// Repackage writes a zip file to out that contains the entries of in that transform keeps, under
+// the names it returns, in the order they appear in in.  Like Merge, stored and deflated entries
+// are copied without decompressing them, even when they are renamed, and entries using any other
+// method are decompressed and deflated.  Names that would be outside of the zip file are rejected
+// with a DestinationOutsideZipError, and files renamed to the same name as another entry are an
+// error.  Directories renamed to the same name are merged into the first one.
+func Repackage(in *zip.Reader, out io.Writer, transform RepackageFunc) error {
+	return RepackageWithOptions(in, out, transform, RepackageOptions{})
+}
+
+// RepackageWithOptions is like Repackage, with the options in opts.
+func RepackageWithOptions(in *zip.Reader, out io.Writer, transform RepackageFunc, opts RepackageOptions) error {
+	zipw := zip.NewWriter(out)
+	written := make(map[string]bool)
+
+	for _, f := range in.File {
+		name, keep := transform(&f.FileHeader)
+		if !keep {
+			continue
+		}
+		if name == "" {
+			return fmt.Errorf("transform returned an empty name for %q", f.Name)
+		}
+
+		isDir := strings.HasSuffix(f.Name, "/")
+		if outsideZip(name) {
+			return DestinationOutsideZipError{Path: f.Name, Dest: name}
+		}
+		name = path.Clean(name)
+		if name == "." {
+			if isDir {
+				// The root of the zip file doesn't need an entry.
+				continue
+			}
+			return DestinationOutsideZipError{Path: f.Name, Dest: name}
+		}
+		if isDir {
+			name += "/"
+		}
+
+		if written[name] {
+			if isDir {
+				continue
+			}
+			return fmt.Errorf("repackaged zip file contains %q more than once", name)
+		}
+		written[name] = true
+
+		if err := copyEntry(zipw, f, name, opts.RecomputeCRC); err != nil {
+			return fmt.Errorf("failed to copy %q: %s", f.Name, err)
+		}
+	}
+
+	return zipw.Close()
+}
+
+// RepackageTransform returns a RepackageFunc for Repackage that leaves out the entries whose names
+// match one of excludes, which follow pathtools.Match, and renames the others with maps like
+// ZipArgs.PrefixMaps.
+func RepackageTransform(excludes []string, maps []PrefixMap) (RepackageFunc, error) {
+	for _, pattern := range excludes {
+		if _, err := pathtools.Match(pattern, "a"); err != nil {
+			return nil, fmt.Errorf("%s: %s", pattern, err)
+		}
+	}
+
+	return func(fh *zip.FileHeader) (string, bool) {
+		name := strings.TrimSuffix(fh.Name, "/")
+		for _, pattern := range excludes {
+			if match, _ := pathtools.Match(pattern, name); match {
+				return "", false
+			}
+		}
+		return applyPrefixMaps(maps, name), true
+	}, nil
+}
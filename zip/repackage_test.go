@@ -0,0 +1,211 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"android/soong/third_party/zip"
+)
+
+// rawContents returns the compressed data of every entry of the zip file in data by name.
+func rawContents(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := make(map[string][]byte)
+	for _, f := range zr.File {
+		offset, err := f.DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret[f.Name] = data[offset : offset+int64(f.CompressedSize64)]
+	}
+	return ret
+}
+
+func TestRepackage(t *testing.T) {
+	dir := t.TempDir()
+	input := writeTestZip(t, dir, "in.zip", []testZipEntry{
+		{name: "a/", method: zip.Store},
+		{name: "a/b", method: zip.Deflate, contents: fileA},
+		{name: "a/c.o", method: zip.Deflate, contents: fileB},
+		{name: "d/", method: zip.Store},
+		{name: "d/e", method: zip.Store, contents: fileC},
+		{name: "z", method: ZstdMethod, contents: fileA},
+	})
+	inData, err := ioutil.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repackage := func(t *testing.T, transform RepackageFunc) ([]byte, error) {
+		r, err := zip.OpenReader(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		buf := &bytes.Buffer{}
+		err = Repackage(&r.Reader, buf, transform)
+		return buf.Bytes(), err
+	}
+
+	type entry struct {
+		name     string
+		method   uint16
+		contents string
+	}
+	entries := func(t *testing.T, data []byte) []entry {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ret []entry
+		for _, f := range zr.File {
+			r, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("%s: %s", f.Name, err)
+			}
+			ret = append(ret, entry{f.Name, f.Method, string(b)})
+		}
+		return ret
+	}
+
+	t.Run("exclude and rename", func(t *testing.T) {
+		transform, err := RepackageTransform([]string{"**/*.o"},
+			[]PrefixMap{{From: "a", To: "x/y"}, {From: "d", To: ""}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := repackage(t, transform)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		want := []entry{
+			{"x/y/", zip.Store, ""},
+			{"x/y/b", zip.Deflate, string(fileA)},
+			{"e", zip.Store, string(fileC)},
+			{"z", zip.Deflate, string(fileA)},
+		}
+		if got := entries(t, out); !reflect.DeepEqual(got, want) {
+			t.Errorf("want entries %v, got %v", want, got)
+		}
+
+		// Kept entries are copied as is even when they are renamed.
+		in, got := rawContents(t, inData), rawContents(t, out)
+		for inName, outName := range map[string]string{"a/b": "x/y/b", "d/e": "e"} {
+			if !bytes.Equal(in[inName], got[outName]) {
+				t.Errorf("%s: compressed data differs from %s", outName, inName)
+			}
+		}
+	})
+
+	t.Run("keep everything", func(t *testing.T) {
+		out, err := repackage(t, func(fh *zip.FileHeader) (string, bool) { return fh.Name, true })
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		in, got := rawContents(t, inData), rawContents(t, out)
+		for _, name := range []string{"a/b", "a/c.o", "d/e"} {
+			if !bytes.Equal(in[name], got[name]) {
+				t.Errorf("%s: compressed data differs", name)
+			}
+		}
+	})
+
+	t.Run("renamed directories", func(t *testing.T) {
+		out, err := repackage(t, func(fh *zip.FileHeader) (string, bool) {
+			if fh.Name == "d/" {
+				return "a", true
+			}
+			return fh.Name, fh.Name == "a/"
+		})
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		if got, want := entries(t, out), []entry{{"a/", zip.Store, ""}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("want entries %v, got %v", want, got)
+		}
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		_, err := repackage(t, func(fh *zip.FileHeader) (string, bool) {
+			if fh.Name == "a/c.o" {
+				return "a/b", true
+			}
+			return fh.Name, true
+		})
+		if want := `repackaged zip file contains "a/b" more than once`; err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+
+	t.Run("outside of the zip", func(t *testing.T) {
+		_, err := repackage(t, func(fh *zip.FileHeader) (string, bool) { return "../" + fh.Name, true })
+		if _, ok := err.(DestinationOutsideZipError); !ok {
+			t.Errorf("want DestinationOutsideZipError, got %v", err)
+		}
+	})
+	t.Run("recompute crc", func(t *testing.T) {
+		keep := func(fh *zip.FileHeader) (string, bool) { return fh.Name, true }
+		r, err := zip.OpenReader(corruptTestZip(t, input, dir, "corrupt.zip", "d/e"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		if err := Repackage(&r.Reader, &bytes.Buffer{}, keep); err != nil {
+			t.Errorf("got error %v", err)
+		}
+		err = RepackageWithOptions(&r.Reader, &bytes.Buffer{}, keep, RepackageOptions{RecomputeCRC: true})
+		if want := `failed to copy "d/e": ` + zip.ErrChecksum.Error(); err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+
+		buf := &bytes.Buffer{}
+		in, err := zip.OpenReader(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer in.Close()
+		if err := RepackageWithOptions(&in.Reader, buf, keep, RepackageOptions{RecomputeCRC: true}); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		want := []entry{
+			{"a/", zip.Store, ""},
+			{"a/b", zip.Deflate, string(fileA)},
+			{"a/c.o", zip.Deflate, string(fileB)},
+			{"d/", zip.Store, ""},
+			{"d/e", zip.Store, string(fileC)},
+			{"z", zip.Deflate, string(fileA)},
+		}
+		if got := entries(t, buf.Bytes()); !reflect.DeepEqual(got, want) {
+			t.Errorf("want entries %v, got %v", want, got)
+		}
+	})
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/google/blueprint/pathtools"
+
+	"android/soong/third_party/zip"
+)
+
+// compressionRule is a line of a compression rules file, see ZipArgs.CompressionRulesPath.
+type compressionRule struct {
+	// pattern is matched against paths in the zip file with pathtools.Match.
+	pattern string
+	// method is the zip method of the matching files.
+	method uint16
+	// level is the compression level of the matching files, or nil to keep the level they would
+	// otherwise have.
+	level *int
+
+	// source is the file and line the rule came from, for errors.
+	source string
+}
+
+// readCompressionRules returns the rules in the compression rules file at path.
+func (z *ZipWriter) readCompressionRules(path string) ([]compressionRule, error) {
+	f, err := z.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	return parseCompressionRules(path, string(contents))
+}
+
+// parseCompressionRules parses lines of the form "pattern = method[:level]" from the compression
+// rules file name.  Blank lines and lines starting with # are ignored.  The method must be
+// deflate, store, zstd or bzip2, and the level must be a valid compression level.
+func parseCompressionRules(name, contents string) ([]compressionRule, error) {
+	var rules []compressionRule
+	for i, line := range strings.Split(contents, "\n") {
+		source := fmt.Sprintf("%s:%d", name, i+1)
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		equals := strings.LastIndex(line, "=")
+		if equals == -1 {
+			return nil, fmt.Errorf("%s: expected pattern = method[:level], got %q", source, line)
+		}
+		rule := compressionRule{
+			pattern: strings.TrimSpace(line[:equals]),
+			source:  source,
+		}
+		if rule.pattern == "" {
+			return nil, fmt.Errorf("%s: missing pattern", source)
+		}
+
+		value := strings.TrimSpace(line[equals+1:])
+		methodName := value
+		if colon := strings.Index(value, ":"); colon != -1 {
+			methodName = value[:colon]
+			level, err := strconv.Atoi(value[colon+1:])
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid compression level %q", source, value[colon+1:])
+			}
+			if err := validCompressionLevel(level); err != nil {
+				return nil, fmt.Errorf("%s: %s", source, err)
+			}
+			rule.level = &level
+		}
+
+		switch methodName {
+		case "deflate":
+			rule.method = zip.Deflate
+		case "store":
+			rule.method = zip.Store
+		case "zstd":
+			rule.method = ZstdMethod
+		case "bzip2":
+			rule.method = Bzip2Method
+		default:
+			return nil, fmt.Errorf("%s: unknown compression method %q, must be deflate, store, zstd or bzip2",
+				source, methodName)
+		}
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// compressionRule returns the first of z.compressionRules that matches dest, or nil if none do.
+func (z *ZipWriter) compressionRule(dest string) (*compressionRule, error) {
+	for i := range z.compressionRules {
+		rule := &z.compressionRules[i]
+		match, err := pathtools.Match(rule.pattern, dest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", rule.source, rule.pattern, err)
+		}
+		if match {
+			return rule, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/blueprint/pathtools"
+
+	"android/soong/third_party/zip"
+)
+
+func TestParseCompressionRules(t *testing.T) {
+	contents := "# comment\n" +
+		"\n" +
+		"**/*.so = store\n" +
+		"  sub/*=zstd:3  \n" +
+		"**/*.txt = deflate:-1\r\n"
+
+	three, defaultLevel := 3, -1
+	want := []compressionRule{
+		{pattern: "**/*.so", method: zip.Store, source: "rules:3"},
+		{pattern: "sub/*", method: ZstdMethod, level: &three, source: "rules:4"},
+		{pattern: "**/*.txt", method: zip.Deflate, level: &defaultLevel, source: "rules:5"},
+	}
+
+	got, err := parseCompressionRules("rules", contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want rules %+v, got %+v", want, got)
+	}
+
+	errorCases := []struct {
+		name     string
+		contents string
+		err      string
+	}{
+		{
+			name:     "no method",
+			contents: "# comment\n*.so\n",
+			err:      `rules:2: expected pattern = method[:level], got "*.so"`,
+		},
+		{
+			name:     "no pattern",
+			contents: " = store\n",
+			err:      "rules:1: missing pattern",
+		},
+		{
+			name:     "unknown method",
+			contents: "*.so = store\n*.txt = lzma\n",
+			err:      `rules:2: unknown compression method "lzma", must be deflate, store, zstd or bzip2`,
+		},
+		{
+			name:     "invalid level",
+			contents: "\n\n*.txt = deflate:fast\n",
+			err:      `rules:3: invalid compression level "fast"`,
+		},
+		{
+			name:     "level out of range",
+			contents: "*.txt = zstd:10\n",
+			err:      "rules:1: invalid compression level 10, must be between 0 and 9, or -1 for the default",
+		},
+	}
+
+	for _, test := range errorCases {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseCompressionRules("rules", test.contents)
+			if err == nil || err.Error() != test.err {
+				t.Errorf("want error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestCompressionRules(t *testing.T) {
+	contents := []byte(strings.Repeat("compressible contents ", 100))
+	rules := "**/*.so = store\n" +
+		"sub/* = zstd:3\n" +
+		"**/*.txt = bzip2\n"
+
+	fs := pathtools.MockFs(map[string][]byte{
+		"a.txt":     contents,
+		"b.png":     contents,
+		"sub/c.txt": contents,
+		"sub/d.so":  contents,
+		"rules":     []byte(rules),
+		"bad_rules": []byte("*.txt = lzma\n"),
+	})
+
+	zero := 0
+
+	testCases := []struct {
+		name string
+		args func(args *ZipArgs)
+		want map[string]uint16
+		err  string
+	}{
+		{
+			name: "first match wins",
+			want: map[string]uint16{
+				"a.txt":     Bzip2Method,
+				"b.png":     zip.Deflate,
+				"sub/c.txt": ZstdMethod,
+				"sub/d.so":  zip.Store,
+			},
+		},
+		{
+			name: "over level patterns",
+			args: func(args *ZipArgs) {
+				args.CompressionLevelPatterns = []CompressionLevelPattern{{Pattern: "**/*", Level: 0}}
+			},
+			want: map[string]uint16{
+				"a.txt":     zip.Store,
+				"b.png":     zip.Store,
+				"sub/c.txt": ZstdMethod,
+				"sub/d.so":  zip.Store,
+			},
+		},
+		{
+			name: "file arg level",
+			args: func(args *ZipArgs) {
+				// The FileArgs of a.txt and sub/c.txt.
+				args.FileArgs[0].CompressionLevel = &zero
+				args.FileArgs[2].CompressionLevel = &zero
+			},
+			want: map[string]uint16{
+				"a.txt":     zip.Store,
+				"b.png":     zip.Deflate,
+				"sub/c.txt": zip.Store,
+				"sub/d.so":  zip.Store,
+			},
+		},
+		{
+			name: "non deflated files",
+			args: func(args *ZipArgs) {
+				args.NonDeflatedFiles = map[string]bool{"a.txt": true}
+			},
+			want: map[string]uint16{
+				"a.txt":     zip.Store,
+				"b.png":     zip.Deflate,
+				"sub/c.txt": ZstdMethod,
+				"sub/d.so":  zip.Store,
+			},
+		},
+		{
+			name: "invalid",
+			args: func(args *ZipArgs) {
+				args.CompressionRulesPath = "bad_rules"
+			},
+			err: `bad_rules:1: unknown compression method "lzma", must be deflate, store, zstd or bzip2`,
+		},
+		{
+			name: "missing",
+			args: func(args *ZipArgs) {
+				args.CompressionRulesPath = "missing"
+			},
+			err: "open missing: file does not exist",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{}
+			args.FileArgs = fileArgsBuilder().File("a.txt").File("b.png").File("sub/c.txt").
+				File("sub/d.so").FileArgs()
+			args.CompressionLevel = 5
+			args.CompressionRulesPath = "rules"
+			args.Filesystem = fs
+			args.Stderr = &bytes.Buffer{}
+			if test.args != nil {
+				test.args(&args)
+			}
+
+			buf := &bytes.Buffer{}
+			err := ZipTo(args, buf)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("want error %q, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]uint16)
+			for _, f := range zr.File {
+				got[f.Name] = f.Method
+				r, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatalf("%s: %s", f.Name, err)
+				}
+				if !bytes.Equal(data, contents) {
+					t.Errorf("%s: contents don't round trip", f.Name)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("want methods %v, got %v", test.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MinSplitSize is the smallest ZipArgs.SplitSize, the minimum size of a volume of a split archive
+// allowed by the zip spec.
+const MinSplitSize = 64 * 1024
+
+const (
+	// splitSignature starts the first volume of a split archive.
+	splitSignature = 0x08074b50
+
+	localHeaderSig   = 0x04034b50
+	centralHeaderSig = 0x02014b50
+	endOfCentralSig  = 0x06054b50
+	zip64LocatorSig  = 0x07064b50
+
+	localHeaderLen   = 30
+	centralHeaderLen = 46
+	endOfCentralLen  = 22
+	zip64LocatorLen  = 20
+)
+
+// SplitVolumeName returns the name of volume i, counting from 1, of a split archive of n volumes
+// whose last volume is zipPath: the last volume keeps its name, the others replace its extension
+// with .z01, .z02 and so on.
+func SplitVolumeName(zipPath string, i, n int) string {
+	if i == n {
+		return zipPath
+	}
+	return fmt.Sprintf("%s.z%02d", strings.TrimSuffix(zipPath, filepath.Ext(zipPath)), i)
+}
+
+// splitVolumes tracks the volumes of a split archive while they are laid out.  Headers and records
+// are never split across volumes, a volume ends early instead when one wouldn't fit in it.
+type splitVolumes struct {
+	size int64
+	// starts are the offsets in the concatenated volumes at which each volume starts.
+	starts []int64
+}
+
+// place returns the volume and the offset in it of a header of length n at offset off in the
+// concatenated volumes, starting a new volume before it if it wouldn't fit in the current one.
+func (v *splitVolumes) place(off, n int64) (int, int64) {
+	last := v.starts[len(v.starts)-1]
+	for off >= last+v.size {
+		last += v.size
+		v.starts = append(v.starts, last)
+	}
+	if off+n > last+v.size {
+		last = off
+		v.starts = append(v.starts, last)
+	}
+	return len(v.starts) - 1, off - last
+}
+
+// splitZip splits the zip file at zipPath into volumes of at most splitSize bytes following the
+// split archive convention of the zip spec: the first volume starts with the split signature, the
+// central directory records the volume of every entry and offsets are relative to the start of a
+// volume.  The zip file is left as is if it already fits in a single volume.  Zip64 archives can't
+// be split.
+func splitZip(zipPath string, splitSize int64) error {
+	f, err := os.Open(zipPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() <= splitSize {
+		return nil
+	}
+
+	eocd, eocdOffset, err := readEndOfCentralDirectory(f, info.Size())
+	if err != nil {
+		return fmt.Errorf("failed to read %q to split it: %s", zipPath, err)
+	}
+	le := binary.LittleEndian
+	entries := int(le.Uint16(eocd[10:]))
+	cdSize := int64(le.Uint32(eocd[12:]))
+	cdOffset := int64(le.Uint32(eocd[16:]))
+	if le.Uint16(eocd[8:]) == 0xffff || le.Uint32(eocd[12:]) == 0xffffffff ||
+		le.Uint32(eocd[16:]) == 0xffffffff || hasZip64Locator(f, eocdOffset) {
+		return fmt.Errorf("can't split %q, zip64 archives can't be split", zipPath)
+	}
+
+	cd := make([]byte, cdSize)
+	if _, err := f.ReadAt(cd, cdOffset); err != nil {
+		return fmt.Errorf("failed to read the central directory of %q: %s", zipPath, err)
+	}
+
+	// The concatenated volumes are the split signature, the entries, the rewritten central
+	// directory and the end of central directory record.
+	const sigLen = 4
+	volumes := &splitVolumes{size: splitSize, starts: []int64{0}}
+
+	var records [][]byte
+	for i, pos := 0, 0; i < entries; i++ {
+		if pos+centralHeaderLen > len(cd) || le.Uint32(cd[pos:]) != centralHeaderSig {
+			return fmt.Errorf("invalid central directory in %q", zipPath)
+		}
+		n := centralHeaderLen + int(le.Uint16(cd[pos+28:])) + int(le.Uint16(cd[pos+30:])) +
+			int(le.Uint16(cd[pos+32:]))
+		if pos+n > len(cd) {
+			return fmt.Errorf("invalid central directory in %q", zipPath)
+		}
+		records = append(records, append([]byte(nil), cd[pos:pos+n]...))
+		pos += n
+	}
+
+	// Entries are laid out in the order they were written, which isn't necessarily the order of
+	// the central directory.
+	order := make([]int, len(records))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return le.Uint32(records[order[i]][42:]) < le.Uint32(records[order[j]][42:])
+	})
+	for _, i := range order {
+		record := records[i]
+		offset := int64(le.Uint32(record[42:]))
+		local := make([]byte, localHeaderLen)
+		if _, err := f.ReadAt(local, offset); err != nil || le.Uint32(local) != localHeaderSig {
+			return fmt.Errorf("invalid local header at offset %d in %q", offset, zipPath)
+		}
+		n := int64(localHeaderLen + int(le.Uint16(local[26:])) + int(le.Uint16(local[28:])))
+		volume, rel := volumes.place(sigLen+offset, n)
+		le.PutUint16(record[34:], uint16(volume))
+		le.PutUint32(record[42:], uint32(rel))
+	}
+
+	tail := &bytes.Buffer{}
+	pos := sigLen + cdOffset
+	recordVolumes := make([]int, len(records))
+	cdVolume, cdRel := volumes.place(pos, 0)
+	for i, record := range records {
+		volume, rel := volumes.place(pos, int64(len(record)))
+		if i == 0 {
+			cdVolume, cdRel = volume, rel
+		}
+		recordVolumes[i] = volume
+		tail.Write(record)
+		pos += int64(len(record))
+	}
+
+	eocdVolume, _ := volumes.place(pos, int64(len(eocd)))
+	onLast := 0
+	for _, volume := range recordVolumes {
+		if volume == eocdVolume {
+			onLast++
+		}
+	}
+	eocd = append([]byte(nil), eocd...)
+	le.PutUint16(eocd[4:], uint16(eocdVolume))
+	le.PutUint16(eocd[6:], uint16(cdVolume))
+	le.PutUint16(eocd[8:], uint16(onLast))
+	le.PutUint32(eocd[16:], uint32(cdRel))
+	tail.Write(eocd)
+	pos += int64(len(eocd))
+
+	if len(volumes.starts) > 0xffff {
+		return fmt.Errorf("can't split %q into more than %d volumes", zipPath, 0xffff)
+	}
+
+	var sig [sigLen]byte
+	le.PutUint32(sig[:], splitSignature)
+	r := io.MultiReader(bytes.NewReader(sig[:]), io.NewSectionReader(f, 0, cdOffset), tail)
+
+	n := len(volumes.starts)
+	tmpLast := zipPath + ".tmp"
+	for i, start := range volumes.starts {
+		end := pos
+		if i+1 < n {
+			end = volumes.starts[i+1]
+		}
+		name := SplitVolumeName(zipPath, i+1, n)
+		if i+1 == n {
+			// The last volume replaces the zip file once it has been read completely.
+			name = tmpLast
+		}
+		if err := writeVolume(name, r, end-start); err != nil {
+			return err
+		}
+	}
+
+	f.Close()
+	return os.Rename(tmpLast, zipPath)
+}
+
+func writeVolume(name string, r io.Reader, n int64) error {
+	out, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(out, r, n)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	return err
+}
+
+// readEndOfCentralDirectory returns the end of central directory record of the zip file r of size
+// bytes, including the zip file comment, and its offset.
+func readEndOfCentralDirectory(r io.ReaderAt, size int64) ([]byte, int64, error) {
+	// The record is at the end of the file, followed only by a comment of up to 64KB.
+	bufLen := int64(endOfCentralLen + 0xffff)
+	if bufLen > size {
+		bufLen = size
+	}
+	buf := make([]byte, bufLen)
+	if _, err := r.ReadAt(buf, size-bufLen); err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	for i := len(buf) - endOfCentralLen; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(buf[i:]) == endOfCentralSig &&
+			i+endOfCentralLen+int(binary.LittleEndian.Uint16(buf[i+20:])) == len(buf) {
+			return buf[i:], size - bufLen + int64(i), nil
+		}
+	}
+	return nil, 0, fmt.Errorf("end of central directory record not found")
+}
+
+// hasZip64Locator returns true if a zip64 end of central directory locator precedes the end of
+// central directory record at eocdOffset.
+func hasZip64Locator(r io.ReaderAt, eocdOffset int64) bool {
+	if eocdOffset < zip64LocatorLen {
+		return false
+	}
+	var buf [4]byte
+	if _, err := r.ReadAt(buf[:], eocdOffset-zip64LocatorLen); err != nil {
+		return false
+	}
+	return binary.LittleEndian.Uint32(buf[:]) == zip64LocatorSig
+}
@@ -0,0 +1,192 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"android/soong/third_party/zip"
+)
+
+// joinSplitZip joins the volumes of a split archive back into a single zip file, the way
+// "zip -s 0" does, checking that no header spans volumes.
+func joinSplitZip(t *testing.T, volumes [][]byte, splitSize int64) []byte {
+	t.Helper()
+	le := binary.LittleEndian
+
+	var starts []int64
+	var joined []byte
+	for i, v := range volumes {
+		if int64(len(v)) > splitSize {
+			t.Errorf("volume %d: want at most %d bytes, got %d", i+1, splitSize, len(v))
+		}
+		starts = append(starts, int64(len(joined)))
+		joined = append(joined, v...)
+	}
+	if got := le.Uint32(joined); got != splitSignature {
+		t.Fatalf("want split signature %x, got %x", splitSignature, got)
+	}
+	abs := func(volume uint16, offset uint32) int64 {
+		return starts[volume] + int64(offset)
+	}
+
+	last := volumes[len(volumes)-1]
+	eocd, _, err := readEndOfCentralDirectory(bytes.NewReader(last), int64(len(last)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := int(le.Uint16(eocd[4:])), len(volumes)-1; got != want {
+		t.Errorf("want end of central directory on volume %d, got %d", want, got)
+	}
+	cdStart := abs(le.Uint16(eocd[6:]), le.Uint32(eocd[16:]))
+	cdSize := int64(le.Uint32(eocd[12:]))
+	cd := append([]byte(nil), joined[cdStart:cdStart+cdSize]...)
+
+	for pos := 0; pos < len(cd); {
+		volume := le.Uint16(cd[pos+34:])
+		offset := abs(volume, le.Uint32(cd[pos+42:]))
+		local := joined[offset:]
+		n := int64(localHeaderLen) + int64(le.Uint16(local[26:])) + int64(le.Uint16(local[28:]))
+		if int(volume)+1 < len(starts) && offset+n > starts[volume+1] {
+			t.Errorf("local header at %d spans volumes %d and %d", offset, volume, volume+1)
+		}
+		le.PutUint16(cd[pos+34:], 0)
+		le.PutUint32(cd[pos+42:], uint32(offset-4))
+		pos += centralHeaderLen + int(le.Uint16(cd[pos+28:])) + int(le.Uint16(cd[pos+30:])) +
+			int(le.Uint16(cd[pos+32:]))
+	}
+
+	eocd = append([]byte(nil), eocd...)
+	le.PutUint16(eocd[4:], 0)
+	le.PutUint16(eocd[6:], 0)
+	le.PutUint16(eocd[8:], le.Uint16(eocd[10:]))
+	le.PutUint32(eocd[16:], uint32(cdStart-4))
+
+	ret := append([]byte(nil), joined[4:cdStart]...)
+	ret = append(ret, cd...)
+	return append(ret, eocd...)
+}
+
+func TestSplitSize(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	contents := make(map[string][]byte)
+	b := fileArgsBuilder()
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("file%d", i)
+		contents[name] = make([]byte, 1000+rnd.Intn(40*1024))
+		rnd.Read(contents[name])
+		b.ReaderFile(name, bytes.NewReader(contents[name]))
+	}
+	fileArgs := b.FileArgs()
+
+	dir := t.TempDir()
+	zipFile := func(t *testing.T, out string, splitSize int64) {
+		t.Helper()
+		for _, fa := range fileArgs {
+			fa.Reader.(*bytes.Reader).Seek(0, 0)
+		}
+		args := ZipArgs{}
+		args.FileArgs = fileArgs
+		args.OutputFilePath = out
+		args.CompressionLevel = 9
+		args.SplitSize = splitSize
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+		if err := Zip(args); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+	}
+
+	whole := filepath.Join(dir, "whole.zip")
+	zipFile(t, whole, 0)
+	want, err := ioutil.ReadFile(whole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	split := filepath.Join(dir, "split.zip")
+	zipFile(t, split, MinSplitSize)
+	var volumes [][]byte
+	for i := 1; ; i++ {
+		volume, err := ioutil.ReadFile(SplitVolumeName(split, i, 0))
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		volumes = append(volumes, volume)
+	}
+	last, err := ioutil.ReadFile(split)
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumes = append(volumes, last)
+	if min := len(want)/MinSplitSize + 1; len(volumes) < min {
+		t.Fatalf("want at least %d volumes, got %d", min, len(volumes))
+	}
+
+	joined := joinSplitZip(t, volumes, MinSplitSize)
+	if !bytes.Equal(joined, want) {
+		t.Fatal("want joined volumes to be the same as the unsplit zip file")
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(joined), int64(len(joined)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", f.Name, err)
+		}
+		if !bytes.Equal(got, contents[f.Name]) {
+			t.Errorf("%s: contents don't round trip", f.Name)
+		}
+	}
+
+	t.Run("single volume", func(t *testing.T) {
+		small := filepath.Join(dir, "small.zip")
+		zipFile(t, small, int64(len(want)))
+		got, err := ioutil.ReadFile(small)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Error("want a zip file that fits in a volume to be left as is")
+		}
+		if _, err := os.Stat(SplitVolumeName(small, 1, 0)); !os.IsNotExist(err) {
+			t.Errorf("want no other volumes, got %v", err)
+		}
+	})
+
+	t.Run("too small", func(t *testing.T) {
+		args := ZipArgs{OutputFilePath: filepath.Join(dir, "err.zip"), SplitSize: 1000}
+		if err := Zip(args); err == nil {
+			t.Error("want error for a split size below MinSplitSize")
+		}
+	})
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"android/soong/third_party/zip"
+)
+
+// Stats describes the entries written to a zip file.
+type Stats struct {
+	// EntryCount is the number of entries in the zip file, including directories and symlinks.
+	EntryCount int
+	// UncompressedBytes is the total size of the entries before compression.
+	UncompressedBytes uint64
+	// CompressedBytes is the total size of the entry data in the zip file, excluding headers.
+	CompressedBytes uint64
+	// MethodCounts is the number of entries written with each zip method ID.
+	MethodCounts map[uint16]int
+	// SharedDictionarySavedBytes is how many fewer bytes the entries compressed with
+	// SharedDictionaryMethod took than they would have without the shared dictionary.  Entries
+	// that were streamed because they were larger than LargeFileThreshold aren't included.
+	SharedDictionarySavedBytes int64
+	// DeduplicatedEntries is the number of entries whose compressed contents were copied from
+	// another entry with the same contents by ZipArgs.DeduplicateContents, or from the first
+	// entry of the same FileArg DestFiles source file, instead of compressing them again, or that
+	// were stored as symlinks by ZipArgs.DuplicatesAsSymlinks.
+	DeduplicatedEntries int
+	// PeakInFlightBytes is the largest total uncompressed size of files that were held in memory
+	// at once while they were compressed and written.
+	PeakInFlightBytes int64
+	// SkippedFiles are the source files that were left out of the zip file because they couldn't
+	// be read, with ZipArgs.SkipUnreadable.
+	SkippedFiles []string
+	// SkippedExistingEntries are the names of the entries that were left out because the zip file
+	// being appended to already had them, with ZipArgs.AddIfMissing.
+	SkippedExistingEntries []string
+	// CachedEntries is the number of entries whose compressed contents were copied from
+	// ZipArgs.CacheDir instead of compressing them again.
+	CachedEntries int
+}
+
+// CompressionRatio returns CompressedBytes divided by UncompressedBytes, or 1 if there were no
+// uncompressed bytes.
+func (s *Stats) CompressionRatio() float64 {
+	if s.UncompressedBytes == 0 {
+		return 1
+	}
+	return float64(s.CompressedBytes) / float64(s.UncompressedBytes)
+}
+
+// add records an entry.  It must only be called once the entry has been completely written, as
+// the compressed size is not known until then.
+func (s *Stats) add(fh *zip.FileHeader) {
+	if s.MethodCounts == nil {
+		s.MethodCounts = make(map[uint16]int)
+	}
+	s.EntryCount++
+	s.UncompressedBytes += fh.UncompressedSize64
+	s.CompressedBytes += fh.CompressedSize64
+	s.MethodCounts[fh.Method]++
+}
+
+// Print writes a human readable summary of the stats to w.
+func (s *Stats) Print(w io.Writer) {
+	fmt.Fprintf(w, "entries: %d\n", s.EntryCount)
+	fmt.Fprintf(w, "uncompressed bytes: %d\n", s.UncompressedBytes)
+	fmt.Fprintf(w, "compressed bytes: %d\n", s.CompressedBytes)
+	fmt.Fprintf(w, "compression ratio: %.3f\n", s.CompressionRatio())
+	if s.MethodCounts[SharedDictionaryMethod] > 0 {
+		fmt.Fprintf(w, "shared dictionary saved bytes: %d\n", s.SharedDictionarySavedBytes)
+	}
+	if s.DeduplicatedEntries > 0 {
+		fmt.Fprintf(w, "deduplicated entries: %d\n", s.DeduplicatedEntries)
+	}
+	if s.CachedEntries > 0 {
+		fmt.Fprintf(w, "cached entries: %d\n", s.CachedEntries)
+	}
+	if len(s.SkippedFiles) > 0 {
+		fmt.Fprintf(w, "skipped unreadable files: %d\n", len(s.SkippedFiles))
+	}
+	if len(s.SkippedExistingEntries) > 0 {
+		fmt.Fprintf(w, "skipped existing entries: %d\n", len(s.SkippedExistingEntries))
+	}
+
+	var methods []int
+	for method := range s.MethodCounts {
+		methods = append(methods, int(method))
+	}
+	sort.Ints(methods)
+	for _, method := range methods {
+		fmt.Fprintf(w, "method %s: %d\n", methodName(uint16(method)), s.MethodCounts[uint16(method)])
+	}
+}
+
+func methodName(method uint16) string {
+	switch method {
+	case zip.Store:
+		return "store"
+	case zip.Deflate:
+		return "deflate"
+	case ZstdMethod:
+		return "zstd"
+	case Bzip2Method:
+		return "bzip2"
+	case SharedDictionaryMethod:
+		return "deflate-shared-dict"
+	case AESMethod:
+		return "aes"
+	default:
+		return fmt.Sprintf("%d", method)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"compress/flate"
+	"hash/crc32"
+	"io"
+
+	"android/soong/third_party/zip"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+// streamFile sends ze to compressChan with a reader that produces the compressed contents of r as
+// the write goroutine consumes them, so that the compressed file is never held in memory.
+// Compressed entries are written with a data descriptor, which receives the CRC once the whole
+// file has been compressed.  Stored entries have no data descriptor, so r is read once to compute
+// the CRC before it is copied to the zip file.  The cpuRateLimiter must have been requested.
+func (z *ZipWriter) streamFile(ze *zipEntry, r pathtools.ReaderAtSeekerCloser, compressChan chan *zipEntry) {
+	defer r.Close()
+	defer z.cpuRateLimiter.Finish()
+
+	if ze.fh.Method == zip.Store {
+		crc := crc32.NewIEEE()
+		if _, err := io.Copy(crc, r); err != nil {
+			z.errors <- err
+			return
+		}
+		ze.fh.CRC32 = crc.Sum32()
+
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			z.errors <- err
+			return
+		}
+	}
+
+	// The write loop may change the method of the header once it has the entry, like it does for
+	// encrypted entries, so the data is compressed with the method it had when it was queued.
+	method := ze.fh.Method
+
+	pr, pw := io.Pipe()
+
+	ze.futureReaders = make(chan chan io.Reader, 1)
+	futureReader := make(chan io.Reader, 1)
+	ze.futureReaders <- futureReader
+	close(ze.futureReaders)
+	futureReader <- pr
+	close(futureReader)
+
+	compressChan <- ze
+	close(compressChan)
+
+	// Closing the pipe with a nil error makes the write goroutine see io.EOF, any other error is
+	// returned from its copy.
+	pw.CloseWithError(z.streamContents(pw, r, ze.fh, method, ze.compLevel))
+}
+
+// streamContents writes the contents of r to w, compressed with method at level, and sets the CRC
+// of fh for compressed entries once all of r has been read.
+func (z *ZipWriter) streamContents(w io.Writer, r io.Reader, fh *zip.FileHeader, method uint16,
+	level int) error {
+
+	if method == zip.Store {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	var cw io.WriteCloser
+	var err error
+	switch method {
+	case ZstdMethod:
+		cw, err = z.newZstdWriter(w, level)
+	case Bzip2Method:
+		cw, err = z.newBzip2Writer(w, level)
+	case SharedDictionaryMethod:
+		cw, err = flate.NewWriterDict(w, level, z.sharedDictionary)
+	default:
+		cw, err = flate.NewWriter(w, z.flateLevel(level))
+	}
+	if err != nil {
+		return err
+	}
+
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(cw, io.TeeReader(r, crc)); err != nil {
+		cw.Close()
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+
+	fh.CRC32 = crc.Sum32()
+	return nil
+}
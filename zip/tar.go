@@ -0,0 +1,157 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"android/soong/third_party/zip"
+)
+
+type FromTarOptions struct {
+	// CompressionLevel is the deflate compression level of regular files, from 0 (store) to 9, or
+	// -1 for the default compression level.
+	CompressionLevel int
+
+	// Stderr receives warnings about skipped entries, and defaults to os.Stderr.
+	Stderr io.Writer
+}
+
+// gzipMagic is the start of every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// FromTar writes a zip file to out that contains the regular files, directories and symlinks of
+// the tar stream in r, in the order they appear in it.  The stream is decompressed first if it
+// starts with a gzip header, including all of the members of a stream of concatenated gzip members,
+// as produced by concatenating .tar.gz files or by parallel gzip tools.  Long names from GNU and PAX headers are used, and the permissions,
+// including the type bits, and modification times of the tar entries are kept, with times later
+// than SOURCE_DATE_EPOCH, if it is set, clamped to it and times before 1980 clamped to 1980-01-01
+// UTC.  Symlinks are stored with their target as their contents, like
+// ZipArgs.StoreSymlinks.  Hard links, devices, FIFOs and other entry types are skipped with a
+// warning.  Names are cleaned, and names that would be outside of the zip file are rejected with a
+// DestinationOutsideZipError.
+func FromTar(out io.Writer, r io.Reader, opts FromTarOptions) error {
+	if err := validCompressionLevel(opts.CompressionLevel); err != nil {
+		return err
+	}
+
+	epoch, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+
+	stderr := opts.Stderr
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(gzipMagic)); err == nil && string(magic) == string(gzipMagic) {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		// Read past the end of the first member, this is the default but stopping there would
+		// silently truncate the tar stream.
+		gr.Multistream(true)
+		r = gr
+	} else {
+		r = br
+	}
+
+	zipw := zip.NewWriter(out)
+	zipw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, opts.CompressionLevel)
+	})
+
+	written := make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeDir, tar.TypeSymlink:
+		case tar.TypeXGlobalHeader:
+			// archive/tar applies PAX headers to the entries they precede, global ones only
+			// carry defaults and aren't entries themselves.
+			continue
+		default:
+			fmt.Fprintf(stderr, "warning: skipping %q with unsupported tar type %q\n",
+				hdr.Name, hdr.Typeflag)
+			continue
+		}
+
+		name := path.Clean(hdr.Name)
+		if name == "." || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return DestinationOutsideZipError{Path: hdr.Name, Dest: name}
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			name += "/"
+		}
+
+		if written[name] {
+			if hdr.Typeflag == tar.TypeDir {
+				continue
+			}
+			return fmt.Errorf("tar file contains %q more than once", name)
+		}
+		written[name] = true
+
+		fh := &zip.FileHeader{
+			Name:   name,
+			Method: zip.Deflate,
+		}
+		fh.SetModTime(clampTimestamp(clampToEpoch(hdr.ModTime, epoch)))
+		fh.SetMode(hdr.FileInfo().Mode())
+
+		var contents io.Reader = tr
+		switch {
+		case hdr.Typeflag == tar.TypeDir:
+			fh.Method = zip.Store
+			contents = nil
+		case hdr.Typeflag == tar.TypeSymlink:
+			fh.Method = zip.Store
+			contents = strings.NewReader(hdr.Linkname)
+		case opts.CompressionLevel == 0:
+			fh.Method = zip.Store
+		}
+
+		w, err := zipw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		if contents != nil {
+			if _, err := io.Copy(w, contents); err != nil {
+				return fmt.Errorf("failed to copy %q: %s", hdr.Name, err)
+			}
+		}
+	}
+
+	return zipw.Close()
+}
@@ -0,0 +1,219 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"android/soong/third_party/zip"
+)
+
+// writeTestTar returns a tar stream containing hdrs, with the contents of regular files taken from
+// contents.
+func writeTestTar(t *testing.T, hdrs []*tar.Header, contents map[string]string) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range hdrs {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(contents[hdr.Name]))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(contents[hdr.Name])); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	if _, err := gw.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFromTar(t *testing.T) {
+	mtime := time.Date(2019, 3, 4, 5, 6, 8, 0, time.UTC)
+	longName := "dir/" + strings.Repeat("long", 40) + ".txt"
+
+	hdrs := []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime},
+		{Name: "dir/exe", Typeflag: tar.TypeReg, Mode: 0755, ModTime: mtime},
+		{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file", Mode: 0777, ModTime: mtime},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, ModTime: mtime},
+		{Name: "old", Typeflag: tar.TypeReg, Mode: 0644, ModTime: time.Unix(0, 0)},
+		{Name: longName, Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime, Format: tar.FormatGNU},
+		{Name: "pax/" + longName, Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime, Format: tar.FormatPAX},
+	}
+	contents := map[string]string{
+		"dir/file":        "file contents",
+		"dir/exe":         "#!/bin/sh\n",
+		"old":             "",
+		longName:          strings.Repeat("gnu ", 100),
+		"pax/" + longName: strings.Repeat("pax ", 100),
+	}
+
+	type wantEntry struct {
+		name     string
+		mode     os.FileMode
+		contents string
+		mtime    time.Time
+	}
+	want := []wantEntry{
+		{"dir/", 0755 | os.ModeDir, "", mtime},
+		{"dir/file", 0644, "file contents", mtime},
+		{"dir/exe", 0755, "#!/bin/sh\n", mtime},
+		{"dir/link", 0777 | os.ModeSymlink, "file", mtime},
+		{"old", 0644, "", minTimestamp},
+		{longName, 0644, contents[longName], mtime},
+		{"pax/" + longName, 0644, contents["pax/"+longName], mtime},
+	}
+
+	tarFile := writeTestTar(t, hdrs, contents)
+
+	for _, compressed := range []bool{false, true} {
+		name := "tar"
+		input := tarFile
+		if compressed {
+			name = "tar.gz"
+			input = gzipBytes(t, tarFile)
+		}
+
+		t.Run(name, func(t *testing.T) {
+			stderr := &bytes.Buffer{}
+			buf := &bytes.Buffer{}
+			err := FromTar(buf, bytes.NewReader(input), FromTarOptions{CompressionLevel: 5, Stderr: stderr})
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if want := `warning: skipping "dev/null" with unsupported tar type '3'`; !strings.Contains(stderr.String(), want) {
+				t.Errorf("want warning %q, got %q", want, stderr.String())
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(zr.File) != len(want) {
+				t.Fatalf("want %d entries, got %d", len(want), len(zr.File))
+			}
+			for i, f := range zr.File {
+				w := want[i]
+				if f.Name != w.name {
+					t.Errorf("entry %d: want name %q, got %q", i, w.name, f.Name)
+					continue
+				}
+				if f.Mode() != w.mode {
+					t.Errorf("%s: want mode %v, got %v", f.Name, w.mode, f.Mode())
+				}
+				if !f.ModTime().Equal(w.mtime) {
+					t.Errorf("%s: want time %v, got %v", f.Name, w.mtime, f.ModTime())
+				}
+				r, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatalf("%s: %s", f.Name, err)
+				}
+				if string(got) != w.contents {
+					t.Errorf("%s: want contents %q, got %q", f.Name, w.contents, got)
+				}
+			}
+		})
+	}
+
+	t.Run("multiple gzip members", func(t *testing.T) {
+		// Split the tar stream between two of its 512 byte blocks, after the first entries.
+		split := 3 * 512
+		input := append(gzipBytes(t, tarFile[:split]), gzipBytes(t, tarFile[split:])...)
+
+		buf := &bytes.Buffer{}
+		err := FromTar(buf, bytes.NewReader(input), FromTarOptions{Stderr: &bytes.Buffer{}})
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(zr.File) != len(want) {
+			t.Fatalf("want %d entries, got %d", len(want), len(zr.File))
+		}
+		for i, f := range zr.File {
+			if f.Name != want[i].name {
+				t.Errorf("entry %d: want name %q, got %q", i, want[i].name, f.Name)
+			}
+		}
+	})
+
+	t.Run("SOURCE_DATE_EPOCH", func(t *testing.T) {
+		t.Setenv("SOURCE_DATE_EPOCH", "1500000000")
+		buf := &bytes.Buffer{}
+		err := FromTar(buf, bytes.NewReader(tarFile), FromTarOptions{Stderr: &bytes.Buffer{}})
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		epoch := time.Unix(1500000000, 0)
+		for _, f := range zr.File {
+			want := epoch
+			if f.Name == "old" {
+				want = minTimestamp
+			}
+			if !f.ModTime().Equal(want) {
+				t.Errorf("%s: want time %v, got %v", f.Name, want, f.ModTime())
+			}
+		}
+	})
+
+	t.Run("outside of the zip", func(t *testing.T) {
+		input := writeTestTar(t, []*tar.Header{{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644}}, nil)
+		err := FromTar(&bytes.Buffer{}, bytes.NewReader(input), FromTarOptions{Stderr: &bytes.Buffer{}})
+		if _, ok := err.(DestinationOutsideZipError); !ok {
+			t.Errorf("want DestinationOutsideZipError, got %v", err)
+		}
+	})
+}
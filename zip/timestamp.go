@@ -0,0 +1,113 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"time"
+
+	"android/soong/third_party/zip"
+)
+
+// Flags of the extended timestamp extra field (zip.ExtendedTimeStampTag) for the times that the
+// local version of the field holds.  The central version has the same flags, but only the mtime.
+const (
+	extendedTimeMtime = 0x1
+	extendedTimeAtime = 0x2
+)
+
+// unixTime32 returns t as the signed 32 bit Unix time stored in the extended timestamp field,
+// clamped to the times that it can hold.
+func unixTime32(t time.Time) uint32 {
+	secs := t.Unix()
+	if secs > math.MaxInt32 {
+		secs = math.MaxInt32
+	} else if secs < math.MinInt32 {
+		secs = math.MinInt32
+	}
+	return uint32(int32(secs))
+}
+
+// extendedTimestampExtra returns the local version of the extended timestamp extra field with
+// mtime, and atime if it isn't zero.
+func extendedTimestampExtra(mtime, atime time.Time) []byte {
+	flags := byte(extendedTimeMtime)
+	size := 5
+	if !atime.IsZero() {
+		flags |= extendedTimeAtime
+		size += 4
+	}
+
+	b := make([]byte, 4+size)
+	binary.LittleEndian.PutUint16(b[0:], zip.ExtendedTimeStampTag)
+	binary.LittleEndian.PutUint16(b[2:], uint16(size))
+	b[4] = flags
+	binary.LittleEndian.PutUint32(b[5:], unixTime32(mtime))
+	if !atime.IsZero() {
+		binary.LittleEndian.PutUint32(b[9:], unixTime32(atime))
+	}
+	return b
+}
+
+// extendedTimestamp returns the local version of the extended timestamp extra field for a file
+// with the given stat, or nil if extended timestamps aren't being stored.  Both times are the
+// Timestamp override if there is one, and entries without a stat only get the DOS timestamp of
+// the entry as their mtime.  The times of the stat are clamped to SOURCE_DATE_EPOCH if it is set.
+func (z *ZipWriter) extendedTimestamp(info os.FileInfo) []byte {
+	if !z.extendedTime {
+		return nil
+	}
+
+	if !z.timestampOverride.IsZero() {
+		return extendedTimestampExtra(z.timestampOverride, z.timestampOverride)
+	}
+
+	if info == nil {
+		return extendedTimestampExtra(z.time, time.Time{})
+	}
+
+	mtime := clampToEpoch(info.ModTime(), z.sourceDateEpoch)
+	atime, _, ok := statTimes(info)
+	if !ok {
+		return extendedTimestampExtra(mtime, time.Time{})
+	}
+	return extendedTimestampExtra(mtime, clampToEpoch(atime, z.sourceDateEpoch))
+}
+
+// centralExtendedTimestamp returns a copy of extra with the local version of the extended
+// timestamp field replaced by the central version, which keeps the flags and the mtime.
+func centralExtendedTimestamp(extra []byte) []byte {
+	ret := make([]byte, 0, len(extra))
+	for len(extra) >= 4 {
+		tag := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		if tag == zip.ExtendedTimeStampTag && size >= 5 {
+			field := make([]byte, 9)
+			binary.LittleEndian.PutUint16(field[0:], tag)
+			binary.LittleEndian.PutUint16(field[2:], 5)
+			copy(field[4:], extra[4:9])
+			ret = append(ret, field...)
+		} else {
+			ret = append(ret, extra[:4+size]...)
+		}
+		extra = extra[4+size:]
+	}
+	return append(ret, extra...)
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"android/soong/third_party/zip"
+)
+
+// EntryError is an entry of a zip file that failed verification.
+type EntryError struct {
+	Name string
+	Err  error
+}
+
+func (e EntryError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, e.Err)
+}
+
+// VerifyArchive decompresses every entry of the zip file at path and returns the entries that
+// couldn't be read or whose contents don't match their CRC32, in the order of the central
+// directory.  Entries compressed with ZstdMethod and Bzip2Method can be read, entries encrypted
+// with AESMethod or compressed with SharedDictionaryMethod can't.  The error is only set if the
+// zip file itself can't be read.
+func VerifyArchive(path string) ([]EntryError, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return verifyEntries(&r.Reader), nil
+}
+
+// verifyZip decompresses every entry in r, which was read from name, and returns an error listing
+// the entries that couldn't be read or whose contents don't match their CRC32.
+func verifyZip(name string, r *zip.Reader) error {
+	var failed []string
+	for _, err := range verifyEntries(r) {
+		failed = append(failed, err.Error())
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%s failed verification:\n  %s", name, strings.Join(failed, "\n  "))
+	}
+	return nil
+}
+
+func verifyEntries(r *zip.Reader) []EntryError {
+	var failed []EntryError
+	for _, f := range r.File {
+		if err := verifyEntry(f); err != nil {
+			failed = append(failed, EntryError{Name: f.Name, Err: err})
+		}
+	}
+	return failed
+}
+
+// verifyEntry reads the contents of f, which checks them against the CRC32 of f.
+func verifyEntry(f *zip.File) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
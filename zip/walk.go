@@ -0,0 +1,231 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+// Maximum directory depth followed by globDir, matching the limit used by pathtools when listing
+// directories recursively.  It prevents infinite recursion through symlink loops.
+const maxWalkDepth = 255
+
+// globDir returns the files and directories under fa.GlobDir in the same order as a
+// fa.GlobDir/**/* glob would, skipping hidden files and directories.  Entries whose path relative
+// to fa.SourcePrefixToStrip matches one of the exclude patterns are skipped, and excluded
+// directories are not descended into.  Symlinks to directories are only descended into when
+// symlinks are being followed instead of stored.
+//
+// Subdirectories are listed concurrently, with at most parallelJobs directories being read at a
+// time, but the results are always returned in the same order.  If ignoreErrors is set,
+// directories that can't be read are reported as warnings and skipped.  If .zipignore files are
+// enabled, the patterns in the .zipignore file in fa.SourcePrefixToStrip also skip entries the
+// same way as excludes.
+func (z *ZipWriter) globDir(fa FileArg, excludes []string, parallelJobs int, ignoreErrors bool) ([]string, error) {
+	if parallelJobs < 1 {
+		parallelJobs = 1
+	}
+
+	root := fa.SourcePrefixToStrip
+	if root == "" {
+		root = "."
+	}
+
+	var ignore zipIgnore
+	if z.zipIgnore {
+		var err error
+		ignore, err = z.readZipIgnore(root)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// readDir returns the entries of dir that should be returned, and the subset of them that
+	// should be descended into.  unreadable is true if the error was returned when reading the
+	// directory.
+	readDir := func(dir string) (entries, subdirs []string, unreadable bool, err error) {
+		names, err := z.fs.ReadDirNames(dir)
+		if err != nil {
+			return nil, nil, true, err
+		}
+
+		for _, name := range names {
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+			if z.skipMacOSCruft && name == "__MACOSX" {
+				continue
+			}
+
+			path := filepath.Join(dir, name)
+
+			excluded, err := matchesExclude(fa, path, excludes)
+			if err != nil {
+				return nil, nil, false, err
+			} else if excluded {
+				continue
+			}
+
+			var info os.FileInfo
+			var statErr error
+			if z.followSymlinks {
+				info, statErr = z.fs.Stat(path)
+			} else {
+				info, statErr = z.fs.Lstat(path)
+			}
+			isDir := statErr == nil && info.IsDir()
+
+			if ignore != nil {
+				rel, err := filepath.Rel(root, path)
+				if err != nil {
+					return nil, nil, false, err
+				}
+				if ignored, err := ignore.ignored(rel, isDir); err != nil {
+					return nil, nil, false, err
+				} else if ignored {
+					continue
+				}
+			}
+
+			// Dangling symlinks are returned by the glob, let addFile report them.
+			entries = append(entries, path)
+			if isDir {
+				subdirs = append(subdirs, path)
+			}
+		}
+
+		return entries, subdirs, false, nil
+	}
+
+	// Directories waiting to be read are kept on a stack shared by the workers, each directory's
+	// results are stored in its node of the tree so that they can be put back in order.
+	rootNode := &walkNode{dir: fa.GlobDir}
+	stack := []*walkNode{rootNode}
+	pending := 1
+	var lock sync.Mutex
+	cond := sync.NewCond(&lock)
+
+	worker := func() {
+		lock.Lock()
+		defer lock.Unlock()
+
+		for {
+			for len(stack) == 0 && pending > 0 {
+				cond.Wait()
+			}
+			if pending == 0 {
+				return
+			}
+
+			node := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			lock.Unlock()
+			var subdirs []string
+			node.entries, subdirs, node.unreadable, node.err = readDir(node.dir)
+			lock.Lock()
+
+			if node.err == nil && node.depth < maxWalkDepth {
+				for _, subdir := range subdirs {
+					child := &walkNode{dir: subdir, depth: node.depth + 1}
+					node.children = append(node.children, child)
+					stack = append(stack, child)
+				}
+				pending += len(subdirs)
+			}
+			pending--
+			cond.Broadcast()
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallelJobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker()
+		}()
+	}
+	wg.Wait()
+
+	var ret []string
+	var flatten func(node *walkNode) error
+	flatten = func(node *walkNode) error {
+		if node.err != nil {
+			if !ignoreErrors || !node.unreadable {
+				return node.err
+			}
+			z.warnf("%s", node.err)
+			return nil
+		}
+		ret = append(ret, node.entries...)
+		for _, child := range node.children {
+			if err := flatten(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := flatten(rootNode); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// walkNode holds the results of reading a directory in globDir.
+type walkNode struct {
+	dir   string
+	depth int
+
+	entries    []string
+	children   []*walkNode
+	unreadable bool
+	err        error
+}
+
+// matchesExclude returns true if path, relative to the relative root of fa, matches any of the
+// exclude patterns.  Patterns follow pathtools.Match, so ** matches any number of directories.
+func matchesExclude(fa FileArg, path string, excludes []string) (bool, error) {
+	if len(excludes) == 0 {
+		return false, nil
+	}
+
+	rel := path
+	if fa.SourcePrefixToStrip != "" {
+		var err error
+		rel, err = filepath.Rel(fa.SourcePrefixToStrip, path)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	for _, exclude := range excludes {
+		match, err := pathtools.Match(exclude, rel)
+		if err != nil {
+			return false, err
+		}
+		if match {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
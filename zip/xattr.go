@@ -0,0 +1,123 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+// XattrTag is the ID of the extra field that StoreXattrs writes the extended attributes of a file
+// into.  The data of the field is a sequence of attributes sorted by name, each made of a 2 byte
+// little endian length of the name, the name, a 2 byte little endian length of the value and the
+// value.
+const XattrTag = 0x6178
+
+// xattr is an extended attribute of a file.
+type xattr struct {
+	name  string
+	value []byte
+}
+
+// xattrExtra returns the extra field with the extended attributes of xattrs.
+func xattrExtra(xattrs []xattr) ([]byte, error) {
+	sort.Slice(xattrs, func(i, j int) bool { return xattrs[i].name < xattrs[j].name })
+
+	var data []byte
+	for _, x := range xattrs {
+		if len(x.name) > 0xffff || len(x.value) > 0xffff {
+			return nil, fmt.Errorf("extended attribute %q is too large", x.name)
+		}
+		data = appendUint16(data, uint16(len(x.name)))
+		data = append(data, x.name...)
+		data = appendUint16(data, uint16(len(x.value)))
+		data = append(data, x.value...)
+	}
+	if len(data) > 0xffff {
+		return nil, fmt.Errorf("extended attributes are larger than an extra field")
+	}
+
+	b := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint16(b[0:], XattrTag)
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(data)))
+	return append(b, data...), nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+// parseXattrExtra returns the extended attributes in the XattrTag field of extra, if it has one.
+func parseXattrExtra(extra []byte) ([]xattr, error) {
+	for len(extra) >= 4 {
+		tag := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		if tag != XattrTag {
+			extra = extra[4+size:]
+			continue
+		}
+
+		var xattrs []xattr
+		data := extra[4 : 4+size]
+		for len(data) > 0 {
+			var name, value []byte
+			var ok bool
+			if name, data, ok = cutXattrField(data); !ok {
+				return nil, fmt.Errorf("truncated extended attribute extra field")
+			}
+			if value, data, ok = cutXattrField(data); !ok {
+				return nil, fmt.Errorf("truncated extended attribute extra field")
+			}
+			xattrs = append(xattrs, xattr{string(name), value})
+		}
+		return xattrs, nil
+	}
+	return nil, nil
+}
+
+// cutXattrField returns the length prefixed field at the start of data and the rest of data.
+func cutXattrField(data []byte) (field, rest []byte, ok bool) {
+	if len(data) < 2 {
+		return nil, nil, false
+	}
+	n := int(binary.LittleEndian.Uint16(data))
+	if len(data) < 2+n {
+		return nil, nil, false
+	}
+	return data[2 : 2+n], data[2+n:], true
+}
+
+// fileXattrExtra returns the extra field with the extended attributes of the source file src, or
+// nil if they aren't being stored, the file doesn't have any or they can't be read from the
+// filesystem.
+func (z *ZipWriter) fileXattrExtra(src string) ([]byte, error) {
+	if !z.storeXattrs || z.fs != pathtools.OsFs {
+		return nil, nil
+	}
+	xattrs, err := readXattrs(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the extended attributes of %q: %s", src, err)
+	}
+	if len(xattrs) == 0 {
+		return nil, nil
+	}
+	return xattrExtra(xattrs)
+}
@@ -0,0 +1,29 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+)
+
+// readXattrs returns no extended attributes, they are only read on Linux.
+func readXattrs(path string) ([]xattr, error) {
+	return nil, nil
+}
+
+// writeXattrs fails, extended attributes are only written on Linux.
+func writeXattrs(path string, xattrs []xattr) error {
+	return fmt.Errorf("restoring extended attributes is only supported on Linux")
+}
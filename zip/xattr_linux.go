@@ -0,0 +1,81 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// readXattrs returns the extended attributes of the file at path, or none if the filesystem
+// doesn't support them.
+func readXattrs(path string) ([]xattr, error) {
+	names, err := xattrCall(func(buf []byte) (int, error) { return syscall.Listxattr(path, buf) })
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var xattrs []xattr
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := xattrCall(func(buf []byte) (int, error) {
+			return syscall.Getxattr(path, string(name), buf)
+		})
+		if err == syscall.ENODATA {
+			// Removed since it was listed.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		xattrs = append(xattrs, xattr{string(name), value})
+	}
+	return xattrs, nil
+}
+
+// xattrCall calls f with a buffer large enough for its result, retrying if the result grew
+// between asking for its size and reading it.
+func xattrCall(f func(buf []byte) (int, error)) ([]byte, error) {
+	for {
+		n, err := f(nil)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n)
+		n, err = f(buf)
+		if err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// writeXattrs sets the extended attributes of the file at path.
+func writeXattrs(path string, xattrs []xattr) error {
+	for _, x := range xattrs {
+		if err := syscall.Setxattr(path, x.name, x.value, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
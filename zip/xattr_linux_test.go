@@ -0,0 +1,149 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"android/soong/third_party/zip"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+func TestXattrs(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	bin := filepath.Join(src, "bin")
+	if err := os.Mkdir(src, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(bin, fileA, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "plain"), fileB, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A revision 2 vfs_cap_data with the effective bit and CAP_NET_BIND_SERVICE permitted.
+	capability := []byte{
+		0x01, 0x00, 0x00, 0x02,
+		0x00, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	if err := syscall.Setxattr(bin, "security.capability", capability, 0); err != nil {
+		t.Skipf("can't set security.capability: %s", err)
+	}
+
+	out := filepath.Join(dir, "out.zip")
+	args := ZipArgs{}
+	args.FileArgs = NewFileArgsBuilder().SourcePrefixToStrip(src).Dir(src).FileArgs()
+	args.OutputFilePath = out
+	args.CompressionLevel = 9
+	args.StoreXattrs = true
+	args.Filesystem = pathtools.OsFs
+	args.Stderr = &bytes.Buffer{}
+	if err := Zip(args); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	zr, err := zip.OpenReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		xattrs, err := parseXattrExtra(f.Extra)
+		if err != nil {
+			t.Fatalf("%s: %s", f.Name, err)
+		}
+		var got []byte
+		for _, x := range xattrs {
+			if x.name == "security.capability" {
+				got = x.value
+			}
+		}
+		switch f.Name {
+		case "bin":
+			if !bytes.Equal(got, capability) {
+				t.Errorf("bin: want security.capability %x, got %x", capability, got)
+			}
+		case "plain":
+			if got != nil {
+				t.Errorf("plain: want no security.capability, got %x", got)
+			}
+		}
+	}
+
+	extracted := filepath.Join(dir, "extracted")
+	if err := Extract(out, extracted, ExtractOptions{Xattrs: true}); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	got, err := readXattrs(filepath.Join(extracted, "bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := readXattrs(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want extracted extended attributes %q, got %q", want, got)
+	}
+
+	withoutXattrs := filepath.Join(dir, "without")
+	if err := Extract(out, withoutXattrs, ExtractOptions{}); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if got, err := readXattrs(filepath.Join(withoutXattrs, "bin")); err != nil || len(got) > 0 {
+		t.Errorf("want no extended attributes without Xattrs, got %q, %v", got, err)
+	}
+}
+
+func TestXattrExtra(t *testing.T) {
+	xattrs := []xattr{
+		{"user.b", []byte("2")},
+		{"security.capability", []byte{1, 2, 3}},
+		{"user.a", nil},
+	}
+	extra, err := xattrExtra(xattrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Surround it with other fields to check it is found.
+	extra = append(append(unixOwnershipExtra(1, 2), extra...), unixOwnershipExtra(3, 4)...)
+	got, err := parseXattrExtra(extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []xattr{
+		{"security.capability", []byte{1, 2, 3}},
+		{"user.a", []byte{}},
+		{"user.b", []byte("2")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if _, err := parseXattrExtra([]byte{0x78, 0x61, 3, 0, 5, 0, 'a'}); err == nil {
+		t.Error("want error for a truncated field")
+	}
+}
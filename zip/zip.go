@@ -17,19 +17,27 @@ package zip
 import (
 	"bytes"
 	"compress/flate"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"log"
+	"math"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/google/blueprint/pathtools"
 
@@ -64,13 +72,65 @@ type byteReaderCloser struct {
 type pathMapping struct {
 	dest, src string
 	zipMethod uint16
+
+	// reader, if set, provides the contents of the entry instead of src.
+	reader io.Reader
+
+	// comment is written into the central directory entry of the entry.
+	comment string
+
+	// compLevel is the compression level of the entry.
+	compLevel int
+
+	// autoLevel is set if the method and level of the entry are picked by sampling its contents.
+	autoLevel bool
+
+	// multiDest is set if the entry is one of the FileArg DestFiles of src, which share their
+	// compressed contents.
+	multiDest bool
 }
 
+// FileArg is a set of files to add to the zip file.  A source file of the form "archive!pattern"
+// adds the entries of the zip file archive whose names match pattern, as if they were source files
+// with those paths, see ArchiveSeparator.  Their contents are read from the zip file without
+// extracting them.
 type FileArg struct {
 	PathPrefixInZip, SourcePrefixToStrip string
 	SourceFiles                          []string
 	JunkPaths                            bool
 	GlobDir                              string
+
+	// JunkPathsExceptions are patterns matched against the source paths of the files when
+	// JunkPaths is set.  Matching files keep their source path under PathPrefixInZip instead of
+	// being flattened.  Patterns follow pathtools.Match.
+	JunkPathsExceptions []string
+
+	// StripComponents is the number of leading path components to drop from each path after
+	// SourcePrefixToStrip has been removed.  Files that would be left without a name are skipped
+	// with a warning.  It is ignored when JunkPaths is set.
+	StripComponents int
+
+	// Reader, if set, provides the contents of a single file at DestFile, and SourceFiles and
+	// GlobDir are ignored.
+	Reader io.Reader
+
+	// DestFile, if set, is the exact path in the zip of the single file in SourceFiles or Reader.  The file is
+	// not globbed, and PathPrefixInZip, SourcePrefixToStrip, JunkPaths and StripComponents don't
+	// apply to it.
+	DestFile string
+
+	// DestFiles, if set, are exact paths in the zip of the single file in SourceFiles, like
+	// DestFile.  The file is only read and compressed once, and its compressed contents are
+	// copied into the entry at each of the paths.  DestFile is ignored when it is set.
+	DestFiles []string
+
+	// Comment, if set, is written into the central directory entries of the files.
+	Comment string
+
+	// CompressionLevel, if set, is the compression level of the files instead of
+	// ZipArgs.CompressionLevel and any matching ZipArgs.CompressionLevelPatterns.  A level of 0
+	// stores the files uncompressed.
+	CompressionLevel *int
 }
 
 type FileArgsBuilder struct {
@@ -78,6 +138,9 @@ type FileArgsBuilder struct {
 	err   error
 	fs    pathtools.FileSystem
 
+	// prefixStack holds the SourcePrefixToStrip values replaced by PushSourcePrefixToStrip.
+	prefixStack []string
+
 	fileArgs []FileArg
 }
 
@@ -99,6 +162,58 @@ func (b *FileArgsBuilder) SourcePrefixToStrip(prefixToStrip string) *FileArgsBui
 	return b
 }
 
+// PushSourcePrefixToStrip sets the prefix to strip like SourcePrefixToStrip, and remembers the
+// current one so that PopSourcePrefixToStrip can restore it.
+func (b *FileArgsBuilder) PushSourcePrefixToStrip(prefixToStrip string) *FileArgsBuilder {
+	b.prefixStack = append(b.prefixStack, b.state.SourcePrefixToStrip)
+	return b.SourcePrefixToStrip(prefixToStrip)
+}
+
+// PopSourcePrefixToStrip restores the prefix to strip that was replaced by the last
+// PushSourcePrefixToStrip.  It is an error if there is no prefix left to restore.
+func (b *FileArgsBuilder) PopSourcePrefixToStrip() *FileArgsBuilder {
+	if len(b.prefixStack) == 0 {
+		if b.err == nil {
+			b.err = fmt.Errorf("cannot pop the relative root, none was pushed")
+		}
+		return b
+	}
+
+	prev := b.prefixStack[len(b.prefixStack)-1]
+	b.prefixStack = b.prefixStack[:len(b.prefixStack)-1]
+	return b.SourcePrefixToStrip(prev)
+}
+
+// JunkPathsExcept adds a pattern of source paths that keep their directories when the following
+// files have their paths junked, see FileArg.JunkPathsExceptions.  An empty pattern clears the
+// patterns.
+func (b *FileArgsBuilder) JunkPathsExcept(pattern string) *FileArgsBuilder {
+	if pattern == "" {
+		b.state.JunkPathsExceptions = nil
+		return b
+	}
+	// Copy the patterns so that they aren't shared with the FileArgs that were already added.
+	b.state.JunkPathsExceptions = append(append([]string(nil), b.state.JunkPathsExceptions...),
+		pattern)
+	return b
+}
+
+func (b *FileArgsBuilder) StripComponents(n int) *FileArgsBuilder {
+	b.state.StripComponents = n
+	return b
+}
+
+// Comment sets the comment of the entries of the following files, an empty comment stops adding
+// comments.
+func (b *FileArgsBuilder) Comment(comment string) *FileArgsBuilder {
+	if len(comment) > math.MaxUint16 {
+		b.err = fmt.Errorf("comment is %d bytes, longer than the maximum of %d bytes",
+			len(comment), math.MaxUint16)
+	}
+	b.state.Comment = comment
+	return b
+}
+
 func (b *FileArgsBuilder) PathPrefixInZip(rootPrefix string) *FileArgsBuilder {
 	b.state.PathPrefixInZip = rootPrefix
 	return b
@@ -115,6 +230,66 @@ func (b *FileArgsBuilder) File(name string) *FileArgsBuilder {
 	return b
 }
 
+// RenamedFile adds the file src at the path dest in the zip, regardless of the current relative
+// root, prefix or junk paths settings.
+func (b *FileArgsBuilder) RenamedFile(dest, src string) *FileArgsBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	arg := b.state
+	arg.SourceFiles = []string{src}
+	arg.DestFile = dest
+	b.fileArgs = append(b.fileArgs, arg)
+	return b
+}
+
+// MultiDestFile adds the file src at each of the paths dests in the zip, like RenamedFile, but
+// compresses it only once.
+func (b *FileArgsBuilder) MultiDestFile(src string, dests ...string) *FileArgsBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	arg := b.state
+	arg.SourceFiles = []string{src}
+	arg.DestFiles = dests
+	b.fileArgs = append(b.fileArgs, arg)
+	return b
+}
+
+// ReaderFile adds a file at the path dest in the zip with the contents read from r.  The contents
+// are read into memory when the zip file is written.
+func (b *FileArgsBuilder) ReaderFile(dest string, r io.Reader) *FileArgsBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	arg := b.state
+	arg.Reader = r
+	arg.DestFile = dest
+	b.fileArgs = append(b.fileArgs, arg)
+	return b
+}
+
+// SplitFileDest splits an argument of the form dest=src into its destination in the zip and its
+// source path.  dest is empty if there is no unescaped "=" in arg.  A "\=" in either part is
+// replaced with a literal "=".
+func SplitFileDest(arg string) (dest, src string) {
+	for i := 0; i < len(arg); i++ {
+		if arg[i] == '\\' && i+1 < len(arg) && arg[i+1] == '=' {
+			i++
+		} else if arg[i] == '=' {
+			return unescapeEquals(arg[:i]), unescapeEquals(arg[i+1:])
+		}
+	}
+	return "", unescapeEquals(arg)
+}
+
+func unescapeEquals(s string) string {
+	return strings.ReplaceAll(s, `\=`, "=")
+}
+
 func (b *FileArgsBuilder) Dir(name string) *FileArgsBuilder {
 	if b.err != nil {
 		return b
@@ -126,30 +301,111 @@ func (b *FileArgsBuilder) Dir(name string) *FileArgsBuilder {
 	return b
 }
 
+// RecursiveDir adds the files in the directory name like Dir, but fails if name exists and is not
+// a directory instead of deferring the error to ZipTo.  Missing directories are still handled by
+// ZipTo, so that ZipArgs.IgnoreMissingFiles applies to them.
+func (b *FileArgsBuilder) RecursiveDir(name string) *FileArgsBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	exists, isDir, err := b.fs.Exists(name)
+	if err != nil {
+		b.err = err
+		return b
+	} else if exists && !isDir {
+		b.err = fmt.Errorf("cannot recurse into %q: not a directory, use -f to add a single file", name)
+		return b
+	}
+
+	return b.Dir(name)
+}
+
 func (b *FileArgsBuilder) List(name string) *FileArgsBuilder {
 	if b.err != nil {
 		return b
 	}
 
-	f, err := b.fs.Open(name)
+	list, err := b.readList(name, nil)
 	if err != nil {
 		b.err = err
 		return b
 	}
-	defer f.Close()
 
-	list, err := ioutil.ReadAll(f)
+	arg := b.state
+	arg.SourceFiles = list
+	b.fileArgs = append(b.fileArgs, arg)
+	return b
+}
+
+// ListReader adds the files in a list read from r, like List does for a list file.  Entries of the
+// form @file are read relative to the current directory.
+func (b *FileArgsBuilder) ListReader(r io.Reader) *FileArgsBuilder {
+	if b.err != nil {
+		return b
+	}
+
+	list, err := b.parseList(r, nil)
 	if err != nil {
 		b.err = err
 		return b
 	}
 
 	arg := b.state
-	arg.SourceFiles = strings.Fields(string(list))
+	arg.SourceFiles = list
 	b.fileArgs = append(b.fileArgs, arg)
 	return b
 }
 
+// readList returns the whitespace separated entries in the list file name, replacing any entry of
+// the form @file with the entries of file, recursively.  parents contains the absolute paths of the
+// list files that are currently being expanded, and is used to reject include cycles while still
+// allowing the same file to be included more than once through different paths.
+func (b *FileArgsBuilder) readList(name string, parents []string) ([]string, error) {
+	absName, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, parent := range parents {
+		if parent == absName {
+			return nil, fmt.Errorf("list file %q includes itself", name)
+		}
+	}
+
+	f, err := b.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return b.parseList(f, append(parents, absName))
+}
+
+// parseList returns the whitespace separated entries read from r, expanding @file entries like
+// readList.  parents contains the absolute paths of the list files that contain r.
+func (b *FileArgsBuilder) parseList(r io.Reader, parents []string) ([]string, error) {
+	list, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for _, entry := range strings.Fields(string(list)) {
+		if strings.HasPrefix(entry, "@") {
+			included, err := b.readList(strings.TrimPrefix(entry, "@"), parents)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, included...)
+		} else {
+			ret = append(ret, entry)
+		}
+	}
+
+	return ret, nil
+}
+
 func (b *FileArgsBuilder) Error() error {
 	if b == nil {
 		return nil
@@ -173,11 +429,76 @@ func (x IncorrectRelativeRootError) Error() string {
 	return fmt.Sprintf("path %q is outside relative root %q", x.Path, x.RelativeRoot)
 }
 
+// StripComponentsError is returned by ComputeDest when stripping FileArg.StripComponents path
+// components from a source file leaves no name.
+type StripComponentsError struct {
+	Path       string
+	Components int
+}
+
+func (x StripComponentsError) Error() string {
+	return fmt.Sprintf("stripping %d path components of %q leaves no name", x.Components, x.Path)
+}
+
+// DestinationOutsideZipError is returned when the path in the zip of a file would be absolute or
+// would start with .. after being cleaned.
+type DestinationOutsideZipError struct {
+	Path string
+	Dest string
+}
+
+func (x DestinationOutsideZipError) Error() string {
+	return fmt.Sprintf("destination %q of %q is outside of the zip file", x.Dest, x.Path)
+}
+
+// BackslashInNameError is returned when the path in the zip of a file contains a backslash, which
+// some extractors, mostly on Windows, treat as a directory separator.
+type BackslashInNameError struct {
+	Path string
+	Dest string
+}
+
+func (x BackslashInNameError) Error() string {
+	return fmt.Sprintf("destination %q of %q contains a backslash, zip files separate directories with forward slashes",
+		x.Dest, x.Path)
+}
+
+// OutputTooLargeError is returned when the zip file would be larger than ZipArgs.MaxOutputBytes.
+// Size is the size the zip file had reached when writing it stopped, not its final size.
+type OutputTooLargeError struct {
+	Size int64
+	Max  int64
+}
+
+func (x OutputTooLargeError) Error() string {
+	return fmt.Sprintf("zip file is larger than the maximum of %d bytes, writing it stopped at %d bytes",
+		x.Max, x.Size)
+}
+
+// sizeLimitWriter fails writes that would make more than max bytes written in total with an
+// OutputTooLargeError.
+type sizeLimitWriter struct {
+	w       io.Writer
+	max     int64
+	written int64
+}
+
+func (w *sizeLimitWriter) Write(p []byte) (int, error) {
+	if w.written+int64(len(p)) > w.max {
+		return 0, OutputTooLargeError{Size: w.written + int64(len(p)), Max: w.max}
+	}
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
 type ZipWriter struct {
+	ctx          context.Context
 	time         time.Time
 	createdFiles map[string]string
 	createdDirs  map[string]string
 	directories  bool
+	dirMode      os.FileMode
 
 	errors   chan error
 	writeOps chan chan *zipEntry
@@ -187,17 +508,190 @@ type ZipWriter struct {
 
 	compressorPool sync.Pool
 	compLevel      int
+	huffmanOnly    bool
+
+	// autoLevel picks the level of files that would use compLevel by sampling them, with
+	// autoSampler.
+	autoLevel   bool
+	autoSampler *autoSampler
+
+	// compressionMethod is the zip method of files that are compressed, and levelPatterns
+	// override compLevel for the files they match.  compressionRules override both for the
+	// files they match.  Files in nonDeflatedFiles, with one of storedSuffixes or matching one of
+	// storePatterns are stored instead.
+	compressionMethod uint16
+	levelPatterns     []CompressionLevelPattern
+	compressionRules  []compressionRule
+	prefixMaps        []PrefixMap
+	modePatterns      []ModePattern
+	normalizePerms    bool
+	nonDeflatedFiles  map[string]bool
+	storedSuffixes    []string
+	storePatterns     []string
+	storePatternPaths bool
+
+	// nameMapper, if non-nil, renames or drops files before their paths are cleaned, which only
+	// happens when cleanPaths is set.
+	nameMapper       NameMapper
+	cleanPaths       bool
+	allowBackslashes bool
+
+	// backslashSeparators writes the names of entries with backslashes instead of forward slashes,
+	// see ZipArgs.PathSeparator.
+	backslashSeparators bool
+
+	contentTransform ContentTransform
 
 	followSymlinks     pathtools.ShouldFollowSymlinks
 	ignoreMissingFiles bool
+	skipUnreadable     bool
+	skippedFiles       []string
+	skippedExisting    []string
+	forceZip64         bool
+
+	// storeOwnership adds the Info-ZIP Unix extra field with the owner of each file.
+	storeOwnership bool
+	// storeXattrs adds the XattrTag extra field with the extended attributes of each file.
+	storeXattrs bool
+
+	// ntfsTimes adds the NTFS extra field with the times of each file, see ntfsExtra.
+	ntfsTimes bool
+
+	// extendedTime adds the extended timestamp extra field with the times of each file, see
+	// extendedTimestamp.
+	extendedTime bool
+
+	// timestampOverride is ZipArgs.Timestamp before it was clamped into time.
+	timestampOverride time.Time
+
+	// sourceDateEpoch is the time from SOURCE_DATE_EPOCH that the times of files are clamped to
+	// when there is no timestampOverride, or the zero time.
+	sourceDateEpoch time.Time
+
+	// progress, if non-nil, is called from the write goroutine as path mappings are written.
+	progress ProgressFunc
+
+	// zipIgnore makes globDir skip the patterns listed in .zipignore files.
+	zipIgnore bool
+
+	// comments maps the cleaned names of entries to their comments.
+	comments map[string]string
+
+	// archiveComment is written into the end of central directory record.
+	archiveComment string
+
+	// largeFileThreshold is the size at and above which files are streamed, see streamFile.
+	largeFileThreshold int64
+
+	// cacheDir holds the compressed contents of files from previous runs, see
+	// writeCachedContents.  cachedEntries counts the entries that reused them.
+	cacheDir      string
+	cachedEntries int
+
+	// storeBelow is the size below which files are always stored.
+	storeBelow int64
+
+	// minFileSize and maxFileSize, if greater than 0, are the sizes of the smallest and largest
+	// files found in FileArgs that are added, see sizeExcluded.
+	minFileSize int64
+	maxFileSize int64
+
+	// contentIndex adds a ContentIndexEntry, see writeContentIndex.
+	contentIndex bool
+
+	// maxOutputBytes, if greater than 0, is the size the zip file may not pass, see
+	// sizeLimitWriter.
+	maxOutputBytes int64
+
+	// archives are the zip files that entries are read from, and archiveMembers maps the sources
+	// of their entries to the entries, see globArchive.
+	archives       []io.Closer
+	archiveMembers map[string]*zip.File
+
+	// skipMacOSCruft leaves out the files macOS leaves behind, see isMacOSCruft.
+	skipMacOSCruft bool
+
+	// maxInFlightBytes is the capacity of the memoryRateLimiter, or 0 for the default.
+	maxInFlightBytes int64
+
+	// dataDescriptors writes stored entries with a data descriptor like compressed ones.
+	dataDescriptors bool
+
+	// recomputeCRC checks the kept entries of existing against their CRC32.
+	recomputeCRC bool
+
+	// alignUncompressed is the alignment of the contents of stored entries, or 0.
+	alignUncompressed int
+	// extAlignments maps the lowercased suffixes of ZipArgs.AlignExtensions, including
+	// the leading ".", to their alignment.
+	extAlignments map[string]int
+
+	// forceUTF8 sets utf8Flag on every entry instead of only non-ASCII ones.
+	forceUTF8 bool
+
+	// hostSystem is the host system that all written entries are converted to, see setHostSystem.
+	hostSystem HostSystem
+
+	// password, if non-empty, encrypts the entries of files with AESMethod, see aesWriter.
+	password string
+
+	// contentKeys and sharedContents, when DeduplicateContents is set, contain the hashes of the
+	// files that have the same size as another file and the shared compressed contents of the ones
+	// that have duplicates.  See findDuplicateContents.
+	contentKeys    map[string][sha256.Size]byte
+	sharedContents map[contentKey]*sharedContents
+
+	// duplicateSymlinks stores the files whose contents are in sharedContents as symlinks to the
+	// first of them instead of copying the contents, see writeDuplicateSymlink.
+	duplicateSymlinks bool
+
+	// sharedContentsMu guards deduplicatedEntries, the number of entries that were written with
+	// contents copied from sharedContents or as symlinks.
+	sharedContentsMu    sync.Mutex
+	deduplicatedEntries int
+
+	// sharedDictionary primes the compressor of SharedDictionaryMethod entries.
+	sharedDictionary []byte
+
+	// sharedDictionaryMu guards sharedDictionarySavedBytes, which is updated by the compression
+	// goroutines when stats are being collected.
+	sharedDictionaryMu         sync.Mutex
+	sharedDictionarySavedBytes int64
 
-	stderr io.Writer
+	// manifestContents, if non-nil, is used as the jar manifest instead of reading a file.
+	manifestContents []byte
+
+	// stats, if non-nil, is filled in once all entries have been written.
+	stats *Stats
+
+	// existing, if non-nil, is the zip file that entries are being appended to.
+	existing *existingZip
+
+	// emptyDirs contains the destinations of directories that get an entry even though directory
+	// entries aren't being added, because nothing is written inside them.
+	emptyDirs map[string]bool
+
+	// dryRun prints the planned entries to stdout instead of writing them.
+	dryRun bool
+
+	// logger receives the warnings, and the added entries if logLevel is LogVerbose.
+	logger   *log.Logger
+	logLevel LogLevel
+
+	stdout io.Writer
 	fs     pathtools.FileSystem
 }
 
 type zipEntry struct {
 	fh *zip.FileHeader
 
+	// compLevel is the compression level used for the contents of the entry.
+	compLevel int
+
+	// progress marks an entry without a header that is sent after all entries of a path mapping,
+	// to report progress once they have been written.
+	progress bool
+
 	// List of delayed io.Reader
 	futureReaders chan chan io.Reader
 
@@ -206,6 +700,322 @@ type zipEntry struct {
 	allocatedSize int64
 }
 
+// ProgressFunc is called with the number of files and directories whose entries have been
+// written and the total number that will be written, which is known once all of the FileArgs
+// have been expanded.  It is called once for each of them, in order, so the last call has done
+// equal to total.  It is always called from the goroutine that called Zip or ZipTo, so it
+// doesn't need to be safe for concurrent use.
+type ProgressFunc func(done, total int)
+
+// NameMapper is called with the path of a source file and the name that its FileArg gives it in
+// the zip file, after the prefix to strip, stripped components, junk paths, prefix in the zip
+// file or renaming have been applied.  It returns the name to use instead, or false to leave the
+// file out of the zip file.  It runs before duplicate destinations are resolved and before
+// NonDeflatedFiles and StoredExtensions pick the compression method, so those see the returned
+// name.  Returning an empty name with true is an error.  Files read from a FileArg Reader have a
+// source path of "-".
+type NameMapper func(src, dest string) (newDest string, include bool)
+
+// ContentTransform is called with the name in the zip file and the contents of a file, and returns
+// the contents to store for it instead, which may be r itself, a reader wrapping it or different
+// contents altogether.  The returned contents are read completely before the entry is written, as
+// their size may differ from the size of the file.  If the returned reader is an io.Closer it is
+// closed once it has been read.  Returning an error fails the zip file.  It is called for one file
+// at a time, in order, but not from the goroutine that called Zip or ZipTo.
+type ContentTransform func(dest string, r io.Reader) (io.Reader, error)
+
+// ModePattern sets the permission bits of the entries whose paths in the zip file match Pattern to
+// Mode.
+type ModePattern struct {
+	Pattern string
+	Mode    os.FileMode
+}
+
+// PrefixMap rewrites the paths in the zip file that are From or inside of the directory From to be
+// inside of To instead.  An empty From matches every path, and an empty To removes From.
+type PrefixMap struct {
+	From, To string
+}
+
+// applyPrefixMaps returns dest rewritten by the first of maps that matches it, or dest if none do.
+func applyPrefixMaps(maps []PrefixMap, dest string) string {
+	for _, m := range maps {
+		from := filepath.Clean(m.From)
+		if m.From == "" {
+			return filepath.Join(m.To, dest)
+		} else if dest == from {
+			return filepath.Clean(m.To)
+		} else if strings.HasPrefix(dest, from+"/") {
+			return filepath.Join(m.To, strings.TrimPrefix(dest, from+"/"))
+		}
+	}
+	return dest
+}
+
+// CompressionLevelPattern is the compression level of files whose paths in the zip file match
+// Pattern.
+type CompressionLevelPattern struct {
+	Pattern string
+	Level   int
+}
+
+// CompressionMethod selects the method used for entries that are compressed.
+type CompressionMethod int
+
+const (
+	CompressionDeflate CompressionMethod = iota
+	CompressionStore
+	CompressionZstd
+	CompressionBzip2
+	// CompressionDeflateSharedDictionaryNonPortable compresses entries with deflate primed with
+	// ZipArgs.SharedDictionary, and writes them with SharedDictionaryMethod.  Only readers that
+	// register NewSharedDictionaryDecompressor with the same dictionary can read them.
+	CompressionDeflateSharedDictionaryNonPortable
+)
+
+func (m CompressionMethod) String() string {
+	switch m {
+	case CompressionDeflate:
+		return "deflate"
+	case CompressionStore:
+		return "store"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionBzip2:
+		return "bzip2"
+	case CompressionDeflateSharedDictionaryNonPortable:
+		return "deflate-shared-dict-nonportable"
+	default:
+		return fmt.Sprintf("CompressionMethod(%d)", int(m))
+	}
+}
+
+// zipMethod returns the zip method ID used for entries that are compressed with m.
+func (m CompressionMethod) zipMethod() (uint16, error) {
+	switch m {
+	case CompressionDeflate:
+		return zip.Deflate, nil
+	case CompressionStore:
+		return zip.Store, nil
+	case CompressionZstd:
+		return ZstdMethod, nil
+	case CompressionBzip2:
+		return Bzip2Method, nil
+	case CompressionDeflateSharedDictionaryNonPortable:
+		return SharedDictionaryMethod, nil
+	default:
+		return 0, fmt.Errorf("unknown compression method %v", m)
+	}
+}
+
+// CompressionStrategy selects how the deflate compressor searches for matches, trading compression
+// ratio for speed beyond what the compression level allows.  compress/flate has no other knobs,
+// its memory use and window size are fixed.
+type CompressionStrategy int
+
+const (
+	// CompressionStrategyDefault searches for matches as the compression level of each entry
+	// specifies.
+	CompressionStrategyDefault CompressionStrategy = iota
+	// CompressionStrategyHuffmanOnly doesn't search for matches at all and only Huffman codes
+	// the bytes of entries, whatever their compression level.  It is several times faster than
+	// level 1 and compresses data that is already dense, like images or compressed files, about
+	// as well, but does much worse on text and code.  Entries with level 0 are still stored.
+	CompressionStrategyHuffmanOnly
+)
+
+// ParseCompressionStrategy returns the CompressionStrategy named by s, which must be "default" or
+// "huffman-only".
+func ParseCompressionStrategy(s string) (CompressionStrategy, error) {
+	switch s {
+	case "default":
+		return CompressionStrategyDefault, nil
+	case "huffman-only":
+		return CompressionStrategyHuffmanOnly, nil
+	default:
+		return 0, fmt.Errorf("unknown compression strategy %q, must be default or huffman-only", s)
+	}
+}
+
+func (s CompressionStrategy) String() string {
+	switch s {
+	case CompressionStrategyDefault:
+		return "default"
+	case CompressionStrategyHuffmanOnly:
+		return "huffman-only"
+	default:
+		return fmt.Sprintf("CompressionStrategy(%d)", int(s))
+	}
+}
+
+// DuplicateMode selects what happens when more than one source maps to the same destination in
+// the zip file.
+type DuplicateMode int
+
+const (
+	// DuplicateError fails with an error naming both sources.
+	DuplicateError DuplicateMode = iota
+	// DuplicateFirst keeps the first source and skips any later ones.
+	DuplicateFirst
+	// DuplicateLast lets later sources overwrite earlier ones.
+	DuplicateLast
+)
+
+// ParseDuplicateMode returns the DuplicateMode named by s, which must be "error", "first" or
+// "last".
+func ParseDuplicateMode(s string) (DuplicateMode, error) {
+	switch s {
+	case "error":
+		return DuplicateError, nil
+	case "first":
+		return DuplicateFirst, nil
+	case "last":
+		return DuplicateLast, nil
+	default:
+		return 0, fmt.Errorf("unknown duplicate mode %q, must be error, first or last", s)
+	}
+}
+
+func (m DuplicateMode) String() string {
+	switch m {
+	case DuplicateError:
+		return "error"
+	case DuplicateFirst:
+		return "first"
+	case DuplicateLast:
+		return "last"
+	default:
+		return fmt.Sprintf("DuplicateMode(%d)", int(m))
+	}
+}
+
+// LogLevel selects which messages are written to ZipArgs.Logger.
+type LogLevel int
+
+const (
+	// LogNormal writes warnings, like files that are skipped.
+	LogNormal LogLevel = iota
+	// LogQuiet doesn't write anything, errors are still returned.
+	LogQuiet
+	// LogVerbose writes warnings and a line with the name and compression method of every
+	// entry, in the order they are written to the zip file.
+	LogVerbose
+)
+
+// warnf writes a warning to the logger unless logLevel is LogQuiet.  It can be called from any
+// goroutine.
+func (z *ZipWriter) warnf(format string, v ...interface{}) {
+	if z.logLevel != LogQuiet {
+		z.logger.Printf("warning: "+format, v...)
+	}
+}
+
+// HostSystem selects the host system recorded in the upper byte of the version made by field of
+// the entries, which determines how readers interpret their external attributes.
+type HostSystem int
+
+const (
+	// HostSystemDefault records Unix for entries that have a Unix mode, which are executable
+	// files, files with the setuid, setgid or sticky bit, symlinks and directories, and MS-DOS
+	// for the rest.
+	HostSystemDefault HostSystem = iota
+	// HostSystemUnix records Unix for every entry, giving entries without a Unix mode the 0666
+	// or 0777 mode that readers would have derived from their MS-DOS attributes.
+	HostSystemUnix
+	// HostSystemMSDOS records MS-DOS for every entry, keeping only the directory and read-only
+	// attributes.  Symlinks can't be represented and are an error.
+	HostSystemMSDOS
+)
+
+// ParseHostSystem returns the HostSystem named by s, which must be "default", "unix" or "msdos".
+func ParseHostSystem(s string) (HostSystem, error) {
+	switch s {
+	case "default":
+		return HostSystemDefault, nil
+	case "unix":
+		return HostSystemUnix, nil
+	case "msdos":
+		return HostSystemMSDOS, nil
+	default:
+		return 0, fmt.Errorf("unknown host system %q, must be default, unix or msdos", s)
+	}
+}
+
+func (h HostSystem) String() string {
+	switch h {
+	case HostSystemDefault:
+		return "default"
+	case HostSystemUnix:
+		return "unix"
+	case HostSystemMSDOS:
+		return "msdos"
+	default:
+		return fmt.Sprintf("HostSystem(%d)", int(h))
+	}
+}
+
+// The host system IDs of the version made by field, and the MS-DOS attributes in the low byte of
+// the external attributes.
+const (
+	hostIDMSDOS   = 0
+	hostIDUnix    = 3
+	msdosDir      = 0x10
+	msdosReadOnly = 0x01
+)
+
+// utf8Flag is bit 11 of the general purpose flags, set when the name and comment of the entry are
+// UTF-8.
+const utf8Flag = 0x800
+
+// applyModePatterns sets the permission bits of fh to those of the last of z.modePatterns that
+// matches its name.  Symlinks are left alone.
+func (z *ZipWriter) applyModePatterns(fh *zip.FileHeader) error {
+	mode := fh.Mode()
+	if mode&os.ModeSymlink != 0 {
+		return nil
+	}
+	name := strings.TrimSuffix(fh.Name, "/")
+	matched := false
+	for _, p := range z.modePatterns {
+		match, err := pathtools.Match(p.Pattern, name)
+		if err != nil {
+			return fmt.Errorf("%s: %s", p.Pattern, err)
+		}
+		if match {
+			mode = mode&^os.ModePerm | p.Mode
+			matched = true
+		}
+	}
+	if matched {
+		fh.SetMode(mode)
+	}
+	return nil
+}
+
+// setHostSystem changes the host system of fh to z.hostSystem, converting its external attributes.
+func (z *ZipWriter) setHostSystem(fh *zip.FileHeader) error {
+	switch z.hostSystem {
+	case HostSystemUnix:
+		if fh.CreatorVersion>>8 != hostIDUnix {
+			fh.SetMode(fh.Mode())
+		}
+	case HostSystemMSDOS:
+		mode := fh.Mode()
+		if mode&os.ModeSymlink != 0 {
+			return fmt.Errorf("symlink %q can't be stored with the msdos host system", fh.Name)
+		}
+		fh.CreatorVersion = fh.CreatorVersion&0xff | hostIDMSDOS<<8
+		fh.ExternalAttrs = 0
+		if mode.IsDir() {
+			fh.ExternalAttrs |= msdosDir
+		}
+		if mode&0200 == 0 {
+			fh.ExternalAttrs |= msdosReadOnly
+		}
+	}
+	return nil
+}
+
 type ZipArgs struct {
 	FileArgs                 []FileArg
 	OutputFilePath           string
@@ -213,27 +1023,551 @@ type ZipArgs struct {
 	SrcJar                   bool
 	AddDirectoryEntriesToZip bool
 	CompressionLevel         int
+	CompressionMethod        CompressionMethod
 	ManifestSourcePath       string
 	NumParallelJobs          int
 	NonDeflatedFiles         map[string]bool
+	StoredExtensions         []string
 	WriteIfChanged           bool
 	StoreSymlinks            bool
 	IgnoreMissingFiles       bool
+	SortEntries              bool
+	ForceZip64               bool
+
+	// ListOutputPath, if set, is where a listing of the entries in the finished zip file is
+	// written.  See writeListing for the format.
+	ListOutputPath string
+
+	// WriteContentIndex adds a ContentIndexEntry after all other entries that lists the name,
+	// method, size and CRC32 of every other entry in the central directory, see contentIndex.
+	// Tools can compare the content indexes of two zip files to find the entries that differ
+	// without reading their contents.  It is the same for every run with the same inputs as long
+	// as the timestamp is too.  It can't be combined with a Password.
+	WriteContentIndex bool
+
+	// ShaOutputPath, if set, is where the hex encoded SHA-256 of the finished zip file is written,
+	// as read back from OutputFilePath.
+	ShaOutputPath string
+
+	// TempDir is the directory that the zip file is written to before it is moved to
+	// OutputFilePath once it is complete, so that OutputFilePath never holds a partial zip file
+	// and is left alone if writing fails.  It defaults to the directory of OutputFilePath, where
+	// the zip file can be renamed into place, otherwise it is copied.  The temporary file is
+	// removed whether the zip file is written or not.  It doesn't apply to appending to an
+	// existing zip file, which is written in place, and can't be used when writing to stdout or
+	// an io.Writer.
+	TempDir string
+
+	// DurableWrite syncs the contents of the zip file to stable storage before it is moved to
+	// OutputFilePath, and the directory of OutputFilePath after it has been moved, so that a
+	// crash never leaves a partial or missing zip file behind once Zip has returned.  It is slower,
+	// and can't be combined with SplitSize.
+	DurableWrite bool
+
+	// IgnoreErrors reports directories that can't be read while walking the directories of
+	// FileArgs as warnings instead of failing.
+	IgnoreErrors bool
+
+	// VerifyAfterWrite reads back every entry of the finished zip file and fails if its contents
+	// don't match its CRC32.
+	VerifyAfterWrite bool
+
+	// Append adds the entries to the existing zip file at OutputFilePath instead of replacing it,
+	// if it exists.  Entries with the same name as a new entry are replaced, the data of all other
+	// existing entries is left untouched.
+	Append bool
+
+	// AddIfMissing, with Append, only adds the new entries whose names aren't already in the
+	// existing zip file, and keeps the existing entries instead of replacing them, so a base zip
+	// file can be layered with overlay files without the overlay winning.  The names of the
+	// skipped entries are recorded in Stats.SkippedExistingEntries.
+	AddIfMissing bool
+
+	// RecomputeCRC, with Append, checks the contents of the existing entries that are kept
+	// against their CRC32 before keeping them, instead of trusting the central directory.
+	RecomputeCRC bool
+
+	// ManifestContents is used as the contents of the jar manifest instead of reading
+	// ManifestSourcePath, and may not be combined with it.  Like the file, it requires EmulateJar.
+	ManifestContents []byte
+
+	// Timestamp overrides the modification time written for every entry, including the manifest
+	// when emulating a jar.  The zero value keeps the default of jar.DefaultTime.  Times before
+	// 1980-01-01 can't be represented in a zip file and are clamped to 1980-01-01 UTC.
+	//
+	// When Timestamp is zero and the SOURCE_DATE_EPOCH environment variable is set to a number of
+	// seconds since the Unix epoch, every time written into the zip file, including the times of
+	// files stored by StoreNTFSTimes, is clamped to be no later than it.  An invalid
+	// SOURCE_DATE_EPOCH is an error.
+	Timestamp time.Time
+
+	// ExcludePatterns are matched against the paths found in -D directories, relative to the
+	// relative root of the directory.  Matching directories are not descended into.
+	ExcludePatterns []string
+
+	// EnableZipIgnore skips the paths in the directories of FileArgs that match the gitignore style
+	// patterns in the .zipignore file in the relative root of the FileArg, if there is one.  See
+	// parseZipIgnore for the syntax.
+	EnableZipIgnore bool
+
+	// EmptyDirectoryEntries adds entries for directories in FileArgs that are left empty after
+	// globbing and exclusions, without adding entries for any other directories.  It has no effect
+	// when AddDirectoryEntriesToZip is set.
+	EmptyDirectoryEntries bool
+
+	// DirectoryMode is the permission bits of the directory entries added for
+	// AddDirectoryEntriesToZip, EmptyDirectoryEntries and directories in FileArgs, instead of 0700.
+	// Directory entries always have names ending in a slash and the Unix directory mode and MS-DOS
+	// directory attribute set in their external attributes.  ModePatterns still apply on top of it.
+	DirectoryMode os.FileMode
+
+	// StoreOwnership writes the numeric uid and gid of each file and symlink into an Info-ZIP Unix
+	// extra field (0x7875).  Entries without a source file to stat, like directories and files read
+	// from a Reader, are recorded as owned by 0/0.
+	StoreOwnership bool
+
+	// StoreXattrs writes the extended attributes of each regular file, like the file capabilities
+	// in security.capability, into an XattrTag extra field, see XattrTag for its format.  They
+	// are only read on Linux and from the real filesystem, files on filesystems without extended
+	// attributes get no field.  ExtractOptions.Xattrs restores them.
+	StoreXattrs bool
+
+	// StoreNTFSTimes writes the modification, access and status change times of each file and
+	// symlink into an NTFS extra field (0x000a) with 100ns resolution, in addition to the DOS
+	// timestamp.  Timestamp, if set, is used for all three times of every entry, and entries
+	// without a source file to stat use the DOS timestamp.
+	StoreNTFSTimes bool
+
+	// StoreExtendedTimestamp writes the modification time of each file and symlink, and its access
+	// time where the platform provides it, into an Info-ZIP extended timestamp extra field
+	// (0x5455) as 32 bit Unix times, which Info-ZIP's unzip restores.  The central directory only
+	// holds the modification time, as the format requires.  Timestamp, if set, is used for both
+	// times of every entry, and entries without a source file to stat only get the DOS timestamp
+	// as their modification time.
+	StoreExtendedTimestamp bool
+
+	// ProgressFunc, if set, is called after all of the entries for each file or directory found in
+	// FileArgs, and the manifest when emulating a jar, have been written.  See ProgressFunc.
+	ProgressFunc ProgressFunc
+
+	// ArchiveComment is written into the end of central directory record, and may be at most 65535
+	// bytes.  When appending, an empty ArchiveComment keeps the comment of the existing zip file.
+	ArchiveComment string
+
+	// LargeFileThreshold, if greater than 0, is the size in bytes at and above which files are
+	// compressed while they are written to the zip file instead of into memory first.  That bounds
+	// the memory used for each large file to the compressor's working set instead of the size of
+	// the file, but compressing the file in parallel with other files or with itself is no longer
+	// possible, and entries that don't get smaller are no longer stored uncompressed.
+	LargeFileThreshold int64
+
+	// MaxInFlightBytes, if greater than 0, bounds the total uncompressed size of the files whose
+	// contents are held in memory while they are compressed and written, instead of the default
+	// of 512MB.  Files are not read until their size fits under the limit, except that a single
+	// file larger than the limit is always allowed when nothing else is in memory.  Files at or
+	// above LargeFileThreshold are streamed and don't count against it.
+	MaxInFlightBytes int64
+
+	// SharedDictionary primes the deflate compressor of every entry with a preset dictionary,
+	// which helps many small files that share most of their contents.  A raw deflate stream
+	// compressed with a preset dictionary can refer back into the dictionary, and the zip format
+	// has no way to record it, so it requires CompressionDeflateSharedDictionaryNonPortable and
+	// the resulting entries can't be read by standard zip readers.  Each entry is still
+	// self-contained given the dictionary.
+	SharedDictionary []byte
+
+	// CompressionLevelPatterns sets the compression level of the files whose paths in the zip
+	// file match a pattern, instead of CompressionLevel.  Patterns follow pathtools.Match, and the
+	// first match wins.  A FileArg with a CompressionLevel ignores them.
+	CompressionLevelPatterns []CompressionLevelPattern
+
+	// CompressionRulesPath, if set, is a file of rules choosing the compression method and level
+	// of the files whose paths in the zip file match a pattern, one "pattern = method[:level]" per
+	// line, see parseCompressionRules.  Patterns follow pathtools.Match and the first match wins.
+	// A matching rule takes precedence over CompressionMethod, and its level, if it has one, over
+	// CompressionLevel and CompressionLevelPatterns.  A FileArg with a CompressionLevel still
+	// uses its level, and NonDeflatedFiles, StoredExtensions and StorePatterns still store the
+	// files they match.
+	CompressionRulesPath string
+
+	// NoCleanPaths disables cleaning the paths in the zip file of the files in FileArgs, after
+	// NameMapper has been applied.  By default paths are cleaned like path.Clean, removing ./
+	// segments and repeated slashes and resolving .. segments, and paths that would be absolute or
+	// outside of the zip file are rejected with a DestinationOutsideZipError.
+	NoCleanPaths bool
+
+	// AllowBackslashes allows paths in the zip file of the files in FileArgs that contain a
+	// backslash, which are otherwise rejected with a BackslashInNameError once PrefixMaps,
+	// NameMapper and cleaning have been applied.  A backslash is a valid character in a name, but
+	// extractors that treat it as a directory separator create different files from the same zip.
+	AllowBackslashes bool
+
+	// PathSeparator is the separator between the directories of the names stored in the zip file,
+	// "/" by default.  Paths are always composed from the OS paths of the files with forward
+	// slashes, see zipPath, and only converted when the names are written.  The zip format only
+	// allows "/", so a backslash is only meant for legacy readers that expect it and warns when it is
+	// used.  Directory entries end with the separator too.  The names of the files still can't
+	// contain a backslash unless AllowBackslashes is set.
+	PathSeparator string
+
+	// StripTopLevel removes the first directory from the paths in the zip file of the files in
+	// FileArgs if they are all inside the same one, like the project/ directory of an unpacked
+	// project.zip, along with the entry for the directory itself.  If they aren't the paths are
+	// left alone, unless StripTopLevelRequired is set.  ProvenanceEntry is never stripped.
+	StripTopLevel bool
+
+	// StripTopLevelRequired makes StripTopLevel return an error if the files aren't all inside
+	// the same directory.
+	StripTopLevelRequired bool
+
+	// NameMapper is called for every source file after its name in the zip file has been computed
+	// from the FileArg, and can rename or drop it.  See NameMapper for details.
+	NameMapper NameMapper
+
+	// ContentTransform, if set, is called for every regular file and FileArg Reader to rewrite its
+	// contents before they are stored, see ContentTransform.  The jar manifest, symlinks and
+	// directories aren't transformed.  Transformed files are never deduplicated or cached, as
+	// their contents no longer match their source files.
+	ContentTransform ContentTransform
+
+	// MaxNameLength is the maximum length in bytes of the name of an entry in the zip file, checked
+	// after the names have been computed from the source paths.  0 disables the check.
+	MaxNameLength int
+
+	// MaxEntries is the maximum number of entries in the zip file, checked before anything is
+	// written once the files have been found and duplicates removed, to guard against globs that
+	// match far more files than intended.  The directory entries that AddDirectoryEntriesToZip and
+	// EmulateJar add for the parents of files, and the jar manifest, aren't counted.  0 disables
+	// the check.
+	MaxEntries int
+
+	// MaxOutputBytes is the maximum size in bytes of the zip file, including the existing entries
+	// when appending.  It is checked as the zip file is written, so that writing stops with an
+	// OutputTooLargeError as soon as the limit is passed instead of once the whole zip file has
+	// been compressed, and the output file is left alone.  0 disables the check.
+	MaxOutputBytes int64
+
+	// DuplicateMode selects what happens when more than one file maps to the same destination,
+	// defaults to DuplicateError.
+	DuplicateMode DuplicateMode
+
+	// RenameOnCollision renames files that map to the same destination as an earlier file, for
+	// example because JunkPaths flattened them to the same name, instead of applying
+	// DuplicateMode, which must be DuplicateError.  The first file keeps the name and the others
+	// get a _1, _2, ... suffix before the extension, skipping names that are already taken, in the
+	// order the files were added, so the names are the same on every run.
+	RenameOnCollision bool
+
+	// DryRun expands the FileArgs and prints the destination and source path of each entry that
+	// would be written, separated by a tab, to Stdout instead of writing the zip file.
+	DryRun bool
+
+	// AlwaysDataDescriptor writes every new entry, including stored files, directories and
+	// symlinks, with bit 3 of the general purpose flags set, zeros for the CRC32 and sizes in the
+	// local header, and a data descriptor with its signature after the contents.  The sizes in the
+	// data descriptor are 8 bytes for entries that need zip64.  By default only compressed entries
+	// have a data descriptor.  Some streaming readers, like java.util.zip.ZipInputStream, reject
+	// stored entries with a data descriptor, as their size can't be found without the central
+	// directory.  Entries kept when appending are left as they were.
+	AlwaysDataDescriptor bool
+
+	// DeduplicateContents hashes the files in FileArgs that have the same size and are compressed
+	// with the same method and level before writing the zip file, and compresses each distinct
+	// contents only once.  The other files with the same contents get their own entries with a
+	// copy of the compressed data.  The compressed contents of files with duplicates are kept in
+	// memory until all of their copies have been written.  Files at or above LargeFileThreshold
+	// and files read from a Reader are not deduplicated.
+	DeduplicateContents bool
+
+	// DuplicatesAsSymlinks finds the files with identical contents in FileArgs like
+	// DeduplicateContents, adds the first of them normally and the others as symlinks with a
+	// relative target to the first one, which saves the space of the copies.  Zip files with
+	// symlinks are not portable, extracting them on Windows or with tools that don't restore
+	// symlinks gives files that contain the link target.  Files that would need a link leading
+	// outside of the zip file are added normally.  It can't be combined with DeduplicateContents.
+	DuplicatesAsSymlinks bool
+
+	// ForceUTF8 sets the UTF-8 flag (bit 11 of the general purpose flags) on every entry, and fails
+	// if a name or comment isn't valid UTF-8.  Without it the flag is only set on entries whose
+	// name or comment isn't pure ASCII, as long as both are valid UTF-8.
+	ForceUTF8 bool
+
+	// HostSystem overrides the host system that the version made by field of every written entry
+	// records, so that readers interpret permissions the same way for every entry.  The default
+	// records Unix only for entries with a Unix mode, see HostSystemDefault.  The version made by
+	// is always 2.0, and the version needed to extract each entry is the lowest that covers the
+	// features it uses, 1.0 for stored files up to 6.3 for zstd or UTF-8 names.
+	HostSystem HostSystem
+
+	// ErrorOnEmptyGlob fails when a glob in the source files of a FileArg, or one of the
+	// alternatives of a {x,y} pattern, matches no files, or when a directory to glob contains no
+	// files after exclusions, even with IgnoreMissingFiles.  Source files without wildcards or
+	// braces that don't exist are always an error unless IgnoreMissingFiles is set.
+	ErrorOnEmptyGlob bool
+
+	// Password, if set, encrypts the contents of every entry other than directories with AES-256
+	// using the WinZip AE-2 scheme.  The keys of each entry are derived from the password and a
+	// random 16 byte salt with PBKDF2-HMAC-SHA1 and 1000 iterations, and the encrypted contents
+	// are authenticated with HMAC-SHA1.  Entries are written with AESMethod and the compression
+	// method in an AESExtraTag extra field, and their CRC32 is 0.  Names, sizes and the rest of
+	// the central directory are not encrypted.  The random salts make the output differ between
+	// runs, and it can't be combined with VerifyAfterWrite.
+	Password string
+
+	// StoreBelowBytes, if greater than 0, stores the files smaller than this many bytes
+	// uncompressed whatever their compression method and level, as the overhead of compressing
+	// tiny files usually makes them larger.  It applies to the manifest and files read from a
+	// Reader too.
+	StoreBelowBytes int64
+
+	// MinFileSize and MaxFileSize, if greater than 0, leave the regular files found in the
+	// SourceFiles and GlobDir of FileArgs that are smaller than MinFileSize or larger than
+	// MaxFileSize bytes out of the zip file.  Directories, symlinks that are stored as symlinks
+	// and files read from a Reader are always added.
+	MinFileSize int64
+	MaxFileSize int64
+
+	// SkipMacOSCruft leaves the __MACOSX directories and the AppleDouble files starting with "._"
+	// that macOS creates to hold resource forks and extended attributes out of the files found in
+	// the SourceFiles and GlobDir of FileArgs.  Files read from a Reader are always added.
+	SkipMacOSCruft bool
+
+	// ModePatterns set the permission bits of the files and directories whose paths in the zip
+	// file match a pattern, instead of the ones taken from the source files.  Patterns follow
+	// pathtools.Match, and unlike CompressionLevelPatterns the last match wins, so that specific
+	// patterns can follow general ones.  Symlinks keep their mode.
+	ModePatterns []ModePattern
+
+	// NormalizePermissions stores regular files with mode 0755 if any of the execute bits of the
+	// source file are set and 0644 otherwise, so that the zip file doesn't depend on the umask of
+	// the machine it was built on.  By default only the owner execute bit is kept, as mode 0700,
+	// unless the file has the setuid, setgid or sticky bit set, which keeps its whole mode.  The
+	// setuid, setgid and sticky bits are kept either way.  ModePatterns still override it.
+	NormalizePermissions bool
+
+	// ProvenanceEntry, if set, is the path in the zip file of an entry that records how the zip
+	// file was built, usually DefaultProvenanceEntry.  It is a JSON object with the tool and Go
+	// versions, the modification time of the entries and the FileArgs, which is the same for
+	// every run with the same arguments as long as the timestamp is too.
+	ProvenanceEntry string
+
+	// StorePatterns stores the files whose names match one of the patterns uncompressed, like
+	// NonDeflatedFiles.  Patterns follow pathtools.Match and are matched against the base name of
+	// the source file, or against the path in the zip file if StorePatternsMatchPath is set or for
+	// files read from a Reader.
+	StorePatterns          []string
+	StorePatternsMatchPath bool
+
+	// AlignUncompressed, if set, pads the local headers of stored files so that their contents
+	// start at a multiple of AlignUncompressed bytes from the start of the zip file, like running
+	// zipalign with that alignment, usually 4 for APKs.  It must be a power of 2 up to 32768.
+	// Compressed and encrypted entries, directories and entries kept from Append or copied from
+	// other zip files aren't aligned.
+	AlignUncompressed int
+
+	// AlignExtensions maps case insensitive file extensions, like "so", to the alignment of the
+	// contents of the files with that extension, instead of AlignUncompressed, usually 16384 for
+	// native libraries so they can be mapped into memory from an APK with 16KB pages.  The files
+	// are always stored, as compressed files can't be mapped.  Alignments follow the same rules
+	// as AlignUncompressed, and if more than one extension matches the longest one wins.
+	AlignExtensions map[string]int
+
+	// SkipUnreadable leaves out source files that exist but can't be opened or read, like files
+	// without read permission found in a directory, with a warning instead of failing.  Missing
+	// files are still errors unless IgnoreMissingFiles is set.  The skipped files are listed in
+	// Stats.SkippedFiles.
+	SkipUnreadable bool
+
+	// CompressionStrategy selects how deflated entries are compressed, see CompressionStrategy.
+	// Strategies other than CompressionStrategyDefault require CompressionDeflate.
+	CompressionStrategy CompressionStrategy
+
+	// AutoCompressionLevel picks the compression of each file that would be compressed at
+	// CompressionLevel by sampling it: its first 32KB are compressed at levels 1 and 9, and the
+	// file is stored if level 1 saves less than 5% of the sample, compressed at level 9 if that is
+	// at least 5% smaller than level 1, and at level 1 otherwise.  Incompressible files aren't
+	// compressed for nothing, and the slow level is only used where it pays off.  The choice only
+	// depends on the sample, so it is the same for the same contents.  Files read from a FileArg
+	// Reader, files with a CompressionLevel in their FileArg or matching CompressionLevelPatterns,
+	// and files that are already stored keep their compression.  It requires CompressionDeflate
+	// and CompressionStrategyDefault.
+	AutoCompressionLevel bool
+
+	// JarOrdering orders the entries of the zip file the way EmulateJar does, without any of its
+	// other effects.  Files are ordered by their paths in the zip file as jar.EntryNamesLess
+	// does: META-INF/MANIFEST.MF first, then the other files inside of META-INF/, then all other
+	// files, each group sorted by comparing the bytes of the paths.  Directory entries are
+	// written just before the first file inside of them, so META-INF/ comes first if there are
+	// files inside of it.  It takes precedence over SortEntries.
+	JarOrdering bool
+
+	// PrefixMaps rewrite the paths in the zip file of the files in FileArgs, after the prefix to
+	// strip, stripped components, junk paths, prefix in the zip file or renaming have been
+	// applied and before NameMapper.  The first PrefixMap whose From matches a path is applied
+	// and the rest are ignored.  A PrefixMap with an empty From applies to every path, like
+	// FileArg.PathPrefixInZip.
+	PrefixMaps []PrefixMap
+
+	// OrderFilePath is a file listing paths in the zip file, one per line, in the order their
+	// entries must be written.  Entries that aren't listed are written after them, in the order
+	// they would have been written in without it, so it takes precedence over SortEntries and
+	// JarOrdering.  Directory entries are still written just before the first entry inside of
+	// them, and listed paths that aren't in the zip file are warned about.  It can't be combined
+	// with EmulateJar, which requires its own order.
+	OrderFilePath string
+
+	// FirstEntry is the path in the zip file of an entry to write before all the others, like
+	// EmulateJar does for the manifest, for formats that read the first entry as an index.  It
+	// takes precedence over OrderFilePath, SortEntries and JarOrdering, and it is an error if
+	// no entry has that path.  Directory entries for its parents are still written just before
+	// it, so it is usually at the root of the zip file.  It can't be combined with EmulateJar or
+	// Append, whose first entries are already decided.
+	FirstEntry string
+
+	// CacheDir is a directory that keeps the compressed contents of the files in the zip file, so
+	// that later runs can copy them instead of compressing the files again if they haven't
+	// changed.  Cached contents are keyed by the absolute path, modification time and size of the
+	// file, and by the method and level it is compressed with, so a file that changed without a
+	// new modification time or size reuses stale contents.  Stored and streamed files aren't
+	// cached.  It is created if it doesn't exist, and nothing ever removes old entries from it.
+	CacheDir string
+
+	// SplitSize splits the zip file into volumes of at most SplitSize bytes, which must be at least
+	// MinSplitSize, following the split archive convention of the zip spec.  The last volume is
+	// written to OutputFilePath and the others next to it with the extension replaced by .z01,
+	// .z02 and so on, see SplitVolumeName.  A zip file that fits in a single volume isn't split.
+	// Many readers, including archive/zip, can't read split archives, "zip -s 0" joins them back
+	// into a single zip file.  It can't be combined with Append, WriteIfChanged or ShaOutputPath,
+	// and zip64 archives can't be split.
+	SplitSize int64
+
+	// FS, if set, is used instead of the real filesystem for everything that is read from the
+	// source files: their contents, globs, stats and directory walks, so that zip files can be
+	// built from an in-memory or overlay filesystem.  Source paths are converted to paths in FS,
+	// which must be relative and can't contain "..".  fs.FS has no symlinks, files are always
+	// read through them.  It can't be combined with Filesystem.
+	FS fs.FS
+
+	// Stdout receives the zip file when OutputFilePath is "-", or the planned entries when DryRun
+	// is set.  It defaults to os.Stdout.
+	Stdout io.Writer
+
+	// Logger receives the warnings, and with LogVerbose a line for every entry.  A *log.Logger
+	// can be used from the goroutines that compress entries in parallel.  It defaults to a
+	// logger without a prefix or flags that writes to Stderr.
+	Logger *log.Logger
+	// LogLevel selects which messages are written to Logger, defaults to LogNormal.
+	LogLevel LogLevel
 
 	Stderr     io.Writer
 	Filesystem pathtools.FileSystem
 }
 
-const NOQUOTE = '\x00'
+// validCompressionLevel returns an error if level is not a compression level from 0 (store) to 9
+// (best compression), or -1 for the default compression level.
+func validCompressionLevel(level int) error {
+	if level < flate.DefaultCompression || level > flate.BestCompression {
+		return fmt.Errorf("invalid compression level %d, must be between 0 and 9, or -1 for the default",
+			level)
+	}
+	return nil
+}
 
-func ReadRespFile(bytes []byte) []string {
-	var args []string
-	var arg []rune
+// minTimestamp is the earliest time that can be stored in the MS-DOS date fields of a zip file.
+var minTimestamp = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
 
-	isEscaping := false
-	quotingStart := NOQUOTE
-	for _, c := range string(bytes) {
-		switch {
+// clampTimestamp returns t, or minTimestamp if t is earlier than can be stored in a zip file.
+func clampTimestamp(t time.Time) time.Time {
+	if t.Before(minTimestamp) {
+		return minTimestamp
+	}
+	return t
+}
+
+// sourceDateEpochEnv is the environment variable that reproducible builds use to pass the time
+// that timestamps should be clamped to, see https://reproducible-builds.org/specs/source-date-epoch/.
+const sourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// sourceDateEpoch returns the time in the SOURCE_DATE_EPOCH environment variable, or the zero time
+// if it isn't set.
+func sourceDateEpoch() (time.Time, error) {
+	s := os.Getenv(sourceDateEpochEnv)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || secs < 0 {
+		return time.Time{}, fmt.Errorf("invalid %s %q, must be a non-negative number of seconds since the Unix epoch",
+			sourceDateEpochEnv, s)
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
+
+// clampToEpoch returns t, or epoch if it is set and t is later than it.
+func clampToEpoch(t, epoch time.Time) time.Time {
+	if !epoch.IsZero() && t.After(epoch) {
+		return epoch
+	}
+	return t
+}
+
+// ExpandRespFiles returns args with every argument of the form @file replaced by the arguments in
+// the response file, parsed with ReadRespFile.  Response files may include other response files
+// the same way, but not themselves, directly or indirectly.
+func ExpandRespFiles(args []string) ([]string, error) {
+	return expandRespFiles(pathtools.OsFs, args, nil)
+}
+
+// expandRespFiles expands the response files in args.  parents contains the absolute paths of the
+// response files that are currently being expanded, like FileArgsBuilder.readList.
+func expandRespFiles(fs pathtools.FileSystem, args []string, parents []string) ([]string, error) {
+	var ret []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") {
+			ret = append(ret, arg)
+			continue
+		}
+
+		name := strings.TrimPrefix(arg, "@")
+		absName, err := filepath.Abs(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, parent := range parents {
+			if parent == absName {
+				return nil, fmt.Errorf("response file %q includes itself", name)
+			}
+		}
+
+		f, err := fs.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		contents, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		expanded, err := expandRespFiles(fs, ReadRespFile(contents), append(parents, absName))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, expanded...)
+	}
+	return ret, nil
+}
+
+const NOQUOTE = '\x00'
+
+func ReadRespFile(bytes []byte) []string {
+	var args []string
+	var arg []rune
+
+	isEscaping := false
+	quotingStart := NOQUOTE
+	for _, c := range string(bytes) {
+		switch {
 		case isEscaping:
 			if quotingStart == '"' {
 				if !(c == '"' || c == '\\') {
@@ -267,7 +1601,148 @@ func ReadRespFile(bytes []byte) []string {
 	return args
 }
 
+// ZipTo writes the zip file described by args to w, which only needs to support writing, instead of
+// creating OutputFilePath.  The options that need the output file, WriteIfChanged, Append,
+// ListOutputPath, ShaOutputPath, VerifyAfterWrite and SplitSize, are errors.
 func ZipTo(args ZipArgs, w io.Writer) error {
+	if err := checkNoOutputFile(args, "writing to an io.Writer"); err != nil {
+		return err
+	}
+	return zipTo(context.Background(), args, w, nil, nil)
+}
+
+// ZipToWithStats is like ZipTo, but also returns statistics about the entries that were written.
+func ZipToWithStats(args ZipArgs, w io.Writer) (*Stats, error) {
+	if err := checkNoOutputFile(args, "writing to an io.Writer"); err != nil {
+		return nil, err
+	}
+	stats := &Stats{}
+	err := zipTo(context.Background(), args, w, stats, nil)
+	return stats, err
+}
+
+func zipTo(ctx context.Context, args ZipArgs, w io.Writer, stats *Stats, existing *existingZip) error {
+	if err := validCompressionLevel(args.CompressionLevel); err != nil {
+		return err
+	}
+
+	for _, fa := range args.FileArgs {
+		if fa.CompressionLevel != nil {
+			if err := validCompressionLevel(*fa.CompressionLevel); err != nil {
+				return err
+			}
+		}
+	}
+	for _, p := range args.CompressionLevelPatterns {
+		if err := validCompressionLevel(p.Level); err != nil {
+			return fmt.Errorf("%s: %s", p.Pattern, err)
+		}
+	}
+
+	if err := validSharedDictionary(args.CompressionMethod, args.SharedDictionary); err != nil {
+		return err
+	}
+
+	if args.Password != "" && args.VerifyAfterWrite {
+		return errors.New("encrypted entries can't be verified after writing")
+	}
+	if args.Password != "" && args.WriteContentIndex {
+		return errors.New("a content index can't be written with encrypted entries")
+	}
+
+	if args.DeduplicateContents && args.DuplicatesAsSymlinks {
+		return errors.New("duplicate contents can't be both copied and stored as symlinks")
+	}
+
+	if args.FS != nil && args.Filesystem != nil {
+		return fmt.Errorf("FS can't be combined with Filesystem")
+	}
+	if args.AddIfMissing && !args.Append {
+		return fmt.Errorf("add if missing requires append")
+	}
+	if args.DirectoryMode&^os.ModePerm != 0 {
+		return fmt.Errorf("directory mode %v must only have permission bits", args.DirectoryMode)
+	}
+	if args.StripTopLevelRequired && !args.StripTopLevel {
+		return fmt.Errorf("strip top level required requires strip top level")
+	}
+	if a := args.AlignUncompressed; a < 0 || a > 32768 || a&(a-1) != 0 {
+		return fmt.Errorf("alignment %d must be a power of 2 up to 32768", a)
+	}
+	for ext, a := range args.AlignExtensions {
+		if a <= 0 || a > 32768 || a&(a-1) != 0 {
+			return fmt.Errorf("alignment %d of extension %q must be a power of 2 up to 32768", a, ext)
+		}
+	}
+	if args.MaxEntries < 0 {
+		return fmt.Errorf("max entries must not be negative, got %d", args.MaxEntries)
+	}
+	switch args.PathSeparator {
+	case "", "/", `\`:
+	default:
+		return fmt.Errorf("path separator %q must be / or \\", args.PathSeparator)
+	}
+	if args.MaxOutputBytes < 0 {
+		return fmt.Errorf("max output bytes must not be negative, got %d", args.MaxOutputBytes)
+	}
+	if args.MaxInFlightBytes < 0 {
+		return fmt.Errorf("max in flight bytes must not be negative, got %d", args.MaxInFlightBytes)
+	}
+	if args.CacheDir != "" && !args.DryRun {
+		if err := os.MkdirAll(args.CacheDir, 0777); err != nil {
+			return err
+		}
+	}
+	if args.FirstEntry != "" && (args.EmulateJar || args.Append) {
+		return fmt.Errorf("a first entry can't be used with jar emulation or append")
+	}
+	if args.OrderFilePath != "" && args.EmulateJar {
+		return fmt.Errorf("an order file can't be used with jar emulation")
+	}
+	switch args.CompressionStrategy {
+	case CompressionStrategyDefault:
+	case CompressionStrategyHuffmanOnly:
+		if args.CompressionMethod != CompressionDeflate {
+			return fmt.Errorf("compression strategy %v requires compression method deflate, got %v",
+				args.CompressionStrategy, args.CompressionMethod)
+		}
+	default:
+		return fmt.Errorf("unknown compression strategy %v", args.CompressionStrategy)
+	}
+	if args.AutoCompressionLevel && (args.CompressionMethod != CompressionDeflate ||
+		args.CompressionStrategy != CompressionStrategyDefault) {
+		return fmt.Errorf("auto compression level requires compression method deflate and the default strategy")
+	}
+
+	for _, p := range args.ModePatterns {
+		if p.Mode&^os.ModePerm != 0 {
+			return fmt.Errorf("mode %v of %q has bits other than the permissions", p.Mode, p.Pattern)
+		}
+	}
+
+	if args.StoreBelowBytes < 0 {
+		return fmt.Errorf("store below bytes must not be negative, got %d", args.StoreBelowBytes)
+	}
+
+	if args.MinFileSize < 0 || args.MaxFileSize < 0 {
+		return fmt.Errorf("file size limits must not be negative, got %d and %d",
+			args.MinFileSize, args.MaxFileSize)
+	}
+	if args.MaxFileSize > 0 && args.MinFileSize > args.MaxFileSize {
+		return fmt.Errorf("min file size %d is larger than max file size %d",
+			args.MinFileSize, args.MaxFileSize)
+	}
+
+	if len(args.ArchiveComment) > math.MaxUint16 {
+		return fmt.Errorf("archive comment is %d bytes, longer than the maximum of %d bytes",
+			len(args.ArchiveComment), math.MaxUint16)
+	}
+
+	if args.ManifestSourcePath != "" && args.ManifestContents != nil {
+		return fmt.Errorf("cannot specify both a manifest file %q and manifest contents",
+			args.ManifestSourcePath)
+	}
+
 	if args.EmulateJar {
 		args.AddDirectoryEntriesToZip = true
 	}
@@ -275,31 +1750,159 @@ func ZipTo(args ZipArgs, w io.Writer) error {
 	// Have Glob follow symlinks if they are not being stored as symlinks in the zip file.
 	followSymlinks := pathtools.ShouldFollowSymlinks(!args.StoreSymlinks)
 
+	timestamp := jar.DefaultTime
+	var epoch time.Time
+	if !args.Timestamp.IsZero() {
+		timestamp = clampTimestamp(args.Timestamp)
+	} else {
+		var err error
+		epoch, err = sourceDateEpoch()
+		if err != nil {
+			return err
+		}
+		timestamp = clampTimestamp(clampToEpoch(timestamp, epoch))
+	}
+
 	z := &ZipWriter{
-		time:               jar.DefaultTime,
+		ctx:                ctx,
+		time:               timestamp,
 		createdDirs:        make(map[string]string),
 		createdFiles:       make(map[string]string),
 		directories:        args.AddDirectoryEntriesToZip,
+		dirMode:            args.DirectoryMode,
 		compLevel:          args.CompressionLevel,
+		huffmanOnly:        args.CompressionStrategy == CompressionStrategyHuffmanOnly,
+		autoLevel:          args.AutoCompressionLevel,
+		levelPatterns:      args.CompressionLevelPatterns,
+		prefixMaps:         args.PrefixMaps,
+		modePatterns:       args.ModePatterns,
+		normalizePerms:     args.NormalizePermissions,
+		nonDeflatedFiles:   args.NonDeflatedFiles,
+		storedSuffixes:     extensionSuffixes(args.StoredExtensions),
+		storePatterns:      args.StorePatterns,
+		storePatternPaths:  args.StorePatternsMatchPath,
+		nameMapper:         args.NameMapper,
+		contentTransform:   args.ContentTransform,
+		cleanPaths:         !args.NoCleanPaths,
+		allowBackslashes:   args.AllowBackslashes,
 		followSymlinks:     followSymlinks,
 		ignoreMissingFiles: args.IgnoreMissingFiles,
-		stderr:             args.Stderr,
+		skipUnreadable:     args.SkipUnreadable,
+		forceZip64:         args.ForceZip64,
+		manifestContents:   args.ManifestContents,
+		largeFileThreshold: args.LargeFileThreshold,
+		cacheDir:           args.CacheDir,
+		storeBelow:         args.StoreBelowBytes,
+		minFileSize:        args.MinFileSize,
+		maxFileSize:        args.MaxFileSize,
+		skipMacOSCruft:     args.SkipMacOSCruft,
+		contentIndex:       args.WriteContentIndex,
+		maxOutputBytes:     args.MaxOutputBytes,
+		maxInFlightBytes:   args.MaxInFlightBytes,
+		sharedDictionary:   args.SharedDictionary,
+		password:           args.Password,
+		hostSystem:         args.HostSystem,
+		forceUTF8:          args.ForceUTF8,
+		dataDescriptors:    args.AlwaysDataDescriptor,
+		alignUncompressed:  args.AlignUncompressed,
+		recomputeCRC:       args.RecomputeCRC,
+		extAlignments:      extensionAlignments(args.AlignExtensions),
+		duplicateSymlinks:  args.DuplicatesAsSymlinks,
+		archiveComment:     args.ArchiveComment,
+		zipIgnore:          args.EnableZipIgnore,
+		progress:           args.ProgressFunc,
+		storeOwnership:     args.StoreOwnership,
+		storeXattrs:        args.StoreXattrs,
+		ntfsTimes:          args.StoreNTFSTimes,
+		extendedTime:       args.StoreExtendedTimestamp,
+		timestampOverride:  args.Timestamp,
+		sourceDateEpoch:    epoch,
+		stats:              stats,
+		existing:           existing,
+		dryRun:             args.DryRun,
+		stdout:             args.Stdout,
+		logger:             args.Logger,
+		logLevel:           args.LogLevel,
 		fs:                 args.Filesystem,
 	}
 
-	if z.fs == nil {
+	if z.dirMode == 0 {
+		z.dirMode = 0700
+	}
+
+	if args.FS != nil {
+		z.fs = newIoFs(args.FS)
+	} else if z.fs == nil {
 		z.fs = pathtools.OsFs
 	}
 
-	if z.stderr == nil {
-		z.stderr = os.Stderr
+	if z.stdout == nil {
+		z.stdout = os.Stdout
+	}
+
+	if z.logger == nil {
+		stderr := args.Stderr
+		if stderr == nil {
+			stderr = os.Stderr
+		}
+		z.logger = log.New(stderr, "", 0)
+	}
+
+	if args.PathSeparator == `\` {
+		z.backslashSeparators = true
+		z.warnf("writing names with backslash separators, which the zip format doesn't allow and most extractors don't treat as separators")
+	}
+
+	if existing != nil {
+		if z.archiveComment == "" {
+			z.archiveComment = existing.reader.Comment
+		}
+
+		// Don't write new entries for directories that are already in the zip file.
+		for _, f := range existing.reader.File {
+			if strings.HasSuffix(f.Name, "/") {
+				z.createdDirs[filepath.Clean(f.Name)] = args.OutputFilePath
+			}
+		}
 	}
 
 	pathMappings := []pathMapping{}
 
-	noCompression := args.CompressionLevel == 0
+	var err error
+	z.compressionMethod, err = args.CompressionMethod.zipMethod()
+	if err != nil {
+		return err
+	}
+	if args.CompressionRulesPath != "" {
+		z.compressionRules, err = z.readCompressionRules(args.CompressionRulesPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The zip files that entries are read from stay open until they have been written.
+	defer func() {
+		for _, archive := range z.archives {
+			archive.Close()
+		}
+	}()
 
 	for _, fa := range args.FileArgs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if fa.Reader != nil {
+			i := len(pathMappings)
+			err := z.fillPathPairs(fa, readerSource, &pathMappings)
+			if err != nil {
+				return err
+			}
+			if len(pathMappings) > i {
+				pathMappings[i].reader = fa.Reader
+			}
+			continue
+		}
+
 		var srcs []string
 		for _, s := range fa.SourceFiles {
 			s = strings.TrimSpace(s)
@@ -307,9 +1910,66 @@ func ZipTo(args ZipArgs, w io.Writer) error {
 				continue
 			}
 
-			globbed, _, err := z.fs.Glob(s, nil, followSymlinks)
-			if err != nil {
+			if archive, pattern, ok, err := z.splitArchiveSource(s); err != nil {
 				return err
+			} else if ok {
+				members, err := z.globArchive(archive, pattern)
+				if err != nil {
+					return err
+				}
+				if len(members) == 0 {
+					if args.ErrorOnEmptyGlob && strings.ContainsAny(pattern, "*?[") {
+						return fmt.Errorf("glob %q matched no files", s)
+					}
+					err := &os.PathError{
+						Op:   "lstat",
+						Path: s,
+						Err:  os.ErrNotExist,
+					}
+					if !args.IgnoreMissingFiles {
+						return err
+					}
+					z.warnf("%s", err)
+				}
+				srcs = append(srcs, members...)
+				continue
+			}
+
+			if fa.DestFile != "" || len(fa.DestFiles) > 0 {
+				// Renamed files are used as is instead of as a glob.
+				if exists, _, err := z.fs.Exists(s); err != nil {
+					return err
+				} else if !exists {
+					err := &os.PathError{
+						Op:   "lstat",
+						Path: s,
+						Err:  os.ErrNotExist,
+					}
+					if args.IgnoreMissingFiles {
+						z.warnf("%s", err)
+						continue
+					}
+					return err
+				}
+				srcs = append(srcs, s)
+				continue
+			}
+
+			var globbed []string
+			patterns := z.expandBraces(s)
+			for _, pattern := range patterns {
+				g, _, err := z.fs.Glob(pattern, nil, followSymlinks)
+				if err != nil {
+					return err
+				}
+				if len(g) == 0 && args.ErrorOnEmptyGlob &&
+					(len(patterns) > 1 || strings.ContainsAny(pattern, "*?[")) {
+					if pattern != s {
+						return fmt.Errorf("glob %q of %q matched no files", pattern, s)
+					}
+					return fmt.Errorf("glob %q matched no files", s)
+				}
+				globbed = append(globbed, g...)
 			}
 			if len(globbed) == 0 {
 				err := &os.PathError{
@@ -318,7 +1978,7 @@ func ZipTo(args ZipArgs, w io.Writer) error {
 					Err:  os.ErrNotExist,
 				}
 				if args.IgnoreMissingFiles {
-					fmt.Fprintln(z.stderr, "warning:", err)
+					z.warnf("%s", err)
 				} else {
 					return err
 				}
@@ -326,120 +1986,850 @@ func ZipTo(args ZipArgs, w io.Writer) error {
 			srcs = append(srcs, globbed...)
 		}
 		if fa.GlobDir != "" {
-			if exists, isDir, err := z.fs.Exists(fa.GlobDir); err != nil {
-				return err
-			} else if !exists && !args.IgnoreMissingFiles {
-				err := &os.PathError{
-					Op:   "lstat",
-					Path: fa.GlobDir,
-					Err:  os.ErrNotExist,
+			for _, globDir := range z.expandBraces(fa.GlobDir) {
+				dirArg := fa
+				dirArg.GlobDir = globDir
+
+				if exists, isDir, err := z.fs.Exists(globDir); err != nil {
+					return err
+				} else if !exists && !args.IgnoreMissingFiles {
+					err := &os.PathError{
+						Op:   "lstat",
+						Path: globDir,
+						Err:  os.ErrNotExist,
+					}
+					if args.IgnoreMissingFiles {
+						z.warnf("%s", err)
+					} else {
+						return err
+					}
+				} else if !isDir && !args.IgnoreMissingFiles {
+					err := &os.PathError{
+						Op:   "lstat",
+						Path: globDir,
+						Err:  syscall.ENOTDIR,
+					}
+					if args.IgnoreMissingFiles {
+						z.warnf("%s", err)
+					} else {
+						return err
+					}
+				} else if exists && isDir {
+					globbed, err := z.globDir(dirArg, args.ExcludePatterns, args.NumParallelJobs,
+						args.IgnoreErrors)
+					if err != nil {
+						return err
+					}
+					if len(globbed) == 0 && args.ErrorOnEmptyGlob {
+						return fmt.Errorf("directory %q matched no files", globDir)
+					}
+					srcs = append(srcs, globbed...)
 				}
-				if args.IgnoreMissingFiles {
-					fmt.Fprintln(z.stderr, "warning:", err)
-				} else {
+			}
+		}
+		for _, src := range srcs {
+			if z.skipMacOSCruft && isMacOSCruft(src) {
+				continue
+			}
+			if f, ok := z.archiveMembers[src]; ok {
+				// The entry is added as if it were a source file at its path in the zip file.
+				i := len(pathMappings)
+				if err := z.fillPathPairs(fa, f.Name, &pathMappings); err != nil {
 					return err
 				}
-			} else if !isDir && !args.IgnoreMissingFiles {
-				err := &os.PathError{
-					Op:   "lstat",
-					Path: fa.GlobDir,
-					Err:  syscall.ENOTDIR,
+				if len(pathMappings) > i {
+					pathMappings[i].src = src
+					pathMappings[i].reader = &archiveMemberReader{file: f}
 				}
-				if args.IgnoreMissingFiles {
-					fmt.Fprintln(z.stderr, "warning:", err)
-				} else {
-					return err
+				continue
+			}
+			if z.minFileSize > 0 || z.maxFileSize > 0 {
+				if z.sizeExcluded(src) {
+					continue
 				}
 			}
-			globbed, _, err := z.fs.Glob(filepath.Join(fa.GlobDir, "**/*"), nil, followSymlinks)
+			if len(fa.DestFiles) > 0 {
+				for _, dest := range fa.DestFiles {
+					destArg := fa
+					destArg.DestFile = dest
+					i := len(pathMappings)
+					if err := z.fillPathPairs(destArg, src, &pathMappings); err != nil {
+						return err
+					}
+					if len(pathMappings) > i {
+						pathMappings[i].multiDest = true
+					}
+				}
+				continue
+			}
+			err := z.fillPathPairs(fa, src, &pathMappings)
 			if err != nil {
 				return err
 			}
-			srcs = append(srcs, globbed...)
 		}
-		for _, src := range srcs {
-			err := fillPathPairs(fa, src, &pathMappings, args.NonDeflatedFiles, noCompression)
+	}
+
+	if args.StripTopLevel {
+		var stripped bool
+		pathMappings, stripped = z.stripTopLevel(pathMappings)
+		if !stripped && args.StripTopLevelRequired {
+			return fmt.Errorf("can't strip the top level directory, the files aren't all inside the same directory")
+		}
+	}
+
+	if args.ProvenanceEntry != "" {
+		contents, err := provenanceContents(args.FileArgs, z.time)
+		if err != nil {
+			return err
+		}
+		method := z.compressionMethod
+		if z.compLevel == 0 {
+			method = zip.Store
+		}
+		if outsideZip(filepath.ToSlash(args.ProvenanceEntry)) {
+			return DestinationOutsideZipError{Path: provenanceSource, Dest: args.ProvenanceEntry}
+		}
+		pathMappings = append(pathMappings, pathMapping{
+			dest:      filepath.Clean(args.ProvenanceEntry),
+			src:       provenanceSource,
+			zipMethod: method,
+			reader:    bytes.NewReader(contents),
+			compLevel: z.compLevel,
+		})
+	}
+
+	if args.WriteContentIndex {
+		for _, ele := range pathMappings {
+			if ele.dest == ContentIndexEntry {
+				return fmt.Errorf("destination %q of %q is reserved for the content index", ele.dest, ele.src)
+			}
+		}
+	}
+
+	if args.RenameOnCollision {
+		if args.DuplicateMode != DuplicateError {
+			return fmt.Errorf("rename on collision can't be combined with duplicate mode %v", args.DuplicateMode)
+		}
+		pathMappings = z.renameCollisions(pathMappings)
+	}
+
+	pathMappings, err = z.dedupPathMappings(pathMappings, args.DuplicateMode)
+	if err != nil {
+		return err
+	}
+
+	if args.AddIfMissing && existing != nil {
+		pathMappings = z.skipExistingEntries(pathMappings)
+	}
+
+	// Pick the compression of the files with an automatic level before the files that share
+	// their compressed contents are found, as they have to be compressed the same way.
+	for i, m := range pathMappings {
+		if m.autoLevel {
+			pathMappings[i].zipMethod, pathMappings[i].compLevel, err =
+				z.autoCompression(m.src, m.zipMethod, m.compLevel)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
-	return z.write(w, pathMappings, args.ManifestSourcePath, args.EmulateJar, args.SrcJar, args.NumParallelJobs)
+	if (args.DeduplicateContents || args.DuplicatesAsSymlinks) && !args.DryRun {
+		if err := z.findDuplicateContents(pathMappings); err != nil {
+			return err
+		}
+	}
+	if !args.DryRun {
+		z.findMultiDestContents(pathMappings)
+	}
+
+	if args.MaxNameLength > 0 {
+		if err := z.checkNameLengths(pathMappings, args.MaxNameLength); err != nil {
+			return err
+		}
+	}
+
+	if args.MaxEntries > 0 && len(pathMappings) > args.MaxEntries {
+		return fmt.Errorf("zip file would have %d entries, more than the maximum of %d",
+			len(pathMappings), args.MaxEntries)
+	}
+
+	for _, ele := range pathMappings {
+		if ele.comment != "" {
+			if z.comments == nil {
+				z.comments = make(map[string]string)
+			}
+			z.comments[filepath.Clean(ele.dest)] = ele.comment
+		}
+	}
+
+	if args.EmptyDirectoryEntries && !args.AddDirectoryEntriesToZip {
+		z.emptyDirs = z.emptyDirectories(pathMappings)
+	}
+
+	if args.JarOrdering && !args.EmulateJar {
+		// EmulateJar calls jarSort itself once the manifest has been added.
+		jarSort(pathMappings)
+	} else if args.SortEntries && !args.EmulateJar {
+		// EmulateJar uses jarSort, which already orders entries by name within each section of
+		// the jar.
+		sort.SliceStable(pathMappings, func(i, j int) bool {
+			return pathMappings[i].dest < pathMappings[j].dest
+		})
+	}
+
+	if args.OrderFilePath != "" {
+		pathMappings, err = z.orderPathMappings(pathMappings, args.OrderFilePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if args.FirstEntry != "" {
+		pathMappings, err = moveFirstEntry(pathMappings, args.FirstEntry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return z.write(w, pathMappings, args.ManifestSourcePath, args.EmulateJar, args.SrcJar, args.NumParallelJobs)
+}
+
+func Zip(args ZipArgs) error {
+	return zipFile(context.Background(), args, nil)
+}
+
+// ZipContext is like Zip, but stops writing the zip file once ctx is done and returns ctx.Err().
+// The partially written output file is removed, except when appending to an existing one.
+func ZipContext(ctx context.Context, args ZipArgs) error {
+	return zipFile(ctx, args, nil)
+}
+
+// ZipWithStats is like Zip, but also returns statistics about the entries that were written.
+func ZipWithStats(args ZipArgs) (*Stats, error) {
+	stats := &Stats{}
+	err := zipFile(context.Background(), args, stats)
+	return stats, err
+}
+
+func zipFile(ctx context.Context, args ZipArgs, stats *Stats) error {
+	if args.OutputFilePath == "" {
+		return fmt.Errorf("output file path must be nonempty")
+	}
+
+	// Check the level before creating the output file, zipTo checks it again for ZipTo callers.
+	if err := validCompressionLevel(args.CompressionLevel); err != nil {
+		return err
+	}
+
+	if args.SplitSize != 0 {
+		if args.SplitSize < MinSplitSize {
+			return fmt.Errorf("split size must be at least %d, got %d", MinSplitSize, args.SplitSize)
+		}
+		if args.Append || args.WriteIfChanged || args.ShaOutputPath != "" {
+			return fmt.Errorf("split is not supported with append, write if changed or sha output")
+		}
+		if args.DurableWrite {
+			return fmt.Errorf("split is not supported with durable write")
+		}
+	}
+
+	if args.DryRun {
+		// Nothing is written, so the output file is never created.
+		return zipTo(ctx, args, nil, stats, nil)
+	}
+
+	if args.OutputFilePath == "-" {
+		// The zip writer never seeks, offsets for the central directory are tracked by
+		// counting the bytes written, so the zip file can be streamed straight to stdout.
+		if err := checkNoOutputFile(args, "writing to stdout"); err != nil {
+			return err
+		}
+		stdout := args.Stdout
+		if stdout == nil {
+			stdout = os.Stdout
+		}
+		return zipTo(ctx, args, stdout, stats, nil)
+	}
+
+	if args.Append {
+		if args.WriteIfChanged {
+			return fmt.Errorf("write if changed is not supported when appending")
+		}
+		if _, err := os.Stat(args.OutputFilePath); err == nil {
+			if err := appendZip(ctx, args, stats); err != nil {
+				return err
+			}
+			return readBackOutput(args)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		// There is nothing to append to yet, create the zip file as usual.
+	}
+
+	f, err := createTempOutput(args.TempDir, args.OutputFilePath)
+	if err != nil {
+		return err
+	}
+	// Once it has been renamed there is nothing left to remove.
+	defer os.Remove(f.Name())
+
+	err = zipTo(ctx, args, f, stats, nil)
+	if err == nil && args.DurableWrite {
+		err = outputSyncer.syncFile(f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if args.WriteIfChanged {
+		if same, err := sameContents(f.Name(), args.OutputFilePath); err != nil {
+			return err
+		} else if !same {
+			if err := moveOutput(f.Name(), args.OutputFilePath, args.DurableWrite); err != nil {
+				return err
+			}
+		}
+	} else if err := moveOutput(f.Name(), args.OutputFilePath, args.DurableWrite); err != nil {
+		return err
+	}
+
+	if err := readBackOutput(args); err != nil {
+		return err
+	}
+	if args.SplitSize != 0 {
+		return splitZip(args.OutputFilePath, args.SplitSize)
+	}
+	return nil
+}
+
+// checkNoOutputFile returns an error if args use any of the options that need the zip file to be
+// written to OutputFilePath, which isn't the case when it is written to a stream.
+func checkNoOutputFile(args ZipArgs, where string) error {
+	if args.WriteIfChanged {
+		return fmt.Errorf("write if changed is not supported when %s", where)
+	}
+	if args.Append {
+		return fmt.Errorf("append is not supported when %s", where)
+	}
+	if args.ListOutputPath != "" {
+		return fmt.Errorf("list output is not supported when %s", where)
+	}
+	if args.VerifyAfterWrite {
+		return fmt.Errorf("verify is not supported when %s", where)
+	}
+	if args.SplitSize != 0 {
+		return fmt.Errorf("split is not supported when %s", where)
+	}
+	if args.ShaOutputPath != "" {
+		return fmt.Errorf("sha256 output is not supported when %s", where)
+	}
+	if args.TempDir != "" {
+		return fmt.Errorf("temp dir is not supported when %s", where)
+	}
+	if args.DurableWrite {
+		return fmt.Errorf("durable write is not supported when %s", where)
+	}
+	return nil
+}
+
+// readBackOutput runs the steps that need to read the finished zip file at args.OutputFilePath.
+func readBackOutput(args ZipArgs) error {
+	if args.ShaOutputPath != "" {
+		if err := writeSha256(args.ShaOutputPath, args.OutputFilePath, args.WriteIfChanged); err != nil {
+			return err
+		}
+	}
+
+	if args.ListOutputPath == "" && !args.VerifyAfterWrite {
+		return nil
+	}
+
+	r, err := zip.OpenReader(args.OutputFilePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if args.CompressionMethod == CompressionDeflateSharedDictionaryNonPortable {
+		r.RegisterDecompressor(SharedDictionaryMethod,
+			NewSharedDictionaryDecompressor(args.SharedDictionary))
+	}
+
+	if args.VerifyAfterWrite {
+		if err := verifyZip(args.OutputFilePath, &r.Reader); err != nil {
+			return err
+		}
+	}
+
+	if args.ListOutputPath != "" {
+		return writeListing(args.ListOutputPath, &r.Reader, args.WriteIfChanged)
+	}
+	return nil
+}
+
+// dedupPathMappings applies mode to the path mappings that have the same destination.  Mappings of
+// directories to the same destination are all kept, as the directory entry is only written once.
+// When the last mapping wins it takes the position of the first one.
+func (z *ZipWriter) dedupPathMappings(mappings []pathMapping, mode DuplicateMode) ([]pathMapping, error) {
+	var ret []pathMapping
+	indexes := make(map[string]int)
+
+	for _, ele := range mappings {
+		i, exists := indexes[ele.dest]
+		if !exists {
+			indexes[ele.dest] = len(ret)
+			ret = append(ret, ele)
+			continue
+		}
+
+		prev := ret[i]
+		if z.isDir(prev.src) && z.isDir(ele.src) {
+			ret = append(ret, ele)
+			continue
+		}
+
+		switch mode {
+		case DuplicateError:
+			return nil, fmt.Errorf("destination %q has two files %q and %q", ele.dest, prev.src, ele.src)
+		case DuplicateFirst:
+		case DuplicateLast:
+			ret[i] = ele
+		default:
+			return nil, fmt.Errorf("unknown duplicate mode %v", mode)
+		}
+	}
+
+	return ret, nil
+}
+
+// renameCollisions gives the path mappings of files whose destination is the same as an earlier
+// mapping's a new unique destination, with the smallest _N suffix before the extension that isn't
+// the destination of any other mapping.
+func (z *ZipWriter) renameCollisions(mappings []pathMapping) []pathMapping {
+	taken := make(map[string]bool)
+	for _, ele := range mappings {
+		taken[ele.dest] = true
+	}
+
+	seen := make(map[string]string)
+	for i, ele := range mappings {
+		prev, exists := seen[ele.dest]
+		if !exists {
+			seen[ele.dest] = ele.src
+			continue
+		}
+		if z.isDir(prev) && z.isDir(ele.src) {
+			continue
+		}
+
+		dir, base := filepath.Split(ele.dest)
+		ext := filepath.Ext(base)
+		if ext == base {
+			// Dot files like .config have no extension.
+			ext = ""
+		}
+		stem := strings.TrimSuffix(base, ext)
+		for n := 1; ; n++ {
+			dest := dir + stem + "_" + strconv.Itoa(n) + ext
+			if !taken[dest] {
+				taken[dest] = true
+				seen[dest] = ele.src
+				mappings[i].dest = dest
+				break
+			}
+		}
+	}
+	return mappings
+}
+
+// stripTopLevel removes the first directory from the destinations of mappings if they are all
+// inside it and drops the mappings of the directory itself.  It returns mappings unchanged and
+// false if there are no mappings or they aren't all inside the same directory.
+func (z *ZipWriter) stripTopLevel(mappings []pathMapping) ([]pathMapping, bool) {
+	top := ""
+	for _, ele := range mappings {
+		dir := ele.dest
+		if i := strings.IndexByte(dir, '/'); i >= 0 {
+			dir = dir[:i]
+		} else if !z.isDir(ele.src) {
+			return mappings, false
+		}
+		if top == "" {
+			top = dir
+		} else if dir != top {
+			return mappings, false
+		}
+	}
+	if top == "" {
+		return mappings, false
+	}
+
+	ret := mappings[:0]
+	for _, ele := range mappings {
+		if ele.dest == top {
+			continue
+		}
+		ele.dest = strings.TrimPrefix(ele.dest, top+"/")
+		ret = append(ret, ele)
+	}
+	return ret, true
+}
+
+// moveFirstEntry moves the mapping whose destination is first to the front of mappings, keeping
+// the order of the others.
+func moveFirstEntry(mappings []pathMapping, first string) ([]pathMapping, error) {
+	first = filepath.Clean(first)
+	for i, ele := range mappings {
+		if ele.dest == first {
+			copy(mappings[1:i+1], mappings[:i])
+			mappings[0] = ele
+			return mappings, nil
+		}
+	}
+	return nil, fmt.Errorf("first entry %q is not in the zip file", first)
+}
+
+// orderPathMappings moves the mappings whose destinations are listed in orderFile, one per line, to
+// the front in the order they are listed, and keeps the others after them in their current order.
+// Listed names that aren't the destination of any mapping are warned about.
+func (z *ZipWriter) orderPathMappings(mappings []pathMapping, orderFile string) ([]pathMapping, error) {
+	f, err := z.fs.Open(orderFile)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := make(map[string]int)
+	for i, ele := range mappings {
+		indexes[filepath.ToSlash(filepath.Clean(ele.dest))] = i
+	}
+
+	ret := make([]pathMapping, 0, len(mappings))
+	ordered := make([]bool, len(mappings))
+	for _, name := range strings.Split(string(contents), "\n") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		i, exists := indexes[path.Clean(name)]
+		if !exists {
+			z.warnf("%s: %q is not in the zip file", orderFile, name)
+			continue
+		}
+		if !ordered[i] {
+			ordered[i] = true
+			ret = append(ret, mappings[i])
+		}
+	}
+	for i, ele := range mappings {
+		if !ordered[i] {
+			ret = append(ret, ele)
+		}
+	}
+	return ret, nil
+}
+
+// checkNameLengths returns an error for the first mapping whose name in the zip file is longer than
+// max bytes.
+func (z *ZipWriter) checkNameLengths(mappings []pathMapping, max int) error {
+	for _, ele := range mappings {
+		name := ele.dest
+		if z.isDir(ele.src) {
+			name += "/"
+		}
+		if len(name) > max {
+			return fmt.Errorf("name of entry %q is %d bytes, longer than the maximum of %d bytes",
+				name, len(name), max)
+		}
+	}
+	return nil
+}
+
+// emptyDirectories returns the destinations of the directories in mappings that no other mapping
+// is inside of.
+func (z *ZipWriter) emptyDirectories(mappings []pathMapping) map[string]bool {
+	parents := make(map[string]bool)
+	for _, ele := range mappings {
+		for dir := filepath.Dir(filepath.Clean(ele.dest)); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+			parents[dir] = true
+		}
+	}
+
+	ret := make(map[string]bool)
+	for _, ele := range mappings {
+		dest := filepath.Clean(ele.dest)
+		if !parents[dest] && z.isDir(ele.src) {
+			ret[dest] = true
+		}
+	}
+	return ret
+}
+
+// isMacOSCruft returns true if path is inside a __MACOSX directory or is an AppleDouble file,
+// whose name starts with "._".
+func isMacOSCruft(path string) bool {
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if elem == "__MACOSX" {
+			return true
+		}
+	}
+	return strings.HasPrefix(filepath.Base(path), "._")
+}
+
+// sizeExcluded returns true if path is a regular file whose size is outside of minFileSize and
+// maxFileSize.  Files that can't be stat'd are left for addFile to report.
+func (z *ZipWriter) sizeExcluded(path string) bool {
+	var info os.FileInfo
+	var err error
+	if z.followSymlinks {
+		info, err = z.fs.Stat(path)
+	} else {
+		info, err = z.fs.Lstat(path)
+	}
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	return info.Size() < z.minFileSize || (z.maxFileSize > 0 && info.Size() > z.maxFileSize)
+}
+
+// fileExtras returns the extra fields for a file with the given stat.
+func (z *ZipWriter) fileExtras(info os.FileInfo) []byte {
+	extra := append(z.ownershipExtra(info), z.ntfsExtra(info)...)
+	return append(extra, z.extendedTimestamp(info)...)
 }
 
-func Zip(args ZipArgs) error {
-	if args.OutputFilePath == "" {
-		return fmt.Errorf("output file path must be nonempty")
+// isDir returns true if path is a directory, following symlinks only if they are being followed
+// when adding files.
+func (z *ZipWriter) isDir(path string) bool {
+	var info os.FileInfo
+	var err error
+	if z.followSymlinks {
+		info, err = z.fs.Stat(path)
+	} else {
+		info, err = z.fs.Lstat(path)
 	}
+	return err == nil && info.IsDir()
+}
 
-	buf := &bytes.Buffer{}
-	var out io.Writer = buf
-
-	if !args.WriteIfChanged {
-		f, err := os.Create(args.OutputFilePath)
-		if err != nil {
-			return err
+// extensionSuffixes returns the lowercased suffixes, including the leading ".", of files with the
+// given extensions.
+func extensionSuffixes(extensions []string) []string {
+	var ret []string
+	for _, ext := range extensions {
+		ext = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(ext)), ".")
+		if ext != "" {
+			ret = append(ret, "."+ext)
 		}
-
-		defer f.Close()
-		defer func() {
-			if err != nil {
-				os.Remove(args.OutputFilePath)
-			}
-		}()
-
-		out = f
 	}
+	return ret
+}
 
-	err := ZipTo(args, out)
-	if err != nil {
-		return err
+// extensionAlignments returns alignments keyed by the suffixes of their extensions, see
+// extensionSuffixes.
+func extensionAlignments(alignments map[string]int) map[string]int {
+	if len(alignments) == 0 {
+		return nil
 	}
-
-	if args.WriteIfChanged {
-		err := pathtools.WriteFileIfChanged(args.OutputFilePath, buf.Bytes(), 0666)
-		if err != nil {
-			return err
+	ret := make(map[string]int)
+	for ext, align := range alignments {
+		for _, suffix := range extensionSuffixes([]string{ext}) {
+			ret[suffix] = align
 		}
 	}
+	return ret
+}
 
-	return nil
+// extensionAlignment returns the alignment for name from AlignExtensions, or 0 if its extension
+// isn't in it.
+func (z *ZipWriter) extensionAlignment(name string) int {
+	lowerName := strings.ToLower(name)
+	align, longest := 0, 0
+	for suffix, a := range z.extAlignments {
+		if len(suffix) > longest && strings.HasSuffix(lowerName, suffix) {
+			align, longest = a, len(suffix)
+		}
+	}
+	return align
 }
 
-func fillPathPairs(fa FileArg, src string, pathMappings *[]pathMapping,
-	nonDeflatedFiles map[string]bool, noCompression bool) error {
+// ComputeDest returns the path in the zip file of the source file src of fa, without accessing the
+// filesystem.  It applies DestFile, or JunkPaths and JunkPathsExceptions, or SourcePrefixToStrip
+// and StripComponents, and then PathPrefixInZip, the way Zip does before the options of ZipArgs
+// that rewrite paths, like PrefixMaps, NameMapper and CleanPaths.  It returns an
+// IncorrectRelativeRootError if src is not inside of SourcePrefixToStrip, and a
+// StripComponentsError if stripping StripComponents components leaves no name, in which case Zip
+// skips the file with a warning.
+func ComputeDest(fa FileArg, src string) (string, error) {
+	junk := fa.JunkPaths
+	if junk {
+		for _, pattern := range fa.JunkPathsExceptions {
+			match, err := pathtools.Match(pattern, src)
+			if err != nil {
+				return "", err
+			}
+			if match {
+				junk = false
+				break
+			}
+		}
+	}
+
+	if fa.DestFile != "" {
+		return filepath.Clean(fa.DestFile), nil
+	}
 
 	var dest string
-
-	if fa.JunkPaths {
+	if junk {
 		dest = filepath.Base(src)
 	} else {
 		var err error
 		dest, err = filepath.Rel(fa.SourcePrefixToStrip, src)
 		if err != nil {
-			return err
+			return "", err
 		}
-		if strings.HasPrefix(dest, "../") {
-			return IncorrectRelativeRootError{
+		if dest == ".." || strings.HasPrefix(dest, "../") {
+			return "", IncorrectRelativeRootError{
 				Path:         src,
 				RelativeRoot: fa.SourcePrefixToStrip,
 			}
 		}
 
+		if fa.StripComponents > 0 {
+			components := strings.Split(dest, "/")
+			if len(components) <= fa.StripComponents {
+				return "", StripComponentsError{Path: src, Components: fa.StripComponents}
+			}
+			dest = filepath.Join(components[fa.StripComponents:]...)
+		}
+	}
+	return filepath.Join(fa.PathPrefixInZip, dest), nil
+}
+
+// zipPath returns the OS path p, whose directories are separated by sep, with forward slashes
+// instead, as names in zip files are always separated by forward slashes.
+func zipPath(p string, sep byte) string {
+	if sep == '/' {
+		return p
+	}
+	return strings.Replace(p, string(sep), "/", -1)
+}
+
+func (z *ZipWriter) fillPathPairs(fa FileArg, src string, pathMappings *[]pathMapping) error {
+	dest, err := ComputeDest(fa, src)
+	if stripErr, ok := err.(StripComponentsError); ok {
+		z.warnf("skipping %q, stripping %d path components leaves no name", src, stripErr.Components)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	dest = zipPath(dest, filepath.Separator)
+
+	if len(z.prefixMaps) > 0 {
+		dest = applyPrefixMaps(z.prefixMaps, dest)
+	}
+
+	if z.nameMapper != nil {
+		var include bool
+		dest, include = z.nameMapper(src, dest)
+		if !include {
+			return nil
+		}
+		if dest == "" {
+			return fmt.Errorf("name mapper returned an empty name for %q", src)
+		}
+	}
+
+	if z.cleanPaths {
+		cleaned := path.Clean(filepath.ToSlash(dest))
+		if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+			return DestinationOutsideZipError{Path: src, Dest: dest}
+		}
+		dest = cleaned
+	}
+
+	if !z.allowBackslashes && strings.Contains(dest, `\`) {
+		return BackslashInNameError{Path: src, Dest: dest}
+	}
+
+	rule, err := z.compressionRule(dest)
+	if err != nil {
+		return err
+	}
+
+	compLevel := z.compLevel
+	autoLevel := z.autoLevel
+	if fa.CompressionLevel != nil {
+		compLevel = *fa.CompressionLevel
+		autoLevel = false
+	} else if rule != nil && rule.level != nil {
+		compLevel = *rule.level
+		autoLevel = false
+	} else {
+		for _, p := range z.levelPatterns {
+			match, err := pathtools.Match(p.Pattern, dest)
+			if err != nil {
+				return fmt.Errorf("%s: %s", p.Pattern, err)
+			}
+			if match {
+				compLevel = p.Level
+				autoLevel = false
+				break
+			}
+		}
 	}
-	dest = filepath.Join(fa.PathPrefixInZip, dest)
 
-	zipMethod := zip.Deflate
-	if _, found := nonDeflatedFiles[dest]; found || noCompression {
+	zipMethod := z.compressionMethod
+	if rule != nil {
+		zipMethod = rule.method
+	}
+	if compLevel == 0 {
+		zipMethod = zip.Store
+	} else if _, found := z.nonDeflatedFiles[dest]; found {
+		zipMethod = zip.Store
+	} else if len(z.storedSuffixes) > 0 {
+		lowerDest := strings.ToLower(dest)
+		for _, suffix := range z.storedSuffixes {
+			if strings.HasSuffix(lowerDest, suffix) {
+				zipMethod = zip.Store
+				break
+			}
+		}
+	}
+	if zipMethod != zip.Store && z.extensionAlignment(dest) > 0 {
+		// Aligned files have to be stored to be mapped into memory.
 		zipMethod = zip.Store
 	}
-	*pathMappings = append(*pathMappings,
-		pathMapping{dest: dest, src: src, zipMethod: zipMethod})
+	if zipMethod != zip.Store && len(z.storePatterns) > 0 {
+		name := filepath.Base(src)
+		if z.storePatternPaths || src == readerSource {
+			name = dest
+		}
+		for _, pattern := range z.storePatterns {
+			match, err := pathtools.Match(pattern, name)
+			if err != nil {
+				return fmt.Errorf("%s: %s", pattern, err)
+			}
+			if match {
+				zipMethod = zip.Store
+				break
+			}
+		}
+	}
+	*pathMappings = append(*pathMappings, pathMapping{dest: dest, src: src, zipMethod: zipMethod,
+		comment: fa.Comment, compLevel: compLevel, autoLevel: autoLevel && zipMethod == zip.Deflate})
 
 	return nil
 }
 
+// jarSort orders mappings the way jar files are ordered, see ZipArgs.JarOrdering.
 func jarSort(mappings []pathMapping) {
 	less := func(i int, j int) (smaller bool) {
 		return jar.EntryNamesLess(mappings[i].dest, mappings[j].dest)
@@ -447,6 +2837,13 @@ func jarSort(mappings []pathMapping) {
 	sort.SliceStable(mappings, less)
 }
 
+// write writes the entries of pathMappings to f, compressing up to parallelJobs of them at the
+// same time.  The output only depends on pathMappings and not on the order in which compressions
+// finish: entries are written in the order of pathMappings, which is the order of FileArgs unless
+// they are sorted by SortEntries, JarOrdering or an order file, the blocks of files compressed in
+// parallel are written in the order they appear in the file, and the central directory lists the
+// entries in the order they were written.  Each entry and each block gets a channel, queued
+// before its compression starts, that the write loop waits on in turn.
 func (z *ZipWriter) write(f io.Writer, pathMappings []pathMapping, manifest string, emulateJar, srcJar bool,
 	parallelJobs int) error {
 
@@ -467,44 +2864,112 @@ func (z *ZipWriter) write(f io.Writer, pathMappings []pathMapping, manifest stri
 	// parallel compressions and outstanding buffers.
 	z.writeOps = make(chan chan *zipEntry, 1000)
 	z.cpuRateLimiter = NewCPURateLimiter(int64(parallelJobs))
-	z.memoryRateLimiter = NewMemoryRateLimiter(0)
+	z.memoryRateLimiter = NewMemoryRateLimiter(z.maxInFlightBytes)
 	defer func() {
 		z.cpuRateLimiter.Stop()
 		z.memoryRateLimiter.Stop()
 	}()
 
-	if manifest != "" && !emulateJar {
+	if (manifest != "" || z.manifestContents != nil) && !emulateJar {
 		return errors.New("must specify --jar when specifying a manifest via -m")
 	}
 
 	if emulateJar {
 		// manifest may be empty, in which case addManifest will fill in a default
-		pathMappings = append(pathMappings, pathMapping{jar.ManifestFile, manifest, zip.Deflate})
+		pathMappings = append(pathMappings, pathMapping{dest: jar.ManifestFile, src: manifest, zipMethod: zip.Deflate})
 
 		jarSort(pathMappings)
 	}
 
+	if z.dryRun {
+		return z.printPlan(pathMappings)
+	}
+
 	go func() {
 		var err error
 		defer close(z.writeOps)
 
 		for _, ele := range pathMappings {
+			if z.ctx.Err() != nil {
+				// The write loop returns the error.
+				return
+			}
 			if emulateJar && ele.dest == jar.ManifestFile {
 				err = z.addManifest(ele.dest, ele.src, ele.zipMethod)
+			} else if ele.reader != nil {
+				err = z.addReader(ele.dest, ele.src, ele.reader, ele.zipMethod, ele.compLevel, emulateJar)
 			} else {
-				err = z.addFile(ele.dest, ele.src, ele.zipMethod, emulateJar, srcJar)
+				err = z.addFile(ele.dest, ele.src, ele.zipMethod, ele.compLevel, emulateJar, srcJar)
 			}
 			if err != nil {
 				z.errors <- err
 				return
 			}
+			if z.progress != nil {
+				progressChan := make(chan *zipEntry, 1)
+				progressChan <- &zipEntry{progress: true}
+				close(progressChan)
+				z.writeOps <- progressChan
+			}
 		}
 	}()
 
+	if z.maxOutputBytes > 0 {
+		limited := &sizeLimitWriter{w: f, max: z.maxOutputBytes}
+		if z.existing != nil {
+			// The existing entries before the offset are kept.
+			limited.written = z.existing.offset
+		}
+		f = limited
+	}
+
 	zipw := zip.NewWriter(f)
+	zipw.SetForceZip64(z.forceZip64)
+	if err := zipw.SetComment(z.archiveComment); err != nil {
+		return err
+	}
+
+	// Headers of the existing entries that are kept.
+	var kept []*zip.FileHeader
+
+	if z.existing != nil {
+		// Keep the existing entries that aren't being replaced, new entries are written after
+		// them where the old central directory started.
+		zipw.SetOffset(z.existing.offset)
+
+		replaced := make(map[string]bool)
+		for _, ele := range pathMappings {
+			replaced[ele.dest] = true
+		}
+		if z.contentIndex {
+			// The content index of the existing entries is replaced by a new one.
+			replaced[ContentIndexEntry] = true
+		}
+		for _, file := range z.existing.reader.File {
+			if !replaced[file.Name] {
+				if z.recomputeCRC {
+					if err := verifyEntry(file); err != nil {
+						return fmt.Errorf("failed to keep existing entry %q: %s", file.Name, err)
+					}
+				}
+				zipw.KeepEntry(file)
+				kept = append(kept, &file.FileHeader)
+			}
+		}
+	}
+
+	// Headers of the written entries, their compressed sizes are only final once the zip writer
+	// has finished with them.
+	var written []*zip.FileHeader
+
+	// The number of path mappings whose entries have all been written.
+	progressDone := 0
 
 	var currentWriteOpChan chan *zipEntry
 	var currentWriter io.WriteCloser
+	// The memory reserved for the contents of the entry being written, released once the whole
+	// entry has been written.
+	var currentAllocated int64
 	var currentReaders chan chan io.Reader
 	var currentReader chan io.Reader
 	var done bool
@@ -535,9 +3000,74 @@ func (z *ZipWriter) write(f io.Writer, pathMappings []pathMapping, manifest stri
 		case op := <-writeOpChan:
 			currentWriteOpChan = nil
 
+			if op.progress {
+				progressDone++
+				z.progress(progressDone, len(pathMappings))
+				continue
+			}
+
+			if z.comments != nil {
+				op.fh.Comment = z.comments[filepath.Clean(op.fh.Name)]
+			}
+
+			if z.storeOwnership && !hasExtraTag(op.fh.Extra, UnixOwnershipTag) {
+				// Directories and files that weren't read from the filesystem.
+				op.fh.Extra = append(op.fh.Extra, z.ownershipExtra(nil)...)
+			}
+			if z.ntfsTimes && !hasExtraTag(op.fh.Extra, NTFSTimesTag) {
+				op.fh.Extra = append(op.fh.Extra, z.ntfsExtra(nil)...)
+			}
+			if z.extendedTime && !hasExtraTag(op.fh.Extra, zip.ExtendedTimeStampTag) {
+				op.fh.Extra = append(op.fh.Extra, z.extendedTimestamp(nil)...)
+			}
+
+			if len(z.modePatterns) > 0 {
+				if err := z.applyModePatterns(op.fh); err != nil {
+					return err
+				}
+			}
+			if err := z.setHostSystem(op.fh); err != nil {
+				return err
+			}
+			if z.forceUTF8 {
+				if !utf8.ValidString(op.fh.Name) || !utf8.ValidString(op.fh.Comment) {
+					return fmt.Errorf("name or comment of %q is not valid UTF-8", op.fh.Name)
+				}
+				// Entries with non-ASCII names get the flag from the zip writer.
+				op.fh.Flags |= utf8Flag
+			}
+
+			encrypt := z.password != "" && !strings.HasSuffix(op.fh.Name, "/")
+			if encrypt {
+				op.fh.Extra = append(op.fh.Extra, aesExtra(op.fh.Method)...)
+				op.fh.Method = AESMethod
+				op.fh.Flags |= encryptedFlag
+			}
+
+			if z.extendedTime {
+				// Only the local header holds the atime.
+				op.fh.LocalExtra = op.fh.Extra
+				op.fh.Extra = centralExtendedTimestamp(op.fh.Extra)
+			}
+
+			if op.fh.Method == zip.Store && !strings.HasSuffix(op.fh.Name, "/") {
+				op.fh.Alignment = z.alignUncompressed
+				if align := z.extensionAlignment(op.fh.Name); align > 0 {
+					op.fh.Alignment = align
+				}
+			}
+			if z.backslashSeparators {
+				op.fh.Name = strings.Replace(op.fh.Name, "/", `\`, -1)
+			}
+
 			var err error
-			if op.fh.Method == zip.Deflate {
+			if op.fh.Method != zip.Store || z.dataDescriptors {
+				// The contents of stored entries are already known, so they can be written
+				// as is with a data descriptor like compressed contents.
 				currentWriter, err = zipw.CreateCompressedHeader(op.fh)
+				if err == nil && encrypt {
+					currentWriter, err = newAESWriter(currentWriter, op.fh, z.password)
+				}
 			} else {
 				var zw io.Writer
 
@@ -549,13 +3079,18 @@ func (z *ZipWriter) write(f io.Writer, pathMappings []pathMapping, manifest stri
 			if err != nil {
 				return err
 			}
+			written = append(written, op.fh)
+			if z.logLevel == LogVerbose {
+				z.logger.Printf("adding %s (%s)", op.fh.Name, methodName(op.fh.Method))
+			}
 
 			currentReaders = op.futureReaders
+			currentAllocated = op.allocatedSize
 			if op.futureReaders == nil {
 				currentWriter.Close()
 				currentWriter = nil
+				z.memoryRateLimiter.Finish(currentAllocated)
 			}
-			z.memoryRateLimiter.Finish(op.allocatedSize)
 
 		case futureReader, ok := <-readersChan:
 			if !ok {
@@ -563,6 +3098,7 @@ func (z *ZipWriter) write(f io.Writer, pathMappings []pathMapping, manifest stri
 				currentWriter.Close()
 				currentWriter = nil
 				currentReaders = nil
+				z.memoryRateLimiter.Finish(currentAllocated)
 			}
 
 			currentReader = futureReader
@@ -577,6 +3113,9 @@ func (z *ZipWriter) write(f io.Writer, pathMappings []pathMapping, manifest stri
 
 		case err := <-z.errors:
 			return err
+
+		case <-z.ctx.Done():
+			return z.ctx.Err()
 		}
 	}
 
@@ -585,13 +3124,57 @@ func (z *ZipWriter) write(f io.Writer, pathMappings []pathMapping, manifest stri
 	case err := <-z.errors:
 		return err
 	default:
-		zipw.Close()
+		if err := z.ctx.Err(); err != nil {
+			// The entries after the cancellation were never added.
+			return err
+		}
+		if z.contentIndex {
+			fh, err := z.writeContentIndex(zipw, append(kept, written...))
+			if err != nil {
+				return err
+			}
+			written = append(written, fh)
+		}
+		if err := zipw.Close(); err != nil {
+			return err
+		}
+		if z.stats != nil {
+			for _, fh := range written {
+				z.stats.add(fh)
+			}
+			z.stats.SharedDictionarySavedBytes += z.sharedDictionarySavedBytes
+			z.stats.DeduplicatedEntries += z.deduplicatedEntries
+			z.stats.SkippedFiles = append(z.stats.SkippedFiles, z.skippedFiles...)
+			z.stats.SkippedExistingEntries = append(z.stats.SkippedExistingEntries, z.skippedExisting...)
+			z.stats.CachedEntries += z.cachedEntries
+			if peak := z.memoryRateLimiter.Peak(); peak > z.stats.PeakInFlightBytes {
+				z.stats.PeakInFlightBytes = peak
+			}
+		}
 		return nil
 	}
 }
 
+// printPlan writes the destination and source of each path mapping to z.stdout instead of writing
+// them to the zip file.
+func (z *ZipWriter) printPlan(pathMappings []pathMapping) error {
+	printed := make(map[string]bool)
+	for _, ele := range pathMappings {
+		// Directories mapped to the same destination are only written once.
+		if printed[ele.dest] {
+			continue
+		}
+		printed[ele.dest] = true
+
+		if _, err := fmt.Fprintf(z.stdout, "%s\t%s\n", ele.dest, ele.src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // imports (possibly with compression) <src> into the zip at sub-path <dest>
-func (z *ZipWriter) addFile(dest, src string, method uint16, emulateJar, srcJar bool) error {
+func (z *ZipWriter) addFile(dest, src string, method uint16, level int, emulateJar, srcJar bool) error {
 	var fileSize int64
 	var executable bool
 
@@ -605,7 +3188,10 @@ func (z *ZipWriter) addFile(dest, src string, method uint16, emulateJar, srcJar
 
 	if err != nil {
 		if os.IsNotExist(err) && z.ignoreMissingFiles {
-			fmt.Fprintln(z.stderr, "warning:", err)
+			z.warnf("%s", err)
+			return nil
+		} else if !os.IsNotExist(err) && z.skipUnreadable {
+			z.skipUnreadableFile(src, err)
 			return nil
 		}
 		return err
@@ -629,7 +3215,7 @@ func (z *ZipWriter) addFile(dest, src string, method uint16, emulateJar, srcJar
 	}
 
 	if s.IsDir() {
-		if z.directories {
+		if z.directories || z.emptyDirs[filepath.Clean(dest)] {
 			return z.writeDirectory(dest, src, emulateJar)
 		}
 		return nil
@@ -639,10 +3225,10 @@ func (z *ZipWriter) addFile(dest, src string, method uint16, emulateJar, srcJar
 			return err
 		}
 
-		return z.writeSymlink(dest, src)
+		return z.writeSymlink(dest, src, s)
 	} else if s.Mode().IsRegular() {
-		r, err := z.fs.Open(src)
-		if err != nil {
+		r, err := z.openSource(src, s.Size())
+		if err != nil || r == nil {
 			return err
 		}
 
@@ -662,15 +3248,41 @@ func (z *ZipWriter) addFile(dest, src string, method uint16, emulateJar, srcJar
 		}
 
 		fileSize = s.Size()
+		if z.contentTransform != nil {
+			transformed, err := z.transformContents(dest, r)
+			if err != nil {
+				return err
+			}
+			r = transformed
+			fileSize = transformed.Size()
+		}
 		executable = s.Mode()&0100 != 0
 
+		xattrs, err := z.fileXattrExtra(src)
+		if err != nil {
+			return err
+		}
+
 		header := &zip.FileHeader{
 			Name:               dest,
 			Method:             method,
 			UncompressedSize64: uint64(fileSize),
+			Extra:              append(z.fileExtras(s), xattrs...),
 		}
 
-		if executable {
+		// The setuid, setgid and sticky bits are always kept, along with the permissions of the
+		// source file if NormalizePermissions doesn't replace them, as the file needs them to
+		// work.
+		special := s.Mode() & (os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if z.normalizePerms {
+			if s.Mode()&0111 != 0 {
+				header.SetMode(0755 | special)
+			} else {
+				header.SetMode(0644 | special)
+			}
+		} else if special != 0 {
+			header.SetMode(s.Mode().Perm() | special)
+		} else if executable {
 			header.SetMode(0700)
 		}
 
@@ -679,12 +3291,126 @@ func (z *ZipWriter) addFile(dest, src string, method uint16, emulateJar, srcJar
 			return err
 		}
 
-		return z.writeFileContents(header, r)
+		if z.contentTransform != nil {
+			return z.writeFileContents(header, level, r)
+		}
+		if z.sharedContents != nil && z.duplicateSymlinks {
+			if linked, err := z.writeDuplicateSymlink(header, src, r); linked || err != nil {
+				return err
+			}
+		}
+		if z.sharedContents != nil {
+			if shared, err := z.writeSharedContents(header, src, level, r); shared || err != nil {
+				return err
+			}
+		}
+		if z.cacheDir != "" {
+			if cached, err := z.writeCachedContents(header, src, s, level, r); cached || err != nil {
+				return err
+			}
+		}
+		return z.writeFileContents(header, level, r)
 	} else {
 		return fmt.Errorf("%s is not a file, directory, or symlink", src)
 	}
 }
 
+// openSource opens the regular file src of size bytes.  With SkipUnreadable, a file that can't be
+// opened or whose first byte can't be read is skipped with a warning, and a nil reader is returned.
+func (z *ZipWriter) openSource(src string, size int64) (pathtools.ReaderAtSeekerCloser, error) {
+	r, err := z.fs.Open(src)
+	if err != nil {
+		if z.skipUnreadable && !os.IsNotExist(err) {
+			z.skipUnreadableFile(src, err)
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if z.skipUnreadable && size > 0 {
+		// Opening can succeed for files that fail to read, find out before anything is written
+		// for them.
+		var b [1]byte
+		if _, err := r.ReadAt(b[:], 0); err != nil && err != io.EOF {
+			r.Close()
+			z.skipUnreadableFile(src, err)
+			return nil, nil
+		}
+	}
+	return r, nil
+}
+
+// skipUnreadableFile warns that src is left out of the zip file because of err.
+func (z *ZipWriter) skipUnreadableFile(src string, err error) {
+	z.warnf("skipping unreadable file %q: %s", src, err)
+	z.skippedFiles = append(z.skippedFiles, src)
+}
+
+// readerSource is the source name used in messages for files whose contents come from a
+// FileArg.Reader.
+const readerSource = "-"
+
+// addReader adds a file at dest with the contents read from r.  The contents are read into memory
+// as the size and CRC of the file are needed before its header can be written.
+func (z *ZipWriter) addReader(dest, src string, r io.Reader, method uint16, level int, emulateJar bool) error {
+	if err := z.writeDirectory(filepath.Dir(dest), src, emulateJar); err != nil {
+		return err
+	}
+
+	if prev, exists := z.createdDirs[dest]; exists {
+		return fmt.Errorf("destination %q is both a directory %q and a file %q", dest, prev, src)
+	}
+	if prev, exists := z.createdFiles[dest]; exists {
+		return fmt.Errorf("destination %q has two files %q and %q", dest, prev, src)
+	}
+	z.createdFiles[dest] = src
+
+	if z.contentTransform != nil {
+		transformed, err := z.transformContents(dest, r)
+		if err != nil {
+			return err
+		}
+		r = transformed
+	}
+
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	header := &zip.FileHeader{
+		Name:               dest,
+		Method:             method,
+		UncompressedSize64: uint64(len(contents)),
+	}
+
+	reader := &byteReaderCloser{bytes.NewReader(contents), ioutil.NopCloser(nil)}
+
+	return z.writeFileContents(header, level, reader)
+}
+
+// transformContents passes the contents read from r to z.contentTransform for the entry dest, and
+// returns the transformed contents read into memory.  r is closed if it is an io.Closer.
+func (z *ZipWriter) transformContents(dest string, r io.Reader) (*byteReaderCloser, error) {
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	tr, err := z.contentTransform(dest, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to transform %q: %s", dest, err)
+	}
+	if c, ok := tr.(io.Closer); ok && tr != r {
+		defer c.Close()
+	}
+
+	contents, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to transform %q: %s", dest, err)
+	}
+	return &byteReaderCloser{bytes.NewReader(contents), ioutil.NopCloser(nil)}, nil
+}
+
 func (z *ZipWriter) addManifest(dest string, src string, method uint16) error {
 	if prev, exists := z.createdDirs[dest]; exists {
 		return fmt.Errorf("destination %q is both a directory %q and a file %q", dest, prev, src)
@@ -697,7 +3423,7 @@ func (z *ZipWriter) addManifest(dest string, src string, method uint16) error {
 		return err
 	}
 
-	var contents []byte
+	contents := z.manifestContents
 	if src != "" {
 		f, err := z.fs.Open(src)
 		if err != nil {
@@ -715,34 +3441,59 @@ func (z *ZipWriter) addManifest(dest string, src string, method uint16) error {
 	if err != nil {
 		return err
 	}
+	if err := jar.ValidateManifest(buf); err != nil {
+		if src == "" {
+			src = "manifest contents"
+		}
+		return fmt.Errorf("%s: %s", src, err)
+	}
 
 	reader := &byteReaderCloser{bytes.NewReader(buf), ioutil.NopCloser(nil)}
 
-	return z.writeFileContents(fh, reader)
+	return z.writeFileContents(fh, z.compLevel, reader)
 }
 
-func (z *ZipWriter) writeFileContents(header *zip.FileHeader, r pathtools.ReaderAtSeekerCloser) (err error) {
+func (z *ZipWriter) writeFileContents(header *zip.FileHeader, level int, r pathtools.ReaderAtSeekerCloser) (err error) {
 
 	header.SetModTime(z.time)
 
 	compressChan := make(chan *zipEntry, 1)
 	z.writeOps <- compressChan
 
+	return z.compressFileContents(header, level, r, compressChan)
+}
+
+// compressFileContents compresses the contents of r in the background and sends the entry with
+// header to compressChan once its method and CRC are known.
+func (z *ZipWriter) compressFileContents(header *zip.FileHeader, level int, r pathtools.ReaderAtSeekerCloser,
+	compressChan chan *zipEntry) (err error) {
+
 	// Pre-fill a zipEntry, it will be sent in the compressChan once
 	// we're sure about the Method and CRC.
 	ze := &zipEntry{
-		fh: header,
+		fh:        header,
+		compLevel: level,
 	}
 
-	ze.allocatedSize = int64(header.UncompressedSize64)
-	z.cpuRateLimiter.Request()
-	z.memoryRateLimiter.Request(ze.allocatedSize)
-
 	fileSize := int64(header.UncompressedSize64)
 	if fileSize == 0 {
 		fileSize = int64(header.UncompressedSize)
 	}
 
+	if z.storeBelow > 0 && fileSize < z.storeBelow {
+		header.Method = zip.Store
+	}
+
+	if z.largeFileThreshold > 0 && fileSize >= z.largeFileThreshold {
+		z.cpuRateLimiter.Request()
+		go z.streamFile(ze, r, compressChan)
+		return nil
+	}
+
+	ze.allocatedSize = int64(header.UncompressedSize64)
+	z.cpuRateLimiter.Request()
+	z.memoryRateLimiter.Request(ze.allocatedSize)
+
 	if header.Method == zip.Deflate && fileSize >= minParallelFileSize {
 		wg := new(sync.WaitGroup)
 
@@ -777,7 +3528,7 @@ func (z *ZipWriter) writeFileContents(header *zip.FileHeader, r pathtools.Reader
 			}
 
 			wg.Add(1)
-			go z.compressPartialFile(sr, dict, last, resultChan, wg)
+			go z.compressPartialFile(sr, level, dict, last, resultChan, wg)
 		}
 
 		close(ze.futureReaders)
@@ -813,10 +3564,10 @@ func (z *ZipWriter) crcFile(r io.Reader, ze *zipEntry, resultChan chan *zipEntry
 	close(resultChan)
 }
 
-func (z *ZipWriter) compressPartialFile(r io.Reader, dict []byte, last bool, resultChan chan io.Reader, wg *sync.WaitGroup) {
+func (z *ZipWriter) compressPartialFile(r io.Reader, level int, dict []byte, last bool, resultChan chan io.Reader, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	result, err := z.compressBlock(r, dict, last)
+	result, err := z.compressBlock(r, level, dict, last)
 	if err != nil {
 		z.errors <- err
 		return
@@ -827,20 +3578,31 @@ func (z *ZipWriter) compressPartialFile(r io.Reader, dict []byte, last bool, res
 	resultChan <- result
 }
 
-func (z *ZipWriter) compressBlock(r io.Reader, dict []byte, last bool) (*bytes.Buffer, error) {
+// flateLevel returns the level of the flate compressor of entries compressed at level.
+func (z *ZipWriter) flateLevel(level int) int {
+	if z.huffmanOnly && level != flate.NoCompression {
+		return flate.HuffmanOnly
+	}
+	return level
+}
+
+func (z *ZipWriter) compressBlock(r io.Reader, level int, dict []byte, last bool) (*bytes.Buffer, error) {
 	buf := new(bytes.Buffer)
 	var fw *flate.Writer
 	var err error
 	if len(dict) > 0 {
 		// There's no way to Reset a Writer with a new dictionary, so
 		// don't use the Pool
-		fw, err = flate.NewWriterDict(buf, z.compLevel, dict)
+		fw, err = flate.NewWriterDict(buf, z.flateLevel(level), dict)
+	} else if level != z.compLevel {
+		// The Pool only holds Writers at the default level of the zip file.
+		fw, err = flate.NewWriter(buf, z.flateLevel(level))
 	} else {
 		var ok bool
 		if fw, ok = z.compressorPool.Get().(*flate.Writer); ok {
 			fw.Reset(buf)
 		} else {
-			fw, err = flate.NewWriter(buf, z.compLevel)
+			fw, err = flate.NewWriter(buf, z.flateLevel(z.compLevel))
 		}
 		defer z.compressorPool.Put(fw)
 	}
@@ -897,8 +3659,18 @@ func (z *ZipWriter) compressWholeFile(ze *zipEntry, r io.ReadSeeker, compressCha
 	ze.futureReaders <- futureReader
 	close(ze.futureReaders)
 
-	if ze.fh.Method == zip.Deflate {
-		compressed, err := z.compressBlock(r, nil, true)
+	if ze.fh.Method != zip.Store {
+		var compressed *bytes.Buffer
+		switch ze.fh.Method {
+		case ZstdMethod:
+			compressed, err = z.compressZstd(r, ze.compLevel)
+		case Bzip2Method:
+			compressed, err = z.compressBzip2(r, ze.compLevel)
+		case SharedDictionaryMethod:
+			compressed, err = z.compressSharedDictionary(r, ze.compLevel)
+		default:
+			compressed, err = z.compressBlock(r, ze.compLevel, nil, true)
+		}
 		if err != nil {
 			z.errors <- err
 			return
@@ -956,9 +3728,9 @@ func (z *ZipWriter) writeDirectory(dir string, src string, emulateJar bool) erro
 		dir = filepath.Dir(dir)
 	}
 
-	if z.directories {
-		// make a directory entry for each uncreated directory
-		for _, cleanDir := range zipDirs {
+	// make a directory entry for each uncreated directory
+	for _, cleanDir := range zipDirs {
+		if z.directories || z.emptyDirs[cleanDir] {
 			var dirHeader *zip.FileHeader
 
 			if emulateJar && cleanDir+"/" == jar.MetaDir {
@@ -967,7 +3739,7 @@ func (z *ZipWriter) writeDirectory(dir string, src string, emulateJar bool) erro
 				dirHeader = &zip.FileHeader{
 					Name: cleanDir + "/",
 				}
-				dirHeader.SetMode(0700 | os.ModeDir)
+				dirHeader.SetMode(z.dirMode | os.ModeDir)
 			}
 
 			dirHeader.SetModTime(z.time)
@@ -984,18 +3756,27 @@ func (z *ZipWriter) writeDirectory(dir string, src string, emulateJar bool) erro
 	return nil
 }
 
-func (z *ZipWriter) writeSymlink(rel, file string) error {
+func (z *ZipWriter) writeSymlink(rel, file string, info os.FileInfo) error {
 	fileHeader := &zip.FileHeader{
-		Name: rel,
+		Name:  rel,
+		Extra: z.fileExtras(info),
 	}
-	fileHeader.SetModTime(z.time)
-	fileHeader.SetMode(0777 | os.ModeSymlink)
 
 	dest, err := z.fs.Readlink(file)
 	if err != nil {
 		return err
 	}
 
+	z.writeSymlinkEntry(fileHeader, dest)
+	return nil
+}
+
+// writeSymlinkEntry writes the entry with header fileHeader as a symlink to dest.
+func (z *ZipWriter) writeSymlinkEntry(fileHeader *zip.FileHeader, dest string) {
+	fileHeader.SetModTime(z.time)
+	fileHeader.SetMode(0777 | os.ModeSymlink)
+	fileHeader.Method = zip.Store
+
 	fileHeader.UncompressedSize64 = uint64(len(dest))
 	fileHeader.CRC32 = crc32.ChecksumIEEE([]byte(dest))
 
@@ -1013,6 +3794,4 @@ func (z *ZipWriter) writeSymlink(rel, file string) error {
 	}
 	close(ze)
 	z.writeOps <- ze
-
-	return nil
 }
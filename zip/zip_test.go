@@ -15,17 +15,38 @@
 package zip
 
 import (
+	stdzip "archive/zip"
 	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"context"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"sort"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
+	"android/soong/jar"
 	"android/soong/third_party/zip"
 
 	"github.com/google/blueprint/pathtools"
+	"github.com/klauspost/compress/zstd"
 )
 
 var (
@@ -46,9 +67,19 @@ var mockFs = pathtools.MockFs(map[string][]byte{
 	"dangling -> missing": nil,
 	"a/a/d -> b":          nil,
 	"c":                   fileC,
+	"d/a.c":               fileA,
+	"d/a.o":               fileB,
+	"d/gen/x":             fileC,
+	"d/sub/b.c":           fileA,
+	"d/sub/b.o":           fileB,
+	"e/icon.PNG":          fileA,
+	"e/notes.txt":         fileB,
+	"e/photo.jpg":         fileC,
+	"f/{y,z}":             fileA,
 	"l_nl":                []byte("a/a/a\na/a/b\nc\n"),
 	"l_sp":                []byte("a/a/a a/a/b c"),
 	"l2":                  []byte("missing\n"),
+	"l_e":                 []byte("e/notes.txt\ne/photo.jpg\n"),
 	"manifest.txt":        fileCustomManifest,
 })
 
@@ -103,12 +134,18 @@ func TestZip(t *testing.T) {
 		name               string
 		args               *FileArgsBuilder
 		compressionLevel   int
+		compressionMethod  CompressionMethod
 		emulateJar         bool
 		nonDeflatedFiles   map[string]bool
+		storedExtensions   []string
+		storePatterns      []string
+		storePatternPaths  bool
 		dirEntries         bool
 		manifest           string
 		storeSymlinks      bool
 		ignoreMissingFiles bool
+		excludes           []string
+		prefixMaps         []PrefixMap
 
 		files []zip.FileHeader
 		err   error
@@ -148,6 +185,44 @@ func TestZip(t *testing.T) {
 				fhLink("a/d", "b"),
 			},
 		},
+		{
+			name: "brace expansion",
+			args: fileArgsBuilder().
+				File("a/a/{b,a}").
+				File("{c,e/{notes,icon}.*}"),
+			compressionLevel: 9,
+
+			files: []zip.FileHeader{
+				fh("a/a/b", fileB, zip.Deflate),
+				fh("a/a/a", fileA, zip.Deflate),
+				fh("c", fileC, zip.Deflate),
+				fh("e/notes.txt", fileB, zip.Deflate),
+				fh("e/icon.PNG", fileA, zip.Deflate),
+			},
+		},
+		{
+			name: "escaped braces",
+			args: fileArgsBuilder().
+				File(`f/\{y,z\}`),
+			compressionLevel: 9,
+
+			files: []zip.FileHeader{
+				fh("f/{y,z}", fileA, zip.Deflate),
+			},
+		},
+		{
+			name: "brace expansion dir",
+			args: fileArgsBuilder().
+				Dir("{e,d/sub}"),
+			compressionLevel: 9,
+			excludes:         []string{"e/*.PNG", "e/*.jpg"},
+
+			files: []zip.FileHeader{
+				fh("e/notes.txt", fileB, zip.Deflate),
+				fh("d/sub/b.c", fileA, zip.Deflate),
+				fh("d/sub/b.o", fileB, zip.Deflate),
+			},
+		},
 		{
 			name: "dir",
 			args: fileArgsBuilder().
@@ -163,6 +238,45 @@ func TestZip(t *testing.T) {
 				fhLink("a/d", "b"),
 			},
 		},
+		{
+			name: "dir exclude files",
+			args: fileArgsBuilder().
+				SourcePrefixToStrip("d").
+				Dir("d"),
+			compressionLevel: 9,
+			excludes:         []string{"**/*.o"},
+
+			files: []zip.FileHeader{
+				fh("a.c", fileA, zip.Deflate),
+				fh("gen/x", fileC, zip.Deflate),
+				fh("sub/b.c", fileA, zip.Deflate),
+			},
+		},
+		{
+			name: "dir exclude subtree",
+			args: fileArgsBuilder().
+				SourcePrefixToStrip("d").
+				Dir("d"),
+			compressionLevel: 9,
+			excludes:         []string{"sub", "gen/**/*"},
+
+			files: []zip.FileHeader{
+				fh("a.c", fileA, zip.Deflate),
+				fh("a.o", fileB, zip.Deflate),
+			},
+		},
+		{
+			name: "exclude without relative root",
+			args: fileArgsBuilder().
+				Dir("d"),
+			compressionLevel: 9,
+			excludes:         []string{"d/*.o", "d/sub/*.o", "d/gen"},
+
+			files: []zip.FileHeader{
+				fh("d/a.c", fileA, zip.Deflate),
+				fh("d/sub/b.c", fileA, zip.Deflate),
+			},
+		},
 		{
 			name: "stored files",
 			args: fileArgsBuilder().
@@ -177,6 +291,34 @@ func TestZip(t *testing.T) {
 				fh("c", fileC, zip.Store),
 			},
 		},
+		{
+			name: "zstd files",
+			args: fileArgsBuilder().
+				File("a/a/a").
+				File("a/a/b").
+				File("c"),
+			compressionLevel:  9,
+			compressionMethod: CompressionZstd,
+
+			files: []zip.FileHeader{
+				fh("a/a/a", fileA, ZstdMethod),
+				fh("a/a/b", fileB, ZstdMethod),
+				fh("c", fileC, ZstdMethod),
+			},
+		},
+		{
+			name: "store method",
+			args: fileArgsBuilder().
+				File("a/a/a").
+				File("c"),
+			compressionLevel:  9,
+			compressionMethod: CompressionStore,
+
+			files: []zip.FileHeader{
+				fh("a/a/a", fileA, zip.Store),
+				fh("c", fileC, zip.Store),
+			},
+		},
 		{
 			name: "symlinks in zip",
 			args: fileArgsBuilder().
@@ -288,6 +430,189 @@ func TestZip(t *testing.T) {
 				fh("b", fileB, zip.Deflate),
 			},
 		},
+		{
+			name: "strip zero components",
+			args: fileArgsBuilder().
+				StripComponents(0).
+				File("a/a/a").
+				File("c"),
+			compressionLevel: 9,
+
+			files: []zip.FileHeader{
+				fh("a/a/a", fileA, zip.Deflate),
+				fh("c", fileC, zip.Deflate),
+			},
+		},
+		{
+			name: "strip components",
+			args: fileArgsBuilder().
+				StripComponents(2).
+				File("a/a/a").
+				Dir("d").
+				StripComponents(0).
+				File("c"),
+			compressionLevel: 9,
+			excludes:         []string{"**/*.o", "d/gen"},
+
+			files: []zip.FileHeader{
+				fh("a", fileA, zip.Deflate),
+				fh("b.c", fileA, zip.Deflate),
+				fh("c", fileC, zip.Deflate),
+			},
+		},
+		{
+			name: "strip components deeper than path",
+			args: fileArgsBuilder().
+				StripComponents(3).
+				File("a/a/a").
+				File("a/a/b").
+				File("c"),
+			compressionLevel: 9,
+
+			files: []zip.FileHeader{},
+		},
+		{
+			name: "strip components with relative root and prefix",
+			args: fileArgsBuilder().
+				SourcePrefixToStrip("a").
+				StripComponents(1).
+				PathPrefixInZip("foo").
+				File("a/a/a").
+				File("a/a/b"),
+			compressionLevel: 9,
+
+			files: []zip.FileHeader{
+				fh("foo/a", fileA, zip.Deflate),
+				fh("foo/b", fileB, zip.Deflate),
+			},
+		},
+		{
+			name: "strip components with junk paths",
+			args: fileArgsBuilder().
+				StripComponents(5).
+				JunkPaths(true).
+				File("a/a/a"),
+			compressionLevel: 9,
+
+			files: []zip.FileHeader{
+				fh("a", fileA, zip.Deflate),
+			},
+		},
+		{
+			name: "junk paths except",
+			args: fileArgsBuilder().
+				PathPrefixInZip("p").
+				JunkPaths(true).
+				JunkPathsExcept("d/sub/**/*").
+				JunkPathsExcept("**/x").
+				Dir("d"),
+			compressionLevel: 9,
+
+			files: []zip.FileHeader{
+				fh("p/a.c", fileA, zip.Deflate),
+				fh("p/a.o", fileB, zip.Deflate),
+				fh("p/d/gen/x", fileC, zip.Deflate),
+				fh("p/d/sub/b.c", fileA, zip.Deflate),
+				fh("p/d/sub/b.o", fileB, zip.Deflate),
+			},
+		},
+		{
+			name: "junk paths except cleared",
+			args: fileArgsBuilder().
+				JunkPaths(true).
+				JunkPathsExcept("a/**/*").
+				File("a/a/a").
+				JunkPathsExcept("").
+				File("a/a/b"),
+			compressionLevel: 9,
+
+			files: []zip.FileHeader{
+				fh("a/a/a", fileA, zip.Deflate),
+				fh("b", fileB, zip.Deflate),
+			},
+		},
+		{
+			name: "prefix maps",
+			args: fileArgsBuilder().
+				File("a/a/a").
+				File("c").
+				File("d/a.c").
+				File("d/sub/b.c"),
+			compressionLevel: 9,
+			prefixMaps:       []PrefixMap{{From: "a/", To: "x"}, {From: "d", To: "y/z"}},
+
+			files: []zip.FileHeader{
+				fh("x/a/a", fileA, zip.Deflate),
+				fh("c", fileC, zip.Deflate),
+				fh("y/z/a.c", fileA, zip.Deflate),
+				fh("y/z/sub/b.c", fileA, zip.Deflate),
+			},
+		},
+		{
+			name: "prefix maps first match",
+			args: fileArgsBuilder().
+				File("d/a.c").
+				File("d/sub/b.c").
+				File("d/gen/x"),
+			compressionLevel: 9,
+			prefixMaps:       []PrefixMap{{From: "d/sub", To: "s"}, {From: "d", To: "y"}, {From: "d/gen", To: "g"}},
+
+			files: []zip.FileHeader{
+				fh("y/a.c", fileA, zip.Deflate),
+				fh("s/b.c", fileA, zip.Deflate),
+				fh("y/gen/x", fileC, zip.Deflate),
+			},
+		},
+		{
+			name: "prefix maps empty from",
+			args: fileArgsBuilder().
+				File("a/a/a").
+				File("c"),
+			compressionLevel: 9,
+			prefixMaps:       []PrefixMap{{From: "c", To: "cc"}, {From: "", To: "p"}},
+
+			files: []zip.FileHeader{
+				fh("p/a/a/a", fileA, zip.Deflate),
+				fh("cc", fileC, zip.Deflate),
+			},
+		},
+		{
+			name: "prefix maps whole components",
+			args: fileArgsBuilder().
+				File("a/a/a").
+				File("e/notes.txt"),
+			compressionLevel: 9,
+			prefixMaps:       []PrefixMap{{From: "a/a/a", To: "file"}, {From: "e/notes", To: "n"}},
+
+			files: []zip.FileHeader{
+				fh("file", fileA, zip.Deflate),
+				fh("e/notes.txt", fileB, zip.Deflate),
+			},
+		},
+		{
+			name: "renamed files",
+			args: fileArgsBuilder().
+				SourcePrefixToStrip("a").
+				PathPrefixInZip("foo").
+				RenamedFile("bar/renamed", "a/a/a").
+				File("a/a/b").
+				JunkPaths(true).
+				RenamedFile("b=c", "c"),
+			compressionLevel: 9,
+
+			files: []zip.FileHeader{
+				fh("bar/renamed", fileA, zip.Deflate),
+				fh("foo/a/b", fileB, zip.Deflate),
+				fh("b=c", fileC, zip.Deflate),
+			},
+		},
+		{
+			name: "error missing renamed file",
+			args: fileArgsBuilder().
+				RenamedFile("a", "missing"),
+
+			err: os.ErrNotExist,
+		},
 		{
 			name: "emulate jar",
 			args: fileArgsBuilder().
@@ -364,6 +689,79 @@ func TestZip(t *testing.T) {
 				fh("a/a/b", fileB, zip.Deflate),
 			},
 		},
+		{
+			name: "stored extensions",
+			args: fileArgsBuilder().
+				File("e/icon.PNG").
+				List("l_e"),
+			compressionLevel: 9,
+			storedExtensions: []string{"png", ".JPG"},
+
+			files: []zip.FileHeader{
+				fh("e/icon.PNG", fileA, zip.Store),
+				fh("e/notes.txt", fileB, zip.Deflate),
+				fh("e/photo.jpg", fileC, zip.Store),
+			},
+		},
+		{
+			name: "stored extensions dir",
+			args: fileArgsBuilder().
+				SourcePrefixToStrip("e").
+				Dir("e"),
+			compressionLevel: 9,
+			storedExtensions: []string{"png", "jpg"},
+
+			files: []zip.FileHeader{
+				fh("icon.PNG", fileA, zip.Store),
+				fh("notes.txt", fileB, zip.Deflate),
+				fh("photo.jpg", fileC, zip.Store),
+			},
+		},
+		{
+			name: "store patterns",
+			args: fileArgsBuilder().
+				SourcePrefixToStrip("e").
+				Dir("e"),
+			compressionLevel: 9,
+			storePatterns:    []string{"*.jpg", "icon.*"},
+
+			files: []zip.FileHeader{
+				fh("icon.PNG", fileA, zip.Store),
+				fh("notes.txt", fileB, zip.Deflate),
+				fh("photo.jpg", fileC, zip.Store),
+			},
+		},
+		{
+			name: "store patterns base name",
+			args: fileArgsBuilder().
+				PathPrefixInZip("res").
+				File("e/icon.PNG").
+				List("l_e"),
+			compressionLevel: 9,
+			storePatterns:    []string{"e/*.PNG", "*.jpg"},
+
+			files: []zip.FileHeader{
+				fh("res/e/icon.PNG", fileA, zip.Deflate),
+				fh("res/e/notes.txt", fileB, zip.Deflate),
+				fh("res/e/photo.jpg", fileC, zip.Store),
+			},
+		},
+		{
+			name: "store patterns path",
+			args: fileArgsBuilder().
+				PathPrefixInZip("res").
+				File("e/icon.PNG").
+				List("l_e"),
+			compressionLevel:  9,
+			storePatterns:     []string{"res/e/*.PNG", "*.jpg"},
+			storePatternPaths: true,
+
+			files: []zip.FileHeader{
+				fh("res/e/icon.PNG", fileA, zip.Store),
+				fh("res/e/notes.txt", fileB, zip.Deflate),
+				fh("res/e/photo.jpg", fileC, zip.Deflate),
+			},
+		},
 		{
 			name: "ignore missing files",
 			args: fileArgsBuilder().
@@ -416,12 +814,18 @@ func TestZip(t *testing.T) {
 			args := ZipArgs{}
 			args.FileArgs = test.args.FileArgs()
 			args.CompressionLevel = test.compressionLevel
+			args.CompressionMethod = test.compressionMethod
 			args.EmulateJar = test.emulateJar
 			args.AddDirectoryEntriesToZip = test.dirEntries
 			args.NonDeflatedFiles = test.nonDeflatedFiles
+			args.StoredExtensions = test.storedExtensions
+			args.StorePatterns = test.storePatterns
+			args.StorePatternsMatchPath = test.storePatternPaths
 			args.ManifestSourcePath = test.manifest
 			args.StoreSymlinks = test.storeSymlinks
 			args.IgnoreMissingFiles = test.ignoreMissingFiles
+			args.ExcludePatterns = test.excludes
+			args.PrefixMaps = test.prefixMaps
 			args.Filesystem = mockFs
 			args.Stderr = &bytes.Buffer{}
 
@@ -578,71 +982,5991 @@ func TestReadRespFile(t *testing.T) {
 			}
 		})
 	}
-}
 
-func TestSrcJar(t *testing.T) {
-	mockFs := pathtools.MockFs(map[string][]byte{
-		"wrong_package.java":       []byte("package foo;"),
-		"foo/correct_package.java": []byte("package foo;"),
-		"src/no_package.java":      nil,
-		"src2/parse_error.java":    []byte("error"),
+	t.Run("nested", func(t *testing.T) {
+		fs := pathtools.MockFs(map[string][]byte{
+			"a.rsp":     []byte(`-o out.zip @b.rsp "-f" 'x y'`),
+			"b.rsp":     []byte("-C dir\n@c.rsp"),
+			"c.rsp":     []byte("-f c"),
+			"self.rsp":  []byte("-f a @self.rsp"),
+			"loop1.rsp": []byte("@loop2.rsp"),
+			"loop2.rsp": []byte("@loop1.rsp"),
+		})
+
+		got, err := expandRespFiles(fs, []string{"soong_zip", "@a.rsp", "-j"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"soong_zip", "-o", "out.zip", "-C", "dir", "-f", "c", "-f", "x y", "-j"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %q got %q", want, got)
+		}
+
+		for _, name := range []string{"self.rsp", "loop1.rsp"} {
+			_, err := expandRespFiles(fs, []string{"@" + name}, nil)
+			want := fmt.Sprintf("response file %q includes itself", name)
+			if err == nil || err.Error() != want {
+				t.Errorf("want error %q, got %v", want, err)
+			}
+		}
 	})
+}
 
-	want := []string{
-		"foo/",
-		"foo/wrong_package.java",
-		"foo/correct_package.java",
-		"no_package.java",
-		"src2/",
-		"src2/parse_error.java",
+func TestSplitFileDest(t *testing.T) {
+	testCases := []struct {
+		arg, dest, src string
+	}{
+		{arg: "a/b", dest: "", src: "a/b"},
+		{arg: "x/y=a/b", dest: "x/y", src: "a/b"},
+		{arg: `a\=b`, dest: "", src: "a=b"},
+		{arg: `x\=y=a\=b`, dest: "x=y", src: "a=b"},
+		{arg: "x=a=b", dest: "x", src: "a=b"},
+		{arg: `a\b`, dest: "", src: `a\b`},
 	}
 
-	args := ZipArgs{}
-	args.FileArgs = NewFileArgsBuilder().File("**/*.java").FileArgs()
+	for _, test := range testCases {
+		t.Run(test.arg, func(t *testing.T) {
+			dest, src := SplitFileDest(test.arg)
+			if dest != test.dest || src != test.src {
+				t.Errorf("want dest %q src %q, got dest %q src %q", test.dest, test.src, dest, src)
+			}
+		})
+	}
+}
 
-	args.SrcJar = true
-	args.AddDirectoryEntriesToZip = true
-	args.Filesystem = mockFs
-	args.Stderr = &bytes.Buffer{}
+func TestSourcePrefixStack(t *testing.T) {
+	b := &FileArgsBuilder{fs: mockFs}
+	b.File("top").
+		PushSourcePrefixToStrip("a").File("a/x").
+		PushSourcePrefixToStrip("a/b").File("a/b/y").
+		PopSourcePrefixToStrip().File("a/z").
+		PushSourcePrefixToStrip("c").File("c/w").
+		PopSourcePrefixToStrip().
+		PopSourcePrefixToStrip().File("bottom")
+	if b.Error() != nil {
+		t.Fatal(b.Error())
+	}
+
+	want := []string{"", "a", "a/b", "a", "c", ""}
+	var got []string
+	for _, fa := range b.FileArgs() {
+		got = append(got, fa.SourcePrefixToStrip)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want prefixes %q, got %q", want, got)
+	}
+
+	t.Run("underflow", func(t *testing.T) {
+		b := &FileArgsBuilder{fs: mockFs}
+		b.PushSourcePrefixToStrip("a").PopSourcePrefixToStrip().PopSourcePrefixToStrip().File("a/x")
+
+		want := "cannot pop the relative root, none was pushed"
+		if b.Error() == nil || b.Error().Error() != want {
+			t.Errorf("want error %q, got %v", want, b.Error())
+		}
+		if len(b.FileArgs()) != 0 {
+			t.Errorf("want no FileArgs after an error, got %v", b.FileArgs())
+		}
+	})
+}
+
+func TestArchiveSources(t *testing.T) {
+	dir := t.TempDir()
+	inner := writeTestZip(t, dir, "inner.zip", []testZipEntry{
+		{name: "x/", method: zip.Store},
+		{name: "x/a.txt", method: zip.Deflate, contents: fileA},
+		{name: "x/b.bin", method: zip.Store, contents: fileB},
+	})
+	innerContents, err := ioutil.ReadFile(inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outerPath := writeTestZip(t, dir, "outer.zip", []testZipEntry{
+		{name: "inner/path/a.txt", method: zip.Deflate, contents: fileA},
+		{name: "inner/path/b.txt", method: zip.Store, contents: fileB},
+		{name: "inner/path/c.bin", method: zip.Deflate, contents: fileC},
+		{name: "nested.zip", method: zip.Store, contents: innerContents},
+	})
+	outerContents, err := ioutil.ReadFile(outerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := pathtools.MockFs(map[string][]byte{
+		"outer.zip": outerContents,
+		"c":         fileC,
+	})
+
+	testCases := []struct {
+		name  string
+		args  *FileArgsBuilder
+		dirs  bool
+		names []string
+		files map[string][]byte
+		err   string
+	}{
+		{
+			name:  "glob",
+			args:  fileArgsBuilder().File("outer.zip!inner/path/*.txt"),
+			names: []string{"inner/path/a.txt", "inner/path/b.txt"},
+			files: map[string][]byte{"inner/path/a.txt": fileA, "inner/path/b.txt": fileB},
+		},
+		{
+			name:  "directories",
+			args:  fileArgsBuilder().File("outer.zip!inner/**/*.bin"),
+			dirs:  true,
+			names: []string{"inner/", "inner/path/", "inner/path/c.bin"},
+			files: map[string][]byte{"inner/path/c.bin": fileC},
+		},
+		{
+			name:  "prefixes",
+			args:  fileArgsBuilder().SourcePrefixToStrip("inner").PathPrefixInZip("out").File("outer.zip!inner/path/c.bin"),
+			names: []string{"out/path/c.bin"},
+			files: map[string][]byte{"out/path/c.bin": fileC},
+		},
+		{
+			name:  "renamed",
+			args:  fileArgsBuilder().RenamedFile("renamed", "outer.zip!inner/path/a.txt"),
+			names: []string{"renamed"},
+			files: map[string][]byte{"renamed": fileA},
+		},
+		{
+			name:  "nested",
+			args:  fileArgsBuilder().File("outer.zip!nested.zip!x/*").File("c"),
+			names: []string{"x/a.txt", "x/b.bin", "c"},
+			files: map[string][]byte{"x/a.txt": fileA, "x/b.bin": fileB, "c": fileC},
+		},
+		{
+			name: "no match",
+			args: fileArgsBuilder().File("outer.zip!missing/*"),
+			err:  "lstat outer.zip!missing/*: file does not exist",
+		},
+		{
+			name: "missing nested zip",
+			args: fileArgsBuilder().File("outer.zip!missing.zip!*"),
+			err:  "lstat outer.zip!missing.zip!*: file does not exist",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{}
+			args.FileArgs = test.args.FileArgs()
+			args.OutputFilePath = filepath.Join(t.TempDir(), "out.zip")
+			args.CompressionLevel = 9
+			args.AddDirectoryEntriesToZip = test.dirs
+			args.Filesystem = fs
+			args.Stderr = &bytes.Buffer{}
+
+			err := Zip(args)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("want error %q, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			names, files := readZipContents(t, args.OutputFilePath)
+			if !reflect.DeepEqual(names, test.names) {
+				t.Errorf("want entries %q, got %q", test.names, names)
+			}
+			for name, want := range test.files {
+				if !bytes.Equal(files[name], want) {
+					t.Errorf("%s: want contents %q, got %q", name, want, files[name])
+				}
+			}
+		})
+	}
+}
+
+func TestListIncludes(t *testing.T) {
+	mockFs := pathtools.MockFs(map[string][]byte{
+		"top":       []byte("a\n@mid\n\n  \nb\n"),
+		"mid":       []byte("c\n@leaf\n"),
+		"leaf":      []byte("d\n"),
+		"self":      []byte("a\n@self\n"),
+		"loop1":     []byte("@loop2\n"),
+		"loop2":     []byte("@loop1\n"),
+		"diamond":   []byte("@left\n@right\n"),
+		"left":      []byte("l\n@bottom\n"),
+		"right":     []byte("r\n@bottom\n"),
+		"bottom":    []byte("x\n"),
+		"with_miss": []byte("@missing\n"),
+	})
+
+	testCases := []struct {
+		name string
+		list string
+		want []string
+		err  string
+	}{
+		{
+			name: "two level include",
+			list: "top",
+			want: []string{"a", "c", "d", "b"},
+		},
+		{
+			name: "diamond include",
+			list: "diamond",
+			want: []string{"l", "x", "r", "x"},
+		},
+		{
+			name: "self reference",
+			list: "self",
+			err:  `list file "self" includes itself`,
+		},
+		{
+			name: "indirect cycle",
+			list: "loop1",
+			err:  `list file "loop1" includes itself`,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			b := &FileArgsBuilder{fs: mockFs}
+			b.List(test.list)
+
+			if test.err != "" {
+				if b.Error() == nil {
+					t.Fatalf("want error %q, got no error", test.err)
+				} else if b.Error().Error() != test.err {
+					t.Fatalf("want error %q, got %q", test.err, b.Error())
+				}
+				return
+			} else if b.Error() != nil {
+				t.Fatal(b.Error())
+			}
+
+			fileArgs := b.FileArgs()
+			if len(fileArgs) != 1 {
+				t.Fatalf("want 1 FileArg, got %d", len(fileArgs))
+			}
+			if !reflect.DeepEqual(fileArgs[0].SourceFiles, test.want) {
+				t.Errorf("want %q, got %q", test.want, fileArgs[0].SourceFiles)
+			}
+		})
+	}
+
+	t.Run("missing include", func(t *testing.T) {
+		b := &FileArgsBuilder{fs: mockFs}
+		b.List("with_miss")
+		if !os.IsNotExist(b.Error()) {
+			t.Fatalf("want not exist error, got %v", b.Error())
+		}
+	})
+
+	t.Run("reader", func(t *testing.T) {
+		b := &FileArgsBuilder{fs: mockFs}
+		b.SourcePrefixToStrip("a").PathPrefixInZip("p").
+			ListReader(bytes.NewReader([]byte("a/x\n\n \t \n@mid\n  a/y  \n")))
+		if b.Error() != nil {
+			t.Fatal(b.Error())
+		}
+
+		want := []FileArg{{
+			PathPrefixInZip:     "p",
+			SourcePrefixToStrip: "a",
+			SourceFiles:         []string{"a/x", "c", "d", "a/y"},
+		}}
+		if !reflect.DeepEqual(b.FileArgs(), want) {
+			t.Errorf("want %+v, got %+v", want, b.FileArgs())
+		}
+	})
+}
+
+type readDirRecorderFs struct {
+	pathtools.FileSystem
+	dirs []string
+}
+
+func (fs *readDirRecorderFs) ReadDirNames(name string) ([]string, error) {
+	fs.dirs = append(fs.dirs, name)
+	return fs.FileSystem.ReadDirNames(name)
+}
+
+func TestExcludePrunesDirectories(t *testing.T) {
+	fs := &readDirRecorderFs{FileSystem: mockFs}
+
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().SourcePrefixToStrip("d").Dir("d").FileArgs()
+	args.ExcludePatterns = []string{"sub"}
+	args.Filesystem = fs
+	args.Stderr = &bytes.Buffer{}
+
+	err := ZipTo(args, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	want := []string{"d", "d/gen"}
+	if !reflect.DeepEqual(fs.dirs, want) {
+		t.Errorf("want directories %q to be read, got %q", want, fs.dirs)
+	}
+}
+
+func TestErrorOnEmptyGlob(t *testing.T) {
+	testCases := []struct {
+		name     string
+		args     *FileArgsBuilder
+		excludes []string
+
+		want    []string
+		err     string
+		flagErr string
+	}{
+		{
+			name:    "glob",
+			args:    fileArgsBuilder().File("a/a/*.x").File("c"),
+			want:    []string{"c"},
+			flagErr: `glob "a/a/*.x" matched no files`,
+		},
+		{
+			name:    "brace alternative",
+			args:    fileArgsBuilder().File("a/a/{a,x}"),
+			want:    []string{"a/a/a"},
+			flagErr: `glob "a/a/x" of "a/a/{a,x}" matched no files`,
+		},
+		{
+			name:     "empty directory",
+			args:     fileArgsBuilder().SourcePrefixToStrip("d").Dir("d"),
+			excludes: []string{"**/*"},
+			want:     []string{},
+			flagErr:  `directory "d" matched no files`,
+		},
+		{
+			name: "matching glob",
+			args: fileArgsBuilder().File("a/a/*").File("{c,d/a.c}"),
+			want: []string{"a/a/a", "a/a/b", "a/a/c", "a/a/d", "c", "d/a.c"},
+		},
+		{
+			name:    "missing file",
+			args:    fileArgsBuilder().File("missing"),
+			err:     "lstat missing: file does not exist",
+			flagErr: "lstat missing: file does not exist",
+		},
+	}
+
+	for _, test := range testCases {
+		for _, flag := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/%v", test.name, flag), func(t *testing.T) {
+				args := ZipArgs{}
+				args.FileArgs = test.args.FileArgs()
+				args.ExcludePatterns = test.excludes
+				args.IgnoreMissingFiles = test.err == ""
+				args.ErrorOnEmptyGlob = flag
+				args.Filesystem = mockFs
+				args.Stderr = &bytes.Buffer{}
+
+				wantErr := test.err
+				if flag {
+					wantErr = test.flagErr
+				}
+
+				buf := &bytes.Buffer{}
+				err := ZipTo(args, buf)
+				if wantErr != "" {
+					if err == nil || err.Error() != wantErr {
+						t.Fatalf("want error %q, got %v", wantErr, err)
+					}
+					return
+				} else if err != nil {
+					t.Fatalf("got error %v", err)
+				}
+
+				zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := []string{}
+				for _, f := range zr.File {
+					got = append(got, f.Name)
+				}
+				if !reflect.DeepEqual(got, test.want) {
+					t.Errorf("want files %q, got %q", test.want, got)
+				}
+			})
+		}
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	testCases := []struct {
+		name  string
+		level LogLevel
+		want  string
+	}{
+		{
+			name:  "normal",
+			level: LogNormal,
+			want:  "warning: skipping \"c\", stripping 1 path components leaves no name\n",
+		},
+		{
+			name:  "quiet",
+			level: LogQuiet,
+			want:  "",
+		},
+		{
+			name:  "verbose",
+			level: LogVerbose,
+			want: "warning: skipping \"c\", stripping 1 path components leaves no name\n" +
+				"adding a/ (store)\n" +
+				"adding a/a (deflate)\n" +
+				"adding a/b (store)\n",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			stderr := &bytes.Buffer{}
+
+			args := ZipArgs{}
+			args.FileArgs = fileArgsBuilder().StripComponents(1).File("a/a/a").File("a/a/b").File("c").FileArgs()
+			args.CompressionLevel = 9
+			args.NonDeflatedFiles = map[string]bool{"a/b": true}
+			args.AddDirectoryEntriesToZip = true
+			args.NumParallelJobs = 4
+			args.LogLevel = test.level
+			args.Filesystem = mockFs
+			args.Stderr = stderr
+
+			if err := ZipTo(args, &bytes.Buffer{}); err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if got := stderr.String(); got != test.want {
+				t.Errorf("want log %q, got %q", test.want, got)
+			}
+		})
+	}
+
+	t.Run("logger", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().File("c").FileArgs()
+		args.LogLevel = LogVerbose
+		args.Logger = log.New(buf, "soong_zip: ", 0)
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+
+		if err := ZipTo(args, &bytes.Buffer{}); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		if got, want := buf.String(), "soong_zip: adding c (store)\n"; got != want {
+			t.Errorf("want log %q, got %q", want, got)
+		}
+		if got := args.Stderr.(*bytes.Buffer).String(); got != "" {
+			t.Errorf("want nothing written to Stderr, got %q", got)
+		}
+	})
+}
+
+func TestStripComponentsWarning(t *testing.T) {
+	stderr := &bytes.Buffer{}
+
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().StripComponents(1).File("a/a/a").File("c").FileArgs()
+	args.Filesystem = mockFs
+	args.Stderr = stderr
+
+	err := ZipTo(args, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	want := "warning: skipping \"c\", stripping 1 path components leaves no name\n"
+	if got := stderr.String(); got != want {
+		t.Errorf("want stderr %q, got %q", want, got)
+	}
+}
+
+func TestRecursiveDir(t *testing.T) {
+	t.Run("file", func(t *testing.T) {
+		b := fileArgsBuilder().RecursiveDir("c")
+		if b.Error() == nil {
+			t.Fatal("expected error for a file")
+		}
+		want := `cannot recurse into "c": not a directory, use -f to add a single file`
+		if got := b.Error().Error(); got != want {
+			t.Errorf("want error %q, got %q", want, got)
+		}
+	})
+
+	t.Run("dir", func(t *testing.T) {
+		zipDir := func(t *testing.T, b *FileArgsBuilder) []byte {
+			if err := b.Error(); err != nil {
+				t.Fatal(err)
+			}
+
+			args := ZipArgs{}
+			args.FileArgs = b.FileArgs()
+			args.CompressionLevel = 9
+			args.ExcludePatterns = []string{"**/*.o"}
+			args.Filesystem = mockFs
+			args.Stderr = &bytes.Buffer{}
+
+			buf := &bytes.Buffer{}
+			err := ZipTo(args, buf)
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			return buf.Bytes()
+		}
+
+		want := zipDir(t, fileArgsBuilder().SourcePrefixToStrip("d").Dir("d"))
+		got := zipDir(t, fileArgsBuilder().SourcePrefixToStrip("d").RecursiveDir("d"))
+		if !bytes.Equal(got, want) {
+			t.Error("expected -r to produce the same zip file as -D")
+		}
+	})
+}
+
+// deepMockFs returns a filesystem with a tree of directories under "deep" that is depth levels
+// deep and width directories wide at each level, with a file in every directory.
+func deepMockFs(depth, width int) pathtools.FileSystem {
+	files := make(map[string][]byte)
+	var fill func(dir string, level int)
+	fill = func(dir string, level int) {
+		files[filepath.Join(dir, "file")] = fileA
+		if level == depth {
+			return
+		}
+		for i := 0; i < width; i++ {
+			fill(filepath.Join(dir, fmt.Sprintf("d%d", i)), level+1)
+		}
+	}
+	fill("deep", 0)
+	return pathtools.MockFs(files)
+}
+
+func TestGlobDirParallel(t *testing.T) {
+	fs := deepMockFs(4, 3)
+
+	globDir := func(t *testing.T, parallelJobs int) []string {
+		z := &ZipWriter{fs: fs, logger: log.New(&bytes.Buffer{}, "", 0)}
+		ret, err := z.globDir(FileArg{GlobDir: "deep"}, nil, parallelJobs, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+
+	want := globDir(t, 1)
+	if len(want) != 241 {
+		t.Fatalf("want 241 paths, got %d", len(want))
+	}
+	if want[0] != "deep/d0" || want[3] != "deep/file" || want[4] != "deep/d0/d0" {
+		t.Errorf("unexpected order %q", want[:5])
+	}
+
+	for i := 0; i < 10; i++ {
+		if got := globDir(t, 8); !reflect.DeepEqual(got, want) {
+			t.Fatalf("want the same paths as a serial walk, got %q", got)
+		}
+	}
+}
+
+// unreadableDirFs fails to read the directories in unreadable.
+type unreadableDirFs struct {
+	pathtools.FileSystem
+	unreadable map[string]bool
+}
+
+func (fs *unreadableDirFs) ReadDirNames(name string) ([]string, error) {
+	if fs.unreadable[name] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	return fs.FileSystem.ReadDirNames(name)
+}
+
+func TestGlobDirIgnoreErrors(t *testing.T) {
+	fs := &unreadableDirFs{
+		FileSystem: mockFs,
+		unreadable: map[string]bool{"d/sub": true},
+	}
+
+	t.Run("error", func(t *testing.T) {
+		z := &ZipWriter{fs: fs, logger: log.New(&bytes.Buffer{}, "", 0)}
+		_, err := z.globDir(FileArg{GlobDir: "d"}, nil, 4, false)
+		if !os.IsPermission(err) {
+			t.Errorf("want permission error, got %v", err)
+		}
+	})
+
+	t.Run("ignore", func(t *testing.T) {
+		stderr := &bytes.Buffer{}
+		z := &ZipWriter{fs: fs, logger: log.New(stderr, "", 0)}
+		got, err := z.globDir(FileArg{GlobDir: "d"}, nil, 4, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"d/a.c", "d/a.o", "d/gen", "d/sub", "d/gen/x"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("want paths %q, got %q", want, got)
+		}
+
+		wantStderr := "warning: open d/sub: permission denied\n"
+		if stderr.String() != wantStderr {
+			t.Errorf("want stderr %q, got %q", wantStderr, stderr.String())
+		}
+	})
+}
+
+func BenchmarkGlobDir(b *testing.B) {
+	fs := deepMockFs(4, 4)
+
+	for _, parallelJobs := range []int{1, 8} {
+		b.Run(fmt.Sprintf("parallel %d", parallelJobs), func(b *testing.B) {
+			z := &ZipWriter{fs: fs, logger: log.New(&bytes.Buffer{}, "", 0)}
+			for i := 0; i < b.N; i++ {
+				_, err := z.globDir(FileArg{GlobDir: "deep"}, nil, parallelJobs, false)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAutoCompressionLevel(t *testing.T) {
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	// Words in a random order compress a lot better at the slowest level than the fastest.
+	words := []string{"zip", "file", "entry", "soong", "build", "android", "compress", "level"}
+	r := rand.New(rand.NewSource(2))
+	text := &bytes.Buffer{}
+	for text.Len() < 64*1024 {
+		text.WriteString(words[r.Intn(len(words))] + " ")
+	}
+
+	fs := pathtools.MockFs(map[string][]byte{
+		"random":   random,
+		"text":     text.Bytes(),
+		"repeated": []byte(strings.Repeat("repeated line of text\n", 3000)),
+		"empty":    nil,
+	})
+
+	t.Run("levels", func(t *testing.T) {
+		z := &ZipWriter{fs: fs}
+		testCases := []struct {
+			src    string
+			method uint16
+			level  int
+		}{
+			{"random", zip.Store, 0},
+			{"text", zip.Deflate, 9},
+			{"repeated", zip.Deflate, 1},
+			{"empty", zip.Deflate, 5},
+			{"missing", zip.Deflate, 5},
+		}
+		for _, test := range testCases {
+			method, level, err := z.autoCompression(test.src, zip.Deflate, 5)
+			if err != nil {
+				t.Fatalf("%s: got error %v", test.src, err)
+			}
+			if method != test.method || level != test.level {
+				t.Errorf("%s: want method %d level %d, got method %d level %d", test.src,
+					test.method, test.level, method, level)
+			}
+		}
+	})
+
+	zipAuto := func(t *testing.T) []byte {
+		args := ZipArgs{}
+		args.FileArgs = (&FileArgsBuilder{fs: fs}).File("random").File("text").File("repeated").FileArgs()
+		args.CompressionLevel = 5
+		args.AutoCompressionLevel = true
+		args.Filesystem = fs
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	t.Run("zip", func(t *testing.T) {
+		out := zipAuto(t)
+		zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]uint16{"random": zip.Store, "text": zip.Deflate, "repeated": zip.Deflate}
+		for _, f := range zr.File {
+			if f.Method != want[f.Name] {
+				t.Errorf("%s: want method %d, got %d", f.Name, want[f.Name], f.Method)
+			}
+		}
+		if !bytes.Equal(out, zipAuto(t)) {
+			t.Error("zip files with auto compression level differ")
+		}
+	})
+
+	t.Run("zstd", func(t *testing.T) {
+		args := ZipArgs{}
+		args.FileArgs = (&FileArgsBuilder{fs: fs}).File("text").FileArgs()
+		args.AutoCompressionLevel = true
+		args.CompressionMethod = CompressionZstd
+		args.Filesystem = fs
+		args.Stderr = &bytes.Buffer{}
+		err := ZipTo(args, &bytes.Buffer{})
+		want := "auto compression level requires compression method deflate and the default strategy"
+		if err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+}
+
+func TestCompressionStrategy(t *testing.T) {
+	// Large enough to be compressed in parallel blocks.
+	large := strings.Repeat("large file contents ", minParallelFileSize/20+1)
+
+	zipWithStrategy := func(t *testing.T, strategy CompressionStrategy) []byte {
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().File("a/a/a").File("c").
+			ReaderFile("large", strings.NewReader(large)).FileArgs()
+		args.CompressionLevel = 9
+		args.CompressionStrategy = strategy
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	huffman := zipWithStrategy(t, CompressionStrategyHuffmanOnly)
+	zr, err := zip.NewReader(bytes.NewReader(huffman), int64(len(huffman)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"a/a/a": string(fileA), "c": string(fileC), "large": large}
+	for _, f := range zr.File {
+		if f.Name == "large" && f.Method != zip.Deflate {
+			t.Errorf("%s: want method deflate, got %d", f.Name, f.Method)
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", f.Name, err)
+		}
+		if string(got) != want[f.Name] {
+			t.Errorf("%s: contents don't round trip", f.Name)
+		}
+	}
+
+	// Repeated text compresses much better when matches are searched for.
+	if def := zipWithStrategy(t, CompressionStrategyDefault); len(huffman) <= len(def) {
+		t.Errorf("want huffman-only zip file larger than default %d, got %d", len(def), len(huffman))
+	}
+
+	t.Run("zstd", func(t *testing.T) {
+		args := ZipArgs{}
+		args.CompressionMethod = CompressionZstd
+		args.CompressionStrategy = CompressionStrategyHuffmanOnly
+		args.Filesystem = mockFs
+		if err := ZipTo(args, &bytes.Buffer{}); err == nil {
+			t.Error("want error for huffman-only with zstd")
+		}
+	})
+}
+
+func BenchmarkCompressionStrategy(b *testing.B) {
+	dense := make([]byte, 4*parallelBlockSize)
+	rand.New(rand.NewSource(1)).Read(dense)
+
+	for _, strategy := range []CompressionStrategy{CompressionStrategyDefault, CompressionStrategyHuffmanOnly} {
+		b.Run(strategy.String(), func(b *testing.B) {
+			b.SetBytes(int64(len(dense)))
+			for i := 0; i < b.N; i++ {
+				args := ZipArgs{}
+				args.FileArgs = fileArgsBuilder().ReaderFile("dense", bytes.NewReader(dense)).FileArgs()
+				args.CompressionLevel = 5
+				args.CompressionStrategy = strategy
+				args.Stderr = &bytes.Buffer{}
+				if err := ZipTo(args, ioutil.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestParallelDeterminism(t *testing.T) {
+	// Files of random words compress at different speeds, and the large ones are compressed in
+	// parallel blocks, so compressions finish in a different order on every run.
+	r := rand.New(rand.NewSource(1))
+	words := []string{"zip", "file", "entry", "header", "deflate", "block", "central", "directory"}
+	randomText := func(size int) []byte {
+		buf := &bytes.Buffer{}
+		for buf.Len() < size {
+			buf.WriteString(words[r.Intn(len(words))])
+			buf.WriteByte(' ')
+		}
+		return buf.Bytes()
+	}
+
+	files := map[string][]byte{}
+	builder := fileArgsBuilder()
+	for i := 0; i < 2; i++ {
+		name := fmt.Sprintf("large/%d", i)
+		files[name] = randomText(minParallelFileSize + i*parallelBlockSize/3)
+		builder.File(name)
+	}
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("small/%02d", i)
+		files[name] = randomText(r.Intn(64 * 1024))
+		builder.File(name)
+	}
+	fs := pathtools.MockFs(files)
+
+	zipWithJobs := func(t *testing.T, jobs int) []byte {
+		args := ZipArgs{}
+		args.FileArgs = builder.FileArgs()
+		args.CompressionLevel = 1
+		args.NumParallelJobs = jobs
+		args.Filesystem = fs
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	want := zipWithJobs(t, 1)
+	for i := 0; i < 10; i++ {
+		if got := zipWithJobs(t, 16); !bytes.Equal(got, want) {
+			t.Fatalf("run %d: output with 16 jobs differs from output with 1 job", i)
+		}
+	}
+}
+
+func TestZipToStdout(t *testing.T) {
+	stdout := &bytes.Buffer{}
+
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().File("a/a/a").File("c").FileArgs()
+	args.OutputFilePath = "-"
+	args.CompressionLevel = 9
+	args.Filesystem = mockFs
+	args.Stdout = stdout
+	args.Stderr = &bytes.Buffer{}
+
+	err := Zip(args)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	br := bytes.NewReader(stdout.Bytes())
+	zr, err := zip.NewReader(br, int64(br.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]byte{
+		"a/a/a": fileA,
+		"c":     fileC,
+	}
+	if len(zr.File) != len(want) {
+		t.Fatalf("want %d files, got %d", len(want), len(zr.File))
+	}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("error when opening %s: %s", f.Name, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("error when reading %s: %s", f.Name, err)
+		}
+		if !bytes.Equal(got, want[f.Name]) {
+			t.Errorf("incorrect contents for %s, want %q got %q", f.Name, want[f.Name], got)
+		}
+	}
+
+	t.Run("write if changed", func(t *testing.T) {
+		args.WriteIfChanged = true
+		if err := Zip(args); err == nil {
+			t.Error("expected error when writing to stdout with write if changed")
+		}
+	})
+}
+
+func TestSortEntries(t *testing.T) {
+	zipWithOrder := func(t *testing.T, emulateJar bool, files ...string) []byte {
+		b := fileArgsBuilder()
+		for _, file := range files {
+			b.File(file)
+		}
+
+		args := ZipArgs{}
+		args.FileArgs = b.FileArgs()
+		args.CompressionLevel = 9
+		args.SortEntries = true
+		args.EmulateJar = emulateJar
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		err := ZipTo(args, buf)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	names := func(t *testing.T, b []byte) []string {
+		br := bytes.NewReader(b)
+		zr, err := zip.NewReader(br, int64(br.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ret []string
+		for _, f := range zr.File {
+			ret = append(ret, f.Name)
+		}
+		return ret
+	}
+
+	t.Run("zip", func(t *testing.T) {
+		a := zipWithOrder(t, false, "c", "a/a/b", "d/a.c", "a/a/a")
+		b := zipWithOrder(t, false, "a/a/a", "d/a.c", "c", "a/a/b")
+
+		if !bytes.Equal(a, b) {
+			t.Error("expected identical zip files")
+		}
+
+		want := []string{"a/a/a", "a/a/b", "c", "d/a.c"}
+		if got := names(t, a); !reflect.DeepEqual(got, want) {
+			t.Errorf("want files %q, got %q", want, got)
+		}
+	})
+
+	t.Run("jar", func(t *testing.T) {
+		a := zipWithOrder(t, true, "c", "a/a/b", "a/a/a")
+		b := zipWithOrder(t, true, "a/a/a", "c", "a/a/b")
+
+		if !bytes.Equal(a, b) {
+			t.Error("expected identical jar files")
+		}
+
+		want := []string{"META-INF/", "META-INF/MANIFEST.MF", "a/", "a/a/", "a/a/a", "a/a/b", "c"}
+		if got := names(t, a); !reflect.DeepEqual(got, want) {
+			t.Errorf("want files %q, got %q", want, got)
+		}
+	})
+}
+
+func TestManifestContents(t *testing.T) {
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().File("a/a/a").File("c").FileArgs()
+	args.CompressionLevel = 9
+	args.EmulateJar = true
+	args.ManifestContents = fileCustomManifest
+	args.Filesystem = mockFs
+	args.Stderr = &bytes.Buffer{}
+
+	buf := &bytes.Buffer{}
+	err := ZipTo(args, buf)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	br := bytes.NewReader(buf.Bytes())
+	zr, err := zip.NewReader(br, int64(br.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	want := []string{"META-INF/", jar.ManifestFile, "a/", "a/a/", "a/a/a", "c"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("want files %q, got %q", want, names)
+	}
+
+	r, err := zr.File[1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, customManifestAfter) {
+		t.Errorf("want manifest %q, got %q", customManifestAfter, got)
+	}
+
+	t.Run("with file", func(t *testing.T) {
+		args := args
+		args.ManifestSourcePath = "manifest.txt"
+
+		err := ZipTo(args, &bytes.Buffer{})
+		want := `cannot specify both a manifest file "manifest.txt" and manifest contents`
+		if err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+
+	t.Run("without jar", func(t *testing.T) {
+		args := args
+		args.EmulateJar = false
+
+		err := ZipTo(args, &bytes.Buffer{})
+		want := "must specify --jar when specifying a manifest via -m"
+		if err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		args := args
+		args.ManifestContents = []byte("Class-Path: " + strings.Repeat("a", 100) + "\n")
+
+		err := ZipTo(args, &bytes.Buffer{})
+		want := "manifest contents: manifest line 3 is 112 bytes long"
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+}
+
+func TestTimestamp(t *testing.T) {
+	zipWithTimestamp := func(t *testing.T, timestamp time.Time) []byte {
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().File("a/a/a").File("c").FileArgs()
+		args.CompressionLevel = 9
+		args.EmulateJar = true
+		args.ManifestSourcePath = "manifest.txt"
+		args.Timestamp = timestamp
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		err := ZipTo(args, buf)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	checkModTimes := func(t *testing.T, b []byte, want time.Time) {
+		br := bytes.NewReader(b)
+		zr, err := zip.NewReader(br, int64(br.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(zr.File) == 0 {
+			t.Fatal("expected files in zip")
+		}
+		for _, f := range zr.File {
+			if got := f.ModTime(); !got.Equal(want) {
+				t.Errorf("incorrect modification time for %s, want %v got %v", f.Name, want, got)
+			}
+		}
+	}
+
+	t.Run("fixed", func(t *testing.T) {
+		timestamp := time.Date(2020, 6, 15, 12, 30, 10, 0, time.UTC)
+		a := zipWithTimestamp(t, timestamp)
+		b := zipWithTimestamp(t, timestamp)
+
+		if !bytes.Equal(a, b) {
+			t.Error("expected identical zip files")
+		}
+		checkModTimes(t, a, timestamp)
+	})
+
+	t.Run("unix", func(t *testing.T) {
+		checkModTimes(t, zipWithTimestamp(t, time.Unix(1500000000, 0)), time.Unix(1500000000, 0))
+	})
+
+	t.Run("clamped", func(t *testing.T) {
+		checkModTimes(t, zipWithTimestamp(t, time.Unix(0, 0)), time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC))
+	})
+
+	t.Run("default", func(t *testing.T) {
+		checkModTimes(t, zipWithTimestamp(t, time.Time{}), jar.DefaultTime)
+	})
+
+	t.Run("SOURCE_DATE_EPOCH", func(t *testing.T) {
+		t.Setenv("SOURCE_DATE_EPOCH", "1104537600")
+		a := zipWithTimestamp(t, time.Time{})
+		b := zipWithTimestamp(t, time.Time{})
+
+		if !bytes.Equal(a, b) {
+			t.Error("expected identical zip files")
+		}
+		checkModTimes(t, a, time.Date(2005, 1, 1, 0, 0, 0, 0, time.UTC))
+	})
+
+	t.Run("SOURCE_DATE_EPOCH later than default", func(t *testing.T) {
+		t.Setenv("SOURCE_DATE_EPOCH", "1600000000")
+		checkModTimes(t, zipWithTimestamp(t, time.Time{}), jar.DefaultTime)
+	})
+
+	t.Run("SOURCE_DATE_EPOCH clamped", func(t *testing.T) {
+		t.Setenv("SOURCE_DATE_EPOCH", "0")
+		checkModTimes(t, zipWithTimestamp(t, time.Time{}), time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC))
+	})
+
+	t.Run("SOURCE_DATE_EPOCH with timestamp", func(t *testing.T) {
+		t.Setenv("SOURCE_DATE_EPOCH", "1104537600")
+		timestamp := time.Date(2020, 6, 15, 12, 30, 10, 0, time.UTC)
+		checkModTimes(t, zipWithTimestamp(t, timestamp), timestamp)
+	})
+
+	for _, epoch := range []string{"yesterday", "-1", "1.5"} {
+		t.Run("invalid SOURCE_DATE_EPOCH "+epoch, func(t *testing.T) {
+			t.Setenv("SOURCE_DATE_EPOCH", epoch)
+			args := ZipArgs{}
+			args.FileArgs = fileArgsBuilder().File("a/a/a").FileArgs()
+			args.Filesystem = mockFs
+			args.Stderr = &bytes.Buffer{}
+
+			err := ZipTo(args, &bytes.Buffer{})
+			if err == nil || !strings.Contains(err.Error(), "invalid SOURCE_DATE_EPOCH") {
+				t.Errorf("want invalid SOURCE_DATE_EPOCH error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestAlwaysDataDescriptor(t *testing.T) {
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().File("a/a/a").File("a/a/b").File("a/a/c").
+		ReaderFile("stdin", bytes.NewReader(fileC)).FileArgs()
+	args.AddDirectoryEntriesToZip = true
+	args.CompressionLevel = 9
+	args.NonDeflatedFiles = map[string]bool{"a/a/b": true}
+	args.StoreSymlinks = true
+	args.AlwaysDataDescriptor = true
+	args.Filesystem = mockFs
+	args.Stderr = &bytes.Buffer{}
+
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	data := buf.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	methods := make(map[uint16]bool)
+	// Walk the local headers in order like a streaming reader, using the compressed sizes from
+	// the central directory to skip over the contents.
+	offset := 0
+	for _, f := range zr.File {
+		methods[f.Method] = true
+		if f.Flags&0x8 == 0 {
+			t.Errorf("%s: data descriptor flag not set in the central directory", f.Name)
+		}
+
+		local := data[offset:]
+		if sig := binary.LittleEndian.Uint32(local); sig != 0x04034b50 {
+			t.Fatalf("%s: want local header signature at %d, got %08x", f.Name, offset, sig)
+		}
+		if flags := binary.LittleEndian.Uint16(local[6:]); flags&0x8 == 0 {
+			t.Errorf("%s: data descriptor flag not set in the local header", f.Name)
+		}
+		for _, field := range []int{14, 18, 22} {
+			if v := binary.LittleEndian.Uint32(local[field:]); v != 0 {
+				t.Errorf("%s: want 0 at offset %d of the local header, got %d", f.Name, field, v)
+			}
+		}
+		nameLen := int(binary.LittleEndian.Uint16(local[26:]))
+		extraLen := int(binary.LittleEndian.Uint16(local[28:]))
+		offset += 30 + nameLen + extraLen + int(f.CompressedSize64)
+
+		descriptor := data[offset:]
+		if sig := binary.LittleEndian.Uint32(descriptor); sig != 0x08074b50 {
+			t.Fatalf("%s: want data descriptor signature at %d, got %08x", f.Name, offset, sig)
+		}
+		if crc := binary.LittleEndian.Uint32(descriptor[4:]); crc != f.CRC32 {
+			t.Errorf("%s: want data descriptor CRC32 %08x, got %08x", f.Name, f.CRC32, crc)
+		}
+		if size := binary.LittleEndian.Uint32(descriptor[8:]); uint64(size) != f.CompressedSize64 {
+			t.Errorf("%s: want data descriptor compressed size %d, got %d", f.Name, f.CompressedSize64, size)
+		}
+		if size := binary.LittleEndian.Uint32(descriptor[12:]); uint64(size) != f.UncompressedSize64 {
+			t.Errorf("%s: want data descriptor size %d, got %d", f.Name, f.UncompressedSize64, size)
+		}
+		offset += 16
+
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("%s: %s", f.Name, err)
+		}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			t.Errorf("%s: %s", f.Name, err)
+		}
+		r.Close()
+	}
+	if !methods[zip.Store] || !methods[zip.Deflate] {
+		t.Errorf("want both stored and deflated entries, got methods %v", methods)
+	}
+}
+
+func TestAlignUncompressed(t *testing.T) {
+	testCases := []struct {
+		name            string
+		align           int
+		dataDescriptors bool
+	}{
+		{name: "4", align: 4},
+		{name: "4096", align: 4096},
+		{name: "data descriptors", align: 4, dataDescriptors: true},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{}
+			args.FileArgs = fileArgsBuilder().File("a/a/a").File("a/a/b").File("c").
+				ReaderFile("stdin", bytes.NewReader(fileB)).File("d/a.c").FileArgs()
+			args.AddDirectoryEntriesToZip = true
+			args.CompressionLevel = 9
+			args.NonDeflatedFiles = map[string]bool{"a/a/b": true, "c": true, "stdin": true}
+			args.AlignUncompressed = test.align
+			args.AlwaysDataDescriptor = test.dataDescriptors
+			args.Filesystem = mockFs
+			args.Stderr = &bytes.Buffer{}
+
+			buf := &bytes.Buffer{}
+			if err := ZipTo(args, buf); err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			data := buf.Bytes()
+			zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if failed := verifyEntries(zr); len(failed) > 0 {
+				t.Fatalf("want no failed entries, got %v", failed)
+			}
+
+			stored := 0
+			offset := 0
+			for _, f := range zr.File {
+				local := data[offset:]
+				if sig := binary.LittleEndian.Uint32(local); sig != 0x04034b50 {
+					t.Fatalf("%s: want local header signature at %d, got %08x", f.Name, offset, sig)
+				}
+				nameLen := int(binary.LittleEndian.Uint16(local[26:]))
+				extraLen := int(binary.LittleEndian.Uint16(local[28:]))
+				dataOffset, err := f.DataOffset()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if f.Method == zip.Store && !strings.HasSuffix(f.Name, "/") {
+					stored++
+					if dataOffset%int64(test.align) != 0 {
+						t.Errorf("%s: want contents aligned to %d, got offset %d", f.Name, test.align, dataOffset)
+					}
+				} else if extraLen != len(f.Extra) {
+					t.Errorf("%s: want the %d bytes of extra of the central directory in the local header, got %d",
+						f.Name, len(f.Extra), extraLen)
+				}
+				offset += 30 + nameLen + extraLen + int(f.CompressedSize64)
+				if f.Flags&0x8 != 0 {
+					offset += 16
+				}
+			}
+			if stored != 3 {
+				t.Errorf("want 3 stored files, got %d", stored)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		err := ZipTo(ZipArgs{AlignUncompressed: 3}, &bytes.Buffer{})
+		if want := "alignment 3 must be a power of 2 up to 32768"; err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+}
+
+func TestZipStats(t *testing.T) {
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().File("a/a/a").File("a/a/b").File("c").FileArgs()
+	args.CompressionLevel = 9
+	args.AddDirectoryEntriesToZip = true
+	args.NonDeflatedFiles = map[string]bool{"c": true}
+	args.NumParallelJobs = 4
+	args.Filesystem = mockFs
+	args.Stderr = &bytes.Buffer{}
+
+	buf := &bytes.Buffer{}
+	stats, err := ZipToWithStats(args, buf)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if stats.EntryCount != 5 {
+		t.Errorf("want 5 entries, got %d", stats.EntryCount)
+	}
+
+	wantUncompressed := uint64(len(fileA) + len(fileB) + len(fileC))
+	if stats.UncompressedBytes != wantUncompressed {
+		t.Errorf("want %d uncompressed bytes, got %d", wantUncompressed, stats.UncompressedBytes)
+	}
+
+	br := bytes.NewReader(buf.Bytes())
+	zr, err := zip.NewReader(br, int64(br.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wantCompressed, deflatedCompressed, deflatedUncompressed uint64
+	for _, f := range zr.File {
+		wantCompressed += f.CompressedSize64
+		if f.Method == zip.Deflate {
+			deflatedCompressed += f.CompressedSize64
+			deflatedUncompressed += f.UncompressedSize64
+		}
+	}
+	if stats.CompressedBytes != wantCompressed {
+		t.Errorf("want %d compressed bytes, got %d", wantCompressed, stats.CompressedBytes)
+	}
+	if deflatedCompressed > deflatedUncompressed {
+		t.Errorf("want deflated text to shrink, got %d compressed bytes from %d", deflatedCompressed, deflatedUncompressed)
+	}
+
+	wantMethods := map[uint16]int{zip.Store: 3, zip.Deflate: 2}
+	if !reflect.DeepEqual(stats.MethodCounts, wantMethods) {
+		t.Errorf("want method counts %v, got %v", wantMethods, stats.MethodCounts)
+	}
+}
+
+func TestAlignExtensions(t *testing.T) {
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().RenamedFile("lib/arm64/libfoo.so", "a/a/a").
+		RenamedFile("lib/arm64/libbar.SO", "a/a/b").File("c").File("d/a.c").FileArgs()
+	args.CompressionLevel = 9
+	args.NonDeflatedFiles = map[string]bool{"c": true}
+	args.AlignUncompressed = 4
+	args.AlignExtensions = map[string]int{"so": 16384}
+	args.Filesystem = mockFs
+	args.Stderr = &bytes.Buffer{}
+
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := verifyEntries(zr); len(failed) > 0 {
+		t.Fatalf("want no failed entries, got %v", failed)
+	}
+
+	want := map[string]struct {
+		method uint16
+		align  int64
+	}{
+		"lib/arm64/libfoo.so": {zip.Store, 16384},
+		"lib/arm64/libbar.SO": {zip.Store, 16384},
+		"c":                   {zip.Store, 4},
+		"d/a.c":               {zip.Deflate, 1},
+	}
+	for _, f := range zr.File {
+		w, ok := want[f.Name]
+		if !ok {
+			t.Errorf("unexpected entry %q", f.Name)
+			continue
+		}
+		if f.Method != w.method {
+			t.Errorf("%s: want method %d, got %d", f.Name, w.method, f.Method)
+		}
+		offset, err := f.DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offset%w.align != 0 {
+			t.Errorf("%s: want contents aligned to %d, got offset %d", f.Name, w.align, offset)
+		}
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		err := ZipTo(ZipArgs{AlignExtensions: map[string]int{"so": 10000}}, &bytes.Buffer{})
+		if want := `alignment 10000 of extension "so" must be a power of 2 up to 32768`; err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+}
+
+func TestListOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestListOutput")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zipWithListing := func(t *testing.T, name string) ([]byte, []byte) {
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().File("c").File("a/a/a").FileArgs()
+		args.OutputFilePath = filepath.Join(dir, name+".zip")
+		args.ListOutputPath = filepath.Join(dir, name+".txt")
+		args.CompressionLevel = 9
+		args.NonDeflatedFiles = map[string]bool{"c": true}
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+
+		err := Zip(args)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		zipBytes, err := ioutil.ReadFile(args.OutputFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listing, err := ioutil.ReadFile(args.ListOutputPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zipBytes, listing
+	}
+
+	zipBytes, got := zipWithListing(t, "first")
+
+	br := bytes.NewReader(zipBytes)
+	zr, err := zip.NewReader(br, int64(br.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressedSizes := make(map[string]uint64)
+	for _, f := range zr.File {
+		compressedSizes[f.Name] = f.CompressedSize64
+	}
+
+	want := fmt.Sprintf("a/a/a\tdeflate\t%d\t%d\t%08x\n"+"c\tstore\t%d\t%d\t%08x\n",
+		compressedSizes["a/a/a"], len(fileA), crc32.ChecksumIEEE(fileA),
+		len(fileC), len(fileC), crc32.ChecksumIEEE(fileC))
+	if string(got) != want {
+		t.Errorf("want listing:\n%s\ngot:\n%s", want, got)
+	}
+
+	if _, again := zipWithListing(t, "second"); !bytes.Equal(got, again) {
+		t.Errorf("expected identical listings, got:\n%s\nand:\n%s", got, again)
+	}
+}
+
+func TestList(t *testing.T) {
+	dir := t.TempDir()
+	timestamp := time.Date(2020, 6, 15, 12, 30, 10, 0, time.UTC)
+
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().File("c").File("a/a/a").File("a/a/c").FileArgs()
+	args.OutputFilePath = filepath.Join(dir, "out.zip")
+	args.CompressionLevel = 9
+	args.NonDeflatedFiles = map[string]bool{"c": true}
+	args.Timestamp = timestamp
+	args.StoreSymlinks = true
+	args.Filesystem = mockFs
+	args.Stderr = &bytes.Buffer{}
+	if err := Zip(args); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	b, err := ioutil.ReadFile(args.OutputFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := List(args.OutputFilePath)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	want := []EntryInfo{
+		{
+			Name:             "c",
+			Method:           zip.Store,
+			CompressedSize:   uint64(len(fileC)),
+			UncompressedSize: uint64(len(fileC)),
+			CRC32:            crc32.ChecksumIEEE(fileC),
+			Modified:         timestamp,
+			Mode:             0666,
+		},
+		{
+			Name:             "a/a/a",
+			Method:           zip.Deflate,
+			CompressedSize:   zr.File[1].CompressedSize64,
+			UncompressedSize: uint64(len(fileA)),
+			CRC32:            crc32.ChecksumIEEE(fileA),
+			Modified:         timestamp,
+			Mode:             0666,
+		},
+		{
+			Name:             "a/a/c",
+			Method:           zip.Store,
+			CompressedSize:   uint64(len("../../c")),
+			UncompressedSize: uint64(len("../../c")),
+			CRC32:            crc32.ChecksumIEEE([]byte("../../c")),
+			Modified:         timestamp,
+			Mode:             os.ModeSymlink | 0777,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want entries:\n%+v\ngot:\n%+v", want, got)
+	}
+	if got[0].MethodName() != "store" || got[1].MethodName() != "deflate" {
+		t.Errorf("want methods store and deflate, got %s and %s", got[0].MethodName(), got[1].MethodName())
+	}
+
+	if _, err := List(filepath.Join(dir, "missing.zip")); err == nil {
+		t.Error("want error for a missing zip file")
+	}
+}
+
+func TestContentIndex(t *testing.T) {
+	dir := t.TempDir()
+
+	zipWithIndex := func(t *testing.T, name string, fa *FileArgsBuilder, append bool) ([]byte, *zip.Reader) {
+		args := ZipArgs{}
+		args.FileArgs = fa.FileArgs()
+		args.OutputFilePath = filepath.Join(dir, name)
+		args.CompressionLevel = 9
+		args.AddDirectoryEntriesToZip = true
+		args.NonDeflatedFiles = map[string]bool{"c": true}
+		args.Timestamp = time.Date(2020, 6, 15, 12, 30, 10, 0, time.UTC)
+		args.WriteContentIndex = true
+		args.Append = append
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+		if err := Zip(args); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		b, err := ioutil.ReadFile(args.OutputFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b, zr
+	}
+
+	// checkIndex checks that the content index is the last entry of zr and matches the central
+	// directory entries of all the others.
+	checkIndex := func(t *testing.T, zr *zip.Reader) {
+		t.Helper()
+		last := zr.File[len(zr.File)-1]
+		if last.Name != ContentIndexEntry {
+			t.Fatalf("want last entry %q, got %q", ContentIndexEntry, last.Name)
+		}
+		r, err := last.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var lines []string
+		for _, f := range zr.File[:len(zr.File)-1] {
+			if f.Name == ContentIndexEntry {
+				t.Fatalf("more than one %q", ContentIndexEntry)
+			}
+			lines = append(lines, fmt.Sprintf("%s\t%s\t%d\t%08x\n", f.Name, methodName(f.Method),
+				f.UncompressedSize64, f.CRC32))
+		}
+		sort.Strings(lines)
+		if want := strings.Join(lines, ""); string(got) != want {
+			t.Errorf("want content index:\n%s\ngot:\n%s", want, got)
+		}
+	}
+
+	first, zr := zipWithIndex(t, "first.zip", fileArgsBuilder().File("c").File("a/a/a").File("a/a/b"), false)
+	checkIndex(t, zr)
+	if g, w := len(zr.File), 6; g != w {
+		t.Errorf("want %d entries, got %d", w, g)
+	}
+
+	t.Run("reproducible", func(t *testing.T) {
+		again, _ := zipWithIndex(t, "second.zip", fileArgsBuilder().File("c").File("a/a/a").File("a/a/b"), false)
+		if !bytes.Equal(first, again) {
+			t.Error("expected identical zip files")
+		}
+	})
+
+	t.Run("append", func(t *testing.T) {
+		if err := ioutil.WriteFile(filepath.Join(dir, "append.zip"), first, 0666); err != nil {
+			t.Fatal(err)
+		}
+		_, zr := zipWithIndex(t, "append.zip", fileArgsBuilder().File("d/a.c"), true)
+		checkIndex(t, zr)
+		if g, w := len(zr.File), 8; g != w {
+			t.Errorf("want %d entries, got %d", w, g)
+		}
+	})
+
+	t.Run("reserved", func(t *testing.T) {
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().RenamedFile(ContentIndexEntry, "c").FileArgs()
+		args.WriteContentIndex = true
+		args.Filesystem = mockFs
+		err := ZipTo(args, &bytes.Buffer{})
+		want := `destination ".zipindex" of "c" is reserved for the content index`
+		if err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+
+	t.Run("password", func(t *testing.T) {
+		args := ZipArgs{}
+		args.WriteContentIndex = true
+		args.Password = "password"
+		if err := ZipTo(args, &bytes.Buffer{}); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestShaOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestShaOutput")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().File("c").File("a/a/a").FileArgs()
+	args.OutputFilePath = filepath.Join(dir, "out.zip")
+	args.ShaOutputPath = filepath.Join(dir, "out.zip.sha256")
+	args.CompressionLevel = 9
+	args.Filesystem = mockFs
+	args.Stderr = &bytes.Buffer{}
+
+	checkSha := func(t *testing.T) {
+		t.Helper()
+		zipBytes, err := ioutil.ReadFile(args.OutputFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(args.ShaOutputPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("%x", sha256.Sum256(zipBytes)); string(got) != want {
+			t.Errorf("want sha256 %q, got %q", want, got)
+		}
+	}
+
+	if err := Zip(args); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	checkSha(t)
+
+	t.Run("unchanged", func(t *testing.T) {
+		// Backdate the zip file so that rewriting it would be visible.
+		old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		if err := os.Chtimes(args.OutputFilePath, old, old); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(args.ShaOutputPath); err != nil {
+			t.Fatal(err)
+		}
+
+		args := args
+		args.WriteIfChanged = true
+		if err := Zip(args); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		info, err := os.Stat(args.OutputFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(old) {
+			t.Errorf("expected the unchanged zip file to be left in place, got modification time %v", info.ModTime())
+		}
+		checkSha(t)
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		args := args
+		args.WriteIfChanged = true
+		args.FileArgs = fileArgsBuilder().File("c").FileArgs()
+		if err := Zip(args); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		checkSha(t)
+	})
+}
+
+func TestCompressionLevel(t *testing.T) {
+	testCases := []struct {
+		level int
+		valid bool
+	}{
+		{level: -2, valid: false},
+		{level: -1, valid: true},
+		{level: 0, valid: true},
+		{level: 1, valid: true},
+		{level: 9, valid: true},
+		{level: 10, valid: false},
+		{level: 15, valid: false},
+	}
+
+	for _, test := range testCases {
+		t.Run(fmt.Sprintf("%d", test.level), func(t *testing.T) {
+			args := ZipArgs{}
+			args.FileArgs = fileArgsBuilder().File("a/a/a").FileArgs()
+			args.CompressionLevel = test.level
+			args.Filesystem = mockFs
+			args.Stderr = &bytes.Buffer{}
+
+			buf := &bytes.Buffer{}
+			err := ZipTo(args, buf)
+			if test.valid && err != nil {
+				t.Fatalf("got error %v", err)
+			} else if !test.valid {
+				want := fmt.Sprintf("invalid compression level %d, must be between 0 and 9, or -1 for the default",
+					test.level)
+				if err == nil {
+					t.Fatalf("want error %q, got no error", want)
+				} else if err.Error() != want {
+					t.Fatalf("want error %q, got %q", want, err)
+				}
+				if buf.Len() != 0 {
+					t.Errorf("expected no output, got %d bytes", buf.Len())
+				}
+			}
+		})
+	}
+}
+
+func TestCleanPaths(t *testing.T) {
+	rename := func(dest string) NameMapper {
+		return func(src, _ string) (string, bool) {
+			return dest, true
+		}
+	}
+
+	testCases := []struct {
+		name           string
+		args           *FileArgsBuilder
+		nameMapper     NameMapper
+		noClean        bool
+		allowBackslash bool
+
+		files []string
+		err   error
+	}{
+		{
+			name:       "doubled slashes",
+			args:       fileArgsBuilder().File("c"),
+			nameMapper: rename("a//b///c"),
+			files:      []string{"a/b/c"},
+		},
+		{
+			name:       "dot segments",
+			args:       fileArgsBuilder().File("c"),
+			nameMapper: rename("./a/./b/../c"),
+			files:      []string{"a/c"},
+		},
+		{
+			name:  "prefix with dot segments",
+			args:  fileArgsBuilder().PathPrefixInZip("./foo/../bar/").File("c"),
+			files: []string{"bar/c"},
+		},
+		{
+			name: "prefix outside zip",
+			args: fileArgsBuilder().PathPrefixInZip("foo/../..").File("c"),
+			err:  DestinationOutsideZipError{Path: "c", Dest: "../c"},
+		},
+		{
+			name: "renamed absolute",
+			args: fileArgsBuilder().RenamedFile("/abs/c", "c"),
+			err:  DestinationOutsideZipError{Path: "c", Dest: "/abs/c"},
+		},
+		{
+			name:       "mapped outside zip",
+			args:       fileArgsBuilder().File("c"),
+			nameMapper: rename("a/../../c"),
+			err:        DestinationOutsideZipError{Path: "c", Dest: "a/../../c"},
+		},
+		{
+			name:       "no clean",
+			args:       fileArgsBuilder().File("c"),
+			nameMapper: rename("./a//c"),
+			noClean:    true,
+			files:      []string{"./a//c"},
+		},
+		{
+			name: "backslash",
+			args: fileArgsBuilder().RenamedFile(`dir\c`, "c"),
+			err:  BackslashInNameError{Path: "c", Dest: `dir\c`},
+		},
+		{
+			name: "backslash in prefix",
+			args: fileArgsBuilder().PathPrefixInZip(`win\dir`).File("c"),
+			err:  BackslashInNameError{Path: "c", Dest: `win\dir/c`},
+		},
+		{
+			name:           "allowed backslash",
+			args:           fileArgsBuilder().RenamedFile(`dir\c`, "c"),
+			allowBackslash: true,
+			files:          []string{`dir\c`},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{}
+			args.FileArgs = test.args.FileArgs()
+			args.NameMapper = test.nameMapper
+			args.NoCleanPaths = test.noClean
+			args.AllowBackslashes = test.allowBackslash
+			args.Filesystem = mockFs
+			args.Stderr = &bytes.Buffer{}
+
+			buf := &bytes.Buffer{}
+			err := ZipTo(args, buf)
+			if test.err != nil {
+				if err != test.err {
+					t.Fatalf("want error %v, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			br := bytes.NewReader(buf.Bytes())
+			zr, err := zip.NewReader(br, int64(br.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var files []string
+			for _, f := range zr.File {
+				files = append(files, f.Name)
+			}
+			if !reflect.DeepEqual(files, test.files) {
+				t.Errorf("want files %q, got %q", test.files, files)
+			}
+		})
+	}
+}
+
+func TestZipPath(t *testing.T) {
+	testCases := []struct {
+		path string
+		sep  byte
+		want string
+	}{
+		{path: `a\b\c`, sep: '\\', want: "a/b/c"},
+		{path: `prefix\dir\`, sep: '\\', want: "prefix/dir/"},
+		{path: "a/b/c", sep: '\\', want: "a/b/c"},
+		{path: "a/b/c", sep: '/', want: "a/b/c"},
+		{path: `a\b`, sep: '/', want: `a\b`},
+	}
+
+	for _, test := range testCases {
+		if got := zipPath(test.path, test.sep); got != test.want {
+			t.Errorf("zipPath(%q, %q): want %q, got %q", test.path, test.sep, test.want, got)
+		}
+	}
+}
+
+func TestPathSeparator(t *testing.T) {
+	testCases := []struct {
+		name           string
+		args           *FileArgsBuilder
+		sep            string
+		dirs           bool
+		allowBackslash bool
+
+		files []string
+		warn  bool
+		err   string
+	}{
+		{
+			name:  "default",
+			args:  fileArgsBuilder().PathPrefixInZip("p").File("a/a/a").File("c"),
+			files: []string{"p/a/a/a", "p/c"},
+		},
+		{
+			name:  "slash",
+			args:  fileArgsBuilder().PathPrefixInZip("p").File("a/a/a").File("c"),
+			sep:   "/",
+			files: []string{"p/a/a/a", "p/c"},
+		},
+		{
+			name:  "backslash",
+			args:  fileArgsBuilder().PathPrefixInZip("p").File("a/a/a").File("c"),
+			sep:   `\`,
+			files: []string{`p\a\a\a`, `p\c`},
+			warn:  true,
+		},
+		{
+			name:  "backslash directories",
+			args:  fileArgsBuilder().PathPrefixInZip("p").File("a/a/a"),
+			sep:   `\`,
+			dirs:  true,
+			files: []string{`p\`, `p\a\`, `p\a\a\`, `p\a\a\a`},
+			warn:  true,
+		},
+		{
+			name: "backslash in name",
+			args: fileArgsBuilder().RenamedFile(`dir\c`, "c"),
+			sep:  `\`,
+			err:  BackslashInNameError{Path: "c", Dest: `dir\c`}.Error(),
+		},
+		{
+			name:           "allowed backslash in name",
+			args:           fileArgsBuilder().RenamedFile(`dir\c`, "c"),
+			sep:            "/",
+			allowBackslash: true,
+			files:          []string{`dir\c`},
+		},
+		{
+			name: "invalid",
+			args: fileArgsBuilder().File("c"),
+			sep:  ":",
+			err:  `path separator ":" must be / or \`,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{}
+			args.FileArgs = test.args.FileArgs()
+			args.PathSeparator = test.sep
+			args.AddDirectoryEntriesToZip = test.dirs
+			args.AllowBackslashes = test.allowBackslash
+			args.Filesystem = mockFs
+			stderr := &bytes.Buffer{}
+			args.Stderr = stderr
+
+			buf := &bytes.Buffer{}
+			err := ZipTo(args, buf)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("want error %q, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			if warned := strings.Contains(stderr.String(), "warning: writing names with backslash separators"); warned != test.warn {
+				t.Errorf("want warning %v, got stderr %q", test.warn, stderr.String())
+			}
+
+			br := bytes.NewReader(buf.Bytes())
+			zr, err := zip.NewReader(br, int64(br.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var files []string
+			for _, f := range zr.File {
+				files = append(files, f.Name)
+			}
+			if !reflect.DeepEqual(files, test.files) {
+				t.Errorf("want files %q, got %q", test.files, files)
+			}
+		})
+	}
+}
+
+func TestStripTopLevel(t *testing.T) {
+	testCases := []struct {
+		name     string
+		args     *FileArgsBuilder
+		dirs     bool
+		required bool
+
+		files []string
+		err   string
+	}{
+		{
+			name:  "single root",
+			args:  fileArgsBuilder().Dir("d"),
+			files: []string{"a.c", "a.o", "gen/x", "sub/b.c", "sub/b.o"},
+		},
+		{
+			name:  "single root with directory entries",
+			args:  fileArgsBuilder().Dir("d"),
+			dirs:  true,
+			files: []string{"a.c", "a.o", "gen/", "sub/", "gen/x", "sub/b.c", "sub/b.o"},
+		},
+		{
+			name:  "single root with prefix",
+			args:  fileArgsBuilder().PathPrefixInZip("project").File("a/a/a").File("c"),
+			files: []string{"a/a/a", "c"},
+		},
+		{
+			name:  "multiple roots",
+			args:  fileArgsBuilder().File("a/a/a").File("c"),
+			files: []string{"a/a/a", "c"},
+		},
+		{
+			name:  "single file",
+			args:  fileArgsBuilder().File("c"),
+			files: []string{"c"},
+		},
+		{
+			name:     "multiple roots required",
+			args:     fileArgsBuilder().File("a/a/a").File("c"),
+			required: true,
+			err:      "can't strip the top level directory, the files aren't all inside the same directory",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{}
+			args.FileArgs = test.args.FileArgs()
+			args.AddDirectoryEntriesToZip = test.dirs
+			args.StripTopLevel = true
+			args.StripTopLevelRequired = test.required
+			args.Filesystem = mockFs
+			args.Stderr = &bytes.Buffer{}
+
+			buf := &bytes.Buffer{}
+			err := ZipTo(args, buf)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("want error %q, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			br := bytes.NewReader(buf.Bytes())
+			zr, err := zip.NewReader(br, int64(br.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var files []string
+			for _, f := range zr.File {
+				files = append(files, f.Name)
+			}
+			if !reflect.DeepEqual(files, test.files) {
+				t.Errorf("want files %q, got %q", test.files, files)
+			}
+		})
+	}
+}
+
+func TestNameMapper(t *testing.T) {
+	testCases := []struct {
+		name   string
+		mapper NameMapper
+		files  []string
+		err    string
+	}{
+		{
+			name: "rename",
+			mapper: func(src, dest string) (string, bool) {
+				return strings.ToUpper(dest), true
+			},
+			files: []string{"FOO/A/A", "FOO/A/B", "FOO/C"},
+		},
+		{
+			name: "drop",
+			mapper: func(src, dest string) (string, bool) {
+				return dest, src != "a/a/b"
+			},
+			files: []string{"foo/a/a", "foo/c"},
+		},
+		{
+			name: "empty name",
+			mapper: func(src, dest string) (string, bool) {
+				if src == "c" {
+					return "", true
+				}
+				return dest, true
+			},
+			err: `name mapper returned an empty name for "c"`,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{}
+			args.FileArgs = fileArgsBuilder().
+				SourcePrefixToStrip("a").
+				PathPrefixInZip("foo").
+				File("a/a/a").
+				File("a/a/b").
+				SourcePrefixToStrip("").
+				File("c").
+				FileArgs()
+			args.NameMapper = test.mapper
+			args.Filesystem = mockFs
+			args.Stderr = &bytes.Buffer{}
+
+			buf := &bytes.Buffer{}
+			err := ZipTo(args, buf)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("want error %q, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			br := bytes.NewReader(buf.Bytes())
+			zr, err := zip.NewReader(br, int64(br.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var files []string
+			for _, f := range zr.File {
+				files = append(files, f.Name)
+			}
+			if !reflect.DeepEqual(files, test.files) {
+				t.Errorf("want files %q, got %q", test.files, files)
+			}
+		})
+	}
+}
+
+func TestContentTransform(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"t/version.txt": []byte("version @VERSION@\n"),
+		"t/lib.bin":     []byte("binary @VERSION@\n"),
+	})
+
+	upper := func(dest string, r io.Reader) (io.Reader, error) {
+		if !strings.HasSuffix(dest, ".txt") {
+			return r, nil
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		// The transformed contents are longer than the file.
+		b = bytes.ReplaceAll(b, []byte("@VERSION@"), []byte("1.2.3-release"))
+		return bytes.NewReader(bytes.ToUpper(b)), nil
+	}
+
+	testCases := []struct {
+		name      string
+		transform ContentTransform
+		method    CompressionMethod
+		want      map[string]string
+		err       string
+	}{
+		{
+			name:      "deflate",
+			transform: upper,
+			want: map[string]string{
+				"t/version.txt": "VERSION 1.2.3-RELEASE\n",
+				"t/lib.bin":     "binary @VERSION@\n",
+				"r/reader.txt":  "FROM A READER\n",
+			},
+		},
+		{
+			name:      "zstd",
+			transform: upper,
+			method:    CompressionZstd,
+			want: map[string]string{
+				"t/version.txt": "VERSION 1.2.3-RELEASE\n",
+				"t/lib.bin":     "binary @VERSION@\n",
+				"r/reader.txt":  "FROM A READER\n",
+			},
+		},
+		{
+			name: "error",
+			transform: func(dest string, r io.Reader) (io.Reader, error) {
+				return nil, fmt.Errorf("no template")
+			},
+			err: `failed to transform "t/lib.bin": no template`,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			b := &FileArgsBuilder{fs: fs}
+			args := ZipArgs{}
+			args.FileArgs = b.File("t/lib.bin").File("t/version.txt").
+				ReaderFile("r/reader.txt", strings.NewReader("from a reader\n")).FileArgs()
+			args.CompressionLevel = 9
+			args.CompressionMethod = test.method
+			args.ContentTransform = test.transform
+			args.Filesystem = fs
+			args.Stderr = &bytes.Buffer{}
+
+			buf := &bytes.Buffer{}
+			err := ZipTo(args, buf)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("want error %q, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			br := bytes.NewReader(buf.Bytes())
+			zr, err := zip.NewReader(br, int64(br.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string)
+			for _, f := range zr.File {
+				r, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				contents, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatalf("%s: %s", f.Name, err)
+				}
+				if f.UncompressedSize64 != uint64(len(contents)) {
+					t.Errorf("%s: want size %d, got %d", f.Name, len(contents), f.UncompressedSize64)
+				}
+				got[f.Name] = string(contents)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("want files %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestLargeFileThreshold(t *testing.T) {
+	for _, method := range []CompressionMethod{CompressionDeflate, CompressionZstd, CompressionBzip2} {
+		t.Run(method.String(), func(t *testing.T) {
+			args := ZipArgs{}
+			args.FileArgs = fileArgsBuilder().File("a/a/a").File("a/a/b").File("c").FileArgs()
+			args.CompressionLevel = 5
+			args.CompressionMethod = method
+			args.LargeFileThreshold = int64(len(fileC))
+			args.NonDeflatedFiles = map[string]bool{"a/a/b": true}
+			args.Filesystem = mockFs
+			args.Stderr = &bytes.Buffer{}
+
+			buf := &bytes.Buffer{}
+			err := ZipTo(args, buf)
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			br := bytes.NewReader(buf.Bytes())
+			zr, err := zip.NewReader(br, int64(br.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wantMethod, _ := method.zipMethod()
+			want := []zip.FileHeader{
+				fh("a/a/a", fileA, wantMethod),
+				fh("a/a/b", fileB, zip.Store),
+				fh("c", fileC, wantMethod),
+			}
+			if len(zr.File) != len(want) {
+				t.Fatalf("want %d files, got %d", len(want), len(zr.File))
+			}
+			for i, f := range zr.File {
+				if f.Name != want[i].Name || f.Method != want[i].Method || f.CRC32 != want[i].CRC32 ||
+					f.UncompressedSize64 != want[i].UncompressedSize64 {
+					t.Errorf("incorrect file %s, want method %d crc %08x size %d, got method %d crc %08x size %d",
+						f.Name, want[i].Method, want[i].CRC32, want[i].UncompressedSize64,
+						f.Method, f.CRC32, f.UncompressedSize64)
+				}
+				if (f.Method == zip.Store) == (f.Flags&zip.DataDescriptorFlag != 0) {
+					t.Errorf("file %s with method %d has flags %x", f.Name, f.Method, f.Flags)
+				}
+
+				r, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				contents, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatalf("error when reading %s: %s", f.Name, err)
+				}
+				if crc32.ChecksumIEEE(contents) != f.CRC32 {
+					t.Errorf("incorrect contents for %s", f.Name)
+				}
+			}
+		})
+	}
+
+	t.Run("bounded memory", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "TestLargeFileThreshold")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		const size = 32 * 1024 * 1024
+		large := filepath.Join(dir, "large")
+		f, err := os.Create(large)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Truncate(size)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		allocated := func(level int, threshold int64) uint64 {
+			args := ZipArgs{}
+			args.FileArgs = NewFileArgsBuilder().JunkPaths(true).File(large).FileArgs()
+			args.CompressionLevel = level
+			args.LargeFileThreshold = threshold
+			args.Filesystem = pathtools.OsFs
+			args.Stderr = &bytes.Buffer{}
+
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			err := ZipTo(args, ioutil.Discard)
+			runtime.ReadMemStats(&after)
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			return after.TotalAlloc - before.TotalAlloc
+		}
+
+		if got := allocated(0, 0); got < size {
+			t.Errorf("expected buffering the file to allocate at least %d bytes, got %d", size, got)
+		}
+		// Level 0 streams the stored file directly, other levels stream it through a compressor
+		// into a pipe.
+		for _, level := range []int{0, 1, 5, 9} {
+			if got := allocated(level, size); got > size/8 {
+				t.Errorf("expected streaming the file at level %d to allocate at most %d bytes, got %d",
+					level, size/8, got)
+			}
+		}
+	})
+}
+
+func TestComments(t *testing.T) {
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().
+		File("a/a/a").
+		Comment("first").
+		File("a/a/b").
+		File("c").
+		Comment("").
+		File("d/a.c").
+		FileArgs()
+	args.ArchiveComment = "archive"
+	args.Filesystem = mockFs
+	args.Stderr = &bytes.Buffer{}
+
+	buf := &bytes.Buffer{}
+	err := ZipTo(args, buf)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	br := bytes.NewReader(buf.Bytes())
+	zr, err := zip.NewReader(br, int64(br.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if zr.Comment != "archive" {
+		t.Errorf("want archive comment %q, got %q", "archive", zr.Comment)
+	}
+
+	want := map[string]string{
+		"a/a/a": "",
+		"a/a/b": "first",
+		"c":     "first",
+		"d/a.c": "",
+	}
+	got := make(map[string]string)
+	for _, f := range zr.File {
+		got[f.Name] = f.Comment
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want comments %q, got %q", want, got)
+	}
+
+	t.Run("oversized archive comment", func(t *testing.T) {
+		args := args
+		args.ArchiveComment = strings.Repeat("x", 65536)
+
+		err := ZipTo(args, &bytes.Buffer{})
+		want := "archive comment is 65536 bytes, longer than the maximum of 65535 bytes"
+		if err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+
+	t.Run("oversized entry comment", func(t *testing.T) {
+		b := fileArgsBuilder().Comment(strings.Repeat("x", 65536)).File("c")
+
+		want := "comment is 65536 bytes, longer than the maximum of 65535 bytes"
+		if err := b.Error(); err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+}
+
+// ownedFs reports every file as owned by uid and gid.
+type ownedFs struct {
+	pathtools.FileSystem
+	uid, gid uint32
+}
+
+type ownedFileInfo struct {
+	os.FileInfo
+	stat *syscall.Stat_t
+}
+
+func (fi ownedFileInfo) Sys() interface{} { return fi.stat }
+
+func (fs *ownedFs) owned(info os.FileInfo, err error) (os.FileInfo, error) {
+	if err != nil {
+		return nil, err
+	}
+	return ownedFileInfo{info, &syscall.Stat_t{Uid: fs.uid, Gid: fs.gid}}, nil
+}
+
+func (fs *ownedFs) Stat(name string) (os.FileInfo, error) {
+	return fs.owned(fs.FileSystem.Stat(name))
+}
+
+func (fs *ownedFs) Lstat(name string) (os.FileInfo, error) {
+	return fs.owned(fs.FileSystem.Lstat(name))
+}
+
+func TestStoreOwnership(t *testing.T) {
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().
+		File("a/a/a").
+		File("a/a/c").
+		ReaderFile("stdin", bytes.NewReader(fileB)).
+		FileArgs()
+	args.AddDirectoryEntriesToZip = true
+	args.StoreSymlinks = true
+	args.StoreOwnership = true
+	args.Filesystem = &ownedFs{FileSystem: mockFs, uid: 0x01020304, gid: 0x0a0b0c0d}
+	args.Stderr = &bytes.Buffer{}
+
+	buf := &bytes.Buffer{}
+	err := ZipTo(args, buf)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	br := bytes.NewReader(buf.Bytes())
+	zr, err := zip.NewReader(br, int64(br.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owned := []byte{0x75, 0x78, 11, 0, 1, 4, 0x04, 0x03, 0x02, 0x01, 4, 0x0d, 0x0c, 0x0b, 0x0a}
+	root := []byte{0x75, 0x78, 11, 0, 1, 4, 0, 0, 0, 0, 4, 0, 0, 0, 0}
+	want := map[string][]byte{
+		"a/":    root,
+		"a/a/":  root,
+		"a/a/a": owned,
+		"a/a/c": owned,
+		"stdin": root,
+	}
+
+	got := make(map[string][]byte)
+	for _, f := range zr.File {
+		got[f.Name] = f.Extra
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want extras %v, got %v", want, got)
+	}
+
+	if mode := zr.File[3].Mode(); mode&os.ModeSymlink == 0 {
+		t.Errorf("expected a/a/c to still be a symlink, got mode %s", mode)
+	}
+}
+
+// ntfsTimes decodes the times in the NTFS extra field of extra.
+func ntfsTimes(t *testing.T, extra []byte) (mtime, atime, ctime time.Time) {
+	t.Helper()
+	for len(extra) >= 4 {
+		tag := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if tag == NTFSTimesTag {
+			if size != 32 || binary.LittleEndian.Uint16(extra[8:]) != 1 ||
+				binary.LittleEndian.Uint16(extra[10:]) != 24 {
+				t.Fatalf("unexpected NTFS extra field %v", extra[:4+size])
+			}
+			decode := func(b []byte) time.Time {
+				ft := binary.LittleEndian.Uint64(b)
+				return time.Unix(ntfsEpoch.Unix()+int64(ft/1e7), int64(ft%1e7)*100).UTC()
+			}
+			return decode(extra[12:]), decode(extra[20:]), decode(extra[28:])
+		}
+		extra = extra[4+size:]
+	}
+	t.Fatalf("no NTFS extra field")
+	return
+}
+
+func TestHostSystem(t *testing.T) {
+	zipHost := func(t *testing.T, host HostSystem, forceZip64 bool) map[string]*zip.File {
+		t.Helper()
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().File("a/a/a").File("a/a/b").FileArgs()
+		args.AddDirectoryEntriesToZip = true
+		args.CompressionLevel = 9
+		args.NonDeflatedFiles = map[string]bool{"a/a/b": true}
+		args.HostSystem = host
+		args.ForceZip64 = forceZip64
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string]*zip.File)
+		for _, f := range zr.File {
+			files[f.Name] = f
+		}
+		return files
+	}
+
+	testCases := []struct {
+		name       string
+		host       HostSystem
+		forceZip64 bool
+
+		wantHost    map[string]uint16
+		wantMode    map[string]os.FileMode
+		wantVersion map[string]uint16
+	}{
+		{
+			name:        "default",
+			host:        HostSystemDefault,
+			wantHost:    map[string]uint16{"a/": 3, "a/a/a": 0, "a/a/b": 0},
+			wantMode:    map[string]os.FileMode{"a/": 0700 | os.ModeDir, "a/a/a": 0666, "a/a/b": 0666},
+			wantVersion: map[string]uint16{"a/": 20, "a/a/a": 20, "a/a/b": 10},
+		},
+		{
+			name:        "unix",
+			host:        HostSystemUnix,
+			wantHost:    map[string]uint16{"a/": 3, "a/a/a": 3, "a/a/b": 3},
+			wantMode:    map[string]os.FileMode{"a/": 0700 | os.ModeDir, "a/a/a": 0666, "a/a/b": 0666},
+			wantVersion: map[string]uint16{"a/": 20, "a/a/a": 20, "a/a/b": 10},
+		},
+		{
+			name:        "msdos",
+			host:        HostSystemMSDOS,
+			wantHost:    map[string]uint16{"a/": 0, "a/a/a": 0, "a/a/b": 0},
+			wantMode:    map[string]os.FileMode{"a/": 0777 | os.ModeDir, "a/a/a": 0666, "a/a/b": 0666},
+			wantVersion: map[string]uint16{"a/": 20, "a/a/a": 20, "a/a/b": 10},
+		},
+		{
+			name:        "zip64",
+			host:        HostSystemDefault,
+			forceZip64:  true,
+			wantHost:    map[string]uint16{"a/": 3, "a/a/a": 0, "a/a/b": 0},
+			wantMode:    map[string]os.FileMode{"a/": 0700 | os.ModeDir, "a/a/a": 0666, "a/a/b": 0666},
+			wantVersion: map[string]uint16{"a/": 45, "a/a/a": 45, "a/a/b": 45},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			files := zipHost(t, test.host, test.forceZip64)
+			for name, want := range test.wantHost {
+				f := files[name]
+				if f == nil {
+					t.Errorf("missing entry %s", name)
+					continue
+				}
+				if got := f.CreatorVersion >> 8; got != want {
+					t.Errorf("%s: want host system %d, got %d", name, want, got)
+				}
+				if got := f.CreatorVersion & 0xff; got != 20 {
+					t.Errorf("%s: want version made by 20, got %d", name, got)
+				}
+				if got := f.Mode(); got != test.wantMode[name] {
+					t.Errorf("%s: want mode %v, got %v", name, test.wantMode[name], got)
+				}
+				if got := f.ReaderVersion; got != test.wantVersion[name] {
+					t.Errorf("%s: want version needed %d, got %d", name, test.wantVersion[name], got)
+				}
+			}
+		})
+	}
+
+	t.Run("msdos symlink", func(t *testing.T) {
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().File("a/a/c").FileArgs()
+		args.StoreSymlinks = true
+		args.HostSystem = HostSystemMSDOS
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+		err := ZipTo(args, &bytes.Buffer{})
+		if want := `symlink "a/a/c" can't be stored with the msdos host system`; err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+}
+
+func TestUTF8Names(t *testing.T) {
+	const emoji = "\U0001f600/smile.txt"
+	zipNames := func(t *testing.T, forceUTF8 bool, names ...string) (map[string]*zip.File, error) {
+		t.Helper()
+		b := fileArgsBuilder()
+		for _, name := range names {
+			b.ReaderFile(name, bytes.NewReader(fileA))
+		}
+		args := ZipArgs{}
+		args.FileArgs = b.FileArgs()
+		args.ForceUTF8 = forceUTF8
+		args.NoCleanPaths = true
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			return nil, err
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string]*zip.File)
+		for _, f := range zr.File {
+			files[f.Name] = f
+		}
+		return files, nil
+	}
+
+	checkFlag := func(t *testing.T, files map[string]*zip.File, name string, want bool) {
+		t.Helper()
+		f := files[name]
+		if f == nil {
+			t.Fatalf("missing entry %q", name)
+		}
+		if got := f.Flags&utf8Flag != 0; got != want {
+			t.Errorf("%q: want UTF-8 flag %v, got %v", name, want, got)
+		}
+	}
+
+	t.Run("default", func(t *testing.T) {
+		files, err := zipNames(t, false, emoji, "ascii.txt", "\xff.txt")
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		checkFlag(t, files, emoji, true)
+		checkFlag(t, files, "ascii.txt", false)
+		checkFlag(t, files, "\xff.txt", false)
+	})
+
+	t.Run("force", func(t *testing.T) {
+		files, err := zipNames(t, true, emoji, "ascii.txt")
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		checkFlag(t, files, emoji, true)
+		checkFlag(t, files, "ascii.txt", true)
+
+		_, err = zipNames(t, true, "\xff.txt")
+		if want := `name or comment of "\xff.txt" is not valid UTF-8`; err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+}
+
+func TestStoreNTFSTimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestStoreNTFSTimes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "f")
+	if err := ioutil.WriteFile(file, fileA, 0666); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2019, 3, 4, 5, 6, 7, 123456700, time.UTC)
+	atime := time.Date(2020, 8, 9, 10, 11, 12, 987654300, time.UTC)
+	if err := os.Chtimes(file, atime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ctime, _ := statTimes(info)
+
+	zipNTFS := func(t *testing.T, timestamp time.Time) map[string]*zip.File {
+		t.Helper()
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().SourcePrefixToStrip(dir).File(file).
+			ReaderFile("stdin", bytes.NewReader(fileB)).FileArgs()
+		args.StoreNTFSTimes = true
+		args.Timestamp = timestamp
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string]*zip.File)
+		for _, f := range zr.File {
+			files[f.Name] = f
+		}
+		return files
+	}
+
+	checkTimes := func(t *testing.T, f *zip.File, wantM, wantA, wantC time.Time) {
+		t.Helper()
+		gotM, gotA, gotC := ntfsTimes(t, f.Extra)
+		if !gotM.Equal(wantM) || !gotA.Equal(wantA) || !gotC.Equal(wantC.Truncate(100)) {
+			t.Errorf("%s: want times %v %v %v, got %v %v %v", f.Name, wantM, wantA, wantC, gotM, gotA, gotC)
+		}
+	}
+
+	t.Run("source times", func(t *testing.T) {
+		files := zipNTFS(t, time.Time{})
+		checkTimes(t, files["f"], mtime, atime, ctime)
+		checkTimes(t, files["stdin"], jar.DefaultTime, jar.DefaultTime, jar.DefaultTime)
+		if got := files["f"].ModTime(); !got.Equal(jar.DefaultTime) {
+			t.Errorf("want DOS time %v, got %v", jar.DefaultTime, got)
+		}
+	})
+
+	t.Run("timestamp override", func(t *testing.T) {
+		override := time.Date(2021, 1, 2, 3, 4, 5, 600, time.UTC)
+		files := zipNTFS(t, override)
+		checkTimes(t, files["f"], override, override, override)
+		checkTimes(t, files["stdin"], override, override, override)
+	})
+}
+
+func TestProgressFunc(t *testing.T) {
+	type call struct{ done, total int }
+	var calls []call
+
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().File("a/a/a").File("a/a/b").Dir("d").FileArgs()
+	args.EmulateJar = true
+	args.NumParallelJobs = 4
+	args.ProgressFunc = func(done, total int) {
+		calls = append(calls, call{done, total})
+	}
+	args.Filesystem = mockFs
+	args.Stderr = &bytes.Buffer{}
+
+	err := ZipTo(args, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	// a/a/a, a/a/b, the 7 files and directories under d, and the manifest.
+	const total = 10
+	if len(calls) != total {
+		t.Fatalf("want %d calls, got %d: %v", total, len(calls), calls)
+	}
+	for i, c := range calls {
+		if want := (call{i + 1, total}); c != want {
+			t.Errorf("call %d: want %v, got %v", i, want, c)
+		}
+	}
+}
+
+func TestMaxNameLength(t *testing.T) {
+	testCases := []struct {
+		name          string
+		maxNameLength int
+		err           string
+	}{
+		{
+			name:          "at limit",
+			maxNameLength: len("foo/a/a/a"),
+		},
+		{
+			name:          "over limit",
+			maxNameLength: len("foo/a/a/a") - 1,
+			err:           `name of entry "foo/a/a/a" is 9 bytes, longer than the maximum of 8 bytes`,
+		},
+		{
+			name:          "directory",
+			maxNameLength: len("foo/a/a/a"),
+			err:           `name of entry "foo/d/gen/" is 10 bytes, longer than the maximum of 9 bytes`,
+		},
+		{
+			name: "disabled",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			b := fileArgsBuilder().PathPrefixInZip("foo").File("a/a/a").File("c")
+			if test.name == "directory" {
+				b.File("d/gen")
+			}
+
+			args := ZipArgs{}
+			args.FileArgs = b.FileArgs()
+			args.MaxNameLength = test.maxNameLength
+			args.Filesystem = mockFs
+			args.Stderr = &bytes.Buffer{}
+
+			err := ZipTo(args, &bytes.Buffer{})
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("got error %v", err)
+				}
+			} else if err == nil || err.Error() != test.err {
+				t.Errorf("want error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	testCases := []struct {
+		name       string
+		maxEntries int
+		err        string
+	}{
+		{
+			name:       "at limit",
+			maxEntries: 3,
+		},
+		{
+			name:       "over limit",
+			maxEntries: 2,
+			err:        "zip file would have 3 entries, more than the maximum of 2",
+		},
+		{
+			name: "disabled",
+		},
+		{
+			name:       "negative",
+			maxEntries: -1,
+			err:        "max entries must not be negative, got -1",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{}
+			// The duplicate and the parent directory entries aren't counted.
+			args.FileArgs = fileArgsBuilder().File("a/a/a").File("a/a/b").File("c").File("c").FileArgs()
+			args.AddDirectoryEntriesToZip = true
+			args.DuplicateMode = DuplicateFirst
+			args.MaxEntries = test.maxEntries
+			args.Filesystem = mockFs
+			args.Stderr = &bytes.Buffer{}
+
+			err := ZipTo(args, &bytes.Buffer{})
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("got error %v", err)
+				}
+			} else if err == nil || err.Error() != test.err {
+				t.Errorf("want error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestMaxOutputBytes(t *testing.T) {
+	// Random contents don't compress, so the zip file is larger than the files in it.
+	random := make([]byte, 4*parallelBlockSize)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	zipWithMax := func(t *testing.T, out string, max int64, b *FileArgsBuilder) error {
+		args := ZipArgs{}
+		args.FileArgs = b.FileArgs()
+		args.OutputFilePath = out
+		args.CompressionLevel = 9
+		args.MaxOutputBytes = max
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+		return Zip(args)
+	}
+
+	dir := t.TempDir()
+	files := fileArgsBuilder().File("a/a/a").File("a/a/b").File("c")
+	if err := zipWithMax(t, filepath.Join(dir, "unlimited.zip"), 0, files); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "unlimited.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := info.Size()
+
+	t.Run("at limit", func(t *testing.T) {
+		if err := zipWithMax(t, filepath.Join(dir, "at.zip"), size, files); err != nil {
+			t.Errorf("got error %v", err)
+		}
+	})
+
+	t.Run("over limit", func(t *testing.T) {
+		out := filepath.Join(dir, "over.zip")
+		err := zipWithMax(t, out, size-1, files)
+		if tooLarge, ok := err.(OutputTooLargeError); !ok {
+			t.Fatalf("want OutputTooLargeError, got %v", err)
+		} else if tooLarge.Max != size-1 || tooLarge.Size <= size-1 {
+			t.Errorf("want error for a size over %d, got %v", size-1, err)
+		}
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			t.Errorf("want %s to not be created, got %v", out, err)
+		}
+	})
+
+	t.Run("fails early", func(t *testing.T) {
+		err := zipWithMax(t, filepath.Join(dir, "early.zip"), parallelBlockSize, fileArgsBuilder().
+			ReaderFile("random1", bytes.NewReader(random)).
+			ReaderFile("random2", bytes.NewReader(random)))
+		if tooLarge, ok := err.(OutputTooLargeError); !ok {
+			t.Fatalf("want OutputTooLargeError, got %v", err)
+		} else if tooLarge.Size > int64(len(random))+1024 {
+			t.Errorf("want writing to stop in the first file, got %d bytes", tooLarge.Size)
+		}
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		err := zipWithMax(t, filepath.Join(dir, "negative.zip"), -1, files)
+		if want := "max output bytes must not be negative, got -1"; err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+}
+
+func TestDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestDryRun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stdout := &bytes.Buffer{}
+
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().
+		SourcePrefixToStrip("a").
+		PathPrefixInZip("foo").
+		File("a/a/*").
+		JunkPaths(true).
+		PathPrefixInZip("").
+		File("d/sub/b.c").
+		SourcePrefixToStrip("d").
+		PathPrefixInZip("bar").
+		Dir("d/gen").
+		FileArgs()
+	args.OutputFilePath = filepath.Join(dir, "out.zip")
+	args.DryRun = true
+	args.Filesystem = mockFs
+	args.Stdout = stdout
+	args.Stderr = &bytes.Buffer{}
+
+	err = Zip(args)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	if _, err := os.Stat(args.OutputFilePath); !os.IsNotExist(err) {
+		t.Errorf("expected %q to not be created, got %v", args.OutputFilePath, err)
+	}
+
+	want := "foo/a/a\ta/a/a\n" +
+		"foo/a/b\ta/a/b\n" +
+		"foo/a/c\ta/a/c\n" +
+		"foo/a/d\ta/a/d\n" +
+		"b.c\td/sub/b.c\n" +
+		"bar/gen/x\td/gen/x\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("want planned entries:\n%s\ngot:\n%s", want, got)
+	}
+
+	t.Run("duplicates", func(t *testing.T) {
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().File("c").RenamedFile("c", "a/a/a").FileArgs()
+		args.DryRun = true
+		args.Filesystem = mockFs
+		args.Stdout = &bytes.Buffer{}
+		args.Stderr = &bytes.Buffer{}
+
+		err := ZipTo(args, nil)
+		want := `destination "c" has two files "c" and "a/a/a"`
+		if err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+}
+
+func TestDuplicateMode(t *testing.T) {
+	testCases := []struct {
+		name       string
+		args       *FileArgsBuilder
+		duplicates DuplicateMode
+		rename     bool
+		dirEntries bool
+
+		files    []string
+		contents map[string][]byte
+		err      string
+	}{
+		{
+			name:       "error",
+			args:       fileArgsBuilder().File("a/a/a").File("a/a/b").RenamedFile("a/a/a", "c"),
+			duplicates: DuplicateError,
+
+			err: `destination "a/a/a" has two files "a/a/a" and "c"`,
+		},
+		{
+			name:       "first",
+			args:       fileArgsBuilder().File("a/a/a").File("a/a/b").RenamedFile("a/a/a", "c"),
+			duplicates: DuplicateFirst,
+
+			files:    []string{"a/a/a", "a/a/b"},
+			contents: map[string][]byte{"a/a/a": fileA, "a/a/b": fileB},
+		},
+		{
+			name:       "last",
+			args:       fileArgsBuilder().File("a/a/a").File("a/a/b").RenamedFile("a/a/a", "c"),
+			duplicates: DuplicateLast,
+
+			files:    []string{"a/a/a", "a/a/b"},
+			contents: map[string][]byte{"a/a/a": fileC, "a/a/b": fileB},
+		},
+		{
+			name: "rename",
+			args: fileArgsBuilder().JunkPaths(true).
+				File("a/a/a").RenamedFile("a", "a/a/b").RenamedFile("a", "c").
+				RenamedFile("a_2", "d/sub/b.c"),
+			rename: true,
+
+			files:    []string{"a", "a_1", "a_3", "a_2"},
+			contents: map[string][]byte{"a": fileA, "a_1": fileB, "a_3": fileC, "a_2": fileA},
+		},
+		{
+			name: "rename extension",
+			args: fileArgsBuilder().JunkPaths(true).
+				File("d/sub/b.c").RenamedFile("b.c", "a/a/a").RenamedFile("b.c", "a/a/b").
+				RenamedFile(".b", "c").RenamedFile(".b", "a/a/a").
+				RenamedFile("x/y.z", "c").RenamedFile("x/y.z", "a/a/b"),
+			rename: true,
+
+			files: []string{"b.c", "b_1.c", "b_2.c", ".b", ".b_1", "x/y.z", "x/y_1.z"},
+			contents: map[string][]byte{
+				"b.c": fileA, "b_1.c": fileA, "b_2.c": fileB, ".b": fileC, ".b_1": fileA,
+				"x/y.z": fileC, "x/y_1.z": fileB,
+			},
+		},
+		{
+			name:       "rename with duplicate mode",
+			args:       fileArgsBuilder().File("a/a/a"),
+			duplicates: DuplicateFirst,
+			rename:     true,
+
+			err: "rename on collision can't be combined with duplicate mode first",
+		},
+		{
+			name:       "directories",
+			args:       fileArgsBuilder().File("d/sub").File("d/sub"),
+			duplicates: DuplicateError,
+			dirEntries: true,
+
+			files:    []string{"d/", "d/sub/"},
+			contents: map[string][]byte{"d/": nil, "d/sub/": nil},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{}
+			args.FileArgs = test.args.FileArgs()
+			args.CompressionLevel = 9
+			args.DuplicateMode = test.duplicates
+			args.RenameOnCollision = test.rename
+			args.AddDirectoryEntriesToZip = test.dirEntries
+			args.Filesystem = mockFs
+			args.Stderr = &bytes.Buffer{}
+
+			buf := &bytes.Buffer{}
+			err := ZipTo(args, buf)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("want error %q, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			br := bytes.NewReader(buf.Bytes())
+			zr, err := zip.NewReader(br, int64(br.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var files []string
+			for _, f := range zr.File {
+				files = append(files, f.Name)
+
+				r, err := f.Open()
+				if err != nil {
+					t.Fatalf("error when opening %s: %s", f.Name, err)
+				}
+				got, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatalf("error when reading %s: %s", f.Name, err)
+				}
+				if want := test.contents[f.Name]; !bytes.Equal(got, want) {
+					t.Errorf("incorrect contents for %s, want %q got %q", f.Name, want, got)
+				}
+			}
+
+			if !reflect.DeepEqual(files, test.files) {
+				t.Errorf("want files %q, got %q", test.files, files)
+			}
+		})
+	}
+}
+
+func TestReaderFile(t *testing.T) {
+	contents := bytes.Repeat([]byte("stdin contents\n"), 100)
+
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().
+		File("c").
+		ReaderFile("dest/name.txt", bytes.NewReader(contents)).
+		FileArgs()
+	args.CompressionLevel = 9
+	args.AddDirectoryEntriesToZip = true
+	args.Filesystem = mockFs
+	args.Stderr = &bytes.Buffer{}
+
+	buf := &bytes.Buffer{}
+	err := ZipTo(args, buf)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	br := bytes.NewReader(buf.Bytes())
+	zr, err := zip.NewReader(br, int64(br.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if want := []string{"c", "dest/", "dest/name.txt"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("want files %q, got %q", want, names)
+	}
+
+	f := zr.File[2]
+	if f.Method != zip.Deflate {
+		t.Errorf("want method %v, got %v", zip.Deflate, f.Method)
+	}
+	if f.UncompressedSize64 != uint64(len(contents)) {
+		t.Errorf("want size %d, got %d", len(contents), f.UncompressedSize64)
+	}
+	if f.CRC32 != crc32.ChecksumIEEE(contents) {
+		t.Errorf("want crc %08x, got %08x", crc32.ChecksumIEEE(contents), f.CRC32)
+	}
+
+	r, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Errorf("incorrect contents, want %q got %q", contents, got)
+	}
+}
+
+func TestVerifyAfterWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestVerifyAfterWrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().File("a/a/a").File("c").FileArgs()
+	args.OutputFilePath = filepath.Join(dir, "out.zip")
+	args.CompressionLevel = 9
+	args.NonDeflatedFiles = map[string]bool{"c": true}
+	args.VerifyAfterWrite = true
+	args.Filesystem = mockFs
+	args.Stderr = &bytes.Buffer{}
+
+	err = Zip(args)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	// Corrupt a byte in the contents of c.
+	b, err := ioutil.ReadFile(args.OutputFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, err := zr.File[1].DataOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[offset] ^= 0xff
+	if err := ioutil.WriteFile(args.OutputFilePath, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	err = readBackOutput(args)
+	want := args.OutputFilePath + " failed verification:\n  c: " + zip.ErrChecksum.Error()
+	if err == nil || err.Error() != want {
+		t.Errorf("want error %q, got %v", want, err)
+	}
+}
+
+func TestVerifyArchive(t *testing.T) {
+	dir := t.TempDir()
+
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().File("a/a/a").File("a/a/b").File("c").FileArgs()
+	args.OutputFilePath = filepath.Join(dir, "out.zip")
+	args.CompressionLevel = 9
+	args.NonDeflatedFiles = map[string]bool{"a/a/a": true, "c": true}
+	args.Filesystem = mockFs
+	args.Stderr = &bytes.Buffer{}
+	if err := Zip(args); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	failed, err := VerifyArchive(args.OutputFilePath)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	if len(failed) != 0 {
+		t.Errorf("want no failed entries, got %v", failed)
+	}
+
+	// Corrupt a byte in the contents of both stored files.
+	b, err := ioutil.ReadFile(args.OutputFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 2} {
+		offset, err := zr.File[i].DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b[offset] ^= 0xff
+	}
+	corrupt := filepath.Join(dir, "corrupt.zip")
+	if err := ioutil.WriteFile(corrupt, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	failed, err = VerifyArchive(corrupt)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	want := []EntryError{{"a/a/a", zip.ErrChecksum}, {"c", zip.ErrChecksum}}
+	if !reflect.DeepEqual(failed, want) {
+		t.Errorf("want failed entries %v, got %v", want, failed)
+	}
+
+	if _, err := VerifyArchive(filepath.Join(dir, "missing.zip")); err == nil {
+		t.Error("want error for a missing zip file")
+	}
+}
+
+func TestEmptyDirectoryEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestEmptyDirectoryEntries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, d := range []string{"src/empty", "src/full/sub", "src/excluded"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"src/full/sub/a", "src/excluded/b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), fileA, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	args := ZipArgs{}
+	args.FileArgs = NewFileArgsBuilder().
+		SourcePrefixToStrip(filepath.Join(dir, "src")).
+		Dir(filepath.Join(dir, "src")).
+		FileArgs()
+	args.ExcludePatterns = []string{"excluded/*"}
+	args.EmptyDirectoryEntries = true
+	args.Filesystem = pathtools.OsFs
+	args.Stderr = &bytes.Buffer{}
+
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	br := bytes.NewReader(buf.Bytes())
+	zr, err := zip.NewReader(br, int64(br.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if f.Name[len(f.Name)-1] == '/' && !f.Mode().IsDir() {
+			t.Errorf("expected %q to be a directory, got mode %s", f.Name, f.Mode())
+		}
+	}
+
+	want := []string{"empty/", "excluded/", "full/sub/a"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("want files %q, got %q", want, names)
+	}
+}
+
+func TestDirectoryMode(t *testing.T) {
+	testCases := []struct {
+		name    string
+		dirMode os.FileMode
+		want    os.FileMode
+		err     string
+	}{
+		{
+			name: "default",
+			want: 0700,
+		},
+		{
+			name:    "0755",
+			dirMode: 0755,
+			want:    0755,
+		},
+		{
+			name:    "not permission bits",
+			dirMode: 0755 | os.ModeSetuid,
+			err:     "directory mode urwxr-xr-x must only have permission bits",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{}
+			args.FileArgs = fileArgsBuilder().File("a/a/a").Dir("d").FileArgs()
+			args.AddDirectoryEntriesToZip = true
+			args.DirectoryMode = test.dirMode
+			args.Filesystem = mockFs
+			args.Stderr = &bytes.Buffer{}
+
+			buf := &bytes.Buffer{}
+			err := ZipTo(args, buf)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("want error %q, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+
+			br := bytes.NewReader(buf.Bytes())
+			zr, err := zip.NewReader(br, int64(br.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var dirs []string
+			for _, f := range zr.File {
+				if !strings.HasSuffix(f.Name, "/") {
+					if f.Mode().IsDir() {
+						t.Errorf("%s: directory without a trailing slash", f.Name)
+					}
+					continue
+				}
+				dirs = append(dirs, f.Name)
+				if got := f.Mode(); got != test.want|os.ModeDir {
+					t.Errorf("%s: want mode %v, got %v", f.Name, test.want|os.ModeDir, got)
+				}
+				if got := f.ExternalAttrs >> 16 & syscall.S_IFMT; got != syscall.S_IFDIR {
+					t.Errorf("%s: want unix file type %#o, got %#o", f.Name, syscall.S_IFDIR, got)
+				}
+				if f.ExternalAttrs&0x10 == 0 {
+					t.Errorf("%s: missing MS-DOS directory attribute", f.Name)
+				}
+			}
+			want := []string{"a/", "a/a/", "d/", "d/gen/", "d/sub/"}
+			if !reflect.DeepEqual(dirs, want) {
+				t.Errorf("want directories %q, got %q", want, dirs)
+			}
+		})
+	}
+}
+
+func TestStoreSymlinksOsFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestStoreSymlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mustSymlink := func(oldname, newname string) {
+		if err := os.Symlink(oldname, filepath.Join(dir, newname)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub", "file"), fileA, 0666); err != nil {
+		t.Fatal(err)
+	}
+	mustSymlink("sub/file", "file_link")
+	mustSymlink("sub", "dir_link")
+	mustSymlink("missing", "dangling")
+
+	args := ZipArgs{}
+	args.FileArgs = NewFileArgsBuilder().SourcePrefixToStrip(dir).Dir(dir).FileArgs()
+	args.CompressionLevel = 9
+	args.StoreSymlinks = true
+	args.Stderr = &bytes.Buffer{}
+
+	buf := &bytes.Buffer{}
+	err = ZipTo(args, buf)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	br := bytes.NewReader(buf.Bytes())
+	zr, err := zip.NewReader(br, int64(br.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	links := map[string]string{
+		"dangling":  "missing",
+		"dir_link":  "sub",
+		"file_link": "sub/file",
+	}
+
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+
+		target, isLink := links[f.Name]
+		if !isLink {
+			continue
+		}
+
+		if mode := f.ExternalAttrs >> 16; mode != syscall.S_IFLNK|0777 {
+			t.Errorf("incorrect file %s mode want %o got %o", f.Name, syscall.S_IFLNK|0777, mode)
+		}
+
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("error when opening %s: %s", f.Name, err)
+		}
+		body, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("error when reading %s: %s", f.Name, err)
+		}
+		if string(body) != target {
+			t.Errorf("incorrect link %s target want %q got %q", f.Name, target, body)
+		}
+	}
+
+	want := []string{"dangling", "dir_link", "file_link", "sub/file"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("want files %q, got %q", want, names)
+	}
+}
+
+func TestForceZip64(t *testing.T) {
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().File("a/a/a").File("a/a/b").File("c").FileArgs()
+	args.CompressionLevel = 9
+	args.NonDeflatedFiles = map[string]bool{"c": true}
+	args.AddDirectoryEntriesToZip = true
+	args.ForceZip64 = true
+	args.Filesystem = mockFs
+	args.Stderr = &bytes.Buffer{}
+
+	buf := &bytes.Buffer{}
+	err := ZipTo(args, buf)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	// zip64 end of central directory record and locator signatures
+	for _, sig := range [][]byte{{'P', 'K', 6, 6}, {'P', 'K', 6, 7}} {
+		if !bytes.Contains(buf.Bytes(), sig) {
+			t.Errorf("missing zip64 signature %q", sig)
+		}
+	}
+
+	want := map[string][]byte{
+		"a/":    nil,
+		"a/a/":  nil,
+		"a/a/a": fileA,
+		"a/a/b": fileB,
+		"c":     fileC,
+	}
+
+	br := bytes.NewReader(buf.Bytes())
+	zr, err := stdzip.NewReader(br, int64(br.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(zr.File) != len(want) {
+		t.Fatalf("want %d files, got %d", len(want), len(zr.File))
+	}
+
+	for _, f := range zr.File {
+		if f.ReaderVersion != 45 {
+			t.Errorf("incorrect file %s reader version want 45 got %d", f.Name, f.ReaderVersion)
+		}
+
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("error when opening %s: %s", f.Name, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("error when reading %s: %s", f.Name, err)
+		}
+		if !bytes.Equal(got, want[f.Name]) {
+			t.Errorf("incorrect contents for %s, want %q got %q", f.Name, want[f.Name], got)
+		}
+	}
+}
+
+func TestSrcJar(t *testing.T) {
+	mockFs := pathtools.MockFs(map[string][]byte{
+		"wrong_package.java":       []byte("package foo;"),
+		"foo/correct_package.java": []byte("package foo;"),
+		"src/no_package.java":      nil,
+		"src2/parse_error.java":    []byte("error"),
+	})
+
+	want := []string{
+		"foo/",
+		"foo/wrong_package.java",
+		"foo/correct_package.java",
+		"no_package.java",
+		"src2/",
+		"src2/parse_error.java",
+	}
+
+	args := ZipArgs{}
+	args.FileArgs = NewFileArgsBuilder().File("**/*.java").FileArgs()
+
+	args.SrcJar = true
+	args.AddDirectoryEntriesToZip = true
+	args.Filesystem = mockFs
+	args.Stderr = &bytes.Buffer{}
+
+	buf := &bytes.Buffer{}
+	err := ZipTo(args, buf)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	br := bytes.NewReader(buf.Bytes())
+	zr, err := zip.NewReader(br, int64(br.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("error when opening %s: %s", f.Name, err)
+		}
+
+		crc := crc32.NewIEEE()
+		len, err := io.Copy(crc, r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("error when reading %s: %s", f.Name, err)
+		}
+
+		if uint64(len) != f.UncompressedSize64 {
+			t.Errorf("incorrect length for %s, want %d got %d", f.Name, f.UncompressedSize64, len)
+		}
+
+		if crc.Sum32() != f.CRC32 {
+			t.Errorf("incorrect crc for %s, want %x got %x", f.Name, f.CRC32, crc)
+		}
+
+		got = append(got, f.Name)
+	}
+
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want files %q, got %q", want, got)
+	}
+}
+
+func TestZstdInterop(t *testing.T) {
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().File("a/a/a").File("a/a/b").File("c").FileArgs()
+	args.CompressionLevel = 5
+	args.CompressionMethod = CompressionZstd
+	args.Filesystem = mockFs
+	args.Stderr = &bytes.Buffer{}
+
+	buf := &bytes.Buffer{}
+	err := ZipTo(args, buf)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	br := bytes.NewReader(buf.Bytes())
+	zr, err := zip.NewReader(br, int64(br.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]byte{
+		"a/a/a": fileA,
+		"a/a/b": fileB,
+		"c":     fileC,
+	}
+
+	if len(zr.File) != len(want) {
+		t.Fatalf("want %d files, got %d", len(want), len(zr.File))
+	}
+
+	for _, f := range zr.File {
+		if f.Method != ZstdMethod {
+			t.Errorf("incorrect file %s method want %v got %v", f.Name, ZstdMethod, f.Method)
+		}
+
+		// Decode the raw entry data directly with the zstd library to make sure other
+		// zstd-aware readers can decompress it.
+		offset, err := f.DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw := io.NewSectionReader(br, offset, int64(f.CompressedSize64))
+		d, err := zstd.NewReader(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(d)
+		d.Close()
+		if err != nil {
+			t.Fatalf("error when decoding %s: %s", f.Name, err)
+		}
+
+		if !bytes.Equal(got, want[f.Name]) {
+			t.Errorf("incorrect contents for %s, want %q got %q", f.Name, want[f.Name], got)
+		}
+	}
+}
+
+func TestBzip2Interop(t *testing.T) {
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().File("a/a/a").File("a/a/b").File("c").FileArgs()
+	args.CompressionLevel = 1
+	args.CompressionMethod = CompressionBzip2
+	args.Filesystem = mockFs
+	args.Stderr = &bytes.Buffer{}
+
+	buf := &bytes.Buffer{}
+	err := ZipTo(args, buf)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	br := bytes.NewReader(buf.Bytes())
+	zr, err := zip.NewReader(br, int64(br.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]byte{
+		"a/a/a": fileA,
+		"a/a/b": fileB,
+		"c":     fileC,
+	}
+
+	if len(zr.File) != len(want) {
+		t.Fatalf("want %d files, got %d", len(want), len(zr.File))
+	}
+
+	for _, f := range zr.File {
+		if f.Method != Bzip2Method {
+			t.Errorf("incorrect file %s method want %v got %v", f.Name, Bzip2Method, f.Method)
+		}
+		if f.ReaderVersion != 46 {
+			t.Errorf("incorrect file %s reader version want 46 got %d", f.Name, f.ReaderVersion)
+		}
+
+		// Decode the raw entry data directly with the standard library to make sure other
+		// bzip2-aware readers can decompress it.
+		offset, err := f.DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw := io.NewSectionReader(br, offset, int64(f.CompressedSize64))
+		got, err := ioutil.ReadAll(bzip2.NewReader(raw))
+		if err != nil {
+			t.Fatalf("error when decoding %s: %s", f.Name, err)
+		}
+		if !bytes.Equal(got, want[f.Name]) {
+			t.Errorf("incorrect contents for %s, want %q got %q", f.Name, want[f.Name], got)
+		}
+
+		// Also read it back through the registered decompressor.
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("error when reading %s: %s", f.Name, err)
+		}
+		if !bytes.Equal(got, want[f.Name]) {
+			t.Errorf("incorrect contents for %s, want %q got %q", f.Name, want[f.Name], got)
+		}
+	}
+}
+
+func TestSharedDictionary(t *testing.T) {
+	files := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("json/%02d.json", i)] = []byte(fmt.Sprintf(
+			`{"name": "entry%d", "type": "library", "enabled": true, "tags": ["android", "soong", "zip"], "version": %d}`,
+			i, i*7))
+	}
+	fs := pathtools.MockFs(files)
+	dict := []byte(`{"name": "entry", "type": "library", "enabled": true, "tags": ["android", "soong", "zip"], "version": }`)
+
+	zipWith := func(t *testing.T, method CompressionMethod, dict []byte) ([]byte, *Stats) {
+		t.Helper()
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().SourcePrefixToStrip("json").Dir("json").FileArgs()
+		args.CompressionLevel = 9
+		args.CompressionMethod = method
+		args.SharedDictionary = dict
+		args.Filesystem = fs
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		stats, err := ZipToWithStats(args, buf)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		return buf.Bytes(), stats
+	}
+
+	_, plain := zipWith(t, CompressionDeflate, nil)
+	out, shared := zipWith(t, CompressionDeflateSharedDictionaryNonPortable, dict)
+
+	if shared.CompressedBytes >= plain.CompressedBytes {
+		t.Errorf("expected the shared dictionary to shrink the entries, got %d bytes with it and %d without",
+			shared.CompressedBytes, plain.CompressedBytes)
+	}
+	if want := int64(plain.CompressedBytes - shared.CompressedBytes); shared.SharedDictionarySavedBytes != want {
+		t.Errorf("want %d saved bytes, got %d", want, shared.SharedDictionarySavedBytes)
+	}
+	if plain.SharedDictionarySavedBytes != 0 {
+		t.Errorf("want no saved bytes without a shared dictionary, got %d", plain.SharedDictionarySavedBytes)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != len(files) {
+		t.Fatalf("want %d files, got %d", len(files), len(zr.File))
+	}
+
+	// Standard readers must refuse the entries instead of returning corrupt data.
+	if _, err := zr.File[0].Open(); err != zip.ErrAlgorithm {
+		t.Errorf("want error %v without the dictionary, got %v", zip.ErrAlgorithm, err)
+	}
+
+	zr.RegisterDecompressor(SharedDictionaryMethod, NewSharedDictionaryDecompressor(dict))
+	for _, f := range zr.File {
+		if f.Method != SharedDictionaryMethod {
+			t.Errorf("incorrect file %s method want %v got %v", f.Name, SharedDictionaryMethod, f.Method)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("error when reading %s: %s", f.Name, err)
+		}
+		if want := files["json/"+f.Name]; !bytes.Equal(got, want) {
+			t.Errorf("incorrect contents for %s, want %q got %q", f.Name, want, got)
+		}
+	}
+
+	t.Run("verify", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "TestSharedDictionary")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().SourcePrefixToStrip("json").Dir("json").FileArgs()
+		args.OutputFilePath = filepath.Join(dir, "out.zip")
+		args.CompressionLevel = 9
+		args.CompressionMethod = CompressionDeflateSharedDictionaryNonPortable
+		args.SharedDictionary = dict
+		args.VerifyAfterWrite = true
+		args.Filesystem = fs
+		args.Stderr = &bytes.Buffer{}
+
+		if err := Zip(args); err != nil {
+			t.Errorf("got error %v", err)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, test := range []struct {
+			method CompressionMethod
+			dict   []byte
+			err    string
+		}{
+			{
+				method: CompressionDeflateSharedDictionaryNonPortable,
+				err:    "compression method deflate-shared-dict-nonportable requires a shared dictionary",
+			},
+			{
+				method: CompressionDeflate,
+				dict:   dict,
+				err:    "a shared dictionary requires compression method deflate-shared-dict-nonportable",
+			},
+		} {
+			args := ZipArgs{}
+			args.FileArgs = fileArgsBuilder().SourcePrefixToStrip("json").Dir("json").FileArgs()
+			args.CompressionLevel = 9
+			args.CompressionMethod = test.method
+			args.SharedDictionary = test.dict
+			args.Filesystem = fs
+			args.Stderr = &bytes.Buffer{}
+
+			err := ZipTo(args, &bytes.Buffer{})
+			if err == nil || err.Error() != test.err {
+				t.Errorf("want error %q, got %v", test.err, err)
+			}
+		}
+	})
+}
+
+func TestCompressionLevels(t *testing.T) {
+	// Text with plenty of long and short matches, so that deflate levels produce different sizes.
+	contents := &bytes.Buffer{}
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(contents, "line %d: value %d of %d\n", i, (i*7919)%1000, i%13)
+	}
+	fs := pathtools.MockFs(map[string][]byte{
+		"fast/blob.txt": contents.Bytes(),
+		"best/blob.txt": contents.Bytes(),
+		"none/blob.txt": contents.Bytes(),
+	})
+
+	level := func(l int) *int { return &l }
+
+	zipLevels := func(t *testing.T, fileArgs []FileArg, patterns []CompressionLevelPattern) map[string]*zip.File {
+		t.Helper()
+		args := ZipArgs{}
+		args.FileArgs = fileArgs
+		args.CompressionLevel = 5
+		args.CompressionLevelPatterns = patterns
+		args.Filesystem = fs
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string]*zip.File)
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, contents.Bytes()) {
+				t.Errorf("incorrect contents for %s", f.Name)
+			}
+			files[f.Name] = f
+		}
+		return files
+	}
+
+	check := func(t *testing.T, files map[string]*zip.File) {
+		t.Helper()
+		fast, best, none := files["fast/blob.txt"], files["best/blob.txt"], files["none/blob.txt"]
+		if fast.Method != zip.Deflate || best.Method != zip.Deflate {
+			t.Errorf("want deflated entries, got methods %d and %d", fast.Method, best.Method)
+		}
+		if best.CompressedSize64 >= fast.CompressedSize64 {
+			t.Errorf("want level 9 entry smaller than level 1 entry, got %d and %d bytes",
+				best.CompressedSize64, fast.CompressedSize64)
+		}
+		if none.Method != zip.Store {
+			t.Errorf("want level 0 entry stored, got method %d", none.Method)
+		}
+	}
+
+	t.Run("FileArg", func(t *testing.T) {
+		fileArgs := fileArgsBuilder().File("fast/blob.txt").File("best/blob.txt").File("none/blob.txt").FileArgs()
+		fileArgs[0].CompressionLevel = level(1)
+		fileArgs[1].CompressionLevel = level(9)
+		fileArgs[2].CompressionLevel = level(0)
+		check(t, zipLevels(t, fileArgs, nil))
+	})
+
+	t.Run("patterns", func(t *testing.T) {
+		fileArgs := fileArgsBuilder().File("fast/blob.txt").File("best/blob.txt").File("none/blob.txt").FileArgs()
+		check(t, zipLevels(t, fileArgs, []CompressionLevelPattern{
+			{Pattern: "fast/*", Level: 1},
+			{Pattern: "none/*", Level: 0},
+			{Pattern: "**/*.txt", Level: 9},
+			{Pattern: "fast/*", Level: 9},
+		}))
+	})
+
+	t.Run("FileArg wins over patterns", func(t *testing.T) {
+		fileArgs := fileArgsBuilder().File("fast/blob.txt").File("best/blob.txt").File("none/blob.txt").FileArgs()
+		fileArgs[0].CompressionLevel = level(1)
+		fileArgs[2].CompressionLevel = level(0)
+		check(t, zipLevels(t, fileArgs, []CompressionLevelPattern{
+			{Pattern: "**/*.txt", Level: 9},
+		}))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().File("fast/blob.txt").FileArgs()
+		args.FileArgs[0].CompressionLevel = level(10)
+		args.Filesystem = fs
+		args.Stderr = &bytes.Buffer{}
+		want := "invalid compression level 10, must be between 0 and 9, or -1 for the default"
+		if err := ZipTo(args, &bytes.Buffer{}); err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+
+		args.FileArgs[0].CompressionLevel = nil
+		args.CompressionLevelPatterns = []CompressionLevelPattern{{Pattern: "*.txt", Level: -2}}
+		want = "*.txt: invalid compression level -2, must be between 0 and 9, or -1 for the default"
+		if err := ZipTo(args, &bytes.Buffer{}); err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+}
+
+func TestMaxInFlightBytes(t *testing.T) {
+	const fileSize = 1000
+	files := make(map[string][]byte)
+	b := fileArgsBuilder()
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("f/%02d", i)
+		files[name] = bytes.Repeat([]byte{byte('a' + i%26)}, fileSize)
+		b.File(name)
+	}
+
+	testCases := []struct {
+		name     string
+		max      int64
+		wantPeak int64
+	}{
+		{name: "fits two", max: 2500, wantPeak: 2000},
+		{name: "fits one", max: fileSize, wantPeak: fileSize},
+		{name: "smaller than a file", max: 10, wantPeak: fileSize},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{}
+			args.FileArgs = b.FileArgs()
+			args.CompressionLevel = 5
+			args.NumParallelJobs = 16
+			args.MaxInFlightBytes = test.max
+			args.Filesystem = pathtools.MockFs(files)
+			args.Stderr = &bytes.Buffer{}
+
+			buf := &bytes.Buffer{}
+			stats, err := ZipToWithStats(args, buf)
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if stats.EntryCount != len(files) {
+				t.Errorf("want %d entries, got %d", len(files), stats.EntryCount)
+			}
+			if stats.PeakInFlightBytes > test.wantPeak {
+				t.Errorf("want peak in flight bytes at most %d, got %d", test.wantPeak, stats.PeakInFlightBytes)
+			}
+			if stats.PeakInFlightBytes < fileSize {
+				t.Errorf("want peak in flight bytes at least %d, got %d", fileSize, stats.PeakInFlightBytes)
+			}
+		})
+	}
+
+	t.Run("negative", func(t *testing.T) {
+		args := ZipArgs{}
+		args.MaxInFlightBytes = -1
+		args.Filesystem = mockFs
+		want := "max in flight bytes must not be negative, got -1"
+		if err := ZipTo(args, &bytes.Buffer{}); err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+}
+
+// decryptAES checks the AE-2 fields of f in the zip file in data and returns its decrypted and
+// decompressed contents without going through aesWriter.  It shares pbkdf2SHA1 with the package,
+// TestAESKnownAnswer checks both against output of other implementations.
+func decryptAES(t *testing.T, data []byte, f *zip.File, password string) []byte {
+	t.Helper()
+	if f.Method != AESMethod || f.Flags&encryptedFlag == 0 || f.CRC32 != 0 {
+		t.Fatalf("%s: want method %d with the encrypted flag and a CRC32 of 0, got method %d flags %#x CRC32 %08x",
+			f.Name, AESMethod, f.Method, f.Flags, f.CRC32)
+	}
+
+	var method uint16
+	found := false
+	for extra := f.Extra; len(extra) >= 4; {
+		tag := binary.LittleEndian.Uint16(extra)
+		size := binary.LittleEndian.Uint16(extra[2:])
+		if tag == AESExtraTag {
+			if size != 7 || binary.LittleEndian.Uint16(extra[4:]) != 2 || string(extra[6:8]) != "AE" || extra[8] != 3 {
+				t.Fatalf("%s: invalid AES extra field %x", f.Name, extra[:4+size])
+			}
+			method = binary.LittleEndian.Uint16(extra[9:])
+			found = true
+		}
+		extra = extra[4+size:]
+	}
+	if !found {
+		t.Fatalf("%s: missing AES extra field", f.Name)
+	}
+
+	offset, err := f.DataOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := data[offset : offset+int64(f.CompressedSize64)]
+	salt, verifier := raw[:16], raw[16:18]
+	encrypted, mac := raw[18:len(raw)-10], raw[len(raw)-10:]
+
+	keys := pbkdf2SHA1([]byte(password), salt, 1000, 66)
+	if !bytes.Equal(keys[64:], verifier) {
+		t.Fatalf("%s: password verifier mismatch", f.Name)
+	}
+	h := hmac.New(sha1.New, keys[32:64])
+	h.Write(encrypted)
+	if !hmac.Equal(h.Sum(nil)[:10], mac) {
+		t.Fatalf("%s: authentication code mismatch", f.Name)
+	}
+
+	block, err := aes.NewCipher(keys[:32])
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := make([]byte, len(encrypted))
+	var counter, keyStream [aes.BlockSize]byte
+	for i := range encrypted {
+		if i%aes.BlockSize == 0 {
+			binary.LittleEndian.PutUint64(counter[:], uint64(i/aes.BlockSize+1))
+			block.Encrypt(keyStream[:], counter[:])
+		}
+		compressed[i] = encrypted[i] ^ keyStream[i%aes.BlockSize]
+	}
+
+	switch method {
+	case zip.Store:
+		return compressed
+	case zip.Deflate:
+		contents, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+		if err != nil {
+			t.Fatalf("%s: %s", f.Name, err)
+		}
+		return contents
+	default:
+		t.Fatalf("%s: unexpected method %d", f.Name, method)
+		return nil
+	}
+}
+
+func TestPBKDF2SHA1(t *testing.T) {
+	// Test vectors from RFC 6070.
+	testCases := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"password", "salt", 1, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{"password", "salt", 2, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{"password", "salt", 4096, "4b007901b765489abead49d926f721d065a429c1"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096,
+			"3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038"},
+		{"pass\x00word", "sa\x00lt", 4096, "56fa6aa75548099dcc37d7f03425e0c3"},
+	}
+	for _, test := range testCases {
+		got := pbkdf2SHA1([]byte(test.password), []byte(test.salt), test.iterations, len(test.want)/2)
+		if fmt.Sprintf("%x", got) != test.want {
+			t.Errorf("pbkdf2(%q, %q, %d): want %s, got %x", test.password, test.salt, test.iterations,
+				test.want, got)
+		}
+	}
+}
+
+func TestAESEncryption(t *testing.T) {
+	const password = "correct horse battery staple"
+	large := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	files := map[string][]byte{
+		"a/a/a": fileA,
+		"a/a/b": fileB,
+		"empty": {},
+		"large": large,
+	}
+
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().File("a/a/a").File("a/a/b").File("empty").File("large").
+		ReaderFile("stdin", bytes.NewReader(fileC)).FileArgs()
+	args.AddDirectoryEntriesToZip = true
+	args.CompressionLevel = 5
+	args.NonDeflatedFiles = map[string]bool{"a/a/b": true}
+	args.LargeFileThreshold = int64(len(large))
+	args.Password = password
+	args.Filesystem = pathtools.MockFs(files)
+	args.Stderr = &bytes.Buffer{}
+
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]byte{
+		"a/a/a": fileA,
+		"a/a/b": fileB,
+		"empty": {},
+		"large": large,
+		"stdin": fileC,
+	}
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/") {
+			if f.Method == AESMethod || f.Flags&encryptedFlag != 0 {
+				t.Errorf("%s: directories should not be encrypted", f.Name)
+			}
+			continue
+		}
+		if got := decryptAES(t, buf.Bytes(), f, password); !bytes.Equal(got, want[f.Name]) {
+			t.Errorf("%s: decrypted contents don't match", f.Name)
+		}
+		if f.ReaderVersion != 51 {
+			t.Errorf("%s: want reader version 51, got %d", f.Name, f.ReaderVersion)
+		}
+		delete(want, f.Name)
+	}
+	for name := range want {
+		t.Errorf("missing entry %s", name)
+	}
+
+	if bytes.Contains(buf.Bytes(), fileA) || bytes.Contains(buf.Bytes(), fileB) {
+		t.Error("plaintext contents found in the encrypted zip file")
+	}
+
+	t.Run("verify", func(t *testing.T) {
+		args := args
+		args.VerifyAfterWrite = true
+		args.OutputFilePath = filepath.Join(t.TempDir(), "out.zip")
+		err := Zip(args)
+		if err == nil || !strings.Contains(err.Error(), "can't be verified") {
+			t.Errorf("expected an error combining a password with verifying, got %v", err)
+		}
+	})
+}
+
+func TestAESKnownAnswer(t *testing.T) {
+	t.Run("libarchive", func(t *testing.T) {
+		// Written by bsdtar 3.7.7 (libarchive) with:
+		//   bsdtar --format zip --options zip:encryption=aes256 --passphrase 'known answer' \
+		//       -cf aes-libarchive.zip hello.txt short.txt
+		// libarchive uses AE-2 for files smaller than 20 bytes.  The deflated contents of short.txt
+		// are longer than a block, so the counter is incremented.
+		data, err := ioutil.ReadFile("testdata/aes-libarchive.zip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{
+			"hello.txt": "hello, AE-2\n",
+			"short.txt": "Zq8#kW2!pL0@xV7$mN\n",
+		}
+		for _, f := range zr.File {
+			if got := decryptAES(t, data, f, "known answer"); string(got) != want[f.Name] {
+				t.Errorf("%s: want contents %q, got %q", f.Name, want[f.Name], got)
+			}
+			delete(want, f.Name)
+		}
+		for name := range want {
+			t.Errorf("missing entry %s", name)
+		}
+	})
+
+	t.Run("fixed salt", func(t *testing.T) {
+		salt := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
+			0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
+		defer func(r io.Reader) { aesSaltReader = r }(aesSaltReader)
+		aesSaltReader = bytes.NewReader(salt)
+
+		// Computed with Python's hashlib.pbkdf2_hmac and hmac, and the counter blocks 1 to 3 in
+		// little endian encrypted with openssl enc -aes-256-ecb.
+		const (
+			verifier   = "9095"
+			ciphertext = "83cb352c326ec63ea5a481f2ad22c337363b327fd4bcd3e9bd8b843da50ca61eebfcd377621cf6c0ebacd9f1"
+			mac        = "649513fed103016f7108"
+		)
+
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().
+			ReaderFile("fox", strings.NewReader("The quick brown fox jumps over the lazy dog\n")).FileArgs()
+		args.CompressionLevel = 0
+		args.Password = "known answer"
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(zr.File) != 1 {
+			t.Fatalf("want 1 entry, got %d", len(zr.File))
+		}
+		f := zr.File[0]
+
+		if f.Method != AESMethod || f.Flags&encryptedFlag == 0 || f.CRC32 != 0 {
+			t.Errorf("want method %d with the encrypted flag and a CRC32 of 0, got method %d flags %#x CRC32 %08x",
+				AESMethod, f.Method, f.Flags, f.CRC32)
+		}
+		// AE version 2, vendor "AE", AES-256 and the stored method.
+		if extra := fmt.Sprintf("%x", f.Extra); !strings.Contains(extra, "0199070002004145030000") {
+			t.Errorf("want the AE-2 extra field, got extra fields %s", extra)
+		}
+
+		offset, err := f.DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw := buf.Bytes()[offset : offset+int64(f.CompressedSize64)]
+		want := fmt.Sprintf("%x", salt) + verifier + ciphertext + mac
+		if got := fmt.Sprintf("%x", raw); got != want {
+			t.Errorf("want encrypted data\n%s\ngot\n%s", want, got)
+		}
+	})
+}
+
+func TestCacheDir(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	cacheDir := filepath.Join(dir, "cache")
+	files := map[string]string{
+		"a":     strings.Repeat("a contents ", 100),
+		"b":     strings.Repeat("b contents ", 100),
+		"empty": "",
+	}
+	for name, contents := range files {
+		if err := os.MkdirAll(src, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run := func(t *testing.T) ([]byte, *Stats) {
+		t.Helper()
+		args := ZipArgs{}
+		args.FileArgs = (&FileArgsBuilder{fs: pathtools.OsFs}).SourcePrefixToStrip(src).Dir(src).FileArgs()
+		args.CompressionLevel = 9
+		args.CacheDir = cacheDir
+		args.Filesystem = pathtools.OsFs
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		stats, err := ZipToWithStats(args, buf)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		return buf.Bytes(), stats
+	}
+
+	checkContents := func(t *testing.T, out []byte) {
+		t.Helper()
+		zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			r, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("%s: %s", f.Name, err)
+			}
+			if string(got) != files[f.Name] {
+				t.Errorf("%s: want contents %q, got %q", f.Name, files[f.Name], got)
+			}
+		}
+	}
+
+	first, stats := run(t)
+	if stats.CachedEntries != 0 {
+		t.Errorf("want no cached entries in the first run, got %d", stats.CachedEntries)
+	}
+	cached, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != 2 {
+		t.Errorf("want 2 cache files, got %d", len(cached))
+	}
+
+	second, stats := run(t)
+	if stats.CachedEntries != 2 {
+		t.Errorf("want 2 cached entries in the second run, got %d", stats.CachedEntries)
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("want the second run to write the same zip file as the first one")
+	}
+	checkContents(t, second)
+
+	// A file with a new modification time is compressed again.
+	files["b"] = strings.Repeat("B CONTENTS ", 100)
+	if err := ioutil.WriteFile(filepath.Join(src, "b"), []byte(files["b"]), 0666); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "b"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	third, stats := run(t)
+	if stats.CachedEntries != 1 {
+		t.Errorf("want 1 cached entry after changing a file, got %d", stats.CachedEntries)
+	}
+	checkContents(t, third)
+}
+
+func TestMultiDestFile(t *testing.T) {
+	// Large enough to be compressed in parallel blocks.
+	large := []byte(strings.Repeat("large file contents ", minParallelFileSize/20+1))
+	fs := pathtools.MockFs(map[string][]byte{
+		"large": large,
+		"small": fileA,
+	})
+
+	b := &FileArgsBuilder{fs: fs}
+	args := ZipArgs{}
+	args.FileArgs = b.MultiDestFile("large", "lib/large-1.0", "lib/large", "lib/large.o").
+		MultiDestFile("small", "small").
+		File("small").FileArgs()
+	args.CompressionLevel = 9
+	args.NonDeflatedFiles = map[string]bool{"lib/large.o": true}
+	args.DuplicateMode = DuplicateFirst
+	args.Filesystem = fs
+	args.Stderr = &bytes.Buffer{}
+
+	buf := &bytes.Buffer{}
+	stats, err := ZipToWithStats(args, buf)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	// lib/large is a copy of lib/large-1.0, lib/large.o is stored instead and small is only added
+	// once.
+	if g, w := stats.DeduplicatedEntries, 1; g != w {
+		t.Errorf("want %d deduplicated entries, got %d", w, g)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{
+		"lib/large-1.0": large,
+		"lib/large":     large,
+		"lib/large.o":   large,
+		"small":         fileA,
+	}
+	if len(zr.File) != len(want) {
+		t.Fatalf("want %d entries, got %d", len(want), len(zr.File))
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", f.Name, err)
+		}
+		if !bytes.Equal(got, want[f.Name]) {
+			t.Errorf("%s: contents don't round trip", f.Name)
+		}
+	}
+
+	first, copied := files["lib/large-1.0"], files["lib/large"]
+	if first.Method != zip.Deflate || copied.Method != zip.Deflate {
+		t.Errorf("want both entries deflated, got methods %d and %d", first.Method, copied.Method)
+	}
+	if first.CompressedSize64 != copied.CompressedSize64 || first.CRC32 != copied.CRC32 {
+		t.Errorf("want identical entries, got compressed sizes %d and %d", first.CompressedSize64,
+			copied.CompressedSize64)
+	}
+	if m := files["lib/large.o"].Method; m != zip.Store {
+		t.Errorf("lib/large.o: want method store, got %d", m)
+	}
+}
+
+func TestDeduplicateContents(t *testing.T) {
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().File("a/a/a").File("a/a/b").File("d/a.c").File("d/a.o").
+		File("d/sub/b.c").File("e/icon.PNG").File("c").FileArgs()
+	args.CompressionLevel = 9
+	args.CompressionLevelPatterns = []CompressionLevelPattern{{Pattern: "e/*", Level: 1}}
+	args.NonDeflatedFiles = map[string]bool{"d/a.o": true}
+	args.DeduplicateContents = true
+	args.Filesystem = mockFs
+	args.Stderr = &bytes.Buffer{}
+
+	buf := &bytes.Buffer{}
+	stats, err := ZipToWithStats(args, buf)
+	if err != nil {
+		t.Fatalf("got error %v", err)
+	}
+
+	// d/a.c and d/sub/b.c are copies of a/a/a, e/icon.PNG has the same contents but a different
+	// level and d/a.o is stored instead of deflated like a/a/b.
+	if g, w := stats.DeduplicatedEntries, 2; g != w {
+		t.Errorf("want %d deduplicated entries, got %d", w, g)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{
+		"a/a/a":      fileA,
+		"a/a/b":      fileB,
+		"d/a.c":      fileA,
+		"d/a.o":      fileB,
+		"d/sub/b.c":  fileA,
+		"e/icon.PNG": fileA,
+		"c":          fileC,
+	}
+	if len(zr.File) != len(want) {
+		t.Fatalf("want %d entries, got %d", len(want), len(zr.File))
+	}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", f.Name, err)
+		}
+		if !bytes.Equal(got, want[f.Name]) {
+			t.Errorf("%s: want contents %q, got %q", f.Name, want[f.Name], got)
+		}
+		if crc := crc32.ChecksumIEEE(want[f.Name]); f.CRC32 != crc {
+			t.Errorf("%s: want crc %08x, got %08x", f.Name, crc, f.CRC32)
+		}
+	}
+}
+
+// unreadableFs is a filesystem on which the files in unreadable can't be opened.
+type unreadableFs struct {
+	pathtools.FileSystem
+	unreadable map[string]bool
+}
+
+func (fs unreadableFs) Open(name string) (pathtools.ReaderAtSeekerCloser, error) {
+	if fs.unreadable[name] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+	}
+	return fs.FileSystem.Open(name)
+}
+
+func TestSkipUnreadable(t *testing.T) {
+	run := func(t *testing.T, args *FileArgsBuilder, skip bool) (*Stats, string, error) {
+		zipArgs := ZipArgs{}
+		zipArgs.FileArgs = args.FileArgs()
+		zipArgs.SkipUnreadable = skip
+		zipArgs.Filesystem = unreadableFs{mockFs, map[string]bool{"a/a/b": true}}
+		stderr := &bytes.Buffer{}
+		zipArgs.Stderr = stderr
+
+		buf := &bytes.Buffer{}
+		stats, err := ZipToWithStats(zipArgs, buf)
+		if err != nil {
+			return nil, stderr.String(), err
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, f := range zr.File {
+			if f.Name == "a/a/b" {
+				t.Errorf("want unreadable file to be skipped")
+			}
+			found = found || f.Name == "a/a/a"
+		}
+		if !found {
+			t.Errorf("want readable file a/a/a in the zip file")
+		}
+		return stats, stderr.String(), nil
+	}
+
+	t.Run("without flag", func(t *testing.T) {
+		_, _, err := run(t, fileArgsBuilder().Dir("a"), false)
+		if !os.IsPermission(err) {
+			t.Errorf("want permission error, got %v", err)
+		}
+	})
+
+	t.Run("dir", func(t *testing.T) {
+		stats, stderr, err := run(t, fileArgsBuilder().Dir("a"), true)
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		if want := []string{"a/a/b"}; !reflect.DeepEqual(stats.SkippedFiles, want) {
+			t.Errorf("want skipped files %q, got %q", want, stats.SkippedFiles)
+		}
+		if want := `warning: skipping unreadable file "a/a/b"`; !strings.Contains(stderr, want) {
+			t.Errorf("want warning %q, got %q", want, stderr)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, _, err := run(t, fileArgsBuilder().File("a/a/a").File("missing"), true)
+		if !os.IsNotExist(err) {
+			t.Errorf("want not exist error, got %v", err)
+		}
+	})
+}
+
+// cancelReader cancels a context the first time it is read from.
+type cancelReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	c.cancel()
+	return c.r.Read(p)
+}
+
+func TestZipContext(t *testing.T) {
+	run := func(t *testing.T, ctx context.Context, args *FileArgsBuilder) (string, error) {
+		out := filepath.Join(t.TempDir(), "out.zip")
+		zipArgs := ZipArgs{}
+		zipArgs.FileArgs = args.FileArgs()
+		zipArgs.OutputFilePath = out
+		zipArgs.Filesystem = mockFs
+		zipArgs.Stderr = &bytes.Buffer{}
+		return out, ZipContext(ctx, zipArgs)
+	}
+
+	t.Run("canceled mid-run", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		reader := &cancelReader{r: strings.NewReader("stdin"), cancel: cancel}
+		out, err := run(t, ctx, fileArgsBuilder().
+			File("a/a/a").
+			ReaderFile("stdin", reader).
+			File("a/a/b").
+			File("c"))
+		if err != context.Canceled {
+			t.Errorf("want error %v, got %v", context.Canceled, err)
+		}
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			t.Errorf("want %s to be removed, got %v", out, err)
+		}
+	})
+
+	t.Run("canceled before", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		out, err := run(t, ctx, fileArgsBuilder().File("a/a/a"))
+		if err != context.Canceled {
+			t.Errorf("want error %v, got %v", context.Canceled, err)
+		}
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			t.Errorf("want %s to be removed, got %v", out, err)
+		}
+	})
+
+	t.Run("not canceled", func(t *testing.T) {
+		out, err := run(t, context.Background(), fileArgsBuilder().File("a/a/a").File("c"))
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		if _, err := os.Stat(out); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// dirListingReader records the names in dir the first time it is read from.
+type dirListingReader struct {
+	r     io.Reader
+	dir   string
+	names []string
+	err   error
+}
+
+func (d *dirListingReader) Read(p []byte) (int, error) {
+	if d.names == nil && d.err == nil {
+		d.names, d.err = filepath.Glob(filepath.Join(d.dir, "*"))
+		if d.names == nil {
+			d.names = []string{}
+		}
+	}
+	return d.r.Read(p)
+}
+
+func TestTempDir(t *testing.T) {
+	run := func(t *testing.T, out, tempDir string, args *FileArgsBuilder) error {
+		zipArgs := ZipArgs{}
+		zipArgs.FileArgs = args.FileArgs()
+		zipArgs.OutputFilePath = out
+		zipArgs.TempDir = tempDir
+		zipArgs.Filesystem = mockFs
+		zipArgs.Stderr = &bytes.Buffer{}
+		return Zip(zipArgs)
+	}
+
+	// checkEmpty checks that nothing was left in dir.
+	checkEmpty := func(t *testing.T, dir string) {
+		t.Helper()
+		if names, err := filepath.Glob(filepath.Join(dir, "*")); err != nil {
+			t.Fatal(err)
+		} else if len(names) > 0 {
+			t.Errorf("want %s to be empty, got %q", dir, names)
+		}
+	}
+
+	for _, test := range []struct {
+		name   string
+		custom bool
+	}{
+		{name: "default"},
+		{name: "custom", custom: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			outDir := t.TempDir()
+			out := filepath.Join(outDir, "out.zip")
+			tempDir, wantDir := "", outDir
+			if test.custom {
+				tempDir = t.TempDir()
+				wantDir = tempDir
+			}
+
+			reader := &dirListingReader{r: strings.NewReader("stdin"), dir: wantDir}
+			if err := run(t, out, tempDir, fileArgsBuilder().File("a/a/a").ReaderFile("stdin", reader)); err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if reader.err != nil {
+				t.Fatal(reader.err)
+			}
+			if len(reader.names) != 1 || !strings.HasPrefix(filepath.Base(reader.names[0]), ".out.zip.tmp") {
+				t.Errorf("want a temporary file in %s while writing, got %q", wantDir, reader.names)
+			}
+
+			names, _ := readZipContents(t, out)
+			if want := []string{"a/a/a", "stdin"}; !reflect.DeepEqual(names, want) {
+				t.Errorf("want entries %q, got %q", want, names)
+			}
+			if test.custom {
+				checkEmpty(t, tempDir)
+			}
+		})
+	}
+
+	t.Run("failure", func(t *testing.T) {
+		outDir, tempDir := t.TempDir(), t.TempDir()
+		out := filepath.Join(outDir, "out.zip")
+		if err := ioutil.WriteFile(out, []byte("previous"), 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		err := run(t, out, tempDir, fileArgsBuilder().File("a/a/a").File("missing"))
+		if !os.IsNotExist(err) {
+			t.Errorf("want not exist error, got %v", err)
+		}
+		checkEmpty(t, tempDir)
+		if b, err := ioutil.ReadFile(out); err != nil {
+			t.Fatal(err)
+		} else if string(b) != "previous" {
+			t.Errorf("want the previous output to be left alone, got %q", b)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "out.zip")
+		err := run(t, out, filepath.Join(t.TempDir(), "missing"), fileArgsBuilder().File("a/a/a"))
+		if !os.IsNotExist(err) {
+			t.Errorf("want not exist error, got %v", err)
+		}
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			t.Errorf("want %s to not be created, got %v", out, err)
+		}
+	})
+}
+
+// recordingSyncer records the calls to it, and whether the output file existed at the time.
+type recordingSyncer struct {
+	out   string
+	calls []string
+}
+
+func (r *recordingSyncer) exists() string {
+	if _, err := os.Stat(r.out); err == nil {
+		return "out exists"
+	}
+	return "no out"
+}
+
+func (r *recordingSyncer) syncFile(f *os.File) error {
+	name := "temp file"
+	if f.Name() == r.out {
+		name = "out"
+	}
+	r.calls = append(r.calls, fmt.Sprintf("sync %s, %s", name, r.exists()))
+	return nil
+}
+
+func (r *recordingSyncer) syncDir(dir string) error {
+	name := dir
+	if dir == filepath.Dir(r.out) {
+		name = "out dir"
+	}
+	r.calls = append(r.calls, fmt.Sprintf("sync %s, %s", name, r.exists()))
+	return nil
+}
+
+func TestDurableWrite(t *testing.T) {
+	run := func(t *testing.T, durable, append bool) []string {
+		out := filepath.Join(t.TempDir(), "out.zip")
+		recorder := &recordingSyncer{out: out}
+		defer func(s syncer) { outputSyncer = s }(outputSyncer)
+		outputSyncer = recorder
+
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().File("a/a/a").FileArgs()
+		args.OutputFilePath = out
+		args.DurableWrite = durable
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+		if append {
+			if err := Zip(args); err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			recorder.calls = nil
+			args.FileArgs = fileArgsBuilder().File("c").FileArgs()
+			args.Append = true
+		}
+		if err := Zip(args); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		return recorder.calls
+	}
+
+	t.Run("durable", func(t *testing.T) {
+		want := []string{"sync temp file, no out", "sync out dir, out exists"}
+		if got := run(t, true, false); !reflect.DeepEqual(got, want) {
+			t.Errorf("want calls %q, got %q", want, got)
+		}
+	})
+
+	t.Run("append", func(t *testing.T) {
+		want := []string{"sync out, out exists"}
+		if got := run(t, true, true); !reflect.DeepEqual(got, want) {
+			t.Errorf("want calls %q, got %q", want, got)
+		}
+	})
+
+	t.Run("default", func(t *testing.T) {
+		if got := run(t, false, false); len(got) > 0 {
+			t.Errorf("want no calls, got %q", got)
+		}
+	})
+}
+
+func TestComputeDest(t *testing.T) {
+	testCases := []struct {
+		name string
+		fa   FileArg
+		src  string
+
+		want string
+		err  error
+	}{
+		{
+			name: "unchanged",
+			src:  "a/b/c",
+			want: "a/b/c",
+		},
+		{
+			name: "strip prefix",
+			fa:   FileArg{SourcePrefixToStrip: "a"},
+			src:  "a/b/c",
+			want: "b/c",
+		},
+		{
+			name: "prefix in zip",
+			fa:   FileArg{PathPrefixInZip: "res"},
+			src:  "a/b/c",
+			want: "res/a/b/c",
+		},
+		{
+			name: "strip prefix and prefix in zip",
+			fa:   FileArg{SourcePrefixToStrip: "a/b", PathPrefixInZip: "res"},
+			src:  "a/b/c",
+			want: "res/c",
+		},
+		{
+			name: "strip components",
+			fa:   FileArg{StripComponents: 1},
+			src:  "a/b/c",
+			want: "b/c",
+		},
+		{
+			name: "strip prefix and components",
+			fa:   FileArg{SourcePrefixToStrip: "a", StripComponents: 1, PathPrefixInZip: "res"},
+			src:  "a/b/c",
+			want: "res/c",
+		},
+		{
+			name: "strip all components",
+			fa:   FileArg{SourcePrefixToStrip: "a", StripComponents: 2},
+			src:  "a/b/c",
+			err:  StripComponentsError{Path: "a/b/c", Components: 2},
+		},
+		{
+			name: "junk paths",
+			fa:   FileArg{JunkPaths: true, SourcePrefixToStrip: "a", StripComponents: 5, PathPrefixInZip: "res"},
+			src:  "a/b/c",
+			want: "res/c",
+		},
+		{
+			name: "junk paths exception",
+			fa:   FileArg{JunkPaths: true, JunkPathsExceptions: []string{"a/**/*"}, PathPrefixInZip: "res"},
+			src:  "a/b/c",
+			want: "res/a/b/c",
+		},
+		{
+			name: "dest file",
+			fa:   FileArg{DestFile: "x/../y/z", SourcePrefixToStrip: "b", PathPrefixInZip: "res"},
+			src:  "a/b/c",
+			want: "y/z",
+		},
+		{
+			name: "outside of prefix",
+			fa:   FileArg{SourcePrefixToStrip: "b"},
+			src:  "a/b/c",
+			err:  IncorrectRelativeRootError{Path: "a/b/c", RelativeRoot: "b"},
+		},
+		{
+			name: "parent of prefix",
+			fa:   FileArg{SourcePrefixToStrip: "a/b"},
+			src:  "a",
+			err:  IncorrectRelativeRootError{Path: "a", RelativeRoot: "a/b"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ComputeDest(test.fa, test.src)
+			if err != test.err {
+				t.Fatalf("want error %v, got %v", test.err, err)
+			}
+			if got != test.want {
+				t.Errorf("want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestZipToWriter(t *testing.T) {
+	newArgs := func() ZipArgs {
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().File("a/a/a").File("c").FileArgs()
+		args.CompressionLevel = 9
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+		return args
+	}
 
 	buf := &bytes.Buffer{}
-	err := ZipTo(args, buf)
+	if err := ZipTo(newArgs(), buf); err != nil {
+		t.Fatalf("got error %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"a/a/a": fileA, "c": fileC}
+	if len(zr.File) != len(want) {
+		t.Fatalf("want %d entries, got %d", len(want), len(zr.File))
+	}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", f.Name, err)
+		}
+		if !bytes.Equal(got, want[f.Name]) {
+			t.Errorf("%s: want contents %q, got %q", f.Name, want[f.Name], got)
+		}
+	}
+
+	testCases := []struct {
+		name string
+		set  func(args *ZipArgs)
+		err  string
+	}{
+		{"write if changed", func(args *ZipArgs) { args.WriteIfChanged = true },
+			"write if changed is not supported when writing to an io.Writer"},
+		{"append", func(args *ZipArgs) { args.Append = true },
+			"append is not supported when writing to an io.Writer"},
+		{"list", func(args *ZipArgs) { args.ListOutputPath = "out.txt" },
+			"list output is not supported when writing to an io.Writer"},
+		{"verify", func(args *ZipArgs) { args.VerifyAfterWrite = true },
+			"verify is not supported when writing to an io.Writer"},
+		{"sha256", func(args *ZipArgs) { args.ShaOutputPath = "out.sha256" },
+			"sha256 output is not supported when writing to an io.Writer"},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := newArgs()
+			test.set(&args)
+			buf := &bytes.Buffer{}
+			err := ZipTo(args, buf)
+			if err == nil || err.Error() != test.err {
+				t.Errorf("want error %q, got %v", test.err, err)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("want nothing written, got %d bytes", buf.Len())
+			}
+		})
+	}
+}
+
+func TestStoreBelowBytes(t *testing.T) {
+	zipMethods := func(t *testing.T, storeBelow int64) map[string]uint16 {
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().File("a/a/a").
+			ReaderFile("stdin", strings.NewReader(strings.Repeat("stdin ", 50))).FileArgs()
+		args.CompressionLevel = 9
+		args.StoreBelowBytes = storeBelow
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		methods := make(map[string]uint16)
+		for _, f := range zr.File {
+			methods[f.Name] = f.Method
+		}
+		return methods
+	}
+
+	check := func(t *testing.T, got, want map[string]uint16) {
+		t.Helper()
+		for name, method := range want {
+			if got[name] != method {
+				t.Errorf("%s: want method %d, got %d", name, method, got[name])
+			}
+		}
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		check(t, zipMethods(t, 0), map[string]uint16{
+			"a/a/a": zip.Deflate,
+			"stdin": zip.Deflate,
+		})
+	})
+
+	t.Run("threshold", func(t *testing.T) {
+		check(t, zipMethods(t, 100), map[string]uint16{
+			"a/a/a": zip.Store,
+			"stdin": zip.Deflate,
+		})
+	})
+
+	t.Run("exact size", func(t *testing.T) {
+		check(t, zipMethods(t, int64(len(fileA))), map[string]uint16{
+			"a/a/a": zip.Deflate,
+			"stdin": zip.Deflate,
+		})
+	})
+
+	t.Run("reader", func(t *testing.T) {
+		check(t, zipMethods(t, 1000), map[string]uint16{
+			"a/a/a": zip.Store,
+			"stdin": zip.Store,
+		})
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		args := ZipArgs{}
+		args.StoreBelowBytes = -1
+		if err := ZipTo(args, &bytes.Buffer{}); err == nil {
+			t.Error("expected an error for a negative threshold")
+		}
+	})
+}
+
+func TestFileSizeLimits(t *testing.T) {
+	testCases := []struct {
+		name     string
+		min, max int64
+		want     []string
+	}{
+		{
+			name: "unbounded",
+			want: []string{"l_sp", "a/a/a", "a/a/b", "c", "d/a.c", "d/a.o", "d/gen/x", "d/sub/b.c", "d/sub/b.o"},
+		},
+		{
+			name: "min",
+			min:  62,
+			want: []string{"a/a/a", "a/a/b", "d/a.c", "d/a.o", "d/sub/b.c", "d/sub/b.o"},
+		},
+		{
+			name: "max",
+			max:  60,
+			want: []string{"l_sp", "c", "d/gen/x"},
+		},
+		{
+			name: "range",
+			min:  14,
+			max:  63,
+			want: []string{"a/a/b", "c", "d/a.o", "d/gen/x", "d/sub/b.o"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{}
+			args.FileArgs = fileArgsBuilder().File("l_sp").List("l_nl").Dir("d").FileArgs()
+			args.MinFileSize = test.min
+			args.MaxFileSize = test.max
+			args.Filesystem = mockFs
+			args.Stderr = &bytes.Buffer{}
+
+			buf := &bytes.Buffer{}
+			if err := ZipTo(args, buf); err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, f := range zr.File {
+				got = append(got, f.Name)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("want %q, got %q", test.want, got)
+			}
+		})
+	}
+
+	t.Run("min larger than max", func(t *testing.T) {
+		args := ZipArgs{}
+		args.MinFileSize = 10
+		args.MaxFileSize = 5
+		if err := ZipTo(args, &bytes.Buffer{}); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestSkipMacOSCruft(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"x/a":               fileA,
+		"x/._a":             fileB,
+		"x/__MACOSX/x/._a":  fileB,
+		"x/__MACOSX/x/a":    fileB,
+		"x/sub/b":           fileB,
+		"x/sub/._b":         fileC,
+		"__MACOSX/x/sub/b":  fileC,
+		"__MACOSX/x/sub/._": fileC,
+	})
+
+	testCases := []struct {
+		name string
+		skip bool
+		args *FileArgsBuilder
+		want []string
+	}{
+		{
+			name: "dir",
+			skip: true,
+			args: fileArgsBuilder().Dir("x"),
+			want: []string{"x/a", "x/sub/b"},
+		},
+		{
+			name: "files",
+			skip: true,
+			args: fileArgsBuilder().File("x/._a").File("x/a").File("__MACOSX/x/sub/b").File("x/sub/._b"),
+			want: []string{"x/a"},
+		},
+		{
+			name: "glob",
+			skip: true,
+			args: fileArgsBuilder().File("**/*"),
+			want: []string{"x/a", "x/sub/b"},
+		},
+		{
+			name: "disabled dir",
+			args: fileArgsBuilder().Dir("x"),
+			want: []string{"x/a", "x/__MACOSX/x/a", "x/sub/b"},
+		},
+		{
+			name: "disabled files",
+			args: fileArgsBuilder().File("x/._a").File("x/a").File("__MACOSX/x/sub/b"),
+			want: []string{"x/._a", "x/a", "__MACOSX/x/sub/b"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{}
+			args.FileArgs = test.args.FileArgs()
+			args.SkipMacOSCruft = test.skip
+			args.Filesystem = fs
+			args.Stderr = &bytes.Buffer{}
+
+			buf := &bytes.Buffer{}
+			if err := ZipTo(args, buf); err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, f := range zr.File {
+				got = append(got, f.Name)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestDuplicatesAsSymlinks(t *testing.T) {
+	dir := t.TempDir()
+
+	args := ZipArgs{}
+	args.FileArgs = fileArgsBuilder().File("a/a/a").File("a/a/b").File("c").File("d/a.c").
+		File("d/a.o").File("d/sub/b.c").FileArgs()
+	args.OutputFilePath = filepath.Join(dir, "out.zip")
+	args.CompressionLevel = 9
+	args.NonDeflatedFiles = map[string]bool{"d/sub/b.c": true}
+	args.DuplicatesAsSymlinks = true
+	args.Filesystem = mockFs
+	args.Stderr = &bytes.Buffer{}
+
+	stats, err := ZipWithStats(args)
 	if err != nil {
 		t.Fatalf("got error %v", err)
 	}
+	if g, w := stats.DeduplicatedEntries, 3; g != w {
+		t.Errorf("want %d deduplicated entries, got %d", w, g)
+	}
 
-	br := bytes.NewReader(buf.Bytes())
-	zr, err := zip.NewReader(br, int64(br.Len()))
+	// Duplicates are linked whatever their compression method.
+	wantLinks := map[string]string{
+		"d/a.c":     "../a/a/a",
+		"d/a.o":     "../a/a/b",
+		"d/sub/b.c": "../../a/a/a",
+	}
+
+	r, err := zip.OpenReader(args.OutputFilePath)
 	if err != nil {
 		t.Fatal(err)
 	}
+	for _, f := range r.File {
+		isLink := f.Mode()&os.ModeSymlink != 0
+		if _, ok := wantLinks[f.Name]; ok != isLink {
+			t.Errorf("%s: want symlink %v, got mode %v", f.Name, ok, f.Mode())
+		}
+	}
+	r.Close()
 
-	var got []string
-	for _, f := range zr.File {
-		r, err := f.Open()
+	outDir := filepath.Join(dir, "out")
+	if err := Extract(args.OutputFilePath, outDir, ExtractOptions{Symlinks: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range wantLinks {
+		link, err := os.Readlink(filepath.Join(outDir, name))
 		if err != nil {
-			t.Fatalf("error when opening %s: %s", f.Name, err)
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if link != want {
+			t.Errorf("%s: want link %q, got %q", name, want, link)
 		}
+	}
 
-		crc := crc32.NewIEEE()
-		len, err := io.Copy(crc, r)
-		r.Close()
+	for name, want := range map[string][]byte{
+		"a/a/a":     fileA,
+		"a/a/b":     fileB,
+		"c":         fileC,
+		"d/a.c":     fileA,
+		"d/a.o":     fileB,
+		"d/sub/b.c": fileA,
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(outDir, name))
 		if err != nil {
-			t.Fatalf("error when reading %s: %s", f.Name, err)
+			t.Errorf("%s: %s", name, err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%s: want contents %q, got %q", name, want, got)
 		}
+	}
 
-		if uint64(len) != f.UncompressedSize64 {
-			t.Errorf("incorrect length for %s, want %d got %d", f.Name, f.UncompressedSize64, len)
+	t.Run("with DeduplicateContents", func(t *testing.T) {
+		args := args
+		args.DeduplicateContents = true
+		if err := ZipTo(args, &bytes.Buffer{}); err == nil {
+			t.Error("expected an error combining DeduplicateContents and DuplicatesAsSymlinks")
 		}
+	})
+}
 
-		if crc.Sum32() != f.CRC32 {
-			t.Errorf("incorrect crc for %s, want %x got %x", f.Name, f.CRC32, crc)
+func TestModePatterns(t *testing.T) {
+	zipModes := func(t *testing.T, patterns []ModePattern) map[string]os.FileMode {
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().File("a/a/a").File("a/a/b").File("c").File("l_sp").FileArgs()
+		args.CompressionLevel = 9
+		args.AddDirectoryEntriesToZip = true
+		args.ModePatterns = patterns
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		modes := make(map[string]os.FileMode)
+		for _, f := range zr.File {
+			modes[f.Name] = f.Mode()
 		}
+		return modes
+	}
 
-		got = append(got, f.Name)
+	source := zipModes(t, nil)
+
+	t.Run("script", func(t *testing.T) {
+		got := zipModes(t, []ModePattern{{Pattern: "a/a/b", Mode: 0755}})
+		for name, mode := range source {
+			want := mode
+			if name == "a/a/b" {
+				want = 0755
+			}
+			if got[name] != want {
+				t.Errorf("%s: want mode %v, got %v", name, want, got[name])
+			}
+		}
+	})
+
+	t.Run("last match wins", func(t *testing.T) {
+		got := zipModes(t, []ModePattern{
+			{Pattern: "**/*", Mode: 0644},
+			{Pattern: "a/a/b", Mode: 0755},
+			{Pattern: "a", Mode: 0700},
+		})
+		want := map[string]os.FileMode{
+			"a/":    0700 | os.ModeDir,
+			"a/a/":  0644 | os.ModeDir,
+			"a/a/a": 0644,
+			"a/a/b": 0755,
+			"c":     0644,
+			"l_sp":  0644,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("want modes %v, got %v", want, got)
+		}
+	})
+
+	t.Run("invalid mode", func(t *testing.T) {
+		args := ZipArgs{}
+		args.ModePatterns = []ModePattern{{Pattern: "*", Mode: os.ModeSetuid | 0755}}
+		if err := ZipTo(args, &bytes.Buffer{}); err == nil {
+			t.Error("expected an error for a mode with non-permission bits")
+		}
+	})
+}
+
+func TestNormalizePermissions(t *testing.T) {
+	dir := t.TempDir()
+	sources := map[string]os.FileMode{
+		"script":     0750,
+		"other_exec": 0601,
+		"data":       0600,
+		"shared":     0666,
+	}
+	for name, mode := range sources {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, fileA, 0600); err != nil {
+			t.Fatal(err)
+		}
+		// Chmod isn't affected by the umask.
+		if err := os.Chmod(file, mode); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	if !reflect.DeepEqual(want, got) {
-		t.Errorf("want files %q, got %q", want, got)
+	zipModes := func(t *testing.T, patterns []ModePattern) map[string]os.FileMode {
+		args := ZipArgs{}
+		args.FileArgs = NewFileArgsBuilder().SourcePrefixToStrip(dir).Dir(dir).FileArgs()
+		args.NormalizePermissions = true
+		args.ModePatterns = patterns
+		args.Filesystem = pathtools.OsFs
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		modes := make(map[string]os.FileMode)
+		for _, f := range zr.File {
+			modes[f.Name] = f.Mode()
+		}
+		return modes
+	}
+
+	t.Run("normalized", func(t *testing.T) {
+		want := map[string]os.FileMode{
+			"script":     0755,
+			"other_exec": 0755,
+			"data":       0644,
+			"shared":     0644,
+		}
+		if got := zipModes(t, nil); !reflect.DeepEqual(got, want) {
+			t.Errorf("want modes %v, got %v", want, got)
+		}
+	})
+
+	t.Run("mode patterns win", func(t *testing.T) {
+		want := map[string]os.FileMode{
+			"script":     0700,
+			"other_exec": 0755,
+			"data":       0640,
+			"shared":     0644,
+		}
+		got := zipModes(t, []ModePattern{{Pattern: "script", Mode: 0700}, {Pattern: "data", Mode: 0640}})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("want modes %v, got %v", want, got)
+		}
+	})
+}
+
+func TestSpecialModeBits(t *testing.T) {
+	dir := t.TempDir()
+	sources := map[string]os.FileMode{
+		"setuid":      os.ModeSetuid | 0755,
+		"setuid_data": os.ModeSetuid | 0640,
+		"sticky":      os.ModeSticky | 0644,
+		"plain":       0644,
+	}
+	for name, mode := range sources {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, fileA, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(file, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	zipModes := func(t *testing.T, normalize bool) (map[string]os.FileMode, map[string]uint32) {
+		args := ZipArgs{}
+		args.FileArgs = NewFileArgsBuilder().SourcePrefixToStrip(dir).Dir(dir).FileArgs()
+		args.NormalizePermissions = normalize
+		args.Filesystem = pathtools.OsFs
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		modes := make(map[string]os.FileMode)
+		unixModes := make(map[string]uint32)
+		for _, f := range zr.File {
+			modes[f.Name] = f.Mode()
+			unixModes[f.Name] = f.ExternalAttrs >> 16
+		}
+		return modes, unixModes
+	}
+
+	t.Run("default", func(t *testing.T) {
+		modes, unixModes := zipModes(t, false)
+		wantModes := map[string]os.FileMode{
+			"setuid":      os.ModeSetuid | 0755,
+			"setuid_data": os.ModeSetuid | 0640,
+			"sticky":      os.ModeSticky | 0644,
+			"plain":       0666,
+		}
+		if !reflect.DeepEqual(modes, wantModes) {
+			t.Errorf("want modes %v, got %v", wantModes, modes)
+		}
+		// S_IFREG | S_ISUID | 0755, the mode as stat(2) would return it.
+		if got, want := unixModes["setuid"], uint32(0104755); got != want {
+			t.Errorf("want unix mode %o for setuid, got %o", want, got)
+		}
+	})
+
+	t.Run("normalized", func(t *testing.T) {
+		modes, _ := zipModes(t, true)
+		wantModes := map[string]os.FileMode{
+			"setuid":      os.ModeSetuid | 0755,
+			"setuid_data": os.ModeSetuid | 0644,
+			"sticky":      os.ModeSticky | 0644,
+			"plain":       0644,
+		}
+		if !reflect.DeepEqual(modes, wantModes) {
+			t.Errorf("want modes %v, got %v", wantModes, modes)
+		}
+	})
+}
+
+func TestExtendedTimestamp(t *testing.T) {
+	dir := t.TempDir()
+	mtime := time.Date(2020, 6, 15, 12, 30, 10, 0, time.UTC)
+	atime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, fileA, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, atime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	type times struct {
+		localFlags, centralFlags byte
+		local, central           []uint32
+	}
+	parseField := func(t *testing.T, name string, extra []byte) (byte, []uint32) {
+		for len(extra) >= 4 {
+			tag := binary.LittleEndian.Uint16(extra)
+			size := int(binary.LittleEndian.Uint16(extra[2:]))
+			if tag == zip.ExtendedTimeStampTag {
+				var ret []uint32
+				for i := 5; i+4 <= 4+size; i += 4 {
+					ret = append(ret, binary.LittleEndian.Uint32(extra[i:]))
+				}
+				return extra[4], ret
+			}
+			extra = extra[4+size:]
+		}
+		t.Fatalf("%s: no extended timestamp field", name)
+		return 0, nil
+	}
+	// extendedTimes returns the flags and times of the local and central extended timestamp
+	// fields of each entry.
+	extendedTimes := func(t *testing.T, timestamp time.Time) map[string]times {
+		args := ZipArgs{}
+		args.FileArgs = NewFileArgsBuilder().SourcePrefixToStrip(dir).File(file).
+			ReaderFile("stdin", bytes.NewReader(fileB)).FileArgs()
+		args.CompressionLevel = 9
+		args.Timestamp = timestamp
+		args.StoreExtendedTimestamp = true
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		data := buf.Bytes()
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ret := make(map[string]times)
+		offset := 0
+		for _, f := range zr.File {
+			local := data[offset:]
+			nameLen := int(binary.LittleEndian.Uint16(local[26:]))
+			extraLen := int(binary.LittleEndian.Uint16(local[28:]))
+			var tm times
+			tm.localFlags, tm.local = parseField(t, f.Name, local[30+nameLen:30+nameLen+extraLen])
+			tm.centralFlags, tm.central = parseField(t, f.Name, f.Extra)
+			ret[f.Name] = tm
+
+			offset += 30 + nameLen + extraLen + int(f.CompressedSize64)
+			if f.Flags&0x8 != 0 {
+				offset += 16
+			}
+		}
+		return ret
+	}
+
+	unix := func(t time.Time) uint32 { return uint32(t.Unix()) }
+
+	t.Run("file times", func(t *testing.T) {
+		got := extendedTimes(t, time.Time{})
+		want := map[string]times{
+			"file":  {3, 3, []uint32{unix(mtime), unix(atime)}, []uint32{unix(mtime)}},
+			"stdin": {1, 1, []uint32{unix(jar.DefaultTime)}, []uint32{unix(jar.DefaultTime)}},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	})
+
+	t.Run("timestamp", func(t *testing.T) {
+		timestamp := time.Date(2019, 3, 4, 5, 6, 8, 0, time.UTC)
+		got := extendedTimes(t, timestamp)
+		want := map[string]times{
+			"file":  {3, 3, []uint32{unix(timestamp), unix(timestamp)}, []uint32{unix(timestamp)}},
+			"stdin": {3, 3, []uint32{unix(timestamp), unix(timestamp)}, []uint32{unix(timestamp)}},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	})
+}
+
+func TestProvenanceEntry(t *testing.T) {
+	timestamp := time.Date(2020, 6, 15, 12, 30, 10, 0, time.UTC)
+	zipWithProvenance := func(t *testing.T, entry string) []byte {
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().File("a/a/a").PathPrefixInZip("p").SourcePrefixToStrip("d").
+			Dir("d").FileArgs()
+		args.CompressionLevel = 9
+		args.Timestamp = timestamp
+		args.ProvenanceEntry = entry
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	readEntry := func(t *testing.T, data []byte, name string) []byte {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			if f.Name == name {
+				r, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer r.Close()
+				b, err := ioutil.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return b
+			}
+		}
+		t.Fatalf("missing entry %s", name)
+		return nil
+	}
+
+	a := zipWithProvenance(t, DefaultProvenanceEntry)
+	b := zipWithProvenance(t, DefaultProvenanceEntry)
+	if !bytes.Equal(a, b) {
+		t.Error("expected identical zip files")
+	}
+
+	var got struct {
+		Tool        string `json:"tool"`
+		ToolVersion string `json:"tool_version"`
+		GoVersion   string `json:"go_version"`
+		Timestamp   string `json:"timestamp"`
+		Inputs      []struct {
+			SourceFiles         []string `json:"source_files"`
+			GlobDir             string   `json:"glob_dir"`
+			SourcePrefixToStrip string   `json:"source_prefix_to_strip"`
+			PathPrefixInZip     string   `json:"path_prefix_in_zip"`
+		} `json:"inputs"`
+	}
+	if err := json.Unmarshal(readEntry(t, a, DefaultProvenanceEntry), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Tool != "soong_zip" || got.ToolVersion == "" || got.GoVersion == "" {
+		t.Errorf("want tool and versions, got %q %q %q", got.Tool, got.ToolVersion, got.GoVersion)
+	}
+	if want := "2020-06-15T12:30:10Z"; got.Timestamp != want {
+		t.Errorf("want timestamp %q, got %q", want, got.Timestamp)
+	}
+	if len(got.Inputs) != 2 {
+		t.Fatalf("want 2 inputs, got %d", len(got.Inputs))
+	}
+	if !reflect.DeepEqual(got.Inputs[0].SourceFiles, []string{"a/a/a"}) {
+		t.Errorf("want first input source files [a/a/a], got %q", got.Inputs[0].SourceFiles)
+	}
+	if in := got.Inputs[1]; in.GlobDir != "d" || in.SourcePrefixToStrip != "d" || in.PathPrefixInZip != "p" {
+		t.Errorf("want second input of directory d with prefix p, got %+v", in)
+	}
+
+	t.Run("renamed", func(t *testing.T) {
+		data := zipWithProvenance(t, "META-INF/build-info.json")
+		if !bytes.Equal(readEntry(t, data, "META-INF/build-info.json"), readEntry(t, a, DefaultProvenanceEntry)) {
+			t.Error("expected the same contents under the new name")
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		data := zipWithProvenance(t, "")
+		if bytes.Contains(data, []byte(DefaultProvenanceEntry)) {
+			t.Error("unexpected provenance entry")
+		}
+	})
+}
+
+func TestOrderFile(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"a/a/a": fileA,
+		"a/a/b": fileB,
+		"c":     fileC,
+		"d/e":   fileA,
+		"order": []byte("c\n\nmissing\na/a/b\r\nc\n"),
+	})
+
+	zipOrder := func(t *testing.T, args ZipArgs) ([]string, string, error) {
+		args.FileArgs = (&FileArgsBuilder{fs: fs}).File("d/e").File("a/a/a").File("a/a/b").File("c").FileArgs()
+		args.Filesystem = fs
+		stderr := &bytes.Buffer{}
+		args.Stderr = stderr
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			return nil, "", err
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		var lastOffset int64
+		for _, f := range zr.File {
+			// The central directory must list the entries in the order they were written.
+			offset, err := f.DataOffset()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset < lastOffset {
+				t.Errorf("%s: written before the previous entry", f.Name)
+			}
+			lastOffset = offset
+			names = append(names, f.Name)
+		}
+		return names, stderr.String(), nil
+	}
+
+	t.Run("order", func(t *testing.T) {
+		names, stderr, err := zipOrder(t, ZipArgs{OrderFilePath: "order"})
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		if want := []string{"c", "a/a/b", "d/e", "a/a/a"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("want order %q, got %q", want, names)
+		}
+		if want := `warning: order: "missing" is not in the zip file`; !strings.Contains(stderr, want) {
+			t.Errorf("want warning %q, got %q", want, stderr)
+		}
+	})
+
+	t.Run("sorted", func(t *testing.T) {
+		names, _, err := zipOrder(t, ZipArgs{OrderFilePath: "order", SortEntries: true})
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		if want := []string{"c", "a/a/b", "a/a/a", "d/e"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("want order %q, got %q", want, names)
+		}
+	})
+
+	t.Run("dirs", func(t *testing.T) {
+		names, _, err := zipOrder(t, ZipArgs{OrderFilePath: "order", AddDirectoryEntriesToZip: true})
+		if err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		want := []string{"c", "a/", "a/a/", "a/a/b", "d/", "d/e", "a/a/a"}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("want order %q, got %q", want, names)
+		}
+	})
+
+	t.Run("jar", func(t *testing.T) {
+		if _, _, err := zipOrder(t, ZipArgs{OrderFilePath: "order", EmulateJar: true}); err == nil {
+			t.Error("want error for an order file with jar emulation")
+		}
+	})
+}
+
+func TestFirstEntry(t *testing.T) {
+	zipFirst := func(t *testing.T, args ZipArgs) ([]string, error) {
+		args.FileArgs = fileArgsBuilder().File("d/a.c").File("a/a/a").File("c").
+			ReaderFile("index", bytes.NewReader(fileB)).FileArgs()
+		args.CompressionLevel = 9
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			return nil, err
+		}
+		data := buf.Bytes()
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		var lastOffset int64
+		for i, f := range zr.File {
+			offset, err := f.DataOffset()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				// The first entry in the central directory must also be the first local header.
+				if want := int64(30 + len(f.Name) + len(f.Extra)); offset != want {
+					t.Errorf("%s: want contents at offset %d, got %d", f.Name, want, offset)
+				}
+			} else if offset < lastOffset {
+				t.Errorf("%s: written before the previous entry", f.Name)
+			}
+			lastOffset = offset
+			names = append(names, f.Name)
+		}
+		return names, nil
+	}
+
+	testCases := []struct {
+		name string
+		args ZipArgs
+		want []string
+	}{
+		{
+			name: "first",
+			args: ZipArgs{FirstEntry: "index"},
+			want: []string{"index", "d/a.c", "a/a/a", "c"},
+		},
+		{
+			name: "sorted",
+			args: ZipArgs{FirstEntry: "index", SortEntries: true},
+			want: []string{"index", "a/a/a", "c", "d/a.c"},
+		},
+		{
+			name: "already first",
+			args: ZipArgs{FirstEntry: "./d/a.c"},
+			want: []string{"d/a.c", "a/a/a", "c", "index"},
+		},
+		{
+			name: "dirs",
+			args: ZipArgs{FirstEntry: "c", AddDirectoryEntriesToZip: true},
+			want: []string{"c", "d/", "d/a.c", "a/", "a/a/", "a/a/a", "index"},
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			names, err := zipFirst(t, test.args)
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Errorf("want order %q, got %q", test.want, names)
+			}
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := zipFirst(t, ZipArgs{FirstEntry: "missing"})
+		if want := `first entry "missing" is not in the zip file`; err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+
+	t.Run("jar", func(t *testing.T) {
+		if _, err := zipFirst(t, ZipArgs{FirstEntry: "index", EmulateJar: true}); err == nil {
+			t.Error("want error for a first entry with jar emulation")
+		}
+	})
+}
+
+func TestJarOrdering(t *testing.T) {
+	zipNames := func(t *testing.T, emulateJar, jarOrdering bool) []string {
+		args := ZipArgs{}
+		args.FileArgs = fileArgsBuilder().File("c").File("a/a/b").File("a/a/a").
+			ReaderFile("META-INF/services/foo", bytes.NewReader(fileA)).
+			ReaderFile("META-INF/a", bytes.NewReader(fileB)).
+			ReaderFile("B", bytes.NewReader(fileC)).FileArgs()
+		args.CompressionLevel = 9
+		args.AddDirectoryEntriesToZip = true
+		args.EmulateJar = emulateJar
+		args.JarOrdering = jarOrdering
+		args.Filesystem = mockFs
+		args.Stderr = &bytes.Buffer{}
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatalf("got error %v", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		return names
+	}
+
+	want := []string{
+		"META-INF/",
+		"META-INF/a",
+		"META-INF/services/",
+		"META-INF/services/foo",
+		"B",
+		"a/",
+		"a/a/",
+		"a/a/a",
+		"a/a/b",
+		"c",
+	}
+	if got := zipNames(t, false, true); !reflect.DeepEqual(got, want) {
+		t.Errorf("want order %q, got %q", want, got)
+	}
+
+	// EmulateJar orders entries the same way, and adds the manifest after the META-INF/
+	// directory.
+	jarWant := append([]string{"META-INF/", jar.ManifestFile}, want[1:]...)
+	for _, jarOrdering := range []bool{false, true} {
+		if got := zipNames(t, true, jarOrdering); !reflect.DeepEqual(got, jarWant) {
+			t.Errorf("EmulateJar with JarOrdering %v: want order %q, got %q", jarOrdering, jarWant, got)
+		}
 	}
 }
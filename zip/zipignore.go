@@ -0,0 +1,131 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+// zipIgnoreFile is the name of the file in the relative root of a directory that lists the
+// patterns to leave out of the zip file when EnableZipIgnore is set.
+const zipIgnoreFile = ".zipignore"
+
+// zipIgnore is the parsed contents of a .zipignore file.
+type zipIgnore []zipIgnoreRule
+
+type zipIgnoreRule struct {
+	// pattern is matched against paths relative to the directory containing the .zipignore file
+	// with pathtools.Match.
+	pattern string
+	// negate re-includes paths that match pattern.
+	negate bool
+	// dirOnly only matches directories.
+	dirOnly bool
+}
+
+// readZipIgnore returns the rules in the .zipignore file in root, or nil if there isn't one.
+func (z *ZipWriter) readZipIgnore(root string) (zipIgnore, error) {
+	path := filepath.Join(root, zipIgnoreFile)
+	if exists, isDir, err := z.fs.Exists(path); err != nil {
+		return nil, err
+	} else if !exists || isDir {
+		return nil, nil
+	}
+
+	f, err := z.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	contents, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseZipIgnore(string(contents)), nil
+}
+
+// parseZipIgnore parses gitignore style patterns, one per line.  Blank lines and lines starting
+// with # are ignored, a leading ! re-includes paths excluded by earlier patterns, and a trailing /
+// only matches directories.  Patterns containing a / other than a trailing one are relative to the
+// directory containing the .zipignore file, other patterns match at any depth.  \# and \! match a
+// literal leading # or !.
+func parseZipIgnore(contents string) zipIgnore {
+	var rules zipIgnore
+	for _, line := range strings.Split(contents, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rule zipIgnoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		if strings.Contains(line, "/") {
+			line = strings.TrimPrefix(line, "/")
+		} else if line != "" && line != "**" {
+			line = "**/" + line
+		}
+
+		if line == "" {
+			continue
+		}
+
+		// pathtools.Match doesn't allow a trailing **, which matches everything inside the
+		// directory before it.
+		if line == "**" || strings.HasSuffix(line, "/**") {
+			line += "/*"
+		}
+
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// ignored returns true if the last rule matching the path rel, relative to the directory containing
+// the .zipignore file, excludes it.
+func (ig zipIgnore) ignored(rel string, isDir bool) (bool, error) {
+	ignored := false
+	for _, rule := range ig {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		match, err := pathtools.Match(rule.pattern, rel)
+		if err != nil {
+			return false, fmt.Errorf("%s: invalid pattern %q: %s", zipIgnoreFile, rule.pattern, err)
+		}
+		if match {
+			ignored = !rule.negate
+		}
+	}
+	return ignored, nil
+}
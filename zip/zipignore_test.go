@@ -0,0 +1,161 @@
+// Copyright 2020 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"log"
+	"reflect"
+	"testing"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+func TestParseZipIgnore(t *testing.T) {
+	contents := "# comment\n" +
+		"\n" +
+		"*.o\n" +
+		"!keep.o\n" +
+		"/top\n" +
+		"gen/\n" +
+		"a/b/*.c\n" +
+		"out/**\n" +
+		"\\#hash\n" +
+		"trailing   \r\n"
+
+	want := zipIgnore{
+		{pattern: "**/*.o"},
+		{pattern: "**/keep.o", negate: true},
+		{pattern: "top"},
+		{pattern: "**/gen", dirOnly: true},
+		{pattern: "a/b/*.c"},
+		{pattern: "out/**/*"},
+		{pattern: "**/#hash"},
+		{pattern: "**/trailing"},
+	}
+
+	if got := parseZipIgnore(contents); !reflect.DeepEqual(got, want) {
+		t.Errorf("want rules %+v, got %+v", want, got)
+	}
+}
+
+func TestZipIgnore(t *testing.T) {
+	files := map[string][]byte{
+		"root/a.c":         nil,
+		"root/a.o":         nil,
+		"root/keep.o":      nil,
+		"root/gen/x.c":     nil,
+		"root/sub/b.c":     nil,
+		"root/sub/b.o":     nil,
+		"root/sub/gen":     nil,
+		"root/skip/c.c":    nil,
+		"root/skip/keep.c": nil,
+	}
+
+	testCases := []struct {
+		name       string
+		zipIgnore  string
+		unreadable []string
+		want       []string
+	}{
+		{
+			name: "none",
+			want: []string{
+				"root/a.c", "root/a.o", "root/gen", "root/keep.o", "root/skip", "root/sub",
+				"root/gen/x.c",
+				"root/skip/c.c", "root/skip/keep.c",
+				"root/sub/b.c", "root/sub/b.o", "root/sub/gen",
+			},
+		},
+		{
+			name:      "exclude",
+			zipIgnore: "*.o\n",
+			want: []string{
+				"root/a.c", "root/gen", "root/skip", "root/sub",
+				"root/gen/x.c",
+				"root/skip/c.c", "root/skip/keep.c",
+				"root/sub/b.c", "root/sub/gen",
+			},
+		},
+		{
+			name:       "prune directories",
+			zipIgnore:  "gen/\n/skip\n",
+			unreadable: []string{"root/gen", "root/skip"},
+			want: []string{
+				"root/a.c", "root/a.o", "root/keep.o", "root/sub",
+				"root/sub/b.c", "root/sub/b.o", "root/sub/gen",
+			},
+		},
+		{
+			name:      "negation",
+			zipIgnore: "*.o\n!keep.o\n",
+			want: []string{
+				"root/a.c", "root/gen", "root/keep.o", "root/skip", "root/sub",
+				"root/gen/x.c",
+				"root/skip/c.c", "root/skip/keep.c",
+				"root/sub/b.c", "root/sub/gen",
+			},
+		},
+		{
+			name:      "last match wins",
+			zipIgnore: "!keep.o\n*.o\n",
+			want: []string{
+				"root/a.c", "root/gen", "root/skip", "root/sub",
+				"root/gen/x.c",
+				"root/skip/c.c", "root/skip/keep.c",
+				"root/sub/b.c", "root/sub/gen",
+			},
+		},
+		{
+			name:      "no reinclude in pruned directory",
+			zipIgnore: "skip/\n!skip/keep.c\n",
+			want: []string{
+				"root/a.c", "root/a.o", "root/gen", "root/keep.o", "root/sub",
+				"root/gen/x.c",
+				"root/sub/b.c", "root/sub/b.o", "root/sub/gen",
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			mockFiles := make(map[string][]byte)
+			for k, v := range files {
+				mockFiles[k] = v
+			}
+			if test.zipIgnore != "" {
+				mockFiles["root/.zipignore"] = []byte(test.zipIgnore)
+			}
+
+			fs := &unreadableDirFs{
+				FileSystem: pathtools.MockFs(mockFiles),
+				unreadable: make(map[string]bool),
+			}
+			for _, dir := range test.unreadable {
+				fs.unreadable[dir] = true
+			}
+
+			z := &ZipWriter{fs: fs, zipIgnore: true, logger: log.New(&bytes.Buffer{}, "", 0)}
+			got, err := z.globDir(FileArg{GlobDir: "root", SourcePrefixToStrip: "root"}, nil, 4, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("want files %q, got %q", test.want, got)
+			}
+		})
+	}
+}